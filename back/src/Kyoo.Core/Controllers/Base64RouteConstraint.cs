@@ -24,7 +24,8 @@ namespace Kyoo.Core.Controllers;
 
 public class Base64RouteConstraint : IRouteConstraint
 {
-	static Regex Base64Reg = new("^[-A-Za-z0-9+/]*={0,3}$");
+	// Url safe base64 (see the transcoder's EncodePath), standard base64 of older clients is still accepted.
+	static Regex Base64Reg = new("^[-_A-Za-z0-9+/]*={0,3}$");
 
 	/// <inheritdoc />
 	public bool Match(
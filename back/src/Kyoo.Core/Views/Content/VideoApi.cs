@@ -44,6 +44,18 @@ public class VideoApi : Controller
 	public static string TranscoderUrl =
 		Environment.GetEnvironmentVariable("TRANSCODER_URL") ?? "http://transcoder:7666";
 
+	/// <summary>
+	/// The format the transcoder writes its sprites in (its GOCODER_THUMBNAIL_FORMAT).
+	/// </summary>
+	public static string ThumbnailFormat =
+		Environment.GetEnvironmentVariable("GOCODER_THUMBNAIL_FORMAT") ?? "webp";
+
+	/// <summary>
+	/// The name of the transcoder's sprites and vtts (its GOCODER_SPRITE_BASE_NAME), cues point to it.
+	/// </summary>
+	public static string SpriteBaseName =
+		Environment.GetEnvironmentVariable("GOCODER_SPRITE_BASE_NAME") ?? "sprite";
+
 	private Task _Proxy(string route)
 	{
 		HttpProxyOptions proxyOptions = HttpProxyOptionsBuilder
@@ -120,17 +132,117 @@ public class VideoApi : Controller
 		await _Proxy($"{path}/subtitle/{name}");
 	}
 
-	[HttpGet("{path:base64}/thumbnails.png")]
+	[HttpGet("{path:base64}/thumbnails.{ext:regex(^(png|jpeg|webp)$)}")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetThumbnails(string path, string ext)
+	{
+		await _Proxy($"{path}/thumbnails.{ext}{Request.QueryString}");
+	}
+
+	[HttpGet("{path:base64}/sprite.{ext:regex(^(png|jpeg|webp)$)}")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetSprite(string path, string ext)
+	{
+		await _Proxy($"{path}/sprite.{ext}{Request.QueryString}");
+	}
+
+	[HttpGet("thumbnails/{sha}/sprite.{ext:regex(^(png|jpeg|webp)$)}")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetSpriteBySha(string sha, string ext)
+	{
+		await _Proxy($"thumbnails/{sha}/sprite.{ext}{Request.QueryString}");
+	}
+
+	[HttpGet("{path:base64}/{name}.{ext:regex(^(png|jpeg|webp)$)}")]
 	[PartialPermission(Kind.Read)]
-	public async Task GetThumbnails(string path)
+	public async Task<IActionResult> GetNamedSprite(string path, string name, string ext)
 	{
-		await _Proxy($"{path}/thumbnails.png");
+		if (name != SpriteBaseName)
+			return NotFound();
+		await _Proxy($"{path}/{name}.{ext}{Request.QueryString}");
+		return new EmptyResult();
+	}
+
+	[HttpGet("thumbnails/{sha}/{name}.{ext:regex(^(png|jpeg|webp)$)}")]
+	[PartialPermission(Kind.Read)]
+	public async Task<IActionResult> GetNamedSpriteBySha(string sha, string name, string ext)
+	{
+		if (name != SpriteBaseName)
+			return NotFound();
+		await _Proxy($"thumbnails/{sha}/{name}.{ext}{Request.QueryString}");
+		return new EmptyResult();
+	}
+
+	[HttpGet("{path:base64}/{name}.vtt")]
+	[PartialPermission(Kind.Read)]
+	public async Task<IActionResult> GetNamedThumbnailsVtt(string path, string name)
+	{
+		if (name != SpriteBaseName)
+			return NotFound();
+		await _Proxy($"{path}/{name}.vtt{Request.QueryString}");
+		return new EmptyResult();
 	}
 
 	[HttpGet("{path:base64}/thumbnails.vtt")]
 	[PartialPermission(Kind.Read)]
 	public async Task GetThumbnailsVtt(string path)
 	{
-		await _Proxy($"{path}/thumbnails.vtt");
+		await _Proxy($"{path}/thumbnails.vtt{Request.QueryString}");
+	}
+
+	[HttpGet("{path:base64}/sprite.json")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetThumbnailsJson(string path)
+	{
+		await _Proxy($"{path}/sprite.json");
+	}
+
+	[HttpGet("{path:base64}/thumbnails.json")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetThumbnailsInfo(string path)
+	{
+		await _Proxy($"{path}/thumbnails.json");
+	}
+
+	[HttpGet("{path:base64}/preview.webp")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetPreview(string path)
+	{
+		await _Proxy($"{path}/preview.webp");
+	}
+
+	[HttpGet("{path:base64}/preview.gif")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetGifPreview(string path)
+	{
+		await _Proxy($"{path}/preview.gif");
+	}
+
+	[HttpGet("{path:base64}/peaks.json")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetWaveformPeaks(string path)
+	{
+		await _Proxy($"{path}/peaks.json");
+	}
+
+	[HttpGet("{path:base64}/waveform.png")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetWaveformImage(string path)
+	{
+		await _Proxy($"{path}/waveform.png");
+	}
+
+	[HttpGet("{path:base64}/chapters.vtt")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetChapters(string path)
+	{
+		await _Proxy($"{path}/chapters.vtt");
+	}
+
+	[HttpGet("{path:base64}/subtitle/{index:int}/sub.vtt")]
+	[PartialPermission(Kind.Read)]
+	public async Task GetSubtitleVtt(string path, int index)
+	{
+		await _Proxy($"{path}/subtitle/{index}/sub.vtt");
 	}
 }
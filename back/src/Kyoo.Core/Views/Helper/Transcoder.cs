@@ -54,7 +54,12 @@ public abstract class TranscoderApi<T>(IRepository<T> repository) : CrudThumbsAp
 	private async Task<string> _GetPath64(Identifier identifier)
 	{
 		string path = await GetPath(identifier);
-		return Convert.ToBase64String(Encoding.UTF8.GetBytes(path));
+		// Url safe base64 without padding, the same as the transcoder's EncodePath.
+		return Convert
+			.ToBase64String(Encoding.UTF8.GetBytes(path))
+			.TrimEnd('=')
+			.Replace('+', '-')
+			.Replace('/', '_');
 	}
 
 	/// <summary>
@@ -123,11 +128,12 @@ public abstract class TranscoderApi<T>(IRepository<T> repository) : CrudThumbsAp
 	/// <param name="identifier">The ID or slug of the <see cref="Episode"/>.</param>
 	/// <returns>A sprite with an image for every X seconds of the video file.</returns>
 	/// <response code="404">No episode with the given ID or slug could be found.</response>
-	[HttpGet("{identifier:id}/thumbnails.png")]
+	[HttpGet("{identifier:id}/thumbnails.{ext:regex(^(png|jpeg|webp)$)}")]
 	[PartialPermission(Kind.Read)]
 	public async Task GetThumbnails(Identifier identifier)
 	{
-		await _Proxy($"{await _GetPath64(identifier)}/thumbnails.png");
+		// The sprite is served in the format it was generated with, whatever the extension.
+		await _Proxy($"{await _GetPath64(identifier)}/sprite.{VideoApi.ThumbnailFormat}");
 	}
 
 	/// <summary>
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/zoriya/kyoo/transcoder/src"
+)
+
+// Extract the thumbnails of a single file without starting the server, for debugging and scripts.
+// This goes through src.ExtractThumbnail like the routes do, settings come from the same env vars
+// and flags override some of them.
+//
+// Usage: transcoder thumbnails <file> [--out dir] [--interval N] [--height H] [--format webp]
+func runThumbnails(args []string) int {
+	flags := flag.NewFlagSet("thumbnails", flag.ContinueOnError)
+	out := flags.String("out", "", "metadata directory to write the thumbnails to (defaults to GOCODER_METADATA_ROOT)")
+	interval := flags.Float64("interval", 0, "seconds between thumbnails (defaults to GOCODER_THUMBNAIL_INTERVAL)")
+	height := flags.Int("height", src.Settings.ThumbnailHeight, "height of the thumbnails, 0 for auto")
+	format := flags.String("format", src.Settings.ThumbnailFormat, fmt.Sprintf("format of the sprites, one of %v", src.ThumbnailFormats))
+	// flags are accepted after the file, like in the usage.
+	var paths []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return 2
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		paths = append(paths, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(paths) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: transcoder thumbnails <file> [--out dir] [--interval N] [--height H] [--format webp]")
+		return 2
+	}
+
+	if *out != "" {
+		dir, err := filepath.Abs(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		src.UseLocalMetadata(dir)
+	}
+	if !slices.Contains(src.ThumbnailFormats, *format) {
+		fmt.Fprintf(os.Stderr, "invalid format %s, it should be one of %v\n", *format, src.ThumbnailFormats)
+		return 2
+	}
+	src.Settings.ThumbnailFormat = *format
+	if err := src.SetThumbnailHeight(*height); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *interval < 0 {
+		fmt.Fprintln(os.Stderr, "invalid interval, it should be a positive number of seconds")
+		return 2
+	}
+
+	if _, err := src.CheckFfmpeg(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	path, err := filepath.Abs(paths[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// same sha as the routes, thumbnails extracted here are reused by the server.
+	sha, err := src.ComputeMediaSha(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	start := time.Now()
+	dir, err := src.ExtractThumbnail(path, sha, src.ThumbnailOptions{Interval: *interval})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	size := src.DefaultSheetSize()
+	fmt.Println(src.GetVttPath(dir, size))
+	for page := 0; ; page++ {
+		sprite, ok := src.FindSprite(dir, src.ThumbnailOptions{}, size, page)
+		if !ok {
+			break
+		}
+		fmt.Println(sprite)
+	}
+	fmt.Fprintf(os.Stderr, "extracted thumbnails of %s in %s\n", path, time.Since(start).Round(time.Millisecond))
+	return 0
+}
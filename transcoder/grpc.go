@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/transcoder/src"
+	"github.com/zoriya/kyoo/transcoder/thumbnailspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/zoriya/kyoo/transcoder --go-grpc_out=. --go-grpc_opt=module=github.com/zoriya/kyoo/transcoder thumbnails.proto
+
+// Address of the gRPC server of thumbnails operations (see thumbnails.proto), empty to disable it.
+var grpc_addr = src.GetEnvOr("GOCODER_GRPC_ADDR", ":7667")
+
+// The thumbnails operations of thumbnails.proto, for backend services. They share the extractions (and the
+// errors) of the http routes.
+type ThumbnailsServer struct {
+	thumbnailspb.UnimplementedThumbnailsServer
+}
+
+func NewGrpcServer() *grpc.Server {
+	ret := grpc.NewServer()
+	thumbnailspb.RegisterThumbnailsServer(ret, &ThumbnailsServer{})
+	return ret
+}
+
+// Convert the errors of the http handlers (see ThumbnailError) to grpc status.
+func GrpcError(err error) error {
+	var he *echo.HTTPError
+	if !errors.As(ThumbnailError(err), &he) {
+		if errors.Is(err, context.Canceled) {
+			return status.Error(codes.Canceled, err.Error())
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	code := codes.Internal
+	switch he.Code {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.Aborted
+	case http.StatusUnprocessableEntity:
+		code = codes.FailedPrecondition
+	case http.StatusInsufficientStorage:
+		code = codes.ResourceExhausted
+	}
+	return status.Error(code, fmt.Sprint(he.Message))
+}
+
+func (s *ThumbnailsServer) Extract(req *thumbnailspb.ExtractRequest, stream thumbnailspb.Thumbnails_ExtractServer) error {
+	path, sha, err := checkPath(filepath.Join(safe_path, req.Path))
+	if err != nil {
+		return GrpcError(err)
+	}
+	if req.Sha != "" {
+		if err := SanitizePath(req.Sha); err != nil {
+			return GrpcError(err)
+		}
+		sha = req.Sha
+	}
+	// validated like the query params of the http routes.
+	query := url.Values{}
+	if req.Interval != 0 {
+		query.Set("interval", strconv.FormatFloat(req.Interval, 'g', -1, 64))
+	}
+	if req.MaxCaps != 0 {
+		query.Set("maxcaps", fmt.Sprint(req.MaxCaps))
+	}
+	if req.Height != 0 {
+		query.Set("tileheight", fmt.Sprint(req.Height))
+	}
+	if req.Format != "" {
+		query.Set("format", req.Format)
+	}
+	if req.Quality != 0 {
+		query.Set("quality", fmt.Sprint(req.Quality))
+	}
+	opts, err := parseThumbnailOptions(query)
+	if err != nil {
+		return GrpcError(err)
+	}
+
+	var send_err error
+	var last_done, last_total int
+	out, err := src.ExtractThumbnailProgress(stream.Context(), path, sha, opts, func(done int, total int) {
+		last_done, last_total = done, total
+		if send_err == nil {
+			send_err = stream.Send(&thumbnailspb.ExtractProgress{Done: int32(done), Total: int32(total)})
+		}
+	})
+	if err != nil {
+		return GrpcError(err)
+	}
+	if send_err != nil {
+		return send_err
+	}
+	return stream.Send(&thumbnailspb.ExtractProgress{Done: int32(last_done), Total: int32(last_total), Finished: true, Out: out})
+}
+
+func (s *ThumbnailsServer) Status(ctx context.Context, req *thumbnailspb.StatusRequest) (*thumbnailspb.StatusResponse, error) {
+	if err := SanitizePath(req.Sha); err != nil {
+		return nil, GrpcError(err)
+	}
+	done, total, found := src.ExtractThumbnailStatus(req.Sha)
+	return &thumbnailspb.StatusResponse{Found: found, Done: int32(done), Total: int32(total)}, nil
+}
+
+func (s *ThumbnailsServer) GetInfo(ctx context.Context, req *thumbnailspb.InfoRequest) (*thumbnailspb.ThumbnailInfo, error) {
+	if err := SanitizePath(req.Sha); err != nil {
+		return nil, GrpcError(err)
+	}
+	info, err := src.GetThumbnailInfo(req.Sha)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Thumbnails layout not available.")
+	}
+	ret := &thumbnailspb.ThumbnailInfo{
+		Count:      int32(info.Count),
+		Interval:   info.Interval,
+		Timestamps: info.Timestamps,
+		Columns:    int32(info.Columns),
+		Rows:       int32(info.Rows),
+		Order:      info.Order,
+		Pages:      int32(info.Pages),
+		Width:      int32(info.Width),
+		Height:     int32(info.Height),
+		Gap:        int32(info.Gap),
+		Blurhash:   info.Blurhash,
+	}
+	for _, height := range info.Heights {
+		ret.Heights = append(ret.Heights, int32(height))
+	}
+	for _, scale := range info.Scales {
+		ret.Scales = append(ret.Scales, int32(scale))
+	}
+	return ret, nil
+}
+
+func (s *ThumbnailsServer) Invalidate(ctx context.Context, req *thumbnailspb.InvalidateRequest) (*thumbnailspb.InvalidateResponse, error) {
+	if err := SanitizePath(req.Sha); err != nil {
+		return nil, GrpcError(err)
+	}
+	if err := src.InvalidateThumbnail(req.Sha); err != nil {
+		return nil, GrpcError(err)
+	}
+	return &thumbnailspb.InvalidateResponse{}, nil
+}
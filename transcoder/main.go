@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/zoriya/kyoo/transcoder/src"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Direct video
@@ -182,7 +193,7 @@ func (h *Handler) GetInfo(c echo.Context) error {
 	}
 	// Run extractors to have them in cache
 	src.Extract(ret.Path, sha)
-	go src.ExtractThumbnail(ret.Path, sha)
+	go src.ExtractThumbnail(ret.Path, sha, src.ThumbnailOptions{})
 	return c.JSON(http.StatusOK, ret)
 }
 
@@ -207,8 +218,8 @@ func (h *Handler) GetAttachment(c echo.Context) error {
 	}
 	<-wait
 
-	ret := fmt.Sprintf("%s/%s/att/%s", src.Settings.Metadata, sha, name)
-	return c.File(ret)
+	ret := fmt.Sprintf("%s/att/%s", src.GetMetadataPath(sha), name)
+	return ServeMetadata(c, ret)
 }
 
 // Get subtitle
@@ -232,47 +243,668 @@ func (h *Handler) GetSubtitle(c echo.Context) error {
 	}
 	<-wait
 
-	ret := fmt.Sprintf("%s/%s/sub/%s", src.Settings.Metadata, sha, name)
-	return c.File(ret)
+	ret := fmt.Sprintf("%s/sub/%s", src.GetMetadataPath(sha), name)
+	return ServeMetadata(c, ret)
+}
+
+// Get subtitle as vtt
+//
+// Convert an embedded text subtitle (srt, ass...) to vtt. Ass styling is dropped but timings are kept.
+// Image subtitles (pgs, vobsub...) can't be converted. The first request extracts every subtitle of the file.
+//
+// Path: /:path/subtitle/:index/sub.vtt
+func (h *Handler) GetSubtitleVtt(c echo.Context) error {
+	path, sha, err := GetPath(c)
+	if err != nil {
+		return err
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid subtitle index, it should be a number.")
+	}
+
+	ret, err := src.ExtractSubtitle(path, sha, index)
+	if errors.Is(err, src.ErrInvalidSubtitle) {
+		return echo.NewHTTPError(http.StatusNotFound, "Subtitle not found.")
+	}
+	if errors.Is(err, src.ErrUnsupportedSubtitle) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Image subtitles can't be converted to vtt.")
+	}
+	if err != nil {
+		return err
+	}
+	return ServeMetadata(c, ret)
+}
+
+// Get subtitle as vtt by sha
+//
+// Same as /:path/subtitle/:index/sub.vtt but the video is identified by its sha, the path is the one recorded
+// when the video was probed (request /:path/info first). Vtts of a sha never change so they can be cached.
+// Image subtitles (see the isImage field of the info) are only served as is with their link.
+//
+// Path: /subtitle/:sha/:index
+func (h *Handler) GetSubtitleBySha(c echo.Context) error {
+	sha := c.Param("sha")
+	if err := SanitizePath(sha); err != nil {
+		return err
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid subtitle index, it should be a number.")
+	}
+	path, ok := src.ResolveProbedPath(sha)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Video not found. Request its info first.")
+	}
+
+	ret, err := src.ExtractSubtitle(path, sha, index)
+	if errors.Is(err, src.ErrInvalidSubtitle) {
+		return echo.NewHTTPError(http.StatusNotFound, "Subtitle not found.")
+	}
+	if errors.Is(err, src.ErrUnsupportedSubtitle) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Image subtitles can't be converted to vtt, they must be burnt in.")
+	}
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age=604800")
+	return ServeMetadata(c, ret)
 }
 
 // Get thumbnail sprite
 //
 // Get a sprite file containing all the thumbnails of the show.
+// The extension can be any of png, jpeg or webp since the sprite is served in the format it was
+// generated with (see GOCODER_THUMBNAIL_FORMAT).
+// The /:path/thumbnails.:ext route is kept for vtt files generated before routes were named after the sprite.
+// Sprites are also served at /:path/<name>.:ext with the name of GOCODER_SPRITE_BASE_NAME.
+// The interval (in seconds, at least GOCODER_THUMBNAIL_MIN_INTERVAL) and maximum number of thumbnails (at most
+// GOCODER_THUMBNAIL_MAX_CAPS) can be specified with the interval and maxcaps query params. Use the height param to retrieve sheets of other sizes (see GOCODER_THUMBNAIL_HEIGHTS)
+// and the scale param to retrieve high-DPI sheets (see GOCODER_THUMBNAIL_SCALES).
+// Sprites bigger than GOCODER_MAX_SPRITE_DIMENSION are split in multiple files, use the page param to select one.
+// With GOCODER_LAZY_THUMBNAILS and the placeholder=true query param, the poster of the video is served (with
+// a X-Thumbnails-Provisional header) instead of a 202 while the sprite is extracted.
 //
-// Path: /:path/thumbnails.png
+// Path: /:path/sprite.:ext
 func (h *Handler) GetThumbnails(c echo.Context) error {
 	path, sha, err := GetPath(c)
 	if err != nil {
 		return err
 	}
 
-	out, err := src.ExtractThumbnail(path, sha)
+	opts, err := ParseThumbnailOptions(c)
 	if err != nil {
 		return err
 	}
+	size, err := ParseThumbnailSize(c)
+	if err != nil {
+		return err
+	}
+	page, err := ParseThumbnailPage(c)
+	if err != nil {
+		return err
+	}
+
+	if src.Settings.LazyThumbnails && c.QueryParam("placeholder") == "true" {
+		// errors are reported by ExtractThumbnails below.
+		if _, done, err := src.ExtractThumbnailAsync(path, sha, opts); err == nil && !done {
+			return ServePlaceholder(c, path, sha, opts)
+		}
+	}
+	out, ok, err := ExtractThumbnails(c, path, sha, opts)
+	if !ok {
+		return err
+	}
+
+	sprite, ok := src.FindSprite(out, opts, size, page)
+	if ok && !src.VerifySprite(sprite) {
+		// the corrupted thumbnails were discarded, extract them again.
+		out, ok, err = ExtractThumbnails(c, path, sha, opts)
+		if !ok {
+			return err
+		}
+		sprite, ok = src.FindSprite(out, opts, size, page)
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Thumbnails could not be generated.")
+	}
+	return ServeThumbnail(c, sha, sprite)
+}
+
+// Get thumbnail sprite by sha
+//
+// Same as /:path/sprite.:ext but the sprite is identified by its sha, this is the route used in vtt files.
+// This route never starts an extraction, it only serves sprites already generated (or being generated)
+// from a call to /:path/thumbnails.vtt.
+//
+// Path: /thumbnails/:sha/sprite.:ext
+func (h *Handler) GetThumbnailsBySha(c echo.Context) error {
+	sha := c.Param("sha")
+	if err := SanitizePath(sha); err != nil {
+		return err
+	}
+
+	opts, err := ParseThumbnailOptions(c)
+	if err != nil {
+		return err
+	}
+	size, err := ParseThumbnailSize(c)
+	if err != nil {
+		return err
+	}
+	page, err := ParseThumbnailPage(c)
+	if err != nil {
+		return err
+	}
+
+	sprite, ok := src.GetThumbnailSprite(sha, opts, size, page)
+	if !ok || !src.VerifySprite(sprite) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thumbnails not found. Request the vtt file first.")
+	}
+	return ServeThumbnail(c, sha, sprite)
+}
 
-	return c.File(fmt.Sprintf("%s/sprite.png", out))
+// Get a single thumbnail
+//
+// Get the thumbnail displayed at the time t (in seconds) as a standalone image, for clients that don't want
+// the whole sprite and its vtt. The tile is the one of the cue containing t in the vtt (default options,
+// main sheet). Like /thumbnails/:sha/sprite.:ext, this never starts an extraction.
+//
+// Path: /thumbnail/:sha
+func (h *Handler) GetThumbnailTile(c echo.Context) error {
+	sha := c.Param("sha")
+	if err := SanitizePath(sha); err != nil {
+		return err
+	}
+	t, err := strconv.ParseFloat(c.QueryParam("t"), 64)
+	if err != nil || !(t >= 0) || math.IsInf(t, 0) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid t, it should be a positive number of seconds.")
+	}
+
+	content, mime, err := src.GetThumbnailTile(sha, t)
+	if err != nil {
+		return ThumbnailError(err)
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age=604800")
+	return c.Blob(http.StatusOK, mime, content)
+}
+
+// Stream thumbnails progress
+//
+// Stream the progress of the thumbnails extraction (with default options) of a sha as server-sent events,
+// for live progress bars. A progress event ({"done": 12, "total": 150}) is sent every time a thumbnail is
+// extracted, then a done event (or an error event with the message) before the stream is closed. Like
+// /thumbnails/:sha/sprite.:ext, this never starts an extraction: request the vtt first.
+//
+// Path: /thumbnail/:sha/progress
+func (h *Handler) GetThumbnailsProgress(c echo.Context) error {
+	sha := c.Param("sha")
+	if err := SanitizePath(sha); err != nil {
+		return err
+	}
+	res := c.Response()
+	send := func(event string, data any) {
+		content, _ := json.Marshal(data)
+		fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event, content)
+		res.Flush()
+	}
+	// the headers are only sent with the first progress, a missing extraction is still a 404.
+	started := false
+	err := src.WatchThumbnailProgress(c.Request().Context(), sha, func(done int, total int) {
+		if !started {
+			res.Header().Set(echo.HeaderContentType, "text/event-stream")
+			res.Header().Set("Cache-Control", "no-cache")
+			res.WriteHeader(http.StatusOK)
+			started = true
+		}
+		send("progress", struct {
+			Done  int `json:"done"`
+			Total int `json:"total"`
+		}{Done: done, Total: total})
+	})
+	if !started {
+		return ThumbnailError(err)
+	}
+	if c.Request().Context().Err() != nil {
+		// the client is gone.
+		return nil
+	}
+	if err != nil {
+		message := "Internal server error"
+		if he, ok := ThumbnailError(err).(*echo.HTTPError); ok {
+			message = fmt.Sprint(he.Message)
+		} else {
+			c.Logger().Error(err)
+		}
+		send("error", struct {
+			Error string `json:"error"`
+		}{Error: message})
+		return nil
+	}
+	send("done", struct{}{})
+	return nil
 }
 
 // Get thumbnail vtt
 //
 // Get a vtt file containing timing/position of thumbnails inside the sprite file.
 // https://developer.bitmovin.com/playback/docs/webvtt-based-thumbnails for more info.
+// The interval (in seconds, at least GOCODER_THUMBNAIL_MIN_INTERVAL) and maximum number of thumbnails (at most
+// GOCODER_THUMBNAIL_MAX_CAPS) can be specified with the interval and maxcaps query params. Use the height param to retrieve sheets of other sizes (see GOCODER_THUMBNAIL_HEIGHTS)
+// and the scale param to retrieve high-DPI sheets (see GOCODER_THUMBNAIL_SCALES). The stream param selects
+// the video stream of files with multiple angles. The start and end params (in seconds) limit the thumbnails
+// to a range of the video. The count param extracts exactly this number of thumbnails, whatever the duration.
+// The aspect param (16:9 or 1.78 for example) replaces the display aspect ratio of files that are misflagged.
+// The duration param (in seconds) replaces the duration of badly muxed files for the layout of the thumbnails.
+// The tileheight, format, quality and offset params override GOCODER_THUMBNAIL_HEIGHT, GOCODER_THUMBNAIL_FORMAT,
+// GOCODER_THUMBNAIL_QUALITY and GOCODER_THUMBNAIL_START_OFFSET for this video (to tune them per library).
+// With inline=true, tiles are embedded in the cues as data uris instead of pointing to the sprite. This makes
+// a self contained (but much bigger) file, meant for exports. The vtt is also served at /:path/<name>.vtt with
+// the name of GOCODER_SPRITE_BASE_NAME, next to its sprite.
 //
-// Path: /:path/:resource/:slug/thumbnails.vtt
+// Path: /:path/thumbnails.vtt
 func (h *Handler) GetThumbnailsVtt(c echo.Context) error {
 	path, sha, err := GetPath(c)
 	if err != nil {
 		return err
 	}
 
-	out, err := src.ExtractThumbnail(path, sha)
+	opts, err := ParseThumbnailOptions(c)
+	if err != nil {
+		return err
+	}
+	size, err := ParseThumbnailSize(c)
+	if err != nil {
+		return err
+	}
+
+	inline := false
+	if param := c.QueryParam("inline"); param != "" {
+		inline, err = strconv.ParseBool(param)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid inline, it should be a boolean.")
+		}
+	}
+
+	out, ok, err := ExtractThumbnails(c, path, sha, opts)
+	if !ok {
+		return err
+	}
+
+	if inline {
+		vtt, err := src.GetInlineVtt(out, opts, size)
+		if err != nil {
+			return err
+		}
+		return c.Blob(http.StatusOK, "text/vtt", []byte(vtt))
+	}
+	return ServeMetadata(c, src.GetVttPath(out, size))
+}
+
+// Get thumbnails json
+//
+// Same as /:path/thumbnails.vtt but the cues are in json (with their start, end, position and sprite url),
+// for players that can't read vtt. This is only available when GOCODER_THUMBNAIL_JSON is set.
+//
+// Path: /:path/sprite.json
+func (h *Handler) GetThumbnailsJson(c echo.Context) error {
+	if !src.Settings.EmitJsonThumbnails {
+		return echo.NewHTTPError(http.StatusNotFound, "Json thumbnails are disabled.")
+	}
+	path, sha, err := GetPath(c)
+	if err != nil {
+		return err
+	}
+
+	opts, err := ParseThumbnailOptions(c)
+	if err != nil {
+		return err
+	}
+	size, err := ParseThumbnailSize(c)
+	if err != nil {
+		return err
+	}
+
+	out, ok, err := ExtractThumbnails(c, path, sha, opts)
+	if !ok {
+		return err
+	}
+
+	return ServeMetadata(c, src.GetJsonCuesPath(out, size))
+}
+
+// Get thumbnails layout
+//
+// Get the layout (number of thumbnails, rows, columns, size...) of the thumbnails sprite, for clients that
+// do not use the vtt file.
+//
+// Path: /:path/thumbnails.json
+func (h *Handler) GetThumbnailsInfo(c echo.Context) error {
+	path, sha, err := GetPath(c)
+	if err != nil {
+		return err
+	}
+
+	if _, ok, err := ExtractThumbnails(c, path, sha, src.ThumbnailOptions{}); !ok {
+		return err
+	}
+	ret, err := src.GetThumbnailInfo(sha)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Thumbnails layout not available.")
+	}
+	return c.JSON(http.StatusOK, ret)
+}
+
+// Get poster
+//
+// Get a single frame of the video that can be used as a fallback poster.
+// By default, the frame at 20% of the video is used. Use the t query param to specify the time (in seconds)
+// of the frame.
+//
+// Path: /:path/poster.jpg
+func (h *Handler) GetPoster(c echo.Context) error {
+	path, sha, err := GetPath(c)
 	if err != nil {
 		return err
 	}
+	var at float64
+	if t := c.QueryParam("t"); t != "" {
+		at, err = strconv.ParseFloat(t, 64)
+		if err != nil || at < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid time, it should be a positive number of seconds.")
+		}
+	}
 
-	return c.File(fmt.Sprintf("%s/sprite.vtt", out))
+	ret, err := src.ExtractPoster(path, sha, at)
+	if err != nil {
+		return err
+	}
+	return ServeMetadata(c, ret)
+}
+
+// Get thumbnails bif
+//
+// Get a bif file containing thumbnails of the video, for clients that do not support vtt sprites (roku...).
+//
+// Path: /:path/thumbnails.bif
+func (h *Handler) GetThumbnailsBif(c echo.Context) error {
+	path, sha, err := GetPath(c)
+	if err != nil {
+		return err
+	}
+
+	ret, err := src.ExtractBif(path, sha)
+	if err != nil {
+		return err
+	}
+	return ServeMetadata(c, ret)
+}
+
+// Get animated preview
+//
+// Get a short looping animated webp made of frames of the whole video, to display when hovering it.
+//
+// Path: /:path/preview.webp
+func (h *Handler) GetPreview(c echo.Context) error {
+	path, sha, err := GetPath(c)
+	if err != nil {
+		return err
+	}
+
+	ret, err := src.ExtractPreview(path, sha)
+	if err != nil {
+		return err
+	}
+	return ServeMetadata(c, ret)
+}
+
+// Get gif preview
+//
+// Same as /:path/preview.webp but as a palette-quantized gif, for legacy clients that can't display webp.
+// This is only available when GOCODER_GIF_PREVIEW is set.
+//
+// Path: /:path/preview.gif
+func (h *Handler) GetGifPreview(c echo.Context) error {
+	path, sha, err := GetPath(c)
+	if err != nil {
+		return err
+	}
+
+	ret, err := src.ExtractGifPreview(path, sha)
+	if errors.Is(err, src.ErrGifDisabled) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	return ServeMetadata(c, ret)
+}
+
+// Get audio peaks
+//
+// Get the min/max peaks of the audio of the file, clients can display it as a waveform
+// instead of thumbnails for audio only files.
+//
+// Path: /:path/peaks.json
+func (h *Handler) GetWaveformPeaks(c echo.Context) error {
+	path, sha, err := GetPath(c)
+	if err != nil {
+		return err
+	}
+
+	ret, err := src.ExtractWaveform(path, sha)
+	if err != nil {
+		return err
+	}
+	return ServeMetadata(c, ret)
+}
+
+// Get waveform image
+//
+// Get an image of the waveform of the audio of the file.
+//
+// Path: /:path/waveform.png
+func (h *Handler) GetWaveformImage(c echo.Context) error {
+	path, sha, err := GetPath(c)
+	if err != nil {
+		return err
+	}
+
+	ret, err := src.ExtractWaveform(path, sha)
+	if err != nil {
+		return err
+	}
+	return ServeMetadata(c, src.GetWaveformImagePath(ret))
+}
+
+// Get chapters
+//
+// Get the chapters of the file as a vtt, it has no cues if the file does not have chapters.
+//
+// Path: /:path/chapters.vtt
+func (h *Handler) GetChapters(c echo.Context) error {
+	path, sha, err := GetPath(c)
+	if err != nil {
+		return err
+	}
+
+	ret, err := src.ExtractChapters(path, sha)
+	if err != nil {
+		return err
+	}
+	return ServeMetadata(c, ret)
+}
+
+// Readiness check
+//
+// Check that ffmpeg can be run and that the metadata directory is writable, returns a 503 otherwise.
+// The body contains the version of ffmpeg and the problems found.
+//
+// Path: /healthz
+func (h *Handler) Healthz(c echo.Context) error {
+	ret := src.CheckHealth()
+	if len(ret.Errors) > 0 {
+		return c.JSON(http.StatusServiceUnavailable, ret)
+	}
+	return c.JSON(http.StatusOK, ret)
+}
+
+// Get thumbnails stats
+//
+// Get the number of extractions, their durations and the state of the cache. This is not proxied
+// by the back, it is meant for the admins of the transcoder (like /metrics).
+//
+// Path: /thumbnails/stats
+func (h *Handler) GetThumbnailsStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, src.ThumbnailStats())
+}
+
+// Get failed thumbnails
+//
+// List the recent thumbnails extractions that failed (newest first). This is not proxied by the back,
+// it is meant for the admins of the transcoder.
+//
+// Path: /thumbnails/failures
+func (h *Handler) GetThumbnailsFailures(c echo.Context) error {
+	return c.JSON(http.StatusOK, src.ListThumbnailFailures())
+}
+
+// Retry failed thumbnails
+//
+// Extract the thumbnails of every failure listed in /thumbnails/failures again. The extractions run in the
+// background (on the extraction workers), this returns the number of extractions queued.
+//
+// Path: /thumbnails/failures/retry
+func (h *Handler) RetryThumbnailsFailures(c echo.Context) error {
+	// results are buffered, nothing needs to read them.
+	queued, _ := src.RetryFailedThumbnails()
+	return c.JSON(http.StatusAccepted, struct {
+		Queued int `json:"queued"`
+	}{Queued: queued})
+}
+
+// Regenerate the library's thumbnails
+//
+// Extract the thumbnails (with default options) of every video of the metadata directory again, after a change
+// of the thumbnails settings. This runs in the background with half of the extraction workers, its progress is in
+// /thumbnails/stats. Only videos that already have thumbnails are regenerated. This returns the number of videos
+// queued, or a 409 if a regeneration is already running.
+//
+// Path: /thumbnails/regenerate
+func (h *Handler) RegenerateLibrary(c echo.Context) error {
+	shas, err := src.ListMetadataShas()
+	if err != nil {
+		return err
+	}
+	queued, err := src.RegenerateLibrary(shas, src.ResolveProbedPath)
+	if errors.Is(err, src.ErrRegenerationRunning) {
+		return echo.NewHTTPError(http.StatusConflict, "A regeneration of the library is already running.")
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, struct {
+		Queued int `json:"queued"`
+	}{Queued: queued})
+}
+
+// Cancel the library's regeneration
+//
+// Stop the running regeneration of the library (see /thumbnails/regenerate), the extractions already started
+// finish. cancelled is false if no regeneration was running.
+//
+// Path: /thumbnails/regenerate/cancel
+func (h *Handler) CancelLibraryRegeneration(c echo.Context) error {
+	return c.JSON(http.StatusOK, struct {
+		Cancelled bool `json:"cancelled"`
+	}{Cancelled: src.CancelLibraryRegeneration()})
+}
+
+// Get thumbnails state
+//
+// Check if the thumbnails (with default options) of a sha are ready without starting an extraction, to choose
+// between a scrubber, a spinner or nothing. extracting is true while they are being extracted.
+//
+// Path: /thumbnail/:sha/ready
+func (h *Handler) GetThumbnailsReady(c echo.Context) error {
+	sha := c.Param("sha")
+	if err := SanitizePath(sha); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Ready      bool `json:"ready"`
+		Extracting bool `json:"extracting"`
+	}{Ready: src.ThumbnailExists(sha), Extracting: src.ThumbnailExtracting(sha)})
+}
+
+// Get thumbnails extraction status
+//
+// Get the progress of the thumbnails extraction (with default options) of a sha as a percentage, for clients
+// that poll instead of streaming /thumbnail/:sha/progress. Thumbnails already extracted are at 100 percent.
+// Like /thumbnail/:sha/ready, this never starts an extraction.
+//
+// Path: /thumbnail/:sha/status
+func (h *Handler) GetThumbnailsStatus(c echo.Context) error {
+	sha := c.Param("sha")
+	if err := SanitizePath(sha); err != nil {
+		return err
+	}
+	done, total, found := src.ExtractThumbnailStatus(sha)
+	ready := src.ThumbnailExists(sha)
+	extracting := src.ThumbnailExtracting(sha)
+	if !found && !ready {
+		return echo.NewHTTPError(http.StatusNotFound, "Thumbnails not found. Request the vtt file first.")
+	}
+	percent := 0.
+	if ready && !extracting {
+		percent = 100
+	} else if total > 0 {
+		percent = math.Floor(float64(done)*1000/float64(total)) / 10
+	}
+	return c.JSON(http.StatusOK, struct {
+		Done       int     `json:"done"`
+		Total      int     `json:"total"`
+		Percent    float64 `json:"percent"`
+		Extracting bool    `json:"extracting"`
+		Ready      bool    `json:"ready"`
+	}{Done: done, Total: total, Percent: percent, Extracting: extracting, Ready: ready})
+}
+
+// Delete thumbnails
+//
+// Stop the running extractions of a sha and remove everything extracted for it (thumbnails, info, subtitles...),
+// for videos deleted from the library. This returns the number of extractions cancelled.
+//
+// Path: /thumbnail/:sha
+func (h *Handler) DeleteThumbnail(c echo.Context) error {
+	sha := c.Param("sha")
+	if err := SanitizePath(sha); err != nil {
+		return err
+	}
+	cancelled := src.CancelThumbnail(sha)
+	if err := src.InvalidateThumbnail(sha); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Cancelled int `json:"cancelled"`
+	}{Cancelled: cancelled})
+}
+
+// Cancel thumbnails extraction
+//
+// Stop the running thumbnails extractions of a sha and remove their partial files, clients waiting for them
+// get a 409. The next request extracts them again. This returns the number of extractions cancelled once
+// they have stopped.
+//
+// Path: /thumbnail/:sha/cancel
+func (h *Handler) CancelThumbnail(c echo.Context) error {
+	sha := c.Param("sha")
+	if err := SanitizePath(sha); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Cancelled int `json:"cancelled"`
+	}{Cancelled: src.CancelThumbnail(sha)})
 }
 
 type Handler struct {
@@ -280,10 +912,25 @@ type Handler struct {
 }
 
 func main() {
+	src.SetupLogger()
+	if len(os.Args) > 1 && os.Args[1] == "thumbnails" {
+		os.Exit(runThumbnails(os.Args[2:]))
+	}
 	e := echo.New()
 	e.Use(middleware.Logger())
 	e.HTTPErrorHandler = ErrorHandler
 
+	// every extraction and transcode runs ffmpeg, fail now instead of on every request.
+	version, err := src.CheckFfmpeg()
+	if err != nil {
+		e.Logger.Fatal(err)
+		return
+	}
+	slog.Info("Using ffmpeg", "path", src.Settings.FfmpegPath, "version", version)
+	if err := src.InitHardwareAccel(); err != nil {
+		slog.Warn("Hardware acceleration is not available, falling back to software encoding", "err", err)
+	}
+
 	transcoder, err := src.NewTranscoder()
 	if err != nil {
 		e.Logger.Fatal(err)
@@ -292,6 +939,11 @@ func main() {
 	h := Handler{
 		transcoder: transcoder,
 	}
+	if err := src.MigrateMetadataLayout(); err != nil {
+		e.Logger.Error(err)
+	}
+	src.StartMetadataGC()
+	src.CleanScratchDir()
 
 	e.GET("/:path/direct", DirectStream)
 	e.GET("/:path/master.m3u8", h.GetMaster)
@@ -300,10 +952,88 @@ func main() {
 	e.GET("/:path/:quality/:chunk", h.GetVideoSegment)
 	e.GET("/:path/audio/:audio/:chunk", h.GetAudioSegment)
 	e.GET("/:path/info", h.GetInfo)
-	e.GET("/:path/thumbnails.png", h.GetThumbnails)
+	for _, format := range src.ThumbnailFormats {
+		e.GET(fmt.Sprintf("/:path/sprite.%s", format), h.GetThumbnails)
+		e.GET(fmt.Sprintf("/:path/thumbnails.%s", format), h.GetThumbnails)
+		e.GET(fmt.Sprintf("/thumbnails/:sha/sprite.%s", format), h.GetThumbnailsBySha)
+		// cues point to the sprite with a relative url named after GOCODER_SPRITE_BASE_NAME.
+		if base := src.Settings.SpriteBaseName; base != "sprite" && base != "thumbnails" {
+			e.GET(fmt.Sprintf("/:path/%s.%s", base, format), h.GetThumbnails)
+			e.GET(fmt.Sprintf("/thumbnails/:sha/%s.%s", base, format), h.GetThumbnailsBySha)
+		}
+	}
+	e.GET("/thumbnail/:sha", h.GetThumbnailTile)
+	e.GET("/thumbnail/:sha/progress", h.GetThumbnailsProgress)
+	e.POST("/thumbnail/:sha/cancel", h.CancelThumbnail)
+	e.GET("/thumbnail/:sha/ready", h.GetThumbnailsReady)
+	e.GET("/thumbnail/:sha/status", h.GetThumbnailsStatus)
+	e.DELETE("/thumbnail/:sha", h.DeleteThumbnail)
 	e.GET("/:path/thumbnails.vtt", h.GetThumbnailsVtt)
+	if base := src.Settings.SpriteBaseName; base != "thumbnails" {
+		e.GET(fmt.Sprintf("/:path/%s.vtt", base), h.GetThumbnailsVtt)
+	}
+	e.GET("/:path/sprite.json", h.GetThumbnailsJson)
+	e.GET("/:path/thumbnails.bif", h.GetThumbnailsBif)
+	e.GET("/:path/thumbnails.json", h.GetThumbnailsInfo)
+	e.GET("/:path/poster.jpg", h.GetPoster)
+	e.GET("/:path/preview.webp", h.GetPreview)
+	e.GET("/:path/preview.gif", h.GetGifPreview)
+	e.GET("/:path/peaks.json", h.GetWaveformPeaks)
+	e.GET("/:path/waveform.png", h.GetWaveformImage)
+	e.GET("/:path/chapters.vtt", h.GetChapters)
 	e.GET("/:path/attachment/:name", h.GetAttachment)
 	e.GET("/:path/subtitle/:name", h.GetSubtitle)
+	e.GET("/:path/subtitle/:index/sub.vtt", h.GetSubtitleVtt)
+	e.GET("/subtitle/:sha/:index", h.GetSubtitleBySha)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	e.GET("/healthz", h.Healthz)
+	e.GET("/thumbnails/stats", h.GetThumbnailsStats)
+	e.GET("/thumbnails/failures", h.GetThumbnailsFailures)
+	e.POST("/thumbnails/failures/retry", h.RetryThumbnailsFailures)
+	e.POST("/thumbnails/regenerate", h.RegenerateLibrary)
+	e.POST("/thumbnails/regenerate/cancel", h.CancelLibraryRegeneration)
 
-	e.Logger.Fatal(e.Start(":7666"))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := e.Start(":7666"); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+	grpc_server := NewGrpcServer()
+	if grpc_addr != "" {
+		listener, err := net.Listen("tcp", grpc_addr)
+		if err != nil {
+			e.Logger.Fatal(err)
+			return
+		}
+		slog.Info("Serving thumbnails over gRPC", "addr", grpc_addr)
+		go func() {
+			if err := grpc_server.Serve(listener); err != nil {
+				e.Logger.Fatal(err)
+			}
+		}()
+	}
+	<-ctx.Done()
+
+	// let running extractions write their files instead of leaving truncated ones.
+	shutdown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdown); err != nil {
+		e.Logger.Error(err)
+	}
+	// streams of Extract can last for the whole extraction, they are closed at the deadline.
+	stopped := make(chan struct{})
+	go func() {
+		grpc_server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdown.Done():
+		grpc_server.Stop()
+	}
+	if err := src.Shutdown(shutdown); err != nil {
+		e.Logger.Error(err)
+	}
 }
@@ -0,0 +1,88 @@
+package src
+
+import (
+	"context"
+	"image"
+	"math"
+	"slices"
+)
+
+// Number of frames sampled per thumbnail to measure the activity of the video, and the maximum number of samples.
+var (
+	adaptive_samples_per_tile = 2
+	adaptive_max_samples      = 200
+)
+
+// Size of the frames sampled to measure the activity, signatures only keep a 16x16 grid anyway.
+var (
+	adaptive_width  = 64
+	adaptive_height = 36
+)
+
+// Spread numcaps thumbnails over the video with more of them where the picture changes a lot (action scenes)
+// and less where it is static. The activity is the difference between evenly sampled frames. Returns nil
+// (thumbnails stay evenly spaced) when the activity can't be measured or is uniform.
+func getAdaptiveTimestamps(ctx context.Context, gen *Generator, numcaps int) []float64 {
+	logger := getLogger(ctx)
+	duration := float64(gen.Duration) / 1000
+	samples := min(numcaps*adaptive_samples_per_tile, adaptive_max_samples)
+	if duration <= 0 || samples < 3 {
+		return nil
+	}
+	sample_ts := make([]float64, samples)
+	for i := range sample_ts {
+		sample_ts[i] = duration * (float64(i) + 0.5) / float64(samples)
+	}
+	signatures := make([][]uint8, samples)
+	err := grabFrames(ctx, gen, sample_ts, adaptive_width, adaptive_height, func(i int, _ float64, img image.Image) error {
+		signatures[i] = getSignature(img)
+		return nil
+	})
+	if err != nil {
+		logger.Warn("Could not sample the video, thumbnails are evenly spaced", "path", gen.Filename, "err", err)
+		return nil
+	}
+
+	// the activity of each slice of the video is the mean difference of its sample with its neighbors.
+	weights := make([]float64, samples)
+	var total float64
+	for i := range weights {
+		var diff float64
+		count := 0
+		if i > 0 {
+			diff += getSignatureDiff(signatures[i], signatures[i-1])
+			count++
+		}
+		if i+1 < samples {
+			diff += getSignatureDiff(signatures[i], signatures[i+1])
+			count++
+		}
+		weights[i] = diff / float64(count)
+		total += weights[i]
+	}
+	if total == 0 {
+		return nil
+	}
+	// every slice keeps half of its even share so static scenes (dialogs...) still have thumbnails.
+	mean := total / float64(samples)
+	for i := range weights {
+		weights[i] += mean
+	}
+	total *= 2
+
+	// place thumbnails at evenly spaced quantiles of the cumulative activity.
+	ret := make([]float64, 0, numcaps)
+	slice := duration / float64(samples)
+	sum := 0.
+	i := 0
+	for n := 0; n < numcaps; n++ {
+		target := (float64(n) + 0.5) / float64(numcaps) * total
+		for i < samples-1 && sum+weights[i] < target {
+			sum += weights[i]
+			i++
+		}
+		ts := (float64(i) + (target-sum)/weights[i]) * slice
+		ret = append(ret, math.Floor(min(ts, duration)*1000)/1000)
+	}
+	return slices.Compact(ret)
+}
@@ -0,0 +1,60 @@
+package src
+
+import "sync"
+
+type BatchItem struct {
+	Path string
+	Sha  string
+	// Options of the thumbnails, the defaults if empty.
+	Opts ThumbnailOptions
+}
+
+type BatchResult struct {
+	BatchItem
+	// The thumbnails directory (see ExtractThumbnail), empty if the extraction failed.
+	Out string
+	Err error
+	// Number of items finished (including this one) out of the whole batch, to report the progress.
+	Done  int
+	Total int
+}
+
+// Extract the thumbnails of every item, results are sent as soon as each extraction
+// finishes (in any order) and the channel is closed after the last one. At most Settings.ThumbnailWorkers
+// items are started at once so a big batch doesn't queue thousands of goroutines on the worker pool.
+func ExtractThumbnailsBatch(items []BatchItem) <-chan BatchResult {
+	// buffered so extractions never wait for the consumer, even if it stops reading.
+	ret := make(chan BatchResult, len(items))
+	queue := make(chan BatchItem)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	done := 0
+	for i := 0; i < min(Settings.ThumbnailWorkers, len(items)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				// prewarmed thumbnails are needed first, give them every worker.
+				waitForPrewarm()
+				out, err := ExtractThumbnail(item.Path, item.Sha, item.Opts)
+				if err != nil {
+					out = ""
+				}
+				lock.Lock()
+				done++
+				ret <- BatchResult{BatchItem: item, Out: out, Err: err, Done: done, Total: len(items)}
+				lock.Unlock()
+			}
+		}()
+	}
+	go func() {
+		for _, item := range items {
+			queue <- item
+		}
+		close(queue)
+		wg.Wait()
+		close(ret)
+	}()
+	return ret
+}
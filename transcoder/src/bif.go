@@ -0,0 +1,119 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+)
+
+// Height of the frames in bif files, this is the size recommended by roku for hd videos.
+var bif_height = 180
+
+var bif_magic = []byte{0x89, 0x42, 0x49, 0x46, 0x0d, 0x0a, 0x1a, 0x0a}
+
+// Extract thumbnails in the bif format (used by roku and some android tv apps instead of
+// vtt sprites). See https://developer.roku.com/docs/developer-program/media-playback/trick-mode/bif-file-creation.md
+func ExtractBif(path string, sha string) (string, error) {
+	cache_key := fmt.Sprintf("%s/bif", sha)
+	ret, created := thumbnails.GetOrCreate(cache_key, func() *Thumbnail {
+		ret := &Thumbnail{
+			path: fmt.Sprintf("%s/thumbnails.bif", GetMetadataPath(sha)),
+		}
+		if !startJob() {
+			ret.err = ErrShuttingDown
+			ret.finished.Store(true)
+			return ret
+		}
+		ret.ready.Add(1)
+		go func() {
+			defer endJob()
+			ret.err = withExtractionTimeout(context.Background(), func(ctx context.Context) error {
+				return extractBif(ctx, path, sha, ret.path)
+			})
+			if ret.err != nil {
+				slog.Error("Could not extract bif", "path", path, "sha", sha, "err", ret.err)
+				extraction_failures.WithLabelValues("bif").Inc()
+				thumbnails.Remove(cache_key)
+			}
+			ret.finish()
+		}()
+		return ret
+	})
+	observeCache("bif", created)
+	ret.ready.Wait()
+	return ret.path, ret.err
+}
+
+func extractBif(ctx context.Context, path string, sha string, out string) error {
+	defer printExecTime("extracting bif for %s", path)()
+	if metadata_store.Exists(out) {
+		return nil
+	}
+
+	release, err := acquireWorker(ctx, "bif")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	gen, err := openGenerator(path)
+	if err != nil {
+		return err
+	}
+	defer gen.Close()
+
+	numcaps, interval := getThumbnailLayout(gen, ThumbnailOptions{}.withDefaults())
+	width := getThumbnailWidth(gen, bif_height, getPixelAspectRatio(path, sha))
+	transfer := getTransfer(path, sha)
+	colors := getColorFix(path, sha)
+
+	timestamps := make([]uint32, numcaps)
+	frames := make([][]byte, numcaps)
+	err = grabFrames(ctx, gen, getEvenTimestamps(numcaps, interval), width, bif_height, func(i int, ts float64, img image.Image) error {
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, tonemap(fixColors(img, colors), transfer), imaging.JPEG, imaging.JPEGQuality(Settings.ThumbnailQuality)); err != nil {
+			return err
+		}
+		timestamps[i] = uint32(ts)
+		frames[i] = buf.Bytes()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// header: magic, version, image count, timestamp multiplier (in ms) and reserved bytes up to 64.
+	header := make([]byte, 64)
+	copy(header, bif_magic)
+	binary.LittleEndian.PutUint32(header[8:], 0)
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(frames)))
+	binary.LittleEndian.PutUint32(header[16:], 1000)
+
+	// index: a (timestamp, offset) pair per frame and a terminating entry.
+	index := make([]byte, 8*(len(frames)+1))
+	offset := uint32(len(header) + len(index))
+	for i, frame := range frames {
+		binary.LittleEndian.PutUint32(index[i*8:], timestamps[i])
+		binary.LittleEndian.PutUint32(index[i*8+4:], offset)
+		offset += uint32(len(frame))
+	}
+	binary.LittleEndian.PutUint32(index[len(frames)*8:], 0xffffffff)
+	binary.LittleEndian.PutUint32(index[len(frames)*8+4:], offset)
+
+	var bif bytes.Buffer
+	bif.Write(header)
+	bif.Write(index)
+	for _, frame := range frames {
+		bif.Write(frame)
+	}
+	mkdirMetadata(filepath.Dir(out))
+	return writeAtomic(out, func(tmp string) error {
+		return writeMetadataFile(tmp, bif.Bytes())
+	})
+}
@@ -0,0 +1,32 @@
+package src
+
+import (
+	"image"
+	"log/slog"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+)
+
+// Components of the blurhash (the more, the more details and the longer the hash).
+const (
+	blurhash_x = 4
+	blurhash_y = 3
+)
+
+// Index of the frame used for the blurhash, at the same position as the default poster (20% of the video).
+func getBlurhashFrame(numcaps int) int {
+	return numcaps / 5
+}
+
+// Compute the blurhash (https://blurha.sh) of a frame, an empty string if it could not be computed.
+func getBlurhash(img image.Image) string {
+	// the hash only keeps a few colors, a small image is more than enough and way faster to encode.
+	small := imaging.Resize(img, 32, 0, imaging.Box)
+	hash, err := blurhash.Encode(blurhash_x, blurhash_y, small)
+	if err != nil {
+		slog.Warn("Could not compute the blurhash", "err", err)
+		return ""
+	}
+	return hash
+}
@@ -0,0 +1,73 @@
+package src
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+var vtt_escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Write the chapters of a file as vtt cues, players can use them to display chapter markers.
+// Files without chapters get a vtt without cues, an error is only returned if the extraction failed.
+func ExtractChapters(path string, sha string) (string, error) {
+	cache_key := fmt.Sprintf("%s/chapters", sha)
+	ret, created := thumbnails.GetOrCreate(cache_key, func() *Thumbnail {
+		ret := &Thumbnail{
+			path: fmt.Sprintf("%s/chapters.vtt", GetMetadataPath(sha)),
+		}
+		ret.ready.Add(1)
+		go func() {
+			ret.err = extractChapters(path, sha, ret.path)
+			if ret.err != nil {
+				slog.Error("Could not extract chapters", "path", path, "sha", sha, "err", ret.err)
+				extraction_failures.WithLabelValues("chapters").Inc()
+				thumbnails.Remove(cache_key)
+			}
+			ret.finish()
+		}()
+		return ret
+	})
+	observeCache("chapters", created)
+	ret.ready.Wait()
+	return ret.path, ret.err
+}
+
+func extractChapters(path string, sha string, out string) error {
+	if metadata_store.Exists(out) {
+		return nil
+	}
+
+	info, err := GetInfo(path, sha)
+	if err != nil {
+		return err
+	}
+
+	vtt := "WEBVTT\n\n"
+	for i, chapter := range info.Chapters {
+		// the last chapter has no end on some files, it lasts until the end of the video.
+		end := chapter.EndTime
+		if end <= chapter.StartTime {
+			end = info.Duration
+		}
+		// an empty line would end the cue and cue text can't contain -->, < or & unescaped.
+		name := strings.Join(strings.Fields(chapter.Name), " ")
+		name = vtt_escaper.Replace(name)
+		if name == "" {
+			name = fmt.Sprintf("Chapter %d", i+1)
+		}
+		vtt += fmt.Sprintf(
+			"%d\n%s --> %s\n%s\n\n",
+			i+1,
+			tsToVttTime(float64(chapter.StartTime)),
+			tsToVttTime(float64(end)),
+			name,
+		)
+	}
+
+	mkdirMetadata(filepath.Dir(out))
+	return writeAtomic(out, func(tmp string) error {
+		return writeMetadataFile(tmp, []byte(vtt))
+	})
+}
@@ -0,0 +1,83 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sprites already checked this run, a sprite is only hashed on its first read.
+var verified_sprites = NewCMapWithLimit[string, bool](max_cached_thumbnails)
+
+func getChecksumPath(sprite string) string {
+	return sprite + ".sha256"
+}
+
+// Write the checksum of the file at path (a sprite being written) to checksum_path.
+func writeChecksum(path string, checksum_path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	return writeMetadataFile(checksum_path, []byte(hex.EncodeToString(h.Sum(nil))))
+}
+
+// Check a sprite against the checksum written with it. Sprites without checksums (extracted by older
+// versions) are trusted. A corrupted sprite is removed with the rest of its thumbnails so the next
+// ExtractThumbnail call extracts them again, like if they were never extracted.
+func VerifySprite(sprite string) bool {
+	if ok, cached := verified_sprites.Get(sprite); cached {
+		return ok
+	}
+	ok := checkSprite(sprite)
+	if !ok {
+		slog.Warn("Sprite does not match its checksum, discarding it", "path", sprite)
+		metadata_store.Remove(sprite)
+		discardThumbnails(filepath.Dir(sprite))
+		return false
+	}
+	verified_sprites.Set(sprite, ok)
+	return ok
+}
+
+func checkSprite(sprite string) bool {
+	checksum, err := OpenMetadata(getChecksumPath(sprite))
+	if err != nil {
+		return true
+	}
+	defer checksum.Close()
+	expected, err := io.ReadAll(checksum)
+	if err != nil {
+		return true
+	}
+
+	file, err := OpenMetadata(sprite)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == strings.TrimSpace(string(expected))
+}
+
+// Forget every finished extraction of the thumbnails directory out and remove its files.
+func discardThumbnails(out string) {
+	thumbnails.RemoveFunc(func(_ string, val *Thumbnail) bool {
+		return val.path == out && val.finished.Load()
+	})
+	thumbnail_files.RemoveFunc(func(_ string, val string) bool { return val == out })
+	removeSheets(out)
+	removeCheckpoint(out)
+}
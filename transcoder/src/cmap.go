@@ -1,10 +1,20 @@
 package src
 
-import "sync"
+import (
+	"container/list"
+	"sync"
+)
 
 type CMap[K comparable, V any] struct {
 	data map[K]V
 	lock sync.RWMutex
+	// Maximum number of entries, zero means unlimited.
+	limit int
+	// Keys ordered from the most recently used to the least recently used (only used with a limit).
+	lru   *list.List
+	elems map[K]*list.Element
+	// Entries that can't be evicted (running extractions...), nil if every entry can be.
+	pinned func(val V) bool
 }
 
 func NewCMap[K comparable, V any]() CMap[K, V] {
@@ -13,7 +23,76 @@ func NewCMap[K comparable, V any]() CMap[K, V] {
 	}
 }
 
+// Create a map that keeps at most max entries, evicting the least recently used one when full.
+// Get and GetOrCreate count as an access.
+func NewCMapWithLimit[K comparable, V any](max int) CMap[K, V] {
+	return CMap[K, V]{
+		data:  make(map[K]V),
+		limit: max,
+		lru:   list.New(),
+		elems: make(map[K]*list.Element),
+	}
+}
+
+// Same as NewCMapWithLimit but entries for which pinned returns true are never evicted, the least recently
+// used entry that is not pinned is evicted instead. The map grows past max while every entry is pinned.
+// pinned is called with the lock held, it must not use the map.
+func NewCMapWithLimitPinned[K comparable, V any](max int, pinned func(val V) bool) CMap[K, V] {
+	return CMap[K, V]{
+		data:   make(map[K]V),
+		limit:  max,
+		lru:    list.New(),
+		elems:  make(map[K]*list.Element),
+		pinned: pinned,
+	}
+}
+
+// Mark key as the most recently used. The lock must be held for writing.
+func (m *CMap[K, V]) touch(key K) {
+	if m.limit <= 0 {
+		return
+	}
+	if elem, ok := m.elems[key]; ok {
+		m.lru.MoveToFront(elem)
+		return
+	}
+	m.elems[key] = m.lru.PushFront(key)
+	// key was just used, it is never the one evicted.
+	for elem := m.lru.Back(); m.lru.Len() > m.limit && elem != m.lru.Front(); {
+		prev := elem.Prev()
+		oldest := elem.Value.(K)
+		if m.pinned == nil || !m.pinned(m.data[oldest]) {
+			m.lru.Remove(elem)
+			delete(m.elems, oldest)
+			delete(m.data, oldest)
+		}
+		elem = prev
+	}
+}
+
+// Forget the usage info of key. The lock must be held for writing.
+func (m *CMap[K, V]) forget(key K) {
+	if m.limit <= 0 {
+		return
+	}
+	if elem, ok := m.elems[key]; ok {
+		m.lru.Remove(elem)
+		delete(m.elems, key)
+	}
+}
+
 func (m *CMap[K, V]) Get(key K) (V, bool) {
+	if m.limit > 0 {
+		// accesses reorder the lru, a read lock is not enough.
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		ret, ok := m.data[key]
+		if ok {
+			m.touch(key)
+		}
+		return ret, ok
+	}
+
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 	ret, ok := m.data[key]
@@ -21,26 +100,30 @@ func (m *CMap[K, V]) Get(key K) (V, bool) {
 }
 
 func (m *CMap[K, V]) GetOrCreate(key K, create func() V) (V, bool) {
-	m.lock.RLock()
-	ret, ok := m.data[key]
-	if ok {
+	if m.limit <= 0 {
+		m.lock.RLock()
+		ret, ok := m.data[key]
+		if ok {
+			m.lock.RUnlock()
+			return ret, false
+		}
 		m.lock.RUnlock()
-		return ret, false
 	}
-	m.lock.RUnlock()
 
 	// data does not exist, create it
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	// check if another gorountine already created it before we could lock
-	ret, ok = m.data[key]
+	ret, ok := m.data[key]
 	if ok {
+		m.touch(key)
 		return ret, false
 	}
 
 	val := create()
 	m.data[key] = val
+	m.touch(key)
 	return val, true
 }
 
@@ -53,6 +136,19 @@ func (m *CMap[K, V]) Set(key K, val V) {
 	defer m.lock.Unlock()
 
 	m.data[key] = val
+	m.touch(key)
+}
+
+// Replace the value of key by the result of update, called with the current value (if any) under the lock.
+func (m *CMap[K, V]) Update(key K, update func(val V, ok bool) V) V {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old, ok := m.data[key]
+	val := update(old, ok)
+	m.data[key] = val
+	m.touch(key)
+	return val
 }
 
 func (m *CMap[K, V]) Remove(key K) {
@@ -60,6 +156,7 @@ func (m *CMap[K, V]) Remove(key K) {
 	defer m.lock.Unlock()
 
 	delete(m.data, key)
+	m.forget(key)
 }
 
 func (m *CMap[K, V]) GetAndRemove(key K) (V, bool) {
@@ -68,5 +165,70 @@ func (m *CMap[K, V]) GetAndRemove(key K) (V, bool) {
 
 	val, ok := m.data[key]
 	delete(m.data, key)
+	m.forget(key)
 	return val, ok
 }
+
+// Remove every entry for which del returns true.
+func (m *CMap[K, V]) RemoveFunc(del func(key K, val V) bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for key, val := range m.data {
+		if del(key, val) {
+			delete(m.data, key)
+			m.forget(key)
+		}
+	}
+}
+
+// Check if pred returns true for any entry. This does not count as an access.
+func (m *CMap[K, V]) Any(pred func(key K, val V) bool) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for key, val := range m.data {
+		if pred(key, val) {
+			return true
+		}
+	}
+	return false
+}
+
+// Values of the entries for which pred returns true. This does not count as an access.
+func (m *CMap[K, V]) Filter(pred func(key K, val V) bool) []V {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var ret []V
+	for key, val := range m.data {
+		if pred(key, val) {
+			ret = append(ret, val)
+		}
+	}
+	return ret
+}
+
+// Call fn on every entry. This does not count as an access.
+func (m *CMap[K, V]) ForEach(fn func(key K, val V)) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for key, val := range m.data {
+		fn(key, val)
+	}
+}
+
+// Number of entries for which pred returns true. This does not count as an access.
+func (m *CMap[K, V]) Count(pred func(key K, val V) bool) int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ret := 0
+	for key, val := range m.data {
+		if pred(key, val) {
+			ret++
+		}
+	}
+	return ret
+}
@@ -0,0 +1,140 @@
+package src
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// Keys of m from the most recently used to the least recently used.
+func lruKeys[K comparable, V any](m *CMap[K, V]) []K {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var ret []K
+	for elem := m.lru.Front(); elem != nil; elem = elem.Next() {
+		ret = append(ret, elem.Value.(K))
+	}
+	return ret
+}
+
+// The lru and the data must always hold the same keys.
+func checkConsistency[K comparable, V any](t *testing.T, m *CMap[K, V]) {
+	t.Helper()
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.lru.Len() != len(m.data) || len(m.elems) != len(m.data) {
+		t.Fatalf("lru has %d keys, elems %d and data %d", m.lru.Len(), len(m.elems), len(m.data))
+	}
+	for key := range m.data {
+		if _, ok := m.elems[key]; !ok {
+			t.Fatalf("%v is in data but not in the lru", key)
+		}
+	}
+}
+
+func TestCMapEvictionOrder(t *testing.T) {
+	m := NewCMapWithLimit[string, int](3)
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Set("c", 3)
+	m.Get("a")
+	m.Set("d", 4)
+	if _, ok := m.Get("b"); ok {
+		t.Error("b is the least recently used, it should have been evicted")
+	}
+	if got, want := lruKeys(&m), []string{"d", "a", "c"}; !slices.Equal(got, want) {
+		t.Errorf("lru is %v, expected %v", got, want)
+	}
+
+	// GetOrCreate of an existing key counts as an access.
+	if _, created := m.GetOrCreate("c", func() int { return 0 }); created {
+		t.Error("c exists, it should not be created again")
+	}
+	m.Set("e", 5)
+	if got, want := lruKeys(&m), []string{"e", "c", "d"}; !slices.Equal(got, want) {
+		t.Errorf("lru is %v, expected %v", got, want)
+	}
+
+	// accesses that don't count do not reorder the lru.
+	m.Any(func(string, int) bool { return false })
+	m.Count(func(string, int) bool { return true })
+	m.Set("f", 6)
+	if got, want := lruKeys(&m), []string{"f", "e", "c"}; !slices.Equal(got, want) {
+		t.Errorf("lru is %v, expected %v", got, want)
+	}
+
+	m.Remove("e")
+	m.Set("g", 7)
+	if got, want := lruKeys(&m), []string{"g", "f", "c"}; !slices.Equal(got, want) {
+		t.Errorf("lru is %v, expected %v", got, want)
+	}
+	checkConsistency(t, &m)
+}
+
+func TestCMapPinnedEntries(t *testing.T) {
+	// odd values are running extractions.
+	m := NewCMapWithLimitPinned[string, int](2, func(val int) bool { return val%2 == 1 })
+	m.Set("running", 1)
+	m.Set("done", 2)
+	m.Set("new", 4)
+	if _, ok := m.Get("running"); !ok {
+		t.Error("pinned entries should never be evicted")
+	}
+	if _, ok := m.Get("done"); ok {
+		t.Error("done is the least recently used entry that is not pinned, it should have been evicted")
+	}
+
+	// the map grows past its limit while every other entry is pinned, the entry just added is kept.
+	m.Set("other", 3)
+	m.Set("last", 6)
+	for _, key := range []string{"running", "other", "last"} {
+		if _, ok := m.Get(key); !ok {
+			t.Errorf("%s should not have been evicted", key)
+		}
+	}
+	if _, ok := m.Get("new"); ok {
+		t.Error("new is the only entry that can be evicted")
+	}
+	checkConsistency(t, &m)
+
+	// entries are evicted once they are not pinned anymore.
+	m.Set("running", 8)
+	m.Set("other", 10)
+	m.Set("again", 12)
+	if got := m.Count(func(string, int) bool { return true }); got != 2 {
+		t.Errorf("map has %d entries, expected 2", got)
+	}
+	checkConsistency(t, &m)
+}
+
+func TestCMapConcurrentEviction(t *testing.T) {
+	const limit = 8
+	const writers = 3
+	m := NewCMapWithLimit[string, int](limit)
+	m.Set("hot", 0)
+
+	// every writer uses the hot key between its insertions: at most two insertions per writer happen between
+	// two accesses of the hot key, it is never the least recently used one.
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				m.Set(fmt.Sprintf("%d-%d", w, i), i)
+				if _, ok := m.Get("hot"); !ok {
+					t.Error("the hot key was evicted")
+					return
+				}
+				m.GetOrCreate(fmt.Sprintf("%d-%d", w, i%3), func() int { return i })
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if got := m.Count(func(string, int) bool { return true }); got != limit {
+		t.Errorf("map has %d entries, expected %d", got, limit)
+	}
+	checkConsistency(t, &m)
+}
@@ -0,0 +1,103 @@
+package src
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Linear transform applied to the rgb values (0-1) of frames.
+type colorFix struct {
+	mat [3][3]float64
+}
+
+// Luma coefficients (kr, kb) of the yuv matrices.
+var (
+	matrix_601  = [2]float64{0.299, 0.114}
+	matrix_709  = [2]float64{0.2126, 0.0722}
+	matrix_2020 = [2]float64{0.2627, 0.0593}
+)
+
+// Rows of the yuv (Y in 0-1, Cb and Cr in -0.5-0.5) to rgb matrix.
+func yuvToRgb(kr, kb float64) [3][3]float64 {
+	kg := 1 - kr - kb
+	return [3][3]float64{
+		{1, 0, 2 * (1 - kr)},
+		{1, -2 * (1 - kb) * kb / kg, -2 * (1 - kr) * kr / kg},
+		{1, 2 * (1 - kb), 0},
+	}
+}
+
+func rgbToYuv(kr, kb float64) [3][3]float64 {
+	kg := 1 - kr - kb
+	return [3][3]float64{
+		{kr, kg, kb},
+		{-kr / (2 * (1 - kb)), -kg / (2 * (1 - kb)), 0.5},
+		{0.5, -kg / (2 * (1 - kr)), -kb / (2 * (1 - kr))},
+	}
+}
+
+func mulMat(a, b [3][3]float64) [3][3]float64 {
+	var ret [3][3]float64
+	for i := range ret {
+		for j := range ret[i] {
+			for k := 0; k < 3; k++ {
+				ret[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return ret
+}
+
+// screengen converts frames to rgb with swscale's defaults: the bt.601 matrix (and the range implied
+// by the pixel format). Find the transform that fixes frames of videos tagged with another matrix,
+// nil if frames are already right.
+//
+// Full range videos decoded by screengen to a limited pixel format (hevc, vp9...) can't be fixed here: swscale
+// already clipped the shadows and highlights, compressing the range back would only make blacks gray. The
+// ffmpeg generator converts frames with the range of the stream instead (see ffmpegDecoder.scaleFilter).
+func getColorFix(path string, sha string) *colorFix {
+	if IsRemotePath(path) {
+		return nil
+	}
+	info, err := ProbeMedia(path, sha)
+	if err != nil || info.Video == nil || info.Video.MatrixCoefficients == nil {
+		return nil
+	}
+
+	var matrix [2]float64
+	switch coefficients := *info.Video.MatrixCoefficients; {
+	case strings.HasPrefix(coefficients, "BT.709"):
+		matrix = matrix_709
+	case strings.HasPrefix(coefficients, "BT.2020"):
+		matrix = matrix_2020
+	default:
+		return nil
+	}
+	// undo swscale's conversion and convert the yuv values with the right matrix.
+	return &colorFix{
+		mat: mulMat(yuvToRgb(matrix[0], matrix[1]), rgbToYuv(matrix_601[0], matrix_601[1])),
+	}
+}
+
+// Apply the color fix (see getColorFix) to a frame.
+func fixColors(img image.Image, fix *colorFix) image.Image {
+	if fix == nil {
+		return img
+	}
+
+	ret := imaging.Clone(img)
+	to_byte := func(x float64) uint8 {
+		return uint8(math.Round(min(max(x, 0), 1) * 255))
+	}
+	for i := 0; i < len(ret.Pix); i += 4 {
+		r, g, b := float64(ret.Pix[i])/255, float64(ret.Pix[i+1])/255, float64(ret.Pix[i+2])/255
+		for c := 0; c < 3; c++ {
+			m := fix.mat[c]
+			ret.Pix[i+c] = to_byte(m[0]*r + m[1]*g + m[2]*b)
+		}
+	}
+	return ret
+}
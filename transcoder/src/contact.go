@@ -0,0 +1,184 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+type ContactSheetOpts struct {
+	// Number of tiles per row and number of rows, 4 columns of 5 rows when 0.
+	Columns int
+	Rows    int
+	// Width of a tile in pixels, its height follows the aspect ratio of the video. 480 when 0.
+	TileWidth int
+	// Space between tiles and around the grid in pixels, 8 when 0 (negative for no margin).
+	Margin int
+	// Format of the sheet, "jpeg" or "png". jpeg when empty.
+	Format string
+}
+
+func (o ContactSheetOpts) withDefaults() ContactSheetOpts {
+	if o.Columns <= 0 {
+		o.Columns = 4
+	}
+	if o.Rows <= 0 {
+		o.Rows = 5
+	}
+	if o.TileWidth <= 0 {
+		o.TileWidth = 480
+	}
+	if o.Margin == 0 {
+		o.Margin = 8
+	}
+	o.Margin = max(o.Margin, 0)
+	if o.Format != "png" {
+		o.Format = "jpeg"
+	}
+	return o
+}
+
+func (o ContactSheetOpts) key() string {
+	return fmt.Sprintf("contact-%dx%d-w%d-m%d", o.Columns, o.Rows, o.TileWidth, o.Margin)
+}
+
+// Face used to print the header and the timecodes of contact sheets, each line is contact_line_height pixels.
+var contact_face = basicfont.Face7x13
+
+var contact_line_height = 18
+
+// Extract a high resolution contact sheet of the video: a single image with a grid of frames evenly spread
+// over the video, each with its timecode, and a header with the name and the duration of the file.
+// Unlike sprites, it is meant to be shared with people so there is no vtt.
+func ExtractContactSheet(path string, sha string, opts ContactSheetOpts) (string, error) {
+	opts = opts.withDefaults()
+	ext := "jpg"
+	if opts.Format == "png" {
+		ext = "png"
+	}
+	cache_key := fmt.Sprintf("%s/%s.%s", sha, opts.key(), ext)
+	ret, created := thumbnails.GetOrCreate(cache_key, func() *Thumbnail {
+		ret := &Thumbnail{
+			path: fmt.Sprintf("%s/%s.%s", GetMetadataPath(sha), opts.key(), ext),
+		}
+		if !startJob() {
+			ret.err = ErrShuttingDown
+			ret.finished.Store(true)
+			return ret
+		}
+		ret.ready.Add(1)
+		go func() {
+			defer endJob()
+			ret.err = withExtractionTimeout(context.Background(), func(ctx context.Context) error {
+				return extractContactSheet(ctx, path, sha, ret.path, opts)
+			})
+			if ret.err != nil {
+				slog.Error("Could not extract contact sheet", "path", path, "sha", sha, "err", ret.err)
+				extraction_failures.WithLabelValues("contact").Inc()
+				thumbnails.Remove(cache_key)
+			}
+			ret.finish()
+		}()
+		return ret
+	})
+	observeCache("contact", created)
+	ret.ready.Wait()
+	return ret.path, ret.err
+}
+
+func extractContactSheet(ctx context.Context, path string, sha string, out string, opts ContactSheetOpts) error {
+	defer printExecTime("extracting contact sheet for %s", path)()
+	if metadata_store.Exists(out) {
+		return nil
+	}
+
+	release, err := acquireWorker(ctx, "contact")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	gen, err := openGenerator(path)
+	if err != nil {
+		return err
+	}
+	defer gen.Close()
+	if gen.Duration <= 0 {
+		return fmt.Errorf("%w: %s", ErrNoDuration, path)
+	}
+
+	sar := getPixelAspectRatio(path, sha)
+	display_width, display_height := getDisplaySize(gen, sar)
+	width := opts.TileWidth
+	height := int(float64(width)*float64(display_height)/float64(display_width) + 0.5)
+	transfer := getTransfer(path, sha)
+	colors := getColorFix(path, sha)
+
+	// the middle of each slice of the video, the first frame is often black and the last one credits.
+	numcaps := opts.Columns * opts.Rows
+	duration := float64(gen.Duration) / 1000
+	timestamps := make([]float64, numcaps)
+	for i := range timestamps {
+		timestamps[i] = (float64(i) + 0.5) * duration / float64(numcaps)
+	}
+
+	header := 2 * contact_line_height
+	cell_height := height + contact_line_height
+	sheet := imaging.New(
+		opts.Columns*(width+opts.Margin)+opts.Margin,
+		header+opts.Rows*(cell_height+opts.Margin)+opts.Margin,
+		color.Black,
+	)
+	drawContactText(sheet, opts.Margin, opts.Margin, filepath.Base(path))
+	drawContactText(sheet, opts.Margin, opts.Margin+contact_line_height, strings.TrimSuffix(tsToVttTime(math.Floor(duration)), ".000"))
+
+	err = grabFrames(ctx, gen, timestamps, width, height, func(i int, ts float64, img image.Image) error {
+		img = tonemap(fixColors(img, colors), transfer)
+		x := opts.Margin + (i%opts.Columns)*(width+opts.Margin)
+		y := header + opts.Margin + (i/opts.Columns)*(cell_height+opts.Margin)
+		draw.Draw(sheet, image.Rect(x, y, x+width, y+height), img, img.Bounds().Min, draw.Src)
+		// milliseconds are noise on a contact sheet.
+		drawContactText(sheet, x, y+height, strings.TrimSuffix(tsToVttTime(math.Floor(ts)), ".000"))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	format := imaging.JPEG
+	if opts.Format == "png" {
+		format = imaging.PNG
+	}
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, sheet, format, imaging.JPEGQuality(Settings.ThumbnailQuality)); err != nil {
+		return err
+	}
+	mkdirMetadata(filepath.Dir(out))
+	return writeAtomic(out, func(tmp string) error {
+		return writeMetadataFile(tmp, buf.Bytes())
+	})
+}
+
+// Print a line of text with its top left corner at x, y.
+func drawContactText(img draw.Image, x int, y int, text string) {
+	drawer := font.Drawer{
+		Dst:  img,
+		Src:  image.White,
+		Face: contact_face,
+		// the dot is on the baseline, center the line in its contact_line_height.
+		Dot: fixed.P(x, y+(contact_line_height+contact_face.Ascent-contact_face.Descent)/2),
+	}
+	drawer.DrawString(text)
+}
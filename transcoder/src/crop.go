@@ -0,0 +1,117 @@
+package src
+
+import (
+	"image"
+	"log/slog"
+
+	"github.com/disintegration/imaging"
+)
+
+// Part of the frame with the actual picture (without letterbox or pillarbox bars), in fractions of the frame.
+type cropRect struct {
+	x, y, w, h float64
+}
+
+// Rows and columns with a mean luma (0-255) bellow this are considered part of a black bar.
+// Same as the default limit of ffmpeg's cropdetect.
+var crop_limit float64 = 24
+
+// Number of frames (evenly spread over the video) used to find the picture.
+var crop_samples = 5
+
+// Height of the frames used to find the picture, bars don't need a high resolution to be found.
+var crop_height = 180
+
+// Find the black bars baked in the video (like ffmpeg's cropdetect), nil if there are none.
+// Bars are only cropped when every sampled frame has them, a dark scene is not a bar.
+func detectCrop(gen *Generator, sar float64) *cropRect {
+	duration := float64(gen.Duration) / 1000
+	if duration <= 0 {
+		return nil
+	}
+	width := getThumbnailWidth(gen, crop_height, sar)
+	var ret *image.Rectangle
+	for i := 0; i < crop_samples; i++ {
+		ts := duration * float64(i+1) / float64(crop_samples+1)
+		img, err := grabFrame(gen, int64(ts*1000), width, crop_height)
+		if err != nil {
+			slog.Warn("Could not grab a frame to detect black bars", "path", gen.Filename, "ts", ts, "err", err)
+			continue
+		}
+		rect, ok := getPictureRect(imaging.Resize(img, width, crop_height, imaging.Box))
+		if !ok {
+			// fully black frames say nothing about the bars.
+			continue
+		}
+		if ret == nil {
+			ret = &rect
+		} else {
+			*ret = ret.Union(rect)
+		}
+	}
+	if ret == nil {
+		return nil
+	}
+	crop := &cropRect{
+		x: float64(ret.Min.X) / float64(width),
+		y: float64(ret.Min.Y) / float64(crop_height),
+		w: float64(ret.Dx()) / float64(width),
+		h: float64(ret.Dy()) / float64(crop_height),
+	}
+	// a few pixels are not worth the blur of an extra resize.
+	if crop.w > 0.98 && crop.h > 0.98 {
+		return nil
+	}
+	slog.Info("Cropping black bars of thumbnails", "path", gen.Filename, "x", crop.x, "y", crop.y, "w", crop.w, "h", crop.h)
+	return crop
+}
+
+// Bounding box of the rows and columns brighter than crop_limit, ok is false for black frames.
+func getPictureRect(img *image.NRGBA) (rect image.Rectangle, ok bool) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	rows := make([]float64, h)
+	cols := make([]float64, w)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(x, y)
+			// rec.601 luma, like isBlack.
+			luma := 0.299*float64(img.Pix[i]) + 0.587*float64(img.Pix[i+1]) + 0.114*float64(img.Pix[i+2])
+			rows[y] += luma / float64(w)
+			cols[x] += luma / float64(h)
+		}
+	}
+	bounds := func(values []float64) (int, int, bool) {
+		start, end := -1, -1
+		for i, v := range values {
+			if v >= crop_limit {
+				if start == -1 {
+					start = i
+				}
+				end = i + 1
+			}
+		}
+		return start, end, start != -1
+	}
+	top, bottom, ok_y := bounds(rows)
+	left, right, ok_x := bounds(cols)
+	if !ok_x || !ok_y {
+		return image.Rectangle{}, false
+	}
+	return image.Rect(left, top, right, bottom), true
+}
+
+// Crop a frame grabbed at the full size to the picture and resize it to exactly width x height.
+func cropFrame(img image.Image, crop *cropRect, width int, height int) image.Image {
+	bounds := img.Bounds()
+	rect := image.Rect(
+		int(crop.x*float64(bounds.Dx())),
+		int(crop.y*float64(bounds.Dy())),
+		int((crop.x+crop.w)*float64(bounds.Dx())),
+		int((crop.y+crop.h)*float64(bounds.Dy())),
+	).Add(bounds.Min)
+	ret := imaging.Crop(img, rect)
+	if ret.Rect.Dx() != width || ret.Rect.Dy() != height {
+		return imaging.Resize(ret, width, height, Settings.ThumbnailResizeFilter)
+	}
+	return ret
+}
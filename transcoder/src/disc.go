@@ -0,0 +1,123 @@
+package src
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Find the entry of dir named name, ignoring the case (rips made on windows often use lowercase names).
+func findEntry(dir string, name string) (string, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range entries {
+		if strings.EqualFold(entry.Name(), name) {
+			return filepath.Join(dir, entry.Name()), true
+		}
+	}
+	return "", false
+}
+
+// Check if path is a ripped dvd (VIDEO_TS) or blu-ray (BDMV) folder, or the folder containing it.
+func isDiscFolder(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	if name := strings.ToUpper(filepath.Base(path)); name == "VIDEO_TS" || name == "BDMV" {
+		return true
+	}
+	_, dvd := findEntry(path, "VIDEO_TS")
+	_, bluray := findEntry(path, "BDMV")
+	return dvd || bluray
+}
+
+// Files of the main feature of a disc folder, in playing order. Menus, extras and trailers are separate
+// titles, the main feature is the biggest one.
+func resolveDiscTitle(path string) ([]string, error) {
+	dvd, bluray := path, path
+	switch strings.ToUpper(filepath.Base(path)) {
+	case "VIDEO_TS":
+	case "BDMV":
+	default:
+		dvd, _ = findEntry(path, "VIDEO_TS")
+		bluray, _ = findEntry(path, "BDMV")
+	}
+	if strings.EqualFold(filepath.Base(bluray), "BDMV") {
+		if stream, ok := findEntry(bluray, "STREAM"); ok {
+			return resolveBluray(stream)
+		}
+	}
+	if strings.EqualFold(filepath.Base(dvd), "VIDEO_TS") {
+		return resolveDvd(dvd)
+	}
+	return nil, fmt.Errorf("%w: %s is not a disc folder", ErrUnreadableSource, path)
+}
+
+// Dvd titles are split in VTS_<title>_<part>.VOB files of at most 1GB, part 0 is the menu of the title.
+func resolveDvd(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnreadableSource, err)
+	}
+	titles := make(map[string][]string)
+	sizes := make(map[string]int64)
+	for _, entry := range entries {
+		name := strings.ToUpper(entry.Name())
+		var title, part int
+		if _, err := fmt.Sscanf(name, "VTS_%02d_%d.VOB", &title, &part); err != nil || part == 0 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		key := fmt.Sprintf("%02d", title)
+		titles[key] = append(titles[key], filepath.Join(dir, entry.Name()))
+		sizes[key] += info.Size()
+	}
+	var main string
+	for title, size := range sizes {
+		if main == "" || size > sizes[main] || (size == sizes[main] && title < main) {
+			main = title
+		}
+	}
+	if main == "" {
+		return nil, fmt.Errorf("%w: no title found in %s", ErrUnreadableSource, dir)
+	}
+	// parts go up to 9, their names sort in playing order.
+	slices.Sort(titles[main])
+	return titles[main], nil
+}
+
+// Blu-ray playlists (BDMV/PLAYLIST/*.mpls) can chain clips but the main feature is almost always a single
+// clip, the biggest one of BDMV/STREAM.
+func resolveBluray(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnreadableSource, err)
+	}
+	var main string
+	var main_size int64
+	for _, entry := range entries {
+		if !strings.EqualFold(filepath.Ext(entry.Name()), ".m2ts") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.Size() > main_size {
+			main = filepath.Join(dir, entry.Name())
+			main_size = info.Size()
+		}
+	}
+	if main == "" {
+		return nil, fmt.Errorf("%w: no clip found in %s", ErrUnreadableSource, dir)
+	}
+	return []string{main}, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package src
+
+func getFreeSpace(dir string) (uint64, bool) {
+	return 0, false
+}
+
+func isDiskFull(err error) bool {
+	return false
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package src
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Space available to the transcoder (without the blocks reserved to root) in the filesystem of dir.
+func getFreeSpace(dir string) (uint64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false
+	}
+	return stat.Bavail * uint64(stat.Bsize), true
+}
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,50 @@
+package src
+
+import (
+	"image"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+type ThumbnailEncoder func(w io.Writer, img image.Image) error
+
+// Encoders registered with RegisterThumbnailEncoder, by format.
+var thumbnail_encoders = NewCMap[string, ThumbnailEncoder]()
+
+// Register an encoder for sprites of the given format (its file extension), to use formats like avif or jpeg xl
+// with an external (cgo) encoder. GOCODER_THUMBNAIL_FORMAT can then select it, built-in formats can also be
+// replaced. Call it before the server starts (from main), registered encoders ignore Settings.ThumbnailQuality.
+// Sprites are read back with image.Decode (inline vtts, single tiles and verifications), register a
+// decoder for the format with image.RegisterFormat to support those.
+func RegisterThumbnailEncoder(ext string, fn func(w io.Writer, img image.Image) error) {
+	ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+	thumbnail_encoders.Set(ext, fn)
+	if !slices.Contains(ThumbnailFormats, ext) {
+		ThumbnailFormats = append(ThumbnailFormats, ext)
+	}
+	// the settings are read before encoders can be registered.
+	if GetEnvOr("GOCODER_THUMBNAIL_FORMAT", "webp") == ext && Settings.ThumbnailFormat != ext {
+		slog.Info("Using a registered thumbnail encoder", "format", ext)
+		Settings.ThumbnailFormat = ext
+	}
+}
+
+// The registered encoder of a format, ok is false for built-in formats.
+func getThumbnailEncoder(format string) (ThumbnailEncoder, bool) {
+	return thumbnail_encoders.Get(format)
+}
+
+func saveWithEncoder(encode ThumbnailEncoder, img image.Image, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := encode(file, img); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,64 @@
+package src
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Published when a thumbnails extraction finishes (successfully or not).
+type ThumbnailEvent struct {
+	/// The id of the extraction, the one used in the logs.
+	Id string `json:"id"`
+	/// The sha of the video.
+	Sha string `json:"sha"`
+	/// The directory containing the sprites, vtt and info of the extraction.
+	Path string `json:"path"`
+	/// The number of thumbnails extracted.
+	Numcaps int `json:"numcaps"`
+	/// The time the extraction took (in milliseconds).
+	DurationMs int64 `json:"durationMs"`
+	/// The error that made the extraction fail, empty on success.
+	Err string `json:"err,omitempty"`
+}
+
+// Events buffered per subscriber, events are dropped for subscribers that don't keep up.
+const event_buffer = 64
+
+var (
+	subscribers_lock sync.Mutex
+	subscribers      []chan ThumbnailEvent
+)
+
+// Get a channel receiving an event for every thumbnails extraction that finishes. Events are never
+// waited for: if the channel is full, events are dropped so a slow consumer can't stall extractions.
+func SubscribeThumbnailEvents() <-chan ThumbnailEvent {
+	ret := make(chan ThumbnailEvent, event_buffer)
+	subscribers_lock.Lock()
+	defer subscribers_lock.Unlock()
+	subscribers = append(subscribers, ret)
+	return ret
+}
+
+func publishThumbnailEvent(sha string, thumb *Thumbnail, start time.Time) {
+	event := ThumbnailEvent{
+		Id:         thumb.id,
+		Sha:        sha,
+		Path:       thumb.path,
+		Numcaps:    int(thumb.total.Load()),
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if thumb.err != nil {
+		event.Err = thumb.err.Error()
+	}
+
+	subscribers_lock.Lock()
+	defer subscribers_lock.Unlock()
+	for _, sub := range subscribers {
+		select {
+		case sub <- event:
+		default:
+			slog.Warn("Thumbnail event subscriber is full, dropping the event", "sha", sha)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 )
 
 var extracted = NewCMap[string, <-chan struct{}]()
@@ -24,13 +25,13 @@ func Extract(path string, sha string) (<-chan struct{}, error) {
 			close(ret)
 			return
 		}
-		attachment_path := fmt.Sprintf("%s/%s/att", Settings.Metadata, sha)
-		subs_path := fmt.Sprintf("%s/%s/sub", Settings.Metadata, sha)
-		os.MkdirAll(attachment_path, 0o644)
-		os.MkdirAll(subs_path, 0o755)
+		attachment_path := fmt.Sprintf("%s/att", GetMetadataPath(sha))
+		subs_path := fmt.Sprintf("%s/sub", GetMetadataPath(sha))
+		mkdirMetadata(attachment_path)
+		mkdirMetadata(subs_path)
 
 		cmd := exec.Command(
-			"ffmpeg",
+			Settings.FfmpegPath,
 			"-dump_attachment:t", "",
 			// override old attachments
 			"-y",
@@ -54,9 +55,30 @@ func Extract(path string, sha string) (<-chan struct{}, error) {
 		if err != nil {
 			extracted.Remove(sha)
 			fmt.Println("Error starting ffmpeg extract:", err)
+		} else if err := publishDir(attachment_path, subs_path); err != nil {
+			log.Printf("Could not publish the attachments and subtitles of %s: %s", path, err)
 		}
 		close(ret)
 	}()
 
 	return ret, nil
 }
+
+// Save the files written by ffmpeg in dirs to the metadata store, so other transcoders can serve them.
+func publishDir(dirs ...string) error {
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			if err := metadata_store.Save(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package src
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Number of failed extractions kept, the oldest ones are forgotten first.
+var failures_window = 200
+
+var failures = struct {
+	lock sync.Mutex
+	// Most recent failure of each extraction (by cache key), ordered from the oldest to the newest.
+	keys []string
+	list map[string]ThumbnailFailure
+}{
+	list: make(map[string]ThumbnailFailure),
+}
+
+type ThumbnailFailure struct {
+	/// The sha of the video.
+	Sha string `json:"sha"`
+	/// The path of the video.
+	Path string `json:"path"`
+	/// The error of the last attempt.
+	Err string `json:"err"`
+	/// When the last attempt failed.
+	When time.Time `json:"when"`
+	/// The video is encrypted (DRM), it will never have thumbnails.
+	Encrypted bool `json:"encrypted"`
+	opts      ThumbnailOptions
+}
+
+func recordFailure(cache_key string, path string, sha string, opts ThumbnailOptions, err error) {
+	failures.lock.Lock()
+	defer failures.lock.Unlock()
+
+	failures.keys = slices.DeleteFunc(failures.keys, func(key string) bool { return key == cache_key })
+	failures.keys = append(failures.keys, cache_key)
+	failures.list[cache_key] = ThumbnailFailure{
+		Sha:       sha,
+		Path:      path,
+		Err:       err.Error(),
+		When:      time.Now(),
+		Encrypted: errors.Is(err, ErrEncryptedSource),
+		opts:      opts,
+	}
+	if len(failures.keys) > failures_window {
+		delete(failures.list, failures.keys[0])
+		failures.keys = failures.keys[1:]
+	}
+}
+
+// An extraction succeeded, it doesn't need to be retried anymore.
+func clearFailure(cache_key string) {
+	failures.lock.Lock()
+	defer failures.lock.Unlock()
+
+	if _, ok := failures.list[cache_key]; !ok {
+		return
+	}
+	delete(failures.list, cache_key)
+	failures.keys = slices.DeleteFunc(failures.keys, func(key string) bool { return key == cache_key })
+}
+
+// List the thumbnails extractions that failed recently (newest first). Failures are not cached so
+// clients retry them on their next request, this lets admins find files that keep failing.
+func ListThumbnailFailures() []ThumbnailFailure {
+	failures.lock.Lock()
+	defer failures.lock.Unlock()
+
+	ret := make([]ThumbnailFailure, 0, len(failures.keys))
+	for i := len(failures.keys) - 1; i >= 0; i-- {
+		ret = append(ret, failures.list[failures.keys[i]])
+	}
+	return ret
+}
+
+// Extract the thumbnails of every failure again, see ExtractThumbnailsBatch for the results.
+// Thumbnails at custom timestamps or with a poster can't be recreated without their inputs and are skipped,
+// queued is the number of extractions started.
+func RetryFailedThumbnails() (queued int, results <-chan BatchResult) {
+	var items []BatchItem
+	for _, failure := range ListThumbnailFailures() {
+		if failure.opts.At != "" || failure.opts.Poster != "" {
+			continue
+		}
+		items = append(items, BatchItem{Path: failure.Path, Sha: failure.Sha, Opts: failure.opts})
+	}
+	return len(items), ExtractThumbnailsBatch(items)
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package src
+
+func getFileId(path string) (string, bool) {
+	return "", false
+}
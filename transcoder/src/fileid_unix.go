@@ -0,0 +1,23 @@
+//go:build unix
+
+package src
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Identify the physical file behind path, hardlinks of the same file share the same id.
+func getFileId(path string) (string, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	// the size and modification time guard against inodes reused by a new file.
+	return fmt.Sprintf("%d:%d:%d:%d", stat.Dev, stat.Ino, info.Size(), info.ModTime().UnixNano()), true
+}
@@ -0,0 +1,110 @@
+package src
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Last time the metadata of each sha was served since the transcoder started. Shas missing from it use the
+// modification time of their files.
+var metadata_access = NewCMap[string, time.Time]()
+
+// Size (in bytes) of the metadata dir measured by the last collection.
+var metadata_usage atomic.Int64
+
+var metadata_gc_interval = 10 * time.Minute
+
+func touchMetadata(sha string) {
+	metadata_access.Set(sha, time.Now())
+}
+
+// Periodically remove the directories of the least recently served videos while the metadata dir is bigger
+// than Settings.MaxThumbnailCacheBytes. Does nothing when there is no limit.
+func StartMetadataGC() {
+	if Settings.MaxThumbnailCacheBytes <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if err := collectMetadata(); err != nil {
+				slog.Error("Could not collect the metadata dir", "err", err)
+			}
+			time.Sleep(metadata_gc_interval)
+		}
+	}()
+}
+
+func collectMetadata() error {
+	dirs, err := listMetadataDirs()
+	if err != nil {
+		return err
+	}
+	type entry struct {
+		sha    string
+		dir    string
+		size   int64
+		access time.Time
+	}
+	entries := make([]entry, 0, len(dirs))
+	var total int64
+	for sha, dir := range dirs {
+		size, modified := getDirUsage(dir)
+		access, ok := metadata_access.Get(sha)
+		if !ok || modified.After(access) {
+			access = modified
+		}
+		entries = append(entries, entry{sha: sha, dir: dir, size: size, access: access})
+		total += size
+	}
+	metadata_usage.Store(total)
+	if total <= Settings.MaxThumbnailCacheBytes {
+		return nil
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int { return a.access.Compare(b.access) })
+	evicted := 0
+	for _, e := range entries {
+		if total <= Settings.MaxThumbnailCacheBytes {
+			break
+		}
+		if isExtracting(e.sha) {
+			continue
+		}
+		// only the local copy is removed, a shared metadata store keeps serving the files to other instances.
+		forgetThumbnail(e.sha)
+		metadata_access.Remove(e.sha)
+		if err := os.RemoveAll(e.dir); err != nil {
+			slog.Warn("Could not remove a metadata directory", "sha", e.sha, "err", err)
+			continue
+		}
+		total -= e.size
+		evicted++
+	}
+	metadata_usage.Store(total)
+	slog.Info("Collected the metadata dir", "evicted", evicted, "size", total, "max", Settings.MaxThumbnailCacheBytes)
+	return nil
+}
+
+// Size of the files of a directory and the time the last of them was modified.
+func getDirUsage(dir string) (size int64, modified time.Time) {
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		size += info.Size()
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		return nil
+	})
+	return size, modified
+}
@@ -0,0 +1,111 @@
+package src
+
+import (
+	"errors"
+	"image"
+	"log/slog"
+	"strings"
+)
+
+// Same values as screengen's orientations, generators that don't read them use AVIdentity.
+type Orientation int
+
+const (
+	AVIdentity       Orientation = 0
+	AVRotation90     Orientation = 1 << 1
+	AVRotation180    Orientation = 1 << 2
+	AVRotation270    Orientation = 1 << 3
+	AVRotationCustom Orientation = 1 << 4
+	AVFlipHorizontal Orientation = 1 << 5
+	AVFlipVertical   Orientation = 1 << 6
+)
+
+// Decode frames of a video file, see Generator.
+type frameDecoder interface {
+	// Decode the frame at ts (in milliseconds) scaled to width x height, fast seeks to the keyframe before it.
+	ImageWxH(ts int64, width int, height int, fast bool) (image.Image, error)
+	Close() error
+}
+
+// Grab frames of a video. Frames are decoded by screengen (cgo, linked to ffmpeg's libraries) when it is
+// available, by ffmpeg processes otherwise (see newGenerator). The fields follow screengen's.
+type Generator struct {
+	// Seek to the keyframe before the requested time instead of decoding up to the exact frame.
+	Fast     bool
+	Filename string
+	// Duration of the video in milliseconds.
+	Duration int64
+	// Name of the ffmpeg decoder (h264, hevc...).
+	VideoCodec  string
+	Orientation Orientation
+	width       int
+	height      int
+	decoder     frameDecoder
+	// The deinterlacing filter of the decoder, see useDeinterlacer.
+	deinterlace string
+}
+
+func (g *Generator) Width() int  { return g.width }
+func (g *Generator) Height() int { return g.height }
+
+// Same as screengen's: the frame at ts (in milliseconds), scaled to width x height.
+func (g *Generator) ImageWxH(ts int64, width int, height int) (image.Image, error) {
+	return g.decoder.ImageWxH(ts, width, height, g.Fast)
+}
+
+// Decode frames with ffmpeg and a deinterlacing filter: screengen can't filter frames, interlaced ones are
+// combed. A lot slower since ffmpeg is started for each frame.
+func (g *Generator) useDeinterlacer(filter string) {
+	decoder := ffmpegDecoder{path: g.Filename, filter: filter, flags: getThumbnailDecodeFlags(g.VideoCodec)}
+	if old, ok := g.decoder.(ffmpegDecoder); ok {
+		decoder.color_range = old.color_range
+	}
+	g.decoder.Close()
+	g.decoder = decoder
+	g.deinterlace = filter
+}
+
+// Input flags of the decoder of frames, screengen's decoders don't take any.
+func (g *Generator) decodeFlags() []string {
+	if decoder, ok := g.decoder.(ffmpegDecoder); ok {
+		return decoder.flags
+	}
+	return nil
+}
+
+func (g *Generator) Close() error {
+	return g.decoder.Close()
+}
+
+// ffmpeg's errors about encrypted streams (missing keys, failed decryption...), they don't have codes.
+func isEncryptionError(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "decrypt") || strings.Contains(msg, "encrypt")
+}
+
+// Open a generator with screengen when the package is built with it (without the noscreengen tag), with
+// ffmpeg otherwise. Files whose codec screengen can't decode also use ffmpeg: the binary can be newer than
+// the libraries screengen was linked with, or built with other decoders. Image sequences are decoded with
+// imaging (see isImageSequence), a source registered with RegisterFrameSource takes precedence over all of them.
+func newGenerator(path string) (*Generator, error) {
+	if frame_source != nil {
+		gen, err := openFrameSource(path)
+		if !errors.Is(err, ErrUnsupportedCodec) {
+			return gen, err
+		}
+	}
+	if isImageSequence(path) {
+		return openImageSequence(path)
+	}
+	if !has_screengen {
+		return openFfmpegGenerator(path)
+	}
+	gen, err := openScreengen(path)
+	if errors.Is(err, ErrUnsupportedCodec) {
+		if ret, ffmpeg_err := openFfmpegGenerator(path); ffmpeg_err == nil {
+			slog.Info("screengen can't decode this file, decoding it with ffmpeg", "path", path, "codec", ret.VideoCodec)
+			return ret, nil
+		}
+	}
+	return gen, err
+}
@@ -0,0 +1,165 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Decode frames by running ffmpeg for each of them. A lot slower than screengen (ffmpeg opens the file for
+// every frame) but it only needs the ffmpeg binary.
+type ffmpegDecoder struct {
+	path string
+	// Applied before scaling frames (a deinterlacer), empty for none.
+	filter string
+	// Color range of the stream as reported by ffprobe: tv (limited, 16-235) or pc (full), the range tagged on
+	// the frames is used for anything else.
+	color_range string
+	// Input flags of the decoder, see getThumbnailDecodeFlags.
+	flags []string
+}
+
+// The filters of frames: limited range videos are expanded to full range rgb, their blacks would be gray and
+// their whites dim otherwise.
+func (d ffmpegDecoder) scaleFilter(width int, height int) string {
+	ret := fmt.Sprintf("scale=%d:%d:in_color_matrix=bt601", width, height)
+	if d.color_range == "tv" || d.color_range == "pc" {
+		ret += ":in_range=" + d.color_range
+	}
+	ret += ":out_range=pc"
+	if d.filter != "" {
+		ret = d.filter + "," + ret
+	}
+	return ret
+}
+
+func (d ffmpegDecoder) ImageWxH(ts int64, width int, height int, fast bool) (image.Image, error) {
+	args := []string{"-nostdin", "-nostats", "-hide_banner", "-loglevel", "error"}
+	if fast {
+		// input seeks are exact by default, stop at the keyframe like screengen's fast mode.
+		args = append(args, "-noaccurate_seek")
+	}
+	args = append(args, d.flags...)
+	args = append(
+		args,
+		"-ss", formatSeconds(float64(ts)/1000),
+		"-i", d.path,
+		"-map", "0:v:0",
+		"-frames:v", "1",
+		// same conversion as screengen (swscale's defaults, bt601) so fixColors applies the same correction.
+		// ffmpeg applies the rotation itself, width and height are in the display orientation.
+		"-vf", d.scaleFilter(width, height),
+		"-f", "rawvideo",
+		"-pix_fmt", "rgba",
+		"pipe:1",
+	)
+	cmd := exec.Command(Settings.FfmpegPath, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && isEncryptionError(stderr.String()) {
+		return nil, fmt.Errorf("%w: %s: %s", ErrEncryptedSource, d.path, stderr.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the frame at %dms: %w: %s", ts, err, stderr.String())
+	}
+	if len(out) < width*height*4 {
+		return nil, fmt.Errorf("no frame at %dms", ts)
+	}
+	// rawvideo's rgba is not premultiplied.
+	return &image.NRGBA{
+		Pix:    out[:width*height*4],
+		Stride: width * 4,
+		Rect:   image.Rect(0, 0, width, height),
+	}, nil
+}
+
+func (d ffmpegDecoder) Close() error {
+	return nil
+}
+
+func openFfmpegGenerator(path string) (*Generator, error) {
+	cmd := exec.Command(
+		Settings.FfprobePath,
+		"-loglevel", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=codec_name,codec_tag_string,width,height,color_range:stream_tags=rotate:stream_side_data=rotation:format=duration",
+		"-of", "json",
+		path,
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && isEncryptionError(stderr.String()) {
+		return nil, fmt.Errorf("%w: %s: %s", ErrEncryptedSource, path, stderr.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w: %s", ErrUnreadableSource, path, err, stderr.String())
+	}
+	var probe struct {
+		Streams []struct {
+			CodecName  string `json:"codec_name"`
+			CodecTag   string `json:"codec_tag_string"`
+			Width      int    `json:"width"`
+			Height     int    `json:"height"`
+			ColorRange string `json:"color_range"`
+			Tags       struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideDataList []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrUnreadableSource, path, err)
+	}
+	if len(probe.Streams) == 0 || probe.Streams[0].Width == 0 || probe.Streams[0].Height == 0 {
+		return nil, fmt.Errorf("%w in %s", ErrNoVideoStream, path)
+	}
+	stream := probe.Streams[0]
+	// the sample entry of encrypted mp4 streams (cenc), the codec is only known from the protection info.
+	if stream.CodecTag == "encv" {
+		return nil, fmt.Errorf("%w: %s", ErrEncryptedSource, path)
+	}
+	// unknown durations are 0, like screengen.
+	duration, _ := strconv.ParseFloat(probe.Format.Duration, 64)
+
+	// side data rotations are counter-clockwise, the rotate tag (older ffmpeg) and screengen's are clockwise.
+	rotation := 0
+	if len(stream.SideDataList) > 0 {
+		rotation = -int(stream.SideDataList[0].Rotation)
+	} else if tag, err := strconv.Atoi(stream.Tags.Rotate); err == nil {
+		rotation = tag
+	}
+	ret := &Generator{
+		Filename:   path,
+		Duration:   int64(duration * 1000),
+		VideoCodec: stream.CodecName,
+		width:      stream.Width,
+		height:     stream.Height,
+		decoder: ffmpegDecoder{
+			path:        path,
+			color_range: stream.ColorRange,
+			flags:       getThumbnailDecodeFlags(stream.CodecName),
+		},
+	}
+	// like screengen, pure rotations are applied while decoding and the size is in the display orientation.
+	switch ((rotation % 360) + 360) % 360 {
+	case 90:
+		ret.Orientation = AVRotation90
+		ret.width, ret.height = ret.height, ret.width
+	case 180:
+		ret.Orientation = AVRotation180
+	case 270:
+		ret.Orientation = AVRotation270
+		ret.width, ret.height = ret.height, ret.width
+	}
+	return ret, nil
+}
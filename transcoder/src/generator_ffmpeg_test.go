@@ -0,0 +1,267 @@
+package src
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestFfmpegScaleFilter(t *testing.T) {
+	tests := []struct {
+		decoder ffmpegDecoder
+		want    string
+	}{
+		{ffmpegDecoder{}, "scale=64:36:in_color_matrix=bt601:out_range=pc"},
+		{ffmpegDecoder{color_range: "unknown"}, "scale=64:36:in_color_matrix=bt601:out_range=pc"},
+		{ffmpegDecoder{color_range: "tv"}, "scale=64:36:in_color_matrix=bt601:in_range=tv:out_range=pc"},
+		{ffmpegDecoder{color_range: "pc"}, "scale=64:36:in_color_matrix=bt601:in_range=pc:out_range=pc"},
+		{ffmpegDecoder{color_range: "tv", filter: "yadif"}, "yadif,scale=64:36:in_color_matrix=bt601:in_range=tv:out_range=pc"},
+	}
+	for _, test := range tests {
+		if got := test.decoder.scaleFilter(64, 36); got != test.want {
+			t.Errorf("%+v: got %q, expected %q", test.decoder, got, test.want)
+		}
+	}
+}
+
+// Number of pixels of img per luma value.
+func lumaHistogram(img image.Image) [256]int {
+	var ret [256]int
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			luma := (299*(r>>8) + 587*(g>>8) + 114*(b>>8)) / 1000
+			ret[luma]++
+		}
+	}
+	return ret
+}
+
+// Pixels of the histogram between from and to (included).
+func histogramRange(hist [256]int, from int, to int) int {
+	ret := 0
+	for i := from; i <= to; i++ {
+		ret += hist[i]
+	}
+	return ret
+}
+
+func TestFfmpegColorRange(t *testing.T) {
+	if _, err := exec.LookPath(Settings.FfmpegPath); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	if _, err := exec.LookPath(Settings.FfprobePath); err != nil {
+		t.Skip("ffprobe is not installed")
+	}
+	const width, height = 64, 32
+	// half black and half white, encoded in yuv with the given range: limited range black is 16 and white 235.
+	samples := []struct {
+		name  string
+		scale string
+		flag  string
+	}{
+		{"limited", "scale=out_range=tv", "tv"},
+		{"full", "scale=out_range=pc", "pc"},
+	}
+	for _, sample := range samples {
+		t.Run(sample.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sample.mkv")
+			cmd := exec.Command(
+				Settings.FfmpegPath,
+				"-nostdin", "-loglevel", "error",
+				"-f", "lavfi",
+				"-i", "color=c=black:s=64x32:d=1,drawbox=x=32:y=0:w=32:h=32:color=white:t=fill,"+sample.scale+",format=yuv444p",
+				"-color_range", sample.flag,
+				"-c:v", "ffv1",
+				path,
+			)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("could not create the sample: %v: %s", err, out)
+			}
+			gen, err := openFfmpegGenerator(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer gen.Close()
+			img, err := gen.ImageWxH(0, width, height)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the reference: half of the pixels are pure black and the other half pure white (with a small
+			// tolerance for the edge of the box). Without the range expansion, they would be at 16 and 235.
+			hist := lumaHistogram(img)
+			total := width * height
+			if black := histogramRange(hist, 0, 3); black < total*2/5 {
+				t.Errorf("%d pixels out of %d are black, expected half of them (blacks are at %d)", black, total, mostCommonBelow(hist, 128))
+			}
+			if white := histogramRange(hist, 252, 255); white < total*2/5 {
+				t.Errorf("%d pixels out of %d are white, expected half of them", white, total)
+			}
+			if washed := histogramRange(hist, 10, 245); washed > total/10 {
+				t.Errorf("%d pixels out of %d are gray, the range was not expanded", washed, total)
+			}
+		})
+	}
+}
+
+// The most common luma value below limit, to show where the blacks ended up in failures.
+func mostCommonBelow(hist [256]int, limit int) int {
+	ret := 0
+	for i := 0; i < limit; i++ {
+		if hist[i] > hist[ret] {
+			ret = i
+		}
+	}
+	return ret
+}
+
+func TestFfmpegRotation(t *testing.T) {
+	if _, err := exec.LookPath(Settings.FfmpegPath); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	if _, err := exec.LookPath(Settings.FfprobePath); err != nil {
+		t.Skip("ffprobe is not installed")
+	}
+	// a landscape phone video displayed in portrait: rotated 90° counter-clockwise, with a white top left
+	// corner in its stored orientation.
+	path := filepath.Join(t.TempDir(), "rotated.mp4")
+	cmd := exec.Command(
+		Settings.FfmpegPath,
+		"-nostdin", "-loglevel", "error",
+		"-f", "lavfi",
+		"-i", "color=c=black:s=64x32:d=1,drawbox=x=0:y=0:w=16:h=16:color=white:t=fill",
+		"-display_rotation:v", "90",
+		"-c:v", "mpeg4", "-q:v", "2",
+		path,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("could not create the sample (ffmpeg 6.0 or newer is needed): %v: %s", err, out)
+	}
+	gen, err := openFfmpegGenerator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gen.Close()
+	if gen.Width() != 32 || gen.Height() != 64 {
+		t.Fatalf("the generator is %dx%d, expected the display size 32x64", gen.Width(), gen.Height())
+	}
+	if width, height := getDisplaySize(gen, 1); width != 32 || height != 64 {
+		t.Fatalf("displayed at %dx%d, expected 32x64", width, height)
+	}
+	img, err := grabFrame(gen, 0, 32, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stored top left corner is displayed at the bottom left.
+	bottom_left := imaging.Crop(img, image.Rect(0, 48, 16, 64))
+	top_left := imaging.Crop(img, image.Rect(0, 0, 16, 16))
+	if white := histogramRange(lumaHistogram(bottom_left), 200, 255); white < 16*16*3/4 {
+		t.Errorf("the bottom left corner is not white (%d white pixels)", white)
+	}
+	if white := histogramRange(lumaHistogram(top_left), 200, 255); white > 16*16/4 {
+		t.Errorf("the top left corner is white (%d white pixels), the frame was not rotated", white)
+	}
+}
+
+// Mean difference (0-255) between the rows of img and the average of their neighbours, interlaced frames
+// alternate rows of two instants and are combed where things move.
+func getCombing(img image.Image) float64 {
+	gray := imaging.Grayscale(img)
+	w, h := gray.Rect.Dx(), gray.Rect.Dy()
+	luma := func(x int, y int) float64 {
+		return float64(gray.Pix[y*gray.Stride+x*4])
+	}
+	var total float64
+	for y := 1; y < h-1; y++ {
+		for x := 0; x < w; x++ {
+			total += math.Abs(luma(x, y) - (luma(x, y-1)+luma(x, y+1))/2)
+		}
+	}
+	return total / float64(w*(h-2))
+}
+
+func TestCombing(t *testing.T) {
+	smooth := imaging.New(64, 64, color.NRGBA{R: 128, G: 128, B: 128, A: 255})
+	combed := imaging.Clone(smooth)
+	for y := 0; y < 64; y += 2 {
+		for x := 0; x < 64; x++ {
+			combed.Set(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+		}
+	}
+	if got := getCombing(smooth); got != 0 {
+		t.Errorf("a plain frame has a combing of %v", got)
+	}
+	if got := getCombing(combed); got < 50 {
+		t.Errorf("alternating rows have a combing of %v", got)
+	}
+}
+
+func TestDeinterlaceFilter(t *testing.T) {
+	defer func(old SettingsT) { Settings = old }(Settings)
+	tests := []struct {
+		mode string
+		path string
+		want string
+	}{
+		{"always", "/video.mkv", "yadif"},
+		{"never", "/video.mkv", ""},
+		// remote files are not probed, files that can't be probed are progressive.
+		{"auto", "https://example.com/video.mkv", ""},
+		{"auto", "/does/not/exist.mkv", ""},
+	}
+	for _, test := range tests {
+		Settings.DeinterlaceThumbnails = test.mode
+		if got := getDeinterlaceFilter(test.path, "deinterlace"); got != test.want {
+			t.Errorf("%s %s: got %q, expected %q", test.mode, test.path, got, test.want)
+		}
+	}
+}
+
+func TestFfmpegDeinterlace(t *testing.T) {
+	if _, err := exec.LookPath(Settings.FfmpegPath); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	if _, err := exec.LookPath(Settings.FfprobePath); err != nil {
+		t.Skip("ffprobe is not installed")
+	}
+	const width, height = 128, 96
+	// a moving pattern at 50 fps woven in interlaced frames at 25 fps.
+	path := filepath.Join(t.TempDir(), "interlaced.mkv")
+	cmd := exec.Command(
+		Settings.FfmpegPath,
+		"-nostdin", "-loglevel", "error",
+		"-f", "lavfi",
+		"-i", "testsrc2=s=128x96:r=50:d=2,interlace=scan=tff,format=yuv444p",
+		"-field_order", "tt",
+		"-c:v", "ffv1",
+		path,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("could not create the sample: %v: %s", err, out)
+	}
+	gen, err := openFfmpegGenerator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gen.Close()
+	combed, err := gen.ImageWxH(1000, width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen.useDeinterlacer("yadif")
+	deinterlaced, err := gen.ImageWxH(1000, width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, after := getCombing(combed), getCombing(deinterlaced)
+	if after > before*0.7 {
+		t.Errorf("the combing went from %v to %v after deinterlacing", before, after)
+	}
+}
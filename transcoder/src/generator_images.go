@@ -0,0 +1,143 @@
+package src
+
+import (
+	"cmp"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Extensions of the images of a sequence, the formats imaging can decode.
+var image_sequence_extensions = []string{".jpg", ".jpeg", ".png", ".bmp", ".gif", ".tif", ".tiff"}
+
+// The frame number of an image sequence pattern (frame%05d.jpg, like ffmpeg's image2 demuxer).
+var image_sequence_pattern = regexp.MustCompile(`%0?[0-9]*d`)
+
+// Like ffmpeg, the first image of a pattern can be numbered from 0 to 4.
+var image_sequence_first_numbers = 5
+
+// Decode the frames of an image sequence (timelapses, exported renders...): the frame at ts is the image
+// at ts * Settings.ImageSequenceFps.
+type imageSequenceDecoder struct {
+	files []string
+	fps   int
+}
+
+func (d imageSequenceDecoder) ImageWxH(ts int64, width int, height int, fast bool) (image.Image, error) {
+	index := min(max(int(ts*int64(d.fps)/1000), 0), len(d.files)-1)
+	img, err := imaging.Open(d.files[index], imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the frame at %dms: %w", ts, err)
+	}
+	return imaging.Resize(img, width, height, Settings.ThumbnailResizeFilter), nil
+}
+
+func (d imageSequenceDecoder) Close() error {
+	return nil
+}
+
+// Check if path is an image sequence instead of a video: a folder (that is not a disc folder, see
+// isDiscFolder) or a printf pattern with a single frame number.
+func isImageSequence(path string) bool {
+	if IsRemotePath(path) {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err == nil {
+		return info.IsDir() && !isDiscFolder(path)
+	}
+	return len(image_sequence_pattern.FindAllStringIndex(path, -1)) == 1 && strings.Count(path, "%") == 1
+}
+
+// Images of a sequence in frame order. Files of a folder are sorted by the length of their name first so
+// frame2.jpg comes before frame10.jpg, the numbers of a pattern start at the first existing one and stop
+// at the first missing one.
+func listImageSequence(path string) ([]string, error) {
+	var ret []string
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrUnreadableSource, path, err)
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && slices.Contains(image_sequence_extensions, strings.ToLower(filepath.Ext(entry.Name()))) {
+				ret = append(ret, filepath.Join(path, entry.Name()))
+			}
+		}
+		slices.SortFunc(ret, func(a, b string) int {
+			return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+		})
+	} else {
+		start := 0
+		for ; start < image_sequence_first_numbers; start++ {
+			if _, err := os.Stat(fmt.Sprintf(path, start)); err == nil {
+				break
+			}
+		}
+		for i := start; ; i++ {
+			file := fmt.Sprintf(path, i)
+			if _, err := os.Stat(file); err != nil {
+				break
+			}
+			ret = append(ret, file)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("%w: no images in the sequence %s", ErrNoVideoStream, path)
+	}
+	return ret, nil
+}
+
+// Open an image sequence like a video, its size is the size of the first image.
+func openImageSequence(path string) (*Generator, error) {
+	files, err := listImageSequence(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(files[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrUnreadableSource, files[0], err)
+	}
+	defer file.Close()
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrUnreadableSource, files[0], err)
+	}
+	return &Generator{
+		Filename:   path,
+		Duration:   int64(len(files)) * 1000 / int64(Settings.ImageSequenceFps),
+		VideoCodec: format,
+		width:      config.Width,
+		height:     config.Height,
+		decoder:    imageSequenceDecoder{files: files, fps: Settings.ImageSequenceFps},
+	}, nil
+}
+
+// Sequences have no single file to read, they are identified by their path, their number of images and the
+// last modification of one of them whatever the mode of Settings.MediaSha.
+func getImageSequenceSha(path string) (string, error) {
+	files, err := listImageSequence(path)
+	if err != nil {
+		return "", err
+	}
+	var modtime int64
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			modtime = max(modtime, info.ModTime().UnixNano())
+		}
+	}
+	h := sha1.New()
+	h.Write([]byte(path))
+	binary.Write(h, binary.LittleEndian, int64(len(files)))
+	binary.Write(h, binary.LittleEndian, modtime)
+	return sha_version + "images-" + hex.EncodeToString(h.Sum(nil)), nil
+}
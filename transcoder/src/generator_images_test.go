@@ -0,0 +1,121 @@
+package src
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// Write count images of 64x36 in dir named by name (a printf pattern), image i has the color solidColor(i * 1000).
+func writeImageSequence(t *testing.T, dir string, name string, first int, count int) {
+	t.Helper()
+	for i := first; i < first+count; i++ {
+		if err := imaging.Save(imaging.New(64, 36, solidColor(int64(i)*1000)), filepath.Join(dir, fmt.Sprintf(name, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListImageSequence(t *testing.T) {
+	dir := t.TempDir()
+	writeImageSequence(t, dir, "frame%d.png", 1, 12)
+	// ignored, not an image.
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isImageSequence(dir) || !isImageSequence(filepath.Join(dir, "frame%d.png")) {
+		t.Error("the folder or the pattern is not an image sequence")
+	}
+	for _, path := range []string{filepath.Join(dir, "frame1.png"), filepath.Join(dir, "frame%d-%d.png")} {
+		if isImageSequence(path) {
+			t.Errorf("%s is an image sequence", path)
+		}
+	}
+
+	want := make([]string, 12)
+	for i := range want {
+		want[i] = filepath.Join(dir, fmt.Sprintf("frame%d.png", i+1))
+	}
+	// frame2 comes before frame10.
+	if files, err := listImageSequence(dir); err != nil || !slices.Equal(files, want) {
+		t.Errorf("the folder lists %v (%v), expected %v", files, err, want)
+	}
+	if files, err := listImageSequence(filepath.Join(dir, "frame%d.png")); err != nil || !slices.Equal(files, want) {
+		t.Errorf("the pattern lists %v (%v), expected %v", files, err, want)
+	}
+	// the sequence stops at the first missing image.
+	os.Remove(want[5])
+	if files, err := listImageSequence(filepath.Join(dir, "frame%d.png")); err != nil || !slices.Equal(files, want[:5]) {
+		t.Errorf("the pattern lists %v (%v), expected %v", files, err, want[:5])
+	}
+	if _, err := listImageSequence(filepath.Join(dir, "missing%03d.png")); err == nil {
+		t.Error("an empty sequence was listed")
+	}
+}
+
+func TestExtractImageSequence(t *testing.T) {
+	defer func(old SettingsT) { Settings = old }(Settings)
+	Settings.Metadata = t.TempDir()
+	Settings.KeyframeThumbnails = false
+	Settings.ThumbnailFormat = "png"
+	Settings.ImageSequenceFps = 4
+	// 30s at 4 fps.
+	dir := t.TempDir()
+	writeImageSequence(t, dir, "frame%05d.png", 0, 120)
+
+	sha, err := getImageSequenceSha(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ExtractThumbnail(dir, sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := GetThumbnailInfo(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tiles keep the aspect of the images.
+	if info.Height != thumbnail_height || info.Width != thumbnail_height*16/9 {
+		t.Errorf("tiles are %dx%d, expected %dx%d", info.Width, info.Height, thumbnail_height*16/9, thumbnail_height)
+	}
+	content, err := os.ReadFile(GetVttPath(out, DefaultSheetSize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cues, err := ParseThumbnailVtt(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cues) != info.Count || cues[len(cues)-1].End != 30 {
+		t.Errorf("%d cues for %d thumbnails, ending at %v", len(cues), info.Count, cues[len(cues)-1].End)
+	}
+	path, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0)
+	if !ok {
+		t.Fatal("the sprite was not written")
+	}
+	sprite, err := imaging.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first cue may start before its frame (see Settings.ThumbnailCoverStart).
+	for i, cue := range cues[1:] {
+		want := solidColor(int64(math.Round(cue.Start*4)) * 1000)
+		if got := color.NRGBAModel.Convert(sprite.At(cue.X+cue.W/2, cue.Y+cue.H/2)).(color.NRGBA); got != want {
+			t.Errorf("cue %d at %vs is %v, expected the image %v (%v)", i+1, cue.Start, got, cue.Start*4, want)
+		}
+	}
+
+	// adding images changes the sha, the sprites are extracted again.
+	writeImageSequence(t, dir, "frame%05d.png", 120, 1)
+	if other, err := getImageSequenceSha(dir); err != nil || other == sha {
+		t.Errorf("the sha did not change with the number of images (%v)", err)
+	}
+}
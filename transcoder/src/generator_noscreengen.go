@@ -0,0 +1,12 @@
+//go:build noscreengen
+
+package src
+
+import "errors"
+
+// Built without screengen (for images without cgo or ffmpeg's libraries), frames are decoded by ffmpeg.
+const has_screengen = false
+
+func openScreengen(path string) (*Generator, error) {
+	return nil, errors.New("built without screengen")
+}
@@ -0,0 +1,70 @@
+//go:build !noscreengen
+
+package src
+
+import (
+	"fmt"
+	"image"
+	"os"
+
+	"gitlab.com/opennota/screengen"
+)
+
+const has_screengen = true
+
+type screengenDecoder struct {
+	gen *screengen.Generator
+}
+
+func (d screengenDecoder) ImageWxH(ts int64, width int, height int, fast bool) (image.Image, error) {
+	d.gen.Fast = fast
+	img, err := d.gen.ImageWxH(ts, width, height)
+	if err != nil {
+		return nil, err
+	}
+	// swscale writes straight alpha, as an image.RGBA transparent pixels would be read as premultiplied.
+	if rgba, ok := img.(*image.RGBA); ok {
+		return &image.NRGBA{Pix: rgba.Pix, Stride: rgba.Stride, Rect: rgba.Rect}, nil
+	}
+	return img, nil
+}
+
+func (d screengenDecoder) Close() error {
+	return d.gen.Close()
+}
+
+func openScreengen(path string) (*Generator, error) {
+	gen, err := screengen.NewGenerator(path)
+	if err != nil {
+		return nil, getOpenError(path, err)
+	}
+	return &Generator{
+		Filename:    gen.Filename,
+		Duration:    gen.Duration,
+		VideoCodec:  gen.VideoCodec,
+		Orientation: Orientation(gen.Orientation),
+		width:       gen.Width(),
+		height:      gen.Height(),
+		decoder:     screengenDecoder{gen: gen},
+	}, nil
+}
+
+// Classify errors of screengen.NewGenerator, it only returns errors.New so we have to match their messages.
+func getOpenError(path string, err error) error {
+	if !IsRemotePath(path) {
+		// the file's error (does not exist, permission denied...) is more helpful than screengen's.
+		if _, stat_err := os.Stat(path); stat_err != nil {
+			return fmt.Errorf("%w: %w", ErrUnreadableSource, stat_err)
+		}
+	}
+	switch msg := err.Error(); {
+	case isEncryptionError(msg):
+		return fmt.Errorf("%w: %s: %w", ErrEncryptedSource, path, err)
+	case msg == "no video stream":
+		return fmt.Errorf("%w in %s", ErrNoVideoStream, path)
+	case msg == "can't find decoder", msg == "can't initialize codec context":
+		return fmt.Errorf("%w: %s: %w", ErrUnsupportedCodec, path, err)
+	default:
+		return fmt.Errorf("%w: %s: %w", ErrUnreadableSource, path, err)
+	}
+}
@@ -0,0 +1,54 @@
+package src
+
+import (
+	"image"
+)
+
+// Frames of a video decoded outside of the transcoder (hardware decoders, or solid color frames to test the
+// extraction without a video file), see RegisterFrameSource. Frames are in the display orientation.
+type FrameSource interface {
+	// Duration of the video in milliseconds, 0 when it is unknown.
+	Duration() int64
+	Width() int
+	Height() int
+	// The frame at ts (in milliseconds), scaled to width x height.
+	ImageWxH(ts int64, width int, height int) (image.Image, error)
+	Close() error
+}
+
+// The factory of RegisterFrameSource, nil to use screengen or ffmpeg.
+var frame_source func(path string) (FrameSource, error)
+
+// Decode every video with sources returned by fn instead of screengen or ffmpeg. Returning an error wrapping
+// ErrUnsupportedCodec falls back to them, other errors fail the extraction. Call it before the server starts
+// (from main).
+func RegisterFrameSource(fn func(path string) (FrameSource, error)) {
+	frame_source = fn
+}
+
+type frameSourceDecoder struct {
+	source FrameSource
+}
+
+func (d frameSourceDecoder) ImageWxH(ts int64, width int, height int, fast bool) (image.Image, error) {
+	return d.source.ImageWxH(ts, width, height)
+}
+
+func (d frameSourceDecoder) Close() error {
+	return d.source.Close()
+}
+
+func openFrameSource(path string) (*Generator, error) {
+	source, err := frame_source(path)
+	if err != nil {
+		return nil, err
+	}
+	// like other generators, sources without dimensions are rejected by openGenerator.
+	return &Generator{
+		Filename: path,
+		Duration: source.Duration(),
+		width:    source.Width(),
+		height:   source.Height(),
+		decoder:  frameSourceDecoder{source: source},
+	}, nil
+}
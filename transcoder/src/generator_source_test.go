@@ -0,0 +1,542 @@
+package src
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// A FrameSource of solid color frames, the color of a frame only depends on its timestamp (see solidColor).
+// Every source opened by the same factory shares the list of grabbed timestamps.
+type solidSource struct {
+	// Duration in milliseconds.
+	duration int64
+	width    int
+	height   int
+	// Frames at those timestamps (in milliseconds) fail to decode.
+	broken []int64
+
+	lock    *sync.Mutex
+	grabbed *[]int64
+}
+
+// Bright enough to never be taken for black frames or black bars.
+func solidColor(ts int64) color.NRGBA {
+	return color.NRGBA{R: uint8(64 + ts/1000%192), G: uint8(255 - ts/1000%128), B: 160, A: 255}
+}
+
+func (s solidSource) Duration() int64 { return s.duration }
+func (s solidSource) Width() int      { return s.width }
+func (s solidSource) Height() int     { return s.height }
+func (s solidSource) Close() error    { return nil }
+
+func (s solidSource) ImageWxH(ts int64, width int, height int) (image.Image, error) {
+	if slices.Contains(s.broken, ts) {
+		return nil, errors.New("broken frame")
+	}
+	s.lock.Lock()
+	*s.grabbed = append(*s.grabbed, ts)
+	s.lock.Unlock()
+	return imaging.New(width, height, solidColor(ts)), nil
+}
+
+// Decode every video with solid color frames of the given size and duration (in seconds) for the rest of the
+// test, metadata are written in a temporary directory. This returns the timestamps grabbed so far.
+func useSolidSource(t *testing.T, duration int64, width int, height int, broken ...int64) func() []int64 {
+	t.Helper()
+	settings := Settings
+	old_source := frame_source
+	t.Cleanup(func() {
+		Settings = settings
+		frame_source = old_source
+	})
+	Settings.Metadata = t.TempDir()
+	// sources have no keyframes and lossless sprites keep the exact colors.
+	Settings.KeyframeThumbnails = false
+	Settings.ThumbnailFormat = "png"
+
+	var lock sync.Mutex
+	var grabbed []int64
+	RegisterFrameSource(func(path string) (FrameSource, error) {
+		return solidSource{
+			duration: duration * 1000,
+			width:    width,
+			height:   height,
+			broken:   broken,
+			lock:     &lock,
+			grabbed:  &grabbed,
+		}, nil
+	})
+	return func() []int64 {
+		lock.Lock()
+		defer lock.Unlock()
+		ret := slices.Clone(grabbed)
+		slices.Sort(ret)
+		return ret
+	}
+}
+
+func TestExtractFromFrameSource(t *testing.T) {
+	grabbed := useSolidSource(t, 120, 1280, 720)
+	sha := "solid-source"
+	out, err := ExtractThumbnail("/solid.mkv", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := GetThumbnailInfo(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps := grabbed()
+	if len(timestamps) != info.Count || info.Count != 120/Settings.ThumbnailInterval {
+		t.Fatalf("grabbed %d frames for %d thumbnails, expected %d", len(timestamps), info.Count, 120/Settings.ThumbnailInterval)
+	}
+	// 16:9 tiles of the main height.
+	if info.Height != thumbnail_height || info.Width != thumbnail_height*16/9 {
+		t.Errorf("tiles are %dx%d, expected %dx%d", info.Width, info.Height, thumbnail_height*16/9, thumbnail_height)
+	}
+
+	path, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0)
+	if !ok {
+		t.Fatal("the sprite was not written")
+	}
+	sprite, err := imaging.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ts := range timestamps {
+		col, row := i%info.Columns, i/info.Columns
+		if info.Order == "column" {
+			col, row = i/info.Rows, i%info.Rows
+		}
+		x := col*(info.Width+info.Gap) + info.Width/2
+		y := row*(info.Height+info.Gap) + info.Height/2
+		if got, want := color.NRGBAModel.Convert(sprite.At(x, y)).(color.NRGBA), solidColor(ts); got != want {
+			t.Errorf("tile %d is %v, expected the frame at %dms (%v)", i, got, ts, want)
+		}
+	}
+}
+
+func TestExtractWithBrokenFrames(t *testing.T) {
+	// the frame at 30s (and its retries) can't be decoded.
+	grabbed := useSolidSource(t, 60, 640, 360, 30000)
+	out, err := ExtractThumbnail("/broken.mkv", "solid-broken", ThumbnailOptions{})
+	if err != nil {
+		t.Fatalf("a single broken frame should not fail the extraction: %v", err)
+	}
+	if _, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0); !ok {
+		t.Fatal("the sprite was not written")
+	}
+	if slices.Contains(grabbed(), 30000) {
+		t.Error("the broken frame was grabbed")
+	}
+}
+
+func TestExtractRetriesFailures(t *testing.T) {
+	useSolidSource(t, 60, 640, 360)
+	solid := frame_source
+	var lock sync.Mutex
+	fail, opens := true, 0
+	RegisterFrameSource(func(path string) (FrameSource, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		opens++
+		if fail {
+			return nil, errors.New("could not open the source")
+		}
+		return solid(path)
+	})
+
+	sha := "solid-retry"
+	if _, err := ExtractThumbnail("/retry.mkv", sha, ThumbnailOptions{}); err == nil {
+		t.Fatal("the failure of the source was not returned")
+	}
+	lock.Lock()
+	fail, failed_opens := false, opens
+	lock.Unlock()
+
+	// the failure is not cached, the next call extracts again.
+	out, err := ExtractThumbnail("/retry.mkv", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatalf("the extraction was not retried: %v", err)
+	}
+	if opens == failed_opens {
+		t.Error("the second call did not open the source")
+	}
+	if _, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0); !ok {
+		t.Fatal("the sprite was not written")
+	}
+}
+
+// A source where no frame can be decoded.
+type brokenSource struct {
+	solidSource
+}
+
+func (s brokenSource) ImageWxH(ts int64, width int, height int) (image.Image, error) {
+	return nil, errors.New("broken frame")
+}
+
+func TestExtractUnknownDuration(t *testing.T) {
+	grabbed := useSolidSource(t, 0, 640, 360)
+	sha := "solid-no-duration"
+	out, err := ExtractThumbnail("/live.ts", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := GetThumbnailInfo(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the frame can be grabbed more than once (previews, blurhash), never another one.
+	if timestamps := slices.Compact(grabbed()); info.Count != 1 || !slices.Equal(timestamps, []int64{0}) {
+		t.Errorf("expected a single thumbnail at 0, got %d thumbnails at %v", info.Count, timestamps)
+	}
+	if _, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0); !ok {
+		t.Fatal("the sprite was not written")
+	}
+
+	// the first frames are all we have.
+	RegisterFrameSource(func(path string) (FrameSource, error) {
+		return brokenSource{solidSource{width: 640, height: 360}}, nil
+	})
+	if _, err := ExtractThumbnail("/broken-live.ts", "solid-no-duration-broken", ThumbnailOptions{}); !errors.Is(err, ErrNoDuration) {
+		t.Errorf("expected ErrNoDuration, got %v", err)
+	}
+}
+
+// A source ignoring the requested size, like some decoders.
+type undersizedSource struct {
+	FrameSource
+}
+
+func (s undersizedSource) ImageWxH(ts int64, width int, height int) (image.Image, error) {
+	return s.FrameSource.ImageWxH(ts, width/2, height/2+1)
+}
+
+func TestExtractUndersizedFrames(t *testing.T) {
+	grabbed := useSolidSource(t, 60, 1280, 720)
+	solid := frame_source
+	RegisterFrameSource(func(path string) (FrameSource, error) {
+		source, err := solid(path)
+		return undersizedSource{source}, err
+	})
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	sha := "solid-undersized"
+	out, err := ExtractThumbnail("/undersized.mkv", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "Frame has a wrong size") {
+		t.Error("the wrong size was not logged")
+	}
+	info, err := GetThumbnailInfo(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0)
+	if !ok {
+		t.Fatal("the sprite was not written")
+	}
+	sprite, err := imaging.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps := grabbed()
+	if len(timestamps) != info.Count {
+		t.Fatalf("grabbed %d frames for %d thumbnails", len(timestamps), info.Count)
+	}
+	// tiles are filled up to their corners, without black borders.
+	for i, ts := range timestamps {
+		col, row := getTileCell(info.Order, i, info.Columns, info.Rows)
+		x, y := col*(info.Width+info.Gap), row*(info.Height+info.Gap)
+		corners := [][2]int{{x, y}, {x + info.Width - 1, y}, {x, y + info.Height - 1}, {x + info.Width - 1, y + info.Height - 1}}
+		for _, corner := range corners {
+			if got, want := color.NRGBAModel.Convert(sprite.At(corner[0], corner[1])).(color.NRGBA), solidColor(ts); got != want {
+				t.Errorf("tile %d is %v at %v, expected %v", i, got, corner, want)
+			}
+		}
+	}
+}
+
+// A source waiting for gate to be closed before decoding frames.
+type gatedSource struct {
+	FrameSource
+	gate chan struct{}
+}
+
+func (s gatedSource) ImageWxH(ts int64, width int, height int) (image.Image, error) {
+	<-s.gate
+	return s.FrameSource.ImageWxH(ts, width, height)
+}
+
+func TestConcurrentRegenerations(t *testing.T) {
+	useSolidSource(t, 30, 640, 360)
+	solid := frame_source
+	var lock sync.Mutex
+	opens := 0
+	gate := make(chan struct{})
+	RegisterFrameSource(func(path string) (FrameSource, error) {
+		lock.Lock()
+		opens++
+		lock.Unlock()
+		source, err := solid(path)
+		return gatedSource{source, gate}, err
+	})
+	getOpens := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return opens
+	}
+
+	// the sources opened by a single regeneration.
+	close(gate)
+	sha := "solid-regenerate"
+	if _, err := RegenerateThumbnail("/regenerate.mkv", sha); err != nil {
+		t.Fatal(err)
+	}
+	single := getOpens()
+	gate = make(chan struct{})
+
+	const calls = 50
+	var started, done sync.WaitGroup
+	paths := make([]string, calls)
+	errs := make([]error, calls)
+	for i := 0; i < calls; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			started.Done()
+			paths[i], errs[i] = RegenerateThumbnail("/regenerate.mkv", sha)
+		}(i)
+	}
+	// the extraction can't finish before every call is waiting for it.
+	started.Wait()
+	time.Sleep(100 * time.Millisecond)
+	close(gate)
+	done.Wait()
+
+	for i := 0; i < calls; i++ {
+		if errs[i] != nil || paths[i] != paths[0] {
+			t.Errorf("call %d returned %s (%v)", i, paths[i], errs[i])
+		}
+	}
+	if got := getOpens() - single; got != single {
+		t.Errorf("%d concurrent regenerations opened %d sources, a single one opens %d", calls, got, single)
+	}
+	if _, ok := FindSprite(paths[0], ThumbnailOptions{}, DefaultSheetSize(), 0); !ok {
+		t.Fatal("the sprite was not written")
+	}
+}
+
+// A source of soft frames (blurred stripes), like upscaled SD videos.
+type softSource struct {
+	solidSource
+}
+
+func (s softSource) ImageWxH(ts int64, width int, height int) (image.Image, error) {
+	img := imaging.New(width, height, color.NRGBA{R: 200, G: 200, B: 200, A: 255})
+	for x := 0; x < width; x += 8 {
+		for y := 0; y < height; y++ {
+			for i := 0; i < 4 && x+i < width; i++ {
+				img.Set(x+i, y, color.NRGBA{R: 60, G: 60, B: 60, A: 255})
+			}
+		}
+	}
+	return imaging.Blur(img, 2), nil
+}
+
+// Edge energy of the first tile of the sprite extracted from a soft source of the given height.
+func extractSoftTile(t *testing.T, height int, sharpen float64) float64 {
+	t.Helper()
+	useSolidSource(t, 30, height*16/9, height)
+	Settings.ThumbnailSharpen = sharpen
+	RegisterFrameSource(func(path string) (FrameSource, error) {
+		return softSource{solidSource{duration: 30_000, width: height * 16 / 9, height: height}}, nil
+	})
+	sha := fmt.Sprintf("soft-%d-%v", height, sharpen)
+	out, err := ExtractThumbnail("/soft.mkv", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := GetThumbnailInfo(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0)
+	if !ok {
+		t.Fatal("the sprite was not written")
+	}
+	sprite, err := imaging.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return getSharpness(imaging.Crop(sprite, image.Rect(0, 0, info.Width, info.Height)))
+}
+
+func TestSharpenSD(t *testing.T) {
+	before, after := extractSoftTile(t, 480, 0), extractSoftTile(t, 480, 1)
+	if after <= before*1.2 {
+		t.Errorf("sharpened SD tiles have an edge energy of %v, %v without sharpening", after, before)
+	}
+	// HD sources are left alone.
+	if before, after := extractSoftTile(t, 1080, 0), extractSoftTile(t, 1080, 1); before != after {
+		t.Errorf("HD tiles were sharpened: edge energy of %v, %v without sharpening", after, before)
+	}
+}
+
+// A source of random noise frames, the worst case for sprite sizes.
+type noiseSource struct {
+	solidSource
+}
+
+func (s noiseSource) ImageWxH(ts int64, width int, height int) (image.Image, error) {
+	rng := rand.New(rand.NewSource(ts))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rng.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	return img, nil
+}
+
+// Extract the sprites of a noise source in jpeg, this returns the number of thumbnails and the size of the
+// biggest sprite.
+func extractNoise(t *testing.T, name string) (int, int64) {
+	t.Helper()
+	RegisterFrameSource(func(path string) (FrameSource, error) {
+		return noiseSource{solidSource{duration: 300_000, width: 1280, height: 720}}, nil
+	})
+	sha := "noise-" + name
+	out, err := ExtractThumbnail("/noise.mkv", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := GetThumbnailInfo(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sprites, err := filepath.Glob(filepath.Join(out, "*.jpeg"))
+	if err != nil || len(sprites) == 0 {
+		t.Fatalf("no sprite was written (%v)", err)
+	}
+	var biggest int64
+	for _, sprite := range sprites {
+		stat, err := os.Stat(sprite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		biggest = max(biggest, stat.Size())
+	}
+	return info.Count, biggest
+}
+
+func TestMaxSpriteBytes(t *testing.T) {
+	useSolidSource(t, 300, 1280, 720)
+	Settings.ThumbnailFormat = "jpeg"
+	count, size := extractNoise(t, "uncapped")
+	Settings.ThumbnailQuality = sprite_min_quality
+	_, min_size := extractNoise(t, "min-quality")
+	Settings.ThumbnailQuality = 80
+
+	// a lower quality fits.
+	Settings.MaxSpriteBytes = (size + min_size) / 2
+	if got, got_size := extractNoise(t, "lower-quality"); got != count || got_size > Settings.MaxSpriteBytes {
+		t.Errorf("capped at %d bytes: %d thumbnails in %d bytes, expected %d thumbnails", Settings.MaxSpriteBytes, got, got_size, count)
+	}
+
+	// even the lowest quality is too big, less thumbnails are extracted.
+	Settings.MaxSpriteBytes = min_size * 3 / 4
+	if got, got_size := extractNoise(t, "less-thumbnails"); got >= count || got_size > Settings.MaxSpriteBytes {
+		t.Errorf("capped at %d bytes: %d thumbnails in %d bytes, expected less than %d thumbnails", Settings.MaxSpriteBytes, got, got_size, count)
+	}
+}
+
+func TestExtractWithoutDimensions(t *testing.T) {
+	for _, size := range [][2]int{{0, 360}, {640, 0}, {0, 0}, {-1, 360}} {
+		useSolidSource(t, 60, size[0], size[1])
+		sha := fmt.Sprintf("solid-%dx%d", size[0], size[1])
+		if _, err := ExtractThumbnail("/empty-stream.mkv", sha, ThumbnailOptions{}); !errors.Is(err, ErrUnreadableSource) {
+			t.Errorf("%dx%d: expected ErrUnreadableSource, got %v", size[0], size[1], err)
+		}
+	}
+}
+
+// A source that can't decrypt its frames, like screengen on a protected stream.
+type encryptedSource struct {
+	solidSource
+	grabs *atomic.Int32
+}
+
+func (s encryptedSource) ImageWxH(ts int64, width int, height int) (image.Image, error) {
+	s.grabs.Add(1)
+	return nil, fmt.Errorf("%w: no decryption key", ErrEncryptedSource)
+}
+
+func TestExtractEncrypted(t *testing.T) {
+	useSolidSource(t, 600, 1280, 720)
+	Settings.ThumbnailRetries = 3
+	var grabs atomic.Int32
+	RegisterFrameSource(func(path string) (FrameSource, error) {
+		return encryptedSource{solidSource{duration: 600 * 1000, width: 1280, height: 720}, &grabs}, nil
+	})
+	sha := "solid-encrypted"
+	_, err := ExtractThumbnail("/drm.mp4", sha, ThumbnailOptions{})
+	if !errors.Is(err, ErrEncryptedSource) || !IsPermanentThumbnailError(err) {
+		t.Fatalf("expected a permanent ErrEncryptedSource, got %v", err)
+	}
+	// neither retried nor grabbed for the other thumbnails: at most the first frame of each generator.
+	if got := grabs.Load(); got > int32(Settings.ThumbnailGenerators) {
+		t.Errorf("%d frames were grabbed from an encrypted source", got)
+	}
+	i := slices.IndexFunc(ListThumbnailFailures(), func(f ThumbnailFailure) bool { return f.Sha == sha })
+	if i == -1 || !ListThumbnailFailures()[i].Encrypted {
+		t.Errorf("the failure is not reported as encrypted: %+v", ListThumbnailFailures())
+	}
+}
+
+func TestFailureKeepsReplacedExtraction(t *testing.T) {
+	useSolidSource(t, 60, 640, 360)
+	gate := make(chan struct{})
+	RegisterFrameSource(func(path string) (FrameSource, error) {
+		return gatedSource{brokenSource{solidSource{duration: 60 * 1000, width: 640, height: 360}}, gate}, nil
+	})
+	sha := "solid-replaced"
+	if _, done, err := ExtractThumbnailAsync("/replaced.mkv", sha, ThumbnailOptions{}); done || err != nil {
+		t.Fatalf("the extraction finished at once (%v)", err)
+	}
+	cache_key := fmt.Sprintf("%s/%s", sha, ThumbnailOptions{}.key())
+	failing, ok := thumbnails.Get(cache_key)
+	if !ok {
+		t.Fatal("the extraction is not tracked")
+	}
+	// a retry took its place while it was running.
+	retry := &Thumbnail{path: failing.path}
+	thumbnails.Set(cache_key, retry)
+	close(gate)
+	failing.ready.Wait()
+	if failing.err == nil {
+		t.Fatal("the extraction of broken frames succeeded")
+	}
+	if got, ok := thumbnails.Get(cache_key); !ok || got != retry {
+		t.Error("the failed extraction removed the one that replaced it")
+	}
+}
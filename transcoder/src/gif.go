@@ -0,0 +1,117 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+var ErrGifDisabled = errors.New("gif previews are disabled, set GOCODER_GIF_PREVIEW to enable them")
+
+// Extract a small looping gif of the video, for legacy clients that can't display vtt sprites or webp.
+// Gifs are heavy, this is only available when Settings.GifPreview is set.
+func ExtractGifPreview(path string, sha string) (string, error) {
+	if !Settings.GifPreview {
+		return "", ErrGifDisabled
+	}
+	cache_key := fmt.Sprintf("%s/gif", sha)
+	ret, created := thumbnails.GetOrCreate(cache_key, func() *Thumbnail {
+		ret := &Thumbnail{
+			path: fmt.Sprintf("%s/preview.gif", GetMetadataPath(sha)),
+		}
+		if !startJob() {
+			ret.err = ErrShuttingDown
+			ret.finished.Store(true)
+			return ret
+		}
+		ret.ready.Add(1)
+		go func() {
+			defer endJob()
+			ret.err = withExtractionTimeout(context.Background(), func(ctx context.Context) error {
+				return extractGifPreview(ctx, path, sha, ret.path)
+			})
+			if ret.err != nil {
+				slog.Error("Could not extract gif preview", "path", path, "sha", sha, "err", ret.err)
+				extraction_failures.WithLabelValues("gif").Inc()
+				thumbnails.Remove(cache_key)
+			}
+			ret.finish()
+		}()
+		return ret
+	})
+	observeCache("gif", created)
+	ret.ready.Wait()
+	return ret.path, ret.err
+}
+
+func extractGifPreview(ctx context.Context, path string, sha string, out string) error {
+	defer printExecTime("extracting gif preview for %s", path)()
+	if metadata_store.Exists(out) {
+		return nil
+	}
+
+	release, err := acquireWorker(ctx, "gif")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	gen, err := openGenerator(path)
+	if err != nil {
+		return err
+	}
+	defer gen.Close()
+
+	// evenly spread the frames over the whole video.
+	numcaps, interval := getThumbnailLayout(gen, ThumbnailOptions{Interval: 1, MaxCaps: Settings.GifFrames})
+	height := Settings.GifHeight
+	width := getThumbnailWidth(gen, height, getPixelAspectRatio(path, sha))
+	transfer := getTransfer(path, sha)
+	colors := getColorFix(path, sha)
+
+	frames := make([]*image.NRGBA, numcaps)
+	err = grabFrames(ctx, gen, getEvenTimestamps(numcaps, interval), width, height, func(i int, _ float64, img image.Image) error {
+		frames[i] = imaging.Clone(tonemap(fixColors(img, colors), transfer))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var raw bytes.Buffer
+	for _, frame := range frames {
+		raw.Write(frame.Pix)
+	}
+	mkdirMetadata(filepath.Dir(out))
+	return writeAtomic(out, func(tmp string) error {
+		cmd := exec.Command(
+			Settings.FfmpegPath,
+			"-nostats", "-hide_banner", "-loglevel", "warning",
+			"-f", "rawvideo",
+			"-pix_fmt", "rgba",
+			"-s", fmt.Sprintf("%dx%d", width, height),
+			"-framerate", fmt.Sprint(preview_framerate),
+			"-i", "pipe:0",
+			// gifs only have 256 colors, use a palette made for this video instead of a generic one.
+			"-filter_complex", "split[a][b];[a]palettegen=stats_mode=diff[p];[b][p]paletteuse=dither=bayer",
+			"-loop", "0",
+			"-f", "gif",
+			"-y", tmp,
+		)
+		cmd.Stdin = &raw
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("could not encode gif preview: %s: %s", err, stderr.String())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,71 @@
+package src
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Oldest ffmpeg major version supported, older ones miss filters and flags we use.
+var min_ffmpeg_version = 4
+
+type Health struct {
+	/// The version of ffmpeg (the first line of ffmpeg -version), empty if it could not be run.
+	Ffmpeg string `json:"ffmpeg"`
+	/// The hardware acceleration used to transcode ("disabled" when transcoding on the cpu), see GOCODER_HWACCEL.
+	HwAccel string `json:"hwaccel"`
+	/// The problems preventing the transcoder from working, empty when everything is fine.
+	Errors []string `json:"errors"`
+}
+
+// Check that the transcoder can work: ffmpeg can be run and the metadata dir is writable.
+func CheckHealth() Health {
+	ret := Health{HwAccel: Settings.HwAccel.Name, Errors: []string{}}
+
+	version, err := CheckFfmpeg()
+	ret.Ffmpeg = version
+	if err != nil {
+		ret.Errors = append(ret.Errors, err.Error())
+	}
+
+	file, err := os.CreateTemp(Settings.Metadata, ".healthcheck-*")
+	if err != nil {
+		ret.Errors = append(ret.Errors, fmt.Sprintf("metadata dir is not writable: %s", err))
+	} else {
+		file.Close()
+		if err := os.Remove(file.Name()); err != nil {
+			ret.Errors = append(ret.Errors, fmt.Sprintf("could not delete files in the metadata dir: %s", err))
+		}
+	}
+	return ret
+}
+
+// ffprobe is looked up next to ffmpeg when GOCODER_FFMPEG_PATH is a path.
+func getDefaultFfprobePath() string {
+	ffmpeg := GetEnvOr("GOCODER_FFMPEG_PATH", "ffmpeg")
+	if !strings.ContainsRune(ffmpeg, filepath.Separator) {
+		return "ffprobe"
+	}
+	return filepath.Join(filepath.Dir(ffmpeg), "ffprobe")
+}
+
+// Check that ffmpeg and ffprobe can be run and that ffmpeg is recent enough. Returns the version of ffmpeg
+// (the first line of ffmpeg -version), even if it is too old. Builds from git (ffmpeg version N-...) are accepted.
+func CheckFfmpeg() (string, error) {
+	out, err := exec.Command(Settings.FfmpegPath, "-hide_banner", "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not run ffmpeg (%s, see GOCODER_FFMPEG_PATH): %w", Settings.FfmpegPath, err)
+	}
+	version, _, _ := strings.Cut(string(out), "\n")
+	if _, err := exec.LookPath(Settings.FfprobePath); err != nil {
+		return version, fmt.Errorf("could not find ffprobe (%s, see GOCODER_FFPROBE_PATH): %w", Settings.FfprobePath, err)
+	}
+
+	var major int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(version, "ffmpeg version "), "%d.", &major); err == nil && major < min_ffmpeg_version {
+		return version, fmt.Errorf("ffmpeg %d is not supported, at least ffmpeg %d is required", major, min_ffmpeg_version)
+	}
+	return version, nil
+}
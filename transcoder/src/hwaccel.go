@@ -1,10 +1,18 @@
 package src
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/exec"
+	"strings"
+	"time"
 )
 
+// Time given to ffmpeg to open the device and encode a frame in InitHardwareAccel.
+var hwaccel_check_timeout = 30 * time.Second
+
 func DetectHardwareAccel() HwAccelT {
 	name := GetEnvOr("GOCODER_HWACCEL", "disabled")
 	if name == "disabled" {
@@ -18,24 +26,8 @@ func DetectHardwareAccel() HwAccelT {
 	preset := GetEnvOr("GOCODER_PRESET", "fast")
 
 	switch name {
-	case "disabled":
-		return HwAccelT{
-			Name:        "disabled",
-			DecodeFlags: []string{},
-			EncodeFlags: []string{
-				"-c:v", "libx264",
-				"-preset", preset,
-				// sc_threshold is a scene detection mechanisum used to create a keyframe when the scene changes
-				// this is on by default and inserts keyframes where we don't want to (it also breaks force_key_frames)
-				// we disable it to prevents whole scenes from behing removed due to the -f segment failing to find the corresonding keyframe
-				"-sc_threshold", "0",
-				// force 8bits output (by default it keeps the same as the source but 10bits is not playable on some devices)
-				"-pix_fmt", "yuv420p",
-			},
-			// we could put :force_original_aspect_ratio=decrease:force_divisible_by=2 here but we already calculate a correct width and
-			// aspect ratio in our code so there is no need.
-			ScaleFilter: "scale=%d:%d",
-		}
+	case "disabled", "none":
+		return getSoftwareAccel(preset)
 	case "vaapi":
 		return HwAccelT{
 			Name: name,
@@ -79,7 +71,7 @@ func DetectHardwareAccel() HwAccelT {
 			// see note on ScaleFilter of the vaapi HwAccel, this is the same filter but adapted to qsv
 			ScaleFilter: "format=nv12|qsv,hwupload,scale_qsv=%d:%d:format=nv12",
 		}
-	case "nvidia":
+	case "nvidia", "nvenc", "cuda":
 		return HwAccelT{
 			Name: "nvidia",
 			DecodeFlags: []string{
@@ -103,3 +95,52 @@ func DetectHardwareAccel() HwAccelT {
 		panic("unreachable")
 	}
 }
+
+func getSoftwareAccel(preset string) HwAccelT {
+	return HwAccelT{
+		Name:        "disabled",
+		DecodeFlags: []string{},
+		EncodeFlags: []string{
+			"-c:v", "libx264",
+			"-preset", preset,
+			// sc_threshold is a scene detection mechanisum used to create a keyframe when the scene changes
+			// this is on by default and inserts keyframes where we don't want to (it also breaks force_key_frames)
+			// we disable it to prevents whole scenes from behing removed due to the -f segment failing to find the corresonding keyframe
+			"-sc_threshold", "0",
+			// force 8bits output (by default it keeps the same as the source but 10bits is not playable on some devices)
+			"-pix_fmt", "yuv420p",
+		},
+		// we could put :force_original_aspect_ratio=decrease:force_divisible_by=2 here but we already calculate a correct width and
+		// aspect ratio in our code so there is no need.
+		ScaleFilter: "scale=%d:%d",
+	}
+}
+
+// Check that the device of Settings.HwAccel can be opened by encoding a single frame with the flags and the
+// filter used by video streams (the frame is generated on the cpu so it goes through the hwupload path).
+// When it fails (no device, missing drivers or an ffmpeg built without the encoder) every quality would fail
+// to transcode so Settings.HwAccel falls back to software encoding, the returned error says why.
+func InitHardwareAccel() error {
+	if Settings.HwAccel.Name == "disabled" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hwaccel_check_timeout)
+	defer cancel()
+
+	args := []string{"-nostats", "-hide_banner", "-loglevel", "error"}
+	args = append(args, Settings.HwAccel.DecodeFlags...)
+	args = append(args, "-f", "lavfi", "-i", "color=black:size=320x240:duration=1", "-frames:v", "1")
+	args = append(args, Settings.HwAccel.EncodeFlags...)
+	args = append(args, "-vf", fmt.Sprintf(Settings.HwAccel.ScaleFilter, 320, 240), "-f", "null", "-")
+	out, err := exec.CommandContext(ctx, Settings.FfmpegPath, args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	name := Settings.HwAccel.Name
+	Settings.HwAccel = getSoftwareAccel(GetEnvOr("GOCODER_PRESET", "fast"))
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Errorf("could not initialize the %s hardware acceleration: %s", name, msg)
+	}
+	return fmt.Errorf("could not initialize the %s hardware acceleration: %w", name, err)
+}
@@ -2,14 +2,13 @@ package src
 
 import (
 	"cmp"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"mime"
-	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -44,6 +43,8 @@ type MediaInfo struct {
 	Fonts []string `json:"fonts"`
 	/// The list of chapters. See Chapter for more information.
 	Chapters []Chapter `json:"chapters"`
+	/// The size and modification time of the file when it was probed, to detect files replaced in place.
+	Source *FileSource `json:"source,omitempty"`
 }
 
 type Video struct {
@@ -61,6 +62,26 @@ type Video struct {
 	Height uint32 `json:"height"`
 	/// The average bitrate of the video in bytes/s
 	Bitrate uint32 `json:"bitrate"`
+	/// The width/height ratio of a pixel, 1 for square pixels (anamorphic videos use non square pixels).
+	PixelAspectRatio float32 `json:"pixelAspectRatio"`
+	/// The transfer characteristics of the video (PQ or HLG for hdr videos).
+	Transfer *string `json:"transfer"`
+	/// The color primaries of the video (BT.709, BT.2020...).
+	ColorPrimaries *string `json:"colorPrimaries"`
+	/// The matrix coefficients used to convert the video to rgb.
+	MatrixCoefficients *string `json:"matrixCoefficients"`
+	/// The number of bits per color component.
+	BitDepth uint32 `json:"bitDepth"`
+	/// The range of the yuv values, Limited (16-235) or Full (0-255).
+	ColorRange *string `json:"colorRange"`
+	/// The hdr format of the video (dolby vision, hdr10+...), null for sdr videos.
+	HdrFormat *string `json:"hdrFormat"`
+	/// True when the video has an alpha channel (transparent pixels).
+	HasAlpha bool `json:"hasAlpha"`
+	/// True when the video is interlaced (wholly or partly).
+	Interlaced bool `json:"interlaced"`
+	/// True when the video is encrypted (DRM), its frames can't be decoded.
+	Encrypted bool `json:"encrypted"`
 }
 
 type Audio struct {
@@ -91,6 +112,8 @@ type Subtitle struct {
 	Codec string `json:"codec"`
 	/// The extension for the codec.
 	Extension *string `json:"extension"`
+	/// Is this subtitle stored as images (pgs, vobsub...)? They can't be converted to vtt and must be burnt in.
+	IsImage bool `json:"isImage"`
 	/// Is this stream the default one of it's type?
 	IsDefault bool `json:"isDefault"`
 	/// Is this stream tagged as forced? (useful only for subtitles)
@@ -163,31 +186,49 @@ var SubtitleExtensions = map[string]string{
 	"subrip": "srt",
 	"ass":    "ass",
 	"vtt":    "vtt",
+	// image subtitles are extracted as is, see Subtitle.IsImage.
+	"pgs":          "sup",
+	"vobsub":       "mks",
+	"dvb subtitle": "mks",
 }
 
 type MICache struct {
 	info  *MediaInfo
+	err   error
 	ready sync.WaitGroup
 }
 
 var infos = NewCMap[string, *MICache]()
 
-func GetInfo(path string, sha string) (*MediaInfo, error) {
-	var err error
+func getMediaInfoPath(sha string) string {
+	return fmt.Sprintf("%s/info.json", GetMetadataPath(sha))
+}
 
-	ret, _ := infos.GetOrCreate(sha, func() *MICache {
+func GetInfo(path string, sha string) (*MediaInfo, error) {
+	source := getFileSource(path)
+	ret, created := infos.GetOrCreate(sha, func() *MICache {
 		mi := &MICache{info: &MediaInfo{Sha: sha}}
 		mi.ready.Add(1)
 		go func() {
-			save_path := fmt.Sprintf("%s/%s/info.json", Settings.Metadata, sha)
+			save_path := getMediaInfoPath(sha)
 			if err := getSavedInfo(save_path, mi.info); err == nil {
-				log.Printf("Using mediainfo cache on filesystem for %s", path)
+				if mi.info.Source.matches(source) {
+					log.Printf("Using mediainfo cache on filesystem for %s", path)
+					mi.ready.Done()
+					return
+				}
+				invalidateProbes(path, sha)
+				*mi.info = MediaInfo{Sha: sha}
+			}
+
+			val, err := getInfo(path)
+			if err != nil {
+				mi.err = err
+				// do not cache failures, the file might be readable later.
+				infos.Remove(sha)
 				mi.ready.Done()
 				return
 			}
-
-			var val *MediaInfo
-			val, err = getInfo(path)
 			*mi.info = *val
 			mi.info.Sha = sha
 			mi.ready.Done()
@@ -196,14 +237,45 @@ func GetInfo(path string, sha string) (*MediaInfo, error) {
 		return mi
 	})
 	ret.ready.Wait()
-	return ret.info, err
+	// the file was replaced since it was probed by this process.
+	if !created && ret.err == nil && !ret.info.Source.matches(source) {
+		infos.RemoveFunc(func(key string, val *MICache) bool {
+			return key == sha && val == ret
+		})
+		invalidateProbes(path, sha)
+		return GetInfo(path, sha)
+	}
+	return ret.info, ret.err
+}
+
+// Probe the container and the streams (codecs, dimensions, color informations...) of a file. Results are
+// cached in memory and in the metadata dir so this can be called before every extraction without re-reading
+// the file. Without sha, the file is probed every time and nothing is cached.
+func ProbeMedia(path string, sha string) (MediaInfo, error) {
+	// mediainfo reads files, the images of a sequence are read when it's opened.
+	if isImageSequence(path) {
+		return MediaInfo{}, fmt.Errorf("%s is an image sequence and can't be probed", path)
+	}
+	if sha == "" {
+		info, err := getInfo(path)
+		if err != nil {
+			return MediaInfo{}, err
+		}
+		return *info, nil
+	}
+	info, err := GetInfo(path, sha)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	return *info, nil
 }
 
 func getSavedInfo[T any](save_path string, mi *T) error {
-	saved_file, err := os.Open(save_path)
+	saved_file, err := OpenMetadata(save_path)
 	if err != nil {
 		return err
 	}
+	defer saved_file.Close()
 	saved, err := io.ReadAll(saved_file)
 	if err != nil {
 		return err
@@ -220,7 +292,9 @@ func saveInfo[T any](save_path string, mi *T) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(save_path, content, 0o644)
+	return writeAtomic(save_path, func(tmp string) error {
+		return writeMetadataFile(tmp, content)
+	})
 }
 
 func getInfo(path string) (*MediaInfo, error) {
@@ -247,6 +321,7 @@ func getInfo(path string) (*MediaInfo, error) {
 		// Remove leading .
 		Extension: filepath.Ext(path)[1:],
 		Size:      ParseUint64(mi.Parameter(mediainfo.StreamGeneral, 0, "FileSize")),
+		Source:    getFileSource(path),
 		// convert ms to seconds
 		Duration:  ParseFloat(mi.Parameter(mediainfo.StreamGeneral, 0, "Duration")) / 1000,
 		Container: OrNull(mi.Parameter(mediainfo.StreamGeneral, 0, "Format")),
@@ -265,6 +340,19 @@ func getInfo(path string) (*MediaInfo, error) {
 						mi.Parameter(mediainfo.StreamVideo, i, "BitRate_Nominal"),
 					),
 				),
+				PixelAspectRatio:   ParseFloat(mi.Parameter(mediainfo.StreamVideo, i, "PixelAspectRatio")),
+				Transfer:           OrNull(mi.Parameter(mediainfo.StreamVideo, i, "transfer_characteristics")),
+				ColorPrimaries:     OrNull(mi.Parameter(mediainfo.StreamVideo, i, "colour_primaries")),
+				MatrixCoefficients: OrNull(mi.Parameter(mediainfo.StreamVideo, i, "matrix_coefficients")),
+				BitDepth:           ParseUint(mi.Parameter(mediainfo.StreamVideo, i, "BitDepth")),
+				ColorRange:         OrNull(mi.Parameter(mediainfo.StreamVideo, i, "colour_range")),
+				HdrFormat:          OrNull(mi.Parameter(mediainfo.StreamVideo, i, "HDR_Format")),
+				// RGBA or YUVA.
+				HasAlpha: strings.HasSuffix(mi.Parameter(mediainfo.StreamVideo, i, "ColorSpace"), "A"),
+				// Interlaced, MBAFF (h264 frames with interlaced macroblocks) or Mixed (some interlaced frames).
+				Interlaced: slices.Contains([]string{"Interlaced", "MBAFF", "Mixed"}, mi.Parameter(mediainfo.StreamVideo, i, "ScanType")),
+				// the stream or the whole file (encrypted containers).
+				Encrypted: mi.Parameter(mediainfo.StreamVideo, i, "Encryption") != "" || mi.Parameter(mediainfo.StreamGeneral, 0, "Encryption") != "",
 			}
 		}),
 		Audios: Map(make([]Audio, ParseUint(mi.Parameter(mediainfo.StreamAudio, 0, "StreamCount"))), func(_ Audio, i int) Audio {
@@ -279,14 +367,11 @@ func getInfo(path string) (*MediaInfo, error) {
 			}
 		}),
 		Subtitles: Map(make([]Subtitle, ParseUint(mi.Parameter(mediainfo.StreamText, 0, "StreamCount"))), func(_ Subtitle, i int) Subtitle {
-			format := strings.ToLower(mi.Parameter(mediainfo.StreamText, i, "Format"))
-			if format == "utf-8" {
-				format = "subrip"
-			}
+			format := getSubtitleCodec(mi.Parameter(mediainfo.StreamText, i, "Format"))
 			extension := OrNull(SubtitleExtensions[format])
 			var link *string
 			if extension != nil {
-				x := fmt.Sprintf("%s/%s/subtitle/%d.%s", Settings.RoutePrefix, base64.StdEncoding.EncodeToString([]byte(path)), i, *extension)
+				x := fmt.Sprintf("%s/%s/subtitle/%d.%s", Settings.RoutePrefix, EncodePath(path), i, *extension)
 				link = &x
 			}
 			return Subtitle{
@@ -295,6 +380,7 @@ func getInfo(path string) (*MediaInfo, error) {
 				Language:  OrNull(mi.Parameter(mediainfo.StreamText, i, "Language")),
 				Codec:     format,
 				Extension: extension,
+				IsImage:   isImageSubtitle(format),
 				IsDefault: mi.Parameter(mediainfo.StreamText, i, "Default") == "Yes",
 				IsForced:  mi.Parameter(mediainfo.StreamText, i, "Forced") == "Yes",
 				Link:      link,
@@ -311,7 +397,7 @@ func getInfo(path string) (*MediaInfo, error) {
 		Fonts: Map(
 			attachments,
 			func(font string, _ int) string {
-				return fmt.Sprintf("%s/%s/attachment/%s", Settings.RoutePrefix, base64.StdEncoding.EncodeToString([]byte(path)), font)
+				return fmt.Sprintf("%s/%s/attachment/%s", Settings.RoutePrefix, EncodePath(path), font)
 			}),
 	}
 	var codecs []string
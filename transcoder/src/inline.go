@@ -0,0 +1,199 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"mime"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Build a self contained vtt from the sheet of out (extracted with opts): each cue embeds its tile as a data uri
+// instead of pointing to the sprite. This is for exports (offline players, single file downloads), the file is way
+// bigger than the vtt and its sprites since tiles are encoded separately.
+func GetInlineVtt(out string, opts ThumbnailOptions, size SheetSize) (string, error) {
+	file, err := OpenMetadata(GetVttPath(out, size))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var lines []string
+	// index in lines of the src of each cue and its tile.
+	var srcs []int
+	var tiles []image.Image
+	pages := make(map[int]image.Image)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		src, fragment, found := strings.Cut(line, "#xywh=")
+		if !found {
+			lines = append(lines, line)
+			continue
+		}
+		var x, y, w, h int
+		if _, err := fmt.Sscanf(fragment, "%d,%d,%d,%d", &x, &y, &w, &h); err != nil {
+			return "", fmt.Errorf("invalid cue %q: %w", line, err)
+		}
+		page := 0
+		if u, err := url.Parse(src); err == nil && u.Query().Has("page") {
+			page, _ = strconv.Atoi(u.Query().Get("page"))
+		}
+		sprite, ok := pages[page]
+		if !ok {
+			sprite, err = openSprite(out, opts, size, page)
+			if err != nil {
+				return "", err
+			}
+			pages[page] = sprite
+		}
+		srcs = append(srcs, len(lines))
+		lines = append(lines, "")
+		tiles = append(tiles, imaging.Crop(sprite, image.Rect(x, y, x+w, y+h)))
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	encoded, err := encodeTiles(tiles)
+	if err != nil {
+		return "", err
+	}
+	mime_type := getThumbnailMime()
+	for i, line := range srcs {
+		lines[line] = fmt.Sprintf("data:%s;base64,%s", mime_type, base64.StdEncoding.EncodeToString(encoded[i]))
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// Content type of images encoded in Settings.ThumbnailFormat.
+func getThumbnailMime() string {
+	// not every system lists webp in its mime types.
+	if Settings.ThumbnailFormat == "webp" {
+		return "image/webp"
+	}
+	if ret := mime.TypeByExtension("." + Settings.ThumbnailFormat); ret != "" {
+		return ret
+	}
+	// formats of registered encoders (avif, jxl...).
+	return "image/" + Settings.ThumbnailFormat
+}
+
+func openSprite(out string, opts ThumbnailOptions, size SheetSize, page int) (image.Image, error) {
+	sprite_path, found := FindSprite(out, opts, size, page)
+	if !found {
+		return nil, fmt.Errorf("missing sprite page %d of %s", page, out)
+	}
+	file, err := OpenMetadata(sprite_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return imaging.Decode(file)
+}
+
+// Encode tiles in the sprites' format. All the tiles of a sheet have the same size, webp ones are sent to a
+// single ffmpeg as frames of a raw video instead of running it for every tile (see saveWebp).
+func encodeTiles(tiles []image.Image) ([][]byte, error) {
+	ret := make([][]byte, len(tiles))
+	if len(tiles) == 0 {
+		return ret, nil
+	}
+	if encode, ok := getThumbnailEncoder(Settings.ThumbnailFormat); ok {
+		for i, tile := range tiles {
+			var buf bytes.Buffer
+			if err := encode(&buf, tile); err != nil {
+				return nil, err
+			}
+			ret[i] = buf.Bytes()
+		}
+		return ret, nil
+	}
+	if Settings.ThumbnailFormat != "webp" {
+		format, err := imaging.FormatFromExtension(Settings.ThumbnailFormat)
+		if err != nil {
+			return nil, err
+		}
+		for i, tile := range tiles {
+			var buf bytes.Buffer
+			if format == imaging.JPEG {
+				err = encodeJpeg(&buf, tile, Settings.ThumbnailQuality)
+			} else {
+				err = imaging.Encode(&buf, tile, format)
+			}
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = buf.Bytes()
+		}
+		return ret, nil
+	}
+
+	bounds := tiles[0].Bounds()
+	var frames bytes.Buffer
+	for _, tile := range tiles {
+		frames.Write(imaging.Clone(tile).Pix)
+	}
+	// tiles are read back from ffmpeg's output, they never go through the disk (or the metadata store).
+	cmd := exec.Command(
+		Settings.FfmpegPath,
+		"-nostats", "-hide_banner", "-loglevel", "warning",
+		"-f", "rawvideo",
+		"-pix_fmt", "rgba",
+		"-s", fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy()),
+		"-i", "pipe:0",
+		"-map_metadata", "-1",
+		"-fflags", "+bitexact",
+		"-flags:v", "+bitexact",
+		"-c:v", "libwebp",
+		"-quality", fmt.Sprint(Settings.ThumbnailQuality),
+		"-f", "image2pipe",
+		"pipe:1",
+	)
+	cmd.Stdin = &frames
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("could not encode webp tiles: %s: %s", err, stderr.String())
+	}
+	webps, err := splitWebps(stdout.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(webps) != len(ret) {
+		return nil, fmt.Errorf("could not encode webp tiles: got %d images for %d tiles", len(webps), len(ret))
+	}
+	copy(ret, webps)
+	return ret, nil
+}
+
+// Split the webp images written one after the other by ffmpeg's image2pipe. Each one is a riff file, its
+// header gives its size.
+func splitWebps(content []byte) ([][]byte, error) {
+	var ret [][]byte
+	for len(content) > 0 {
+		if len(content) < 12 || string(content[0:4]) != "RIFF" || string(content[8:12]) != "WEBP" {
+			return nil, errors.New("invalid webp tile")
+		}
+		size := 8 + int(binary.LittleEndian.Uint32(content[4:8]))
+		// chunks are padded to an even size.
+		size += size % 2
+		if size > len(content) {
+			return nil, errors.New("truncated webp tile")
+		}
+		ret = append(ret, content[:size])
+		content = content[size:]
+	}
+	return ret, nil
+}
@@ -0,0 +1,53 @@
+package src
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// A riff file of a webp with a payload of size bytes.
+func fakeWebp(size int) []byte {
+	ret := []byte("RIFF\x00\x00\x00\x00WEBP")
+	binary.LittleEndian.PutUint32(ret[4:8], uint32(4+size))
+	return append(ret, bytes.Repeat([]byte{byte(size)}, size)...)
+}
+
+func TestSplitWebps(t *testing.T) {
+	webps := [][]byte{fakeWebp(10), fakeWebp(4), fakeWebp(32)}
+	got, err := splitWebps(bytes.Join(webps, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(got, webps, bytes.Equal) {
+		t.Errorf("got %q, expected %q", got, webps)
+	}
+	for _, invalid := range [][]byte{[]byte("RIFF"), fakeWebp(10)[:15], append(fakeWebp(4), "garbage"...)} {
+		if _, err := splitWebps(invalid); err == nil {
+			t.Errorf("%q was split", invalid)
+		}
+	}
+}
+
+func TestInlineVttFromStore(t *testing.T) {
+	useSolidSource(t, 60, 640, 360)
+	store := useRemoteStore(t)
+	out, err := ExtractThumbnail("/inline.mkv", "remote-inline", ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sheets are only in the store.
+	for _, file := range store.sheets(out) {
+		os.Remove(file)
+	}
+	vtt, err := GetInlineVtt(out, ThumbnailOptions{}, DefaultSheetSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(vtt, "data:image/png;base64,") {
+		t.Errorf("the tiles are not inlined: %s", vtt)
+	}
+}
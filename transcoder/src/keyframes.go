@@ -2,9 +2,11 @@ package src
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,6 +23,8 @@ type KeyframeInfo struct {
 	mutex     sync.RWMutex
 	ready     sync.WaitGroup
 	listeners []func(keyframes []float64)
+	// Closed once every keyframe has been listed (or the listing failed).
+	done chan struct{}
 }
 
 func (kf *Keyframe) Get(idx int32) float64 {
@@ -56,6 +60,21 @@ func (kf *Keyframe) add(values []float64) {
 	}
 }
 
+// Wait for every keyframe to be listed. ok is false if ctx is cancelled first or if they could not be listed.
+func (kf *Keyframe) WaitAll(ctx context.Context) ([]float64, bool) {
+	select {
+	case <-kf.info.done:
+	case <-ctx.Done():
+		return nil, false
+	}
+	kf.info.mutex.RLock()
+	defer kf.info.mutex.RUnlock()
+	if !kf.IsDone {
+		return nil, false
+	}
+	return slices.Clone(kf.Keyframes), true
+}
+
 func (kf *Keyframe) AddListener(callback func(keyframes []float64)) {
 	kf.info.mutex.Lock()
 	defer kf.info.mutex.Unlock()
@@ -69,11 +88,12 @@ func GetKeyframes(sha string, path string) *Keyframe {
 		kf := &Keyframe{
 			Sha:    sha,
 			IsDone: false,
-			info:   &KeyframeInfo{},
+			info:   &KeyframeInfo{done: make(chan struct{})},
 		}
 		kf.info.ready.Add(1)
 		go func() {
-			save_path := fmt.Sprintf("%s/%s/keyframes.json", Settings.Metadata, sha)
+			defer close(kf.info.done)
+			save_path := fmt.Sprintf("%s/keyframes.json", GetMetadataPath(sha))
 			if err := getSavedInfo(save_path, kf); err == nil {
 				log.Printf("Using keyframes cache on filesystem for %s", path)
 				kf.info.ready.Done()
@@ -98,7 +118,7 @@ func getKeyframes(path string, kf *Keyframe) error {
 	// We could ask it to return only i-frames (keyframes) with the -skip_frame nokey but using it is extremly slow
 	// since ffmpeg parses every frames when this flag is set.
 	cmd := exec.Command(
-		"ffprobe",
+		Settings.FfprobePath,
 		"-loglevel", "error",
 		"-select_streams", "v:0",
 		"-show_entries", "packet=pts_time,flags",
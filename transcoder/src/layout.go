@@ -0,0 +1,92 @@
+package src
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Directory of the metadata of a sha. With Settings.MetadataShardDepth set, shas are spread in nested
+// directories named after the first bytes of their hash (Settings.Metadata/ab/cd/v2-abcd...) so no
+// directory grows to tens of thousands of entries.
+func GetMetadataPath(sha string) string {
+	ret := Settings.Metadata
+	// skip the version prefix, every sha would end up in the same shard.
+	hash := sha[strings.LastIndex(sha, "-")+1:]
+	for i := 0; i < Settings.MetadataShardDepth && len(hash) >= 2*(i+1); i++ {
+		ret = filepath.Join(ret, hash[2*i:2*(i+1)])
+	}
+	return filepath.Join(ret, sha)
+}
+
+// Shard directories are named after a byte of a hash, shas are always longer.
+func isShardDir(name string) bool {
+	_, err := hex.DecodeString(name)
+	return len(name) == 2 && err == nil
+}
+
+// List the metadata directories of every sha (sha -> directory), whatever the layout they were created with.
+func listMetadataDirs() (map[string]string, error) {
+	ret := make(map[string]string)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if dir == Settings.Metadata && entry.Name() == placeholder_dir {
+				continue
+			}
+			if isShardDir(entry.Name()) {
+				if err := walk(path); err != nil {
+					return err
+				}
+				continue
+			}
+			ret[entry.Name()] = path
+		}
+		return nil
+	}
+	return ret, walk(Settings.Metadata)
+}
+
+// Move metadata directories created with another layout (flat or with another shard depth) to the path
+// GetMetadataPath uses now. This should run before serving requests, only the local metadata dir is moved.
+func MigrateMetadataLayout() error {
+	dirs, err := listMetadataDirs()
+	if err != nil {
+		return err
+	}
+	moved := 0
+	for sha, dir := range dirs {
+		dest := GetMetadataPath(sha)
+		if dir == dest {
+			continue
+		}
+		if _, err := os.Stat(dest); err == nil {
+			slog.Warn("Metadata already exists in the new layout, keeping the old directory", "sha", sha, "path", dir)
+			continue
+		}
+		if err := mkdirMetadata(filepath.Dir(dest)); err != nil {
+			return err
+		}
+		if err := os.Rename(dir, dest); err != nil {
+			return err
+		}
+		// remove shards left empty by the move, Remove fails on non empty directories.
+		for parent := filepath.Dir(dir); parent != filepath.Clean(Settings.Metadata) && os.Remove(parent) == nil; parent = filepath.Dir(parent) {
+		}
+		moved++
+	}
+	if moved > 0 {
+		slog.Info("Moved metadata directories to the new layout", "count", moved, "depth", Settings.MetadataShardDepth)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"image"
+	"log/slog"
+)
+
+var ErrSpriteTooBig = errors.New("the sprite does not fit in a single image, lower GOCODER_THUMBNAIL_MAX_CAPS")
+
+// Extract the main sprite (with default options) and its vtt without touching the metadata dir, for tests and
+// short lived uses. Cues point to a relative <base name>.<format> since the sprite is not served by the transcoder.
+// Nothing is cached, every call extracts the thumbnails again.
+func ExtractThumbnailToMemory(path string) (*image.NRGBA, string, error) {
+	if !startJob() {
+		return nil, "", ErrShuttingDown
+	}
+	defer endJob()
+
+	logger := slog.With("extraction", newExtractionId())
+	defer printExecTimeWith(logger, "extracting thumbnails in memory for %s", path)()
+	var sprite *image.NRGBA
+	var vtt string
+	err := withExtractionTimeout(withLogger(context.Background(), logger), func(ctx context.Context) error {
+		sheets, _, release, err := renderThumbnails(ctx, path, "", "", &Thumbnail{}, []SheetSize{DefaultSheetSize()}, ThumbnailOptions{}.withDefaults(), nil, nil)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if len(sheets[0].sprites) > 1 {
+			return ErrSpriteTooBig
+		}
+		// sprites are never mapped without an out dir, they stay valid after the release.
+		sprite = sheets[0].sprites[0]
+		vtt = sheets[0].vtt()
+		return nil
+	})
+	if err != nil {
+		logger.Error("Could not extract thumbnails in memory", "path", path, "err", err)
+		extraction_failures.WithLabelValues("sprite").Inc()
+		return nil, "", err
+	}
+	return sprite, vtt, nil
+}
@@ -0,0 +1,35 @@
+package src
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Every metric has a kind label, one of sprite, bif, preview, gif, poster, waveform, chapters or subtitle.
+var (
+	extraction_duration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gocoder_thumbnail_extraction_duration_seconds",
+		Help:    "Time spent extracting thumbnails (excluding the time waiting for a worker).",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"kind"})
+	active_extractions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gocoder_thumbnail_extractions_active",
+		Help: "Number of thumbnails extractions currently running.",
+	}, []string{"kind"})
+	extraction_failures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gocoder_thumbnail_extraction_failures_total",
+		Help: "Number of thumbnails extractions that failed.",
+	}, []string{"kind"})
+	thumbnail_cache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gocoder_thumbnail_cache_requests_total",
+		Help: "Number of thumbnails requests, a hit means the extraction was already running or done.",
+	}, []string{"kind", "result"})
+)
+
+func observeCache(kind string, created bool) {
+	result := "hit"
+	if created {
+		result = "miss"
+	}
+	thumbnail_cache.WithLabelValues(kind, result).Inc()
+}
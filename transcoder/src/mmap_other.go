@@ -0,0 +1,12 @@
+//go:build !unix
+
+package src
+
+import (
+	"errors"
+	"image"
+)
+
+func newMappedImage(dir string, w int, h int) (*image.NRGBA, func(), error) {
+	return nil, nil, errors.New("memory mapped images are not supported on this platform")
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package src
+
+import (
+	"image"
+	"os"
+	"syscall"
+)
+
+// Create a w x h image whose pixels are stored in a memory mapped file inside dir.
+// The kernel can write pages back to the file when memory is needed, so huge sprites don't
+// have to fit in memory. Call the returned function to release the image.
+func newMappedImage(dir string, w int, h int) (*image.NRGBA, func(), error) {
+	file, err := os.CreateTemp(dir, ".sprite-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	// the mapping keeps the file alive, we don't need a name.
+	defer file.Close()
+	defer os.Remove(file.Name())
+
+	size := w * h * 4
+	if err := file.Truncate(int64(size)); err != nil {
+		return nil, nil, err
+	}
+	pix, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	img := &image.NRGBA{
+		Pix:    pix,
+		Stride: w * 4,
+		Rect:   image.Rect(0, 0, w, h),
+	}
+	return img, func() { syscall.Munmap(pix) }, nil
+}
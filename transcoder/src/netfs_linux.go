@@ -0,0 +1,25 @@
+//go:build linux
+
+package src
+
+import "syscall"
+
+// Magic numbers (statfs's f_type) of network and fuse filesystems, see statfs(2).
+var network_filesystems = map[int64]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x01021997: "9p",
+	0x65735546: "fuse",
+}
+
+// Check if path is on a network filesystem, where each seek is a round trip to the server.
+func isNetworkPath(path string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return false
+	}
+	_, ok := network_filesystems[int64(stat.Type)]
+	return ok
+}
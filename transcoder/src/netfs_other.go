@@ -0,0 +1,7 @@
+//go:build !linux
+
+package src
+
+func isNetworkPath(path string) bool {
+	return false
+}
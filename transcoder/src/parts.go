@@ -0,0 +1,119 @@
+package src
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"os"
+)
+
+// A file of a video split in multiple files (part1.mkv, part2.mkv...), start is its position (in seconds)
+// in the whole video.
+type videoPart struct {
+	gen   *Generator
+	start float64
+}
+
+// Identify a video split in multiple files, like the sha of a single file it changes when any part is modified.
+func GetPartsSha(paths []string) (string, error) {
+	h := sha1.New()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(path))
+		h.Write([]byte(info.ModTime().String()))
+	}
+	return "parts-" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Extract the thumbnails of a video split in multiple files as if they were a single file: the sprite and the
+// vtt scrub seamlessly across the parts. Returns the sha of the set (see GetPartsSha) and the thumbnails dir.
+func ExtractThumbnailParts(paths []string, opts ThumbnailOptions) (string, string, error) {
+	if len(paths) == 0 {
+		return "", "", errors.New("no file to extract thumbnails from")
+	}
+	sha, err := GetPartsSha(paths)
+	if err != nil {
+		return "", "", err
+	}
+	opts.Parts = paths[1:]
+	if len(opts.Parts) == 0 {
+		opts.Parts = nil
+	}
+	out, err := extractThumbnailContext(context.Background(), paths[0], sha, opts, nil, nil)
+	return sha, out, err
+}
+
+// Open the parts following gen. timeline has the dimensions of gen but the duration of every part, it is only
+// used for the layout and the cues (frames are grabbed from parts). Without parts, timeline is gen.
+func openParts(gen *Generator, paths []string) (timeline *Generator, parts []videoPart, close_parts func(), err error) {
+	parts = []videoPart{{gen: gen}}
+	close_parts = func() {
+		// the first generator is owned by the caller.
+		for _, part := range parts[1:] {
+			part.gen.Close()
+		}
+	}
+	if len(paths) == 0 {
+		return gen, parts, close_parts, nil
+	}
+
+	duration := gen.Duration
+	for _, path := range paths {
+		other, err := openGenerator(path)
+		if err != nil {
+			close_parts()
+			return nil, nil, nil, fmt.Errorf("could not open the part %s: %w", path, err)
+		}
+		parts = append(parts, videoPart{gen: other, start: float64(duration) / 1000})
+		duration += other.Duration
+	}
+	ret := *gen
+	ret.Duration = duration
+	return &ret, parts, close_parts, nil
+}
+
+// Same as grabFrames but timestamps are positions in the whole video, each frame is grabbed from its part.
+func grabTimeline(
+	ctx context.Context,
+	parts []videoPart,
+	timestamps []float64,
+	width int,
+	height int,
+	on_frame func(i int, ts float64, img image.Image) error,
+) error {
+	if len(parts) == 1 {
+		return grabFrames(ctx, parts[0].gen, timestamps, width, height, on_frame)
+	}
+	for p, part := range parts {
+		end := math.Inf(1)
+		if p+1 < len(parts) {
+			end = parts[p+1].start
+		}
+		// indices (in timestamps) of the frames of this part and their time in the part.
+		var indices []int
+		var local []float64
+		for i, ts := range timestamps {
+			if ts >= part.start && ts < end {
+				indices = append(indices, i)
+				local = append(local, ts-part.start)
+			}
+		}
+		if len(local) == 0 {
+			continue
+		}
+		err := grabFrames(ctx, part.gen, local, width, height, func(i int, ts float64, img image.Image) error {
+			return on_frame(indices[i], ts+part.start, img)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
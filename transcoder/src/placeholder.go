@@ -0,0 +1,87 @@
+package src
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Directory (at the root of Settings.Metadata) of the thumbnails served when Settings.ThumbnailsEnabled is
+// false, it is not the directory of a sha (see listMetadataDirs).
+const placeholder_dir = "placeholder"
+
+// End of the single cue of the placeholder vtts, longer than any video.
+var placeholder_end = 100*3600 - 0.001
+
+// Height of the placeholder tiles when GOCODER_THUMBNAIL_HEIGHT is auto, there is no video to pick it from.
+var placeholder_height = 144
+
+// Only one caller writes the placeholder of a format, the others wait for it.
+var placeholder_lock sync.Mutex
+
+// Thumbnails returned instead of extracting anything when thumbnails are disabled: every sheet is a single
+// tile of Settings.SpriteBackground displayed for the whole video. They are written once for every video,
+// only the format of opts is used (cues point to the sprite with relative urls).
+func getPlaceholderThumbnail(opts ThumbnailOptions) *Thumbnail {
+	opts = ThumbnailOptions{Format: opts.Format}
+	ret := &Thumbnail{path: filepath.Join(Settings.Metadata, placeholder_dir, opts.getFormat())}
+	ret.err = writePlaceholder(ret.path, opts)
+	ret.finished.Store(true)
+	return ret
+}
+
+func writePlaceholder(out string, opts ThumbnailOptions) error {
+	placeholder_lock.Lock()
+	defer placeholder_lock.Unlock()
+	if hasAllSprites(out, opts) {
+		return nil
+	}
+	if err := mkdirMetadata(out); err != nil {
+		return err
+	}
+
+	// the aspect ratio of most videos.
+	tile_width := func(h int) int { return int(float64(h)*16/9+0.5) &^ 1 }
+	height := capTileHeight(cmp.Or(opts.getHeight(), placeholder_height), Settings.MaxTileWidth, tile_width)
+	sheets := make([]*spriteSheet, 0, len(getSheetSizes()))
+	for _, size := range getSheetSizes() {
+		tile_height := capTileHeight(size.tileHeight(height), Settings.MaxTileWidth, tile_width)
+		h := tile_height * size.Scale
+		w := tile_width(tile_height) * size.Scale
+		sprite, release := newSprite(out, w, h, false)
+		defer release()
+		src := fmt.Sprintf("%s.%s%s", Settings.SpriteBaseName, opts.getFormat(), opts.query(size, 0))
+		sheets = append(sheets, &spriteSheet{
+			size:      size,
+			width:     w,
+			height:    h,
+			columns:   1,
+			rows:      1,
+			sprites:   []*image.NRGBA{sprite},
+			format:    opts.getFormat(),
+			quality:   opts.getQuality(),
+			cues:      []string{fmt.Sprintf("%s --> %s\n%s#xywh=0,0,%d,%d\n\n", tsToVttTime(0), tsToVttTime(placeholder_end), src, w, h)},
+			json_cues: []JsonCue{{Start: 0, End: placeholder_end, W: w, H: h, Src: src}},
+		})
+	}
+	info := ThumbnailInfo{
+		Count:   1,
+		Columns: 1,
+		Rows:    1,
+		Order:   Settings.SpriteOrder,
+		Pages:   1,
+		Width:   sheets[0].width,
+		Height:  sheets[0].height,
+		Heights: slices.Replace(slices.Clone(Settings.ThumbnailHeights), 0, 1, height),
+		Scales:  Settings.ThumbnailScales,
+		// see matchesSettings.
+		MaxTileWidth: Settings.MaxTileWidth,
+		MaxSpan:      Settings.ThumbnailMaxSpanSeconds,
+	}
+	slog.Info("Writing the placeholder thumbnails, thumbnails are disabled", "format", opts.getFormat())
+	return writeThumbnails(slog.Default(), out, sheets, info)
+}
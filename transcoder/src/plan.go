@@ -0,0 +1,106 @@
+package src
+
+import "fmt"
+
+// Approximate size (in bytes per pixel) of encoded sprites, thumbnails compress a lot less than videos.
+var sprite_bytes_per_pixel = map[string]float64{
+	"webp": 0.15,
+	"jpeg": 0.2,
+	"png":  1.5,
+}
+
+// What an extraction with the default options would do.
+type ThumbnailPlan struct {
+	/// The number of thumbnails that would be extracted.
+	Numcaps int `json:"numcaps"`
+	/// The number of seconds between two thumbnails.
+	Interval float64 `json:"interval"`
+	/// The layout of the main sprite.
+	Columns int `json:"columns"`
+	Rows    int `json:"rows"`
+	Pages   int `json:"pages"`
+	/// The size of a thumbnail of the main sprite.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	/// A rough estimate of the size (in bytes) of every sprite generated (see GOCODER_THUMBNAIL_HEIGHTS and
+	/// GOCODER_THUMBNAIL_SCALES), to estimate the disk space needed for a library.
+	EstimatedSize int64 `json:"estimatedSize"`
+}
+
+// Compute the layout of the thumbnails of a video without grabbing frames or writing files. Only the
+// container is read so this is cheap enough to run on a whole library before extracting its thumbnails.
+func PlanThumbnail(path string) (ThumbnailPlan, error) {
+	gen, err := openGenerator(path)
+	if err != nil {
+		return ThumbnailPlan{}, err
+	}
+	defer gen.Close()
+
+	// there is no sha to cache the mediainfo with, probe it directly.
+	sar := 1.0
+	if !IsRemotePath(path) {
+		if info, err := getInfo(path); err == nil && info.Video != nil && info.Video.PixelAspectRatio > 0 {
+			sar = float64(info.Video.PixelAspectRatio)
+		}
+	}
+
+	height := thumbnail_height
+	if height == 0 {
+		height = getAutoThumbnailHeight(gen, sar)
+	}
+	height = capTileHeight(height, Settings.MaxTileWidth, func(h int) int {
+		return getThumbnailWidth(gen, h, sar)
+	})
+	width, display_height := getDisplaySize(gen, sar)
+	duration := float64(gen.Duration) / 1000
+	if span := float64(Settings.ThumbnailMaxSpanSeconds); span > 0 && duration > span {
+		duration = span
+	}
+	layout := computeSpriteLayout(duration, width, display_height, ThumbnailOptions{}.withDefaults().layoutOpts(height))
+	ret := ThumbnailPlan{
+		Numcaps:  layout.Numcaps,
+		Interval: layout.Interval,
+		Columns:  layout.Columns,
+		Rows:     layout.Rows,
+		Pages:    layout.Pages,
+		Width:    layout.Width,
+		Height:   layout.Height,
+	}
+
+	ret.EstimatedSize = estimateSpritesSize(layout.Numcaps, height, func(h int) int {
+		return getThumbnailWidth(gen, h, sar)
+	})
+	return ret, nil
+}
+
+// Rough size (in bytes) of every sprite of numcaps thumbnails, width gives the width of a tile of a given height
+// and main_height is the height of the main sprite's thumbnails.
+func estimateSpritesSize(numcaps int, main_height int, width func(height int) int) int64 {
+	var size float64
+	bytes_per_pixel, ok := sprite_bytes_per_pixel[Settings.ThumbnailFormat]
+	if !ok {
+		// formats of registered encoders, they usually compress better than jpeg.
+		bytes_per_pixel = sprite_bytes_per_pixel["jpeg"]
+	}
+	for _, sheet := range getSheetSizes() {
+		w := width(sheet.tileHeight(main_height)) * sheet.Scale
+		h := sheet.tileHeight(main_height) * sheet.Scale
+		size += float64(w*h*numcaps) * bytes_per_pixel
+	}
+	return int64(size)
+}
+
+// The estimate is rough and temporary files are written next to the sprites, require some headroom.
+var free_space_margin = 2
+
+// Fail early when the metadata dir has no room for the sprites instead of after every frame was grabbed.
+func checkFreeSpace(dir string, needed int64) error {
+	free, ok := getFreeSpace(dir)
+	if !ok {
+		return nil
+	}
+	if needed*int64(free_space_margin) > int64(free) {
+		return fmt.Errorf("%w: %d bytes needed, %d bytes available in %s", ErrInsufficientSpace, needed*int64(free_space_margin), free, dir)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+)
+
+// The maximum height of posters, bigger videos are downscaled.
+var poster_height = 720
+
+var posters = NewCMapWithLimitPinned[string, *Thumbnail](max_cached_thumbnails, isRunning)
+
+// Extract a single frame of the video to use as a fallback poster.
+// If at is not positive, the frame at 20% of the video is used (to skip intros).
+func ExtractPoster(path string, sha string, at float64) (string, error) {
+	return extractPosterContext(context.Background(), path, sha, at)
+}
+
+func extractPosterContext(ctx context.Context, path string, sha string, at float64) (string, error) {
+	key := fmt.Sprintf("%s/%g", sha, at)
+	ret, created := posters.GetOrCreate(key, func() *Thumbnail {
+		name := "poster.jpg"
+		if at > 0 {
+			name = fmt.Sprintf("poster-%g.jpg", at)
+		}
+		ret := &Thumbnail{
+			path: fmt.Sprintf("%s/%s", GetMetadataPath(sha), name),
+		}
+		if !startJob() {
+			ret.err = ErrShuttingDown
+			ret.finished.Store(true)
+			return ret
+		}
+		ret.ready.Add(1)
+		go func() {
+			defer endJob()
+			ret.err = withExtractionTimeout(ctx, func(ctx context.Context) error {
+				return extractPoster(ctx, path, sha, ret.path, at)
+			})
+			if ret.err != nil {
+				slog.Error("Could not extract poster", "path", path, "sha", sha, "at", at, "err", ret.err)
+				extraction_failures.WithLabelValues("poster").Inc()
+				posters.Remove(key)
+			}
+			ret.finish()
+		}()
+		return ret
+	})
+	observeCache("poster", created)
+	ret.ready.Wait()
+	return ret.path, ret.err
+}
+
+func extractPoster(ctx context.Context, path string, sha string, out string, at float64) error {
+	defer printExecTime("extracting poster for %s", path)()
+	if metadata_store.Exists(out) {
+		return nil
+	}
+
+	release, err := acquireWorker(ctx, "poster")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	gen, close_gen, err := openSessionGenerator(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer close_gen()
+
+	if at <= 0 {
+		at = float64(gen.Duration) / 1000 * 0.2
+	}
+	sar := getPixelAspectRatio(path, sha)
+	_, display_height := getDisplaySize(gen, sar)
+	height := min(display_height, poster_height)
+	width := getThumbnailWidth(gen, height, sar)
+
+	img, err := grabFrame(gen, int64(at*1000), width, height)
+	if err != nil {
+		return err
+	}
+	mkdirMetadata(filepath.Dir(out))
+	img = tonemap(fixColors(img, getColorFix(path, sha)), getTransfer(path, sha))
+	return writeAtomic(out, func(tmp string) error {
+		file, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err = imaging.Encode(file, img, imaging.JPEG, imaging.JPEGQuality(90)); err != nil {
+			return err
+		}
+		return file.Close()
+	})
+}
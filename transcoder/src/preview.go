@@ -0,0 +1,115 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Height of the frames of animated previews.
+var preview_height = 180
+
+// Number of frames displayed per second in animated previews.
+var preview_framerate = 2
+
+// Extract a short looping animated webp of the video, used as a preview when hovering a video.
+func ExtractPreview(path string, sha string) (string, error) {
+	cache_key := fmt.Sprintf("%s/preview", sha)
+	ret, created := thumbnails.GetOrCreate(cache_key, func() *Thumbnail {
+		ret := &Thumbnail{
+			path: fmt.Sprintf("%s/preview.webp", GetMetadataPath(sha)),
+		}
+		if !startJob() {
+			ret.err = ErrShuttingDown
+			ret.finished.Store(true)
+			return ret
+		}
+		ret.ready.Add(1)
+		go func() {
+			defer endJob()
+			ret.err = withExtractionTimeout(context.Background(), func(ctx context.Context) error {
+				return extractPreview(ctx, path, sha, ret.path)
+			})
+			if ret.err != nil {
+				slog.Error("Could not extract preview", "path", path, "sha", sha, "err", ret.err)
+				extraction_failures.WithLabelValues("preview").Inc()
+				thumbnails.Remove(cache_key)
+			}
+			ret.finish()
+		}()
+		return ret
+	})
+	observeCache("preview", created)
+	ret.ready.Wait()
+	return ret.path, ret.err
+}
+
+func extractPreview(ctx context.Context, path string, sha string, out string) error {
+	defer printExecTime("extracting preview for %s", path)()
+	if metadata_store.Exists(out) {
+		return nil
+	}
+
+	release, err := acquireWorker(ctx, "preview")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	gen, err := openGenerator(path)
+	if err != nil {
+		return err
+	}
+	defer gen.Close()
+
+	// evenly spread the frames over the whole video.
+	numcaps, interval := getThumbnailLayout(gen, ThumbnailOptions{Interval: 1, MaxCaps: Settings.PreviewFrames})
+	width := getThumbnailWidth(gen, preview_height, getPixelAspectRatio(path, sha))
+	transfer := getTransfer(path, sha)
+	colors := getColorFix(path, sha)
+
+	frames := make([]*image.NRGBA, numcaps)
+	err = grabFrames(ctx, gen, getEvenTimestamps(numcaps, interval), width, preview_height, func(i int, _ float64, img image.Image) error {
+		frames[i] = imaging.Clone(tonemap(fixColors(img, colors), transfer))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var raw bytes.Buffer
+	for _, frame := range frames {
+		raw.Write(frame.Pix)
+	}
+	mkdirMetadata(filepath.Dir(out))
+	return writeAtomic(out, func(tmp string) error {
+		cmd := exec.Command(
+			Settings.FfmpegPath,
+			"-nostats", "-hide_banner", "-loglevel", "warning",
+			"-f", "rawvideo",
+			"-pix_fmt", "rgba",
+			"-s", fmt.Sprintf("%dx%d", width, preview_height),
+			"-framerate", fmt.Sprint(preview_framerate),
+			"-i", "pipe:0",
+			"-c:v", "libwebp",
+			"-quality", fmt.Sprint(Settings.ThumbnailQuality),
+			"-loop", "0",
+			"-f", "webp",
+			"-y", tmp,
+		)
+		cmd.Stdin = &raw
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("could not encode webp preview: %s: %s", err, stderr.String())
+		}
+		return nil
+	})
+}
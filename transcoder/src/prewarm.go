@@ -0,0 +1,69 @@
+package src
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// Number of prewarmed extractions queued or running, batches wait for them before starting their next item.
+var (
+	prewarm_lock    sync.Mutex
+	prewarm_idle    = sync.NewCond(&prewarm_lock)
+	prewarm_pending int
+)
+
+// Extract the thumbnails (with default options) of the given shas ahead of running batches (see
+// ExtractThumbnailsBatch), for the titles displayed first (continue watching...). resolve returns the path of a sha
+// (ok is false for unknown shas). Shas that already have their thumbnails are skipped so this can be called on every
+// refresh of the list. Extractions run in the background on the worker pool, this returns the number started.
+func PrewarmThumbnails(shas []string, resolve func(sha string) (path string, ok bool)) int {
+	var items []BatchItem
+	for _, sha := range shas {
+		if hasAllSprites(getThumbnailPath(sha, ""), ThumbnailOptions{}) {
+			continue
+		}
+		path, ok := resolve(sha)
+		if !ok {
+			slog.Warn("Could not find the video of a sha to prewarm, skipping it", "sha", sha)
+			continue
+		}
+		items = append(items, BatchItem{Path: path, Sha: sha})
+	}
+	if len(items) == 0 {
+		return 0
+	}
+
+	prewarm_lock.Lock()
+	prewarm_pending += len(items)
+	prewarm_lock.Unlock()
+	queue := make(chan BatchItem, len(items))
+	for _, item := range items {
+		queue <- item
+	}
+	close(queue)
+	for i := 0; i < min(Settings.ThumbnailWorkers, len(items)); i++ {
+		go func() {
+			for item := range queue {
+				if _, err := ExtractThumbnail(item.Path, item.Sha, ThumbnailOptions{}); err != nil {
+					slog.Warn("Could not prewarm thumbnails", "path", item.Path, "sha", item.Sha, "err", err)
+				}
+				prewarm_lock.Lock()
+				prewarm_pending--
+				if prewarm_pending == 0 {
+					prewarm_idle.Broadcast()
+				}
+				prewarm_lock.Unlock()
+			}
+		}()
+	}
+	return len(items)
+}
+
+// Wait for the prewarmed extractions to finish.
+func waitForPrewarm() {
+	prewarm_lock.Lock()
+	defer prewarm_lock.Unlock()
+	for prewarm_pending > 0 {
+		prewarm_idle.Wait()
+	}
+}
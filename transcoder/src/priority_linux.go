@@ -0,0 +1,38 @@
+//go:build linux
+
+package src
+
+import (
+	"log/slog"
+	"runtime"
+	"syscall"
+)
+
+// Run the calling goroutine with the niceness of Settings.ThumbnailPriority so extractions leave the cpu
+// (and the disk, the io scheduler follows the niceness) to live transcodes. On linux priorities are per
+// thread so the goroutine is locked to its thread until the returned function is called.
+func lowerPriority() func() {
+	if Settings.ThumbnailPriority == 0 {
+		return func() {}
+	}
+	runtime.LockOSThread()
+	tid := syscall.Gettid()
+	// the raw syscall returns 20 - nice.
+	old, err := syscall.Getpriority(syscall.PRIO_PROCESS, tid)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return func() {}
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, Settings.ThumbnailPriority); err != nil {
+		slog.Warn("Could not lower the priority of the extraction", "priority", Settings.ThumbnailPriority, "err", err)
+		runtime.UnlockOSThread()
+		return func() {}
+	}
+	return func() {
+		// raising the priority back needs CAP_SYS_NICE, keep the thread out of the runtime's pool if it fails.
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, 20-old); err != nil {
+			return
+		}
+		runtime.UnlockOSThread()
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package src
+
+func lowerPriority() func() {
+	return func() {}
+}
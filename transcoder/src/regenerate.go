@@ -0,0 +1,183 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrRegenerationRunning = errors.New("a library regeneration is already running")
+
+// Progress of a regeneration started by RegenerateLibrary.
+type LibraryRegeneration struct {
+	/// The number of shas queued.
+	Total int `json:"total"`
+	/// The number of shas regenerated (including the failed ones).
+	Done int `json:"done"`
+	/// The number of shas that could not be regenerated, see /thumbnails/failures.
+	Failed int `json:"failed"`
+	/// False once every sha is done or the regeneration was cancelled.
+	Running bool `json:"running"`
+	/// Set when CancelLibraryRegeneration stopped it before every sha was done.
+	Cancelled bool `json:"cancelled"`
+	/// When the regeneration started.
+	Started time.Time `json:"started"`
+}
+
+type libraryRegeneration struct {
+	total     int
+	done      atomic.Int32
+	failed    atomic.Int32
+	running   atomic.Bool
+	cancelled atomic.Bool
+	cancel    context.CancelFunc
+	started   time.Time
+}
+
+// The running (or last) regeneration, nil if none was started.
+var library_regeneration struct {
+	lock    sync.Mutex
+	current *libraryRegeneration
+}
+
+// Regenerations leave at least half of the workers to the extractions requested by players.
+func getRegenerationWorkers() int {
+	return max(Settings.ThumbnailWorkers/2, 1)
+}
+
+// Extract the thumbnails (with default options) of every sha again in the background, after a change of the
+// thumbnails settings for example. Only the shas that already have thumbnails are regenerated: the others are
+// extracted with the new settings on their first request, and the metadata dir doesn't grow past the budget of
+// the GC (see Settings.MaxThumbnailCacheBytes). resolve returns the path of a sha (ok is false for unknown shas).
+// At most half of Settings.ThumbnailWorkers extractions run at once and prewarmed extractions go first, so
+// players are not blocked. This returns the number of shas queued, the progress is in ThumbnailStats.
+func RegenerateLibrary(shas []string, resolve func(sha string) (path string, ok bool)) (int, error) {
+	library_regeneration.lock.Lock()
+	defer library_regeneration.lock.Unlock()
+	if current := library_regeneration.current; current != nil && current.running.Load() {
+		return 0, ErrRegenerationRunning
+	}
+
+	var items []BatchItem
+	for _, sha := range shas {
+		if getSavedThumbnailInfo(getThumbnailPath(sha, "")).Count == 0 {
+			continue
+		}
+		path, ok := resolve(sha)
+		if !ok {
+			slog.Warn("Could not find the video of a sha to regenerate, skipping it", "sha", sha)
+			continue
+		}
+		items = append(items, BatchItem{Path: path, Sha: sha})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &libraryRegeneration{total: len(items), cancel: cancel, started: time.Now()}
+	job.running.Store(true)
+	library_regeneration.current = job
+	slog.Info("Regenerating the thumbnails of the library", "total", len(items), "workers", getRegenerationWorkers())
+
+	queue := make(chan BatchItem)
+	var wg sync.WaitGroup
+	for i := 0; i < min(getRegenerationWorkers(), len(items)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				waitForPrewarm()
+				_, err := RegenerateThumbnail(item.Path, item.Sha)
+				// each regeneration is a job of its own (see Shutdown), the rest of the library is not waited for.
+				if errors.Is(err, ErrShuttingDown) {
+					cancel()
+					continue
+				}
+				if err != nil {
+					// the failure is recorded by RegenerateThumbnail.
+					job.failed.Add(1)
+				}
+				job.done.Add(1)
+			}
+		}()
+	}
+	go func() {
+		defer cancel()
+	loop:
+		for _, item := range items {
+			select {
+			case queue <- item:
+			case <-ctx.Done():
+				break loop
+			}
+		}
+		close(queue)
+		wg.Wait()
+		job.cancelled.Store(ctx.Err() != nil && int(job.done.Load()) < job.total)
+		job.running.Store(false)
+		slog.Info(
+			"Regenerated the thumbnails of the library",
+			"done", job.done.Load(),
+			"failed", job.failed.Load(),
+			"total", job.total,
+			"duration", time.Since(job.started),
+		)
+	}()
+	return len(items), nil
+}
+
+// Stop the running regeneration of the library, the extractions already started finish but no other sha is
+// regenerated. False if no regeneration is running.
+func CancelLibraryRegeneration() bool {
+	library_regeneration.lock.Lock()
+	defer library_regeneration.lock.Unlock()
+	current := library_regeneration.current
+	if current == nil || !current.running.Load() {
+		return false
+	}
+	current.cancel()
+	return true
+}
+
+// Progress of the running (or last) regeneration of the library, nil if none was started.
+func getLibraryRegeneration() *LibraryRegeneration {
+	library_regeneration.lock.Lock()
+	current := library_regeneration.current
+	library_regeneration.lock.Unlock()
+	if current == nil {
+		return nil
+	}
+	return &LibraryRegeneration{
+		Total:     current.total,
+		Done:      int(current.done.Load()),
+		Failed:    int(current.failed.Load()),
+		Running:   current.running.Load(),
+		Cancelled: current.cancelled.Load(),
+		Started:   current.started,
+	}
+}
+
+// Shas of every directory of the local metadata dir, to regenerate the whole library.
+func ListMetadataShas() ([]string, error) {
+	dirs, err := listMetadataDirs()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(dirs))
+	for sha := range dirs {
+		ret = append(ret, sha)
+	}
+	slices.Sort(ret)
+	return ret, nil
+}
+
+// The path of the video of a sha recorded when it was probed, for RegenerateLibrary.
+func ResolveProbedPath(sha string) (string, bool) {
+	var info MediaInfo
+	if err := getSavedInfo(getMediaInfoPath(sha), &info); err != nil || info.Path == "" {
+		return "", false
+	}
+	return info.Path, true
+}
@@ -0,0 +1,147 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Directory (inside the thumbnails directory of an extraction) of the frames already grabbed, see
+// Settings.ResumableThumbnails. Hidden so it is never mistaken for a sheet.
+const checkpoint_dir = ".partial"
+
+// Encoding speed matters more than size, frames are deleted once the sprites are written.
+var checkpoint_encoder = png.Encoder{CompressionLevel: png.BestSpeed}
+
+// What the frames of a checkpoint were grabbed for, frames of another extraction are not reused.
+type checkpointState struct {
+	Key        string    `json:"key"`
+	Timestamps []float64 `json:"timestamps"`
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+}
+
+// The frames (cropped, tonemapped and sharpened, before Settings.TileTransform) of an extraction saved while
+// they are grabbed, so an extraction interrupted by a crash or a restart only grabs the missing ones the next
+// time. nil checkpoints are valid and save nothing.
+type thumbnailCheckpoint struct {
+	dir string
+	// frames found when the checkpoint was opened.
+	saved []int
+}
+
+// Open the checkpoint of the extraction of out. Frames saved by a previous extraction are kept if it was for the
+// same key, timestamps and size, otherwise they are removed. nil if Settings.ResumableThumbnails is disabled or
+// for in memory extractions.
+func openCheckpoint(logger *slog.Logger, out string, key string, timestamps []float64, width int, height int) *thumbnailCheckpoint {
+	if !Settings.ResumableThumbnails || out == "" {
+		return nil
+	}
+	ret := &thumbnailCheckpoint{dir: filepath.Join(out, checkpoint_dir)}
+	state := checkpointState{Key: key, Timestamps: timestamps, Width: width, Height: height}
+
+	var saved checkpointState
+	if content, err := os.ReadFile(filepath.Join(ret.dir, "state.json")); err == nil && json.Unmarshal(content, &saved) == nil &&
+		saved.Key == state.Key && saved.Width == state.Width && saved.Height == state.Height && slices.Equal(saved.Timestamps, state.Timestamps) {
+		entries, _ := os.ReadDir(ret.dir)
+		for _, entry := range entries {
+			i, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".png"))
+			if err == nil && strings.HasSuffix(entry.Name(), ".png") && i >= 0 && i < len(timestamps) {
+				ret.saved = append(ret.saved, i)
+			}
+		}
+		slices.Sort(ret.saved)
+		if len(ret.saved) > 0 {
+			logger.Info("Resuming an interrupted extraction", "path", out, "saved", len(ret.saved), "numcaps", len(timestamps))
+		}
+		return ret
+	}
+
+	os.RemoveAll(ret.dir)
+	content, _ := json.Marshal(state)
+	if err := mkdirMetadata(ret.dir); err != nil {
+		logger.Warn("Could not create the checkpoint of an extraction, it can't be resumed", "path", out, "err", err)
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(ret.dir, "state.json"), content, Settings.MetadataFileMode); err != nil {
+		logger.Warn("Could not create the checkpoint of an extraction, it can't be resumed", "path", out, "err", err)
+		os.RemoveAll(ret.dir)
+		return nil
+	}
+	return ret
+}
+
+func (c *thumbnailCheckpoint) framePath(i int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%d.png", i))
+}
+
+// Indexes of the timestamps that have no saved frame, all of them for nil checkpoints.
+func (c *thumbnailCheckpoint) missing(numcaps int) []int {
+	ret := make([]int, 0, numcaps)
+	for i := 0; i < numcaps; i++ {
+		if c != nil {
+			if _, found := slices.BinarySearch(c.saved, i); found {
+				continue
+			}
+		}
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+// Indexes of the frames found when the checkpoint was opened, none for nil checkpoints.
+func (c *thumbnailCheckpoint) frames() []int {
+	if c == nil {
+		return nil
+	}
+	return c.saved
+}
+
+// Decode the saved frame i, for frames listed by openCheckpoint.
+func (c *thumbnailCheckpoint) load(i int) (image.Image, error) {
+	file, err := os.Open(c.framePath(i))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return png.Decode(file)
+}
+
+// Save the frame i, errors only mean the frame will be grabbed again if the extraction is interrupted.
+func (c *thumbnailCheckpoint) save(i int, img image.Image) error {
+	if c == nil {
+		return nil
+	}
+	path := c.framePath(i)
+	file, err := os.CreateTemp(c.dir, fmt.Sprintf(".%d.png.*.tmp", i))
+	if err != nil {
+		return err
+	}
+	err = checkpoint_encoder.Encode(file, img)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), Settings.MetadataFileMode)
+	}
+	if err == nil {
+		// frames are only listed once renamed, a crash while encoding leaves no truncated frame.
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// Remove the saved frames of the extraction of out, once its sprites are written or when it was cancelled.
+func removeCheckpoint(out string) {
+	os.RemoveAll(filepath.Join(out, checkpoint_dir))
+}
@@ -0,0 +1,99 @@
+package src
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Copy videos of network filesystems (up to Settings.ScratchMaxBytes) to Settings.LocalScratchDir before
+// extracting their thumbnails: a sequential copy is a lot faster than the seeks of every thumbnail over the
+// network. Returns the path to decode from (path itself when it is not copied) and a function to call once
+// the generators are closed, it removes the copy and logs how long the copy and the extraction took.
+func stageScratchCopy(ctx context.Context, path string) (string, func()) {
+	logger := getLogger(ctx)
+	if Settings.LocalScratchDir == "" || IsRemotePath(path) || !isNetworkPath(path) {
+		return path, func() {}
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > Settings.ScratchMaxBytes {
+		return path, func() {}
+	}
+	if free, ok := getFreeSpace(Settings.LocalScratchDir); ok && int64(free) < info.Size()*int64(free_space_margin) {
+		logger.Warn("Not enough space in the scratch dir, extracting from the network", "path", path, "size", info.Size(), "free", free)
+		return path, func() {}
+	}
+
+	start := time.Now()
+	local, err := copyToScratch(ctx, path)
+	if err != nil {
+		logger.Warn("Could not copy the video to the scratch dir, extracting from the network", "path", path, "err", err)
+		return path, func() {}
+	}
+	copied := time.Now()
+	logger.Info("Copied the video to the scratch dir", "path", path, "size", info.Size(), "duration", copied.Sub(start))
+	return local, func() {
+		os.Remove(local)
+		// compare with the extractions of the same kind of files from the network (see printExecTime).
+		logger.Info(
+			"Extracted thumbnails from a local copy",
+			"path", path,
+			"copy", copied.Sub(start),
+			"extraction", time.Since(copied),
+			"total", time.Since(start),
+		)
+	}
+}
+
+func copyToScratch(ctx context.Context, path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	if err := os.MkdirAll(Settings.LocalScratchDir, 0o755); err != nil {
+		return "", err
+	}
+	// keep the extension, demuxers use it as a hint.
+	dst, err := os.CreateTemp(Settings.LocalScratchDir, "kyoo-*"+filepath.Ext(path))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dst, contextReader{ctx: ctx, r: src})
+	if close_err := dst.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// Remove the copies left by a crash, nothing reads them once the transcoder restarted.
+func CleanScratchDir() {
+	if Settings.LocalScratchDir == "" {
+		return
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(Settings.LocalScratchDir, "kyoo-*"))
+	for _, leftover := range leftovers {
+		if err := os.Remove(leftover); err != nil {
+			slog.Warn("Could not remove a leftover scratch copy", "path", leftover, "err", err)
+		}
+	}
+}
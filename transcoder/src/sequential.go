@@ -0,0 +1,154 @@
+package src
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Transport streams (recordings) have no seek index, ffmpeg seeks in them by guessing byte offsets and can land
+// far from the requested time. Only those files are probed, seeks in other containers are reliable.
+var unindexed_extensions = []string{".ts", ".m2ts", ".mts", ".tp", ".trp"}
+
+// Number of seeks compared by hasInaccurateSeeks and the signature difference above which two frames are
+// considered to be from different scenes (see getSignatureDiff).
+var (
+	seek_probe_samples   = 3
+	seek_probe_threshold = 40.
+)
+
+// Compare fast seeks (to the previous keyframe) to exact ones at a few timestamps. Fast seeks are at most a
+// group of pictures away from the requested time so they show the same scene, they don't in files where
+// seeks are broken. Accurate thumbnails are always exact, files with them are not probed.
+func hasInaccurateSeeks(gen *Generator, sar float64) bool {
+	if Settings.AccurateThumbnails || !slices.Contains(unindexed_extensions, strings.ToLower(filepath.Ext(gen.Filename))) {
+		return false
+	}
+	accurate, err := openGenerator(gen.Filename)
+	if err != nil {
+		return false
+	}
+	defer accurate.Close()
+	accurate.Fast = false
+
+	height := 90
+	width := getThumbnailWidth(gen, height, sar)
+	different := 0
+	for i := 1; i <= seek_probe_samples; i++ {
+		ts := gen.Duration * int64(i) / int64(seek_probe_samples+1)
+		fast, err := grabFrame(gen, ts, width, height)
+		if err != nil {
+			return false
+		}
+		exact, err := grabFrame(accurate, ts, width, height)
+		if err != nil {
+			return false
+		}
+		if getSignatureDiff(getSignature(fast), getSignature(exact)) > seek_probe_threshold {
+			different++
+		}
+	}
+	return different*2 > seek_probe_samples
+}
+
+// Frames are deinterlaced (when needed) before fps drops fields they need.
+func getSequentialFilters(deinterlace string, fps float64, width int, height int) string {
+	ret := fmt.Sprintf("fps=%g,scale=%d:%d:in_color_matrix=bt601", fps, width, height)
+	if deinterlace != "" {
+		ret = deinterlace + "," + ret
+	}
+	return ret
+}
+
+// Same as grabFrames but the whole file is decoded sequentially by ffmpeg instead of seeking for every frame.
+// Way slower but exact, for files where seeks are broken (see hasInaccurateSeeks).
+func grabSequential(
+	ctx context.Context,
+	path string,
+	deinterlace string,
+	timestamps []float64,
+	width int,
+	height int,
+	on_frame func(i int, ts float64, img image.Image) error,
+) error {
+	logger := getLogger(ctx)
+	defer printExecTimeWith(logger, "decoding %s sequentially", path)()
+	defer lowerPriority()()
+
+	// frames are needed in order, custom timestamps are not always sorted.
+	order := make([]int, len(timestamps))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(timestamps[a], timestamps[b])
+	})
+	// output frames as often as the closest thumbnails, at most one per second of video.
+	gap := math.Inf(1)
+	for i := 1; i < len(order); i++ {
+		if diff := timestamps[order[i]] - timestamps[order[i-1]]; diff > 0 {
+			gap = min(gap, diff)
+		}
+	}
+	fps := 1.
+	if !math.IsInf(gap, 1) {
+		fps = max(1/gap, 1)
+	}
+
+	cmd := exec.CommandContext(
+		ctx,
+		Settings.FfmpegPath,
+		"-nostdin", "-nostats", "-hide_banner", "-loglevel", "error",
+		"-i", path,
+		"-an", "-sn",
+		"-map", "0:v:0",
+		// the frames are converted like screengen's (bt601) so fixColors applies the same correction.
+		"-vf", getSequentialFilters(deinterlace, fps, width, height),
+		"-f", "rawvideo",
+		"-pix_fmt", "rgba",
+		"pipe:1",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// stop ffmpeg once every frame was read, the rest of the file is useless.
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	frame := 0
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for _, i := range order {
+		target := int(math.Round(timestamps[i] * fps))
+		for frame <= target {
+			if _, err := io.ReadFull(stdout, img.Pix); err != nil {
+				if frame == 0 {
+					cmd.Wait()
+					return fmt.Errorf("could not decode %s: %w: %s", path, err, stderr.String())
+				}
+				// the last thumbnails can be slightly after the last frame, reuse it.
+				break
+			}
+			frame++
+		}
+		// on_frame can keep the image, give it a copy.
+		tile := image.NewNRGBA(img.Rect)
+		copy(tile.Pix, img.Pix)
+		if err := on_frame(i, timestamps[i], tile); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,64 @@
+package src
+
+import "context"
+
+// A video opened once for several extractions. Extractions running with its context (see withSession)
+// reuse its generator instead of opening and probing the file again. They must run one after the other,
+// a generator can't decode frames concurrently.
+type extractionSession struct {
+	path string
+	// opened by the first extraction that needs it.
+	gen *Generator
+}
+
+type session_key struct{}
+
+func withSession(ctx context.Context, session *extractionSession) context.Context {
+	return context.WithValue(ctx, session_key{}, session)
+}
+
+// Same as openGenerator but reuses the generator of the session of ctx if it is for the same file.
+// close must be called once done, it only closes generators that don't belong to a session.
+func openSessionGenerator(ctx context.Context, path string) (gen *Generator, close func() error, err error) {
+	session, ok := ctx.Value(session_key{}).(*extractionSession)
+	if !ok || session.path != path {
+		gen, err = openGenerator(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gen, gen.Close, nil
+	}
+	if session.gen == nil {
+		session.gen, err = openGenerator(path)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// other extractions (verifications) can change it.
+	session.gen.Fast = !Settings.AccurateThumbnails
+	return session.gen, func() error { return nil }, nil
+}
+
+func (s *extractionSession) Close() error {
+	if s.gen == nil {
+		return nil
+	}
+	return s.gen.Close()
+}
+
+// Extract the info, the thumbnails (with default options) and the poster of a video, what a scan needs,
+// opening it only once for all of them.
+func ExtractAll(path string, sha string) error {
+	defer printExecTime("extracting everything for %s", path)()
+	if _, err := GetInfo(path, sha); err != nil {
+		return err
+	}
+	session := &extractionSession{path: path}
+	defer session.Close()
+	ctx := withSession(context.Background(), session)
+	if _, err := extractThumbnailContext(ctx, path, sha, ThumbnailOptions{}, nil, nil); err != nil {
+		return err
+	}
+	_, err := extractPosterContext(ctx, path, sha, 0)
+	return err
+}
@@ -1,6 +1,17 @@
 package src
 
-import "os"
+import (
+	"image"
+	"image/color"
+	"log"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
 
 func GetEnvOr(env string, def string) string {
 	out := os.Getenv(env)
@@ -10,11 +21,271 @@ func GetEnvOr(env string, def string) string {
 	return out
 }
 
+func GetEnvIntOr(env string, def int) int {
+	out := os.Getenv(env)
+	if out == "" {
+		return def
+	}
+	ret, err := strconv.Atoi(out)
+	if err != nil {
+		log.Printf("Invalid value for %s (%s), using the default (%d)", env, out, def)
+		return def
+	}
+	return ret
+}
+
+func GetEnvBoolOr(env string, def bool) bool {
+	out := os.Getenv(env)
+	if out == "" {
+		return def
+	}
+	ret, err := strconv.ParseBool(out)
+	if err != nil {
+		log.Printf("Invalid value for %s (%s), using the default (%t)", env, out, def)
+		return def
+	}
+	return ret
+}
+
+func getPositiveEnvOr(env string, def int) int {
+	ret := GetEnvIntOr(env, def)
+	if ret <= 0 {
+		log.Printf("Invalid value for %s (%d), it should be positive. Using the default (%d)", env, ret, def)
+		return def
+	}
+	return ret
+}
+
+// Parse an octal permission (like 0755 or 755), used for files and directories created by the transcoder.
+func getFileModeEnvOr(env string, def os.FileMode) os.FileMode {
+	out := os.Getenv(env)
+	if out == "" {
+		return def
+	}
+	ret, err := strconv.ParseUint(strings.TrimPrefix(out, "0o"), 8, 32)
+	if err != nil || ret > 0o777 {
+		log.Printf("Invalid value for %s (%s), it should be an octal permission. Using the default (%#o)", env, out, def)
+		return def
+	}
+	return os.FileMode(ret)
+}
+
+var thumbnail_resize_filters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+// Parse GOCODER_THUMBNAIL_RESIZE_FILTER, see Settings.ThumbnailResizeFilter.
+func getThumbnailResizeFilter() imaging.ResampleFilter {
+	name := GetEnvOr("GOCODER_THUMBNAIL_RESIZE_FILTER", "lanczos")
+	filter, ok := thumbnail_resize_filters[strings.ToLower(name)]
+	if !ok {
+		slog.Warn("Invalid thumbnail resize filter, falling back to lanczos", "filter", name)
+		return imaging.Lanczos
+	}
+	return filter
+}
+
 type SettingsT struct {
-	Outpath     string
-	Metadata    string
-	RoutePrefix string
+	// Format of the logs, text or json.
+	LogFormat string
+	Outpath   string
+	Metadata  string
+	// Permissions of the directories and files created in the metadata dir.
+	MetadataDirMode  os.FileMode
+	MetadataFileMode os.FileMode
+	// Number of nested directories (named after the first bytes of the sha) metadata dirs are spread in,
+	// 0 to store them directly in the metadata root. See GetMetadataPath.
+	MetadataShardDepth int
+	// How videos are identified (see ComputeMediaSha):
+	// - "path" hashes the path and the modification time, it is instant but files that are moved, renamed or
+	//   touched get new shas and their metadata is extracted again.
+	// - "sample" hashes the size and the first and last MiB of the file, it follows files that are moved and
+	//   costs two small reads (slow on network filesystems). Files with identical sizes and edges, which
+	//   practically only happens for copies, share their metadata.
+	// - "full" hashes the whole content. It never mixes up files but reads every byte, minutes for big remuxes.
+	// Changing it gives new shas to every video, their metadata is extracted again.
+	MediaSha string
+	// Where metadata files are stored, local (the metadata dir) or s3 (the metadata dir is used as a cache).
+	MetadataStore string
+	S3            S3T
+	RoutePrefix   string
+	// ffmpeg and ffprobe binaries, looked up in the PATH unless they are paths. Checked at startup by CheckFfmpeg.
+	FfmpegPath  string
+	FfprobePath string
 	HwAccel     HwAccelT
+	// Color the sprites are filled with before thumbnails are drawn. Cells after the last thumbnail use it
+	// for formats without transparency (jpg), they are transparent for others.
+	SpriteBackground color.NRGBA
+	// Placement of the tiles in sprites, "row" (row-major) or "column" (column-major). Sprites and cues always
+	// use the same order.
+	SpriteOrder string
+	// Name of the sprites, vtts and json cues (without extension, sprite.webp and sprite.vtt by default) and
+	// of the sprite routes the cues point to. Thumbnails extracted with another name are extracted again.
+	SpriteBaseName string
+	// Format of the thumbnails sprite, one of ThumbnailFormats.
+	ThumbnailFormat string
+	// Quality (1-100) of the jpeg and webp thumbnails.
+	ThumbnailQuality int
+	// Chroma subsampling of jpeg thumbnails, "420" (the smallest), "422" or "444" (sharp colored edges for
+	// slideshows or anime, bigger files). Lossy webp is always 4:2:0.
+	ThumbnailChromaSubsampling string
+	// Sigma of the sharpening applied to thumbnails of SD videos (which look soft once scaled), 0 disables it.
+	ThumbnailSharpen float64
+	// Filter of the resizes done by the transcoder: smaller sheets, cropped frames, posters and image
+	// sequences. One of lanczos (the default), catmullrom, linear, box or nearest (which aliases), see
+	// BenchmarkResizeFilter for their cost. Frames of the main sheet are scaled by their decoder (screengen
+	// or ffmpeg) which ignores this, it doesn't speed up extractions with a single sheet.
+	ThumbnailResizeFilter imaging.ResampleFilter
+	// Maximum width/height of a sprite, bigger sheets are split in multiple files.
+	MaxSpriteDimension int
+	// Pixels of background (or transparency) between the tiles of sprites, some players bleed adjacent tiles
+	// when scaling them. Sheets with a scale get a proportional gap.
+	TileGap int
+	// Maximum size (in bytes) of a sprite file, bigger ones are saved again with a lower quality and then with
+	// less thumbnails. 0 disables the limit.
+	MaxSpriteBytes int64
+	// Maximum size (in bytes) of the metadata dir, the directories of the least recently served videos are
+	// removed (in the background) when it is bigger. 0 disables the limit.
+	MaxThumbnailCacheBytes int64
+	// Local directory videos of network filesystems (nfs, smb...) are copied to before extracting their
+	// thumbnails, seeks over the network are slow. Empty to always read them from the network. Only videos
+	// up to ScratchMaxBytes are copied. Leftovers are removed at startup, don't share it between instances.
+	LocalScratchDir string
+	ScratchMaxBytes int64
+	// Height of the thumbnails of the main sprite, the width keeps the aspect ratio of the video.
+	// 0 (GOCODER_THUMBNAIL_HEIGHT=auto) picks it from the resolution of each video.
+	ThumbnailHeight int
+	// Heights of the thumbnails sheets to generate (sprite-240 for 240px high thumbnails).
+	// Always contains ThumbnailHeight, the height of the main sprite.
+	ThumbnailHeights []int
+	// Scales of the thumbnails sheets to generate (2 for a sprite@2x for high-DPI screens).
+	// Always contains 1.
+	ThumbnailScales []int
+	// Maximum width of the thumbnails (before scaling), wider videos (2.39:1...) get a lower height instead
+	// so they keep their aspect ratio without very wide sheets. 0 for no limit.
+	MaxTileWidth int
+	// Thumbnails with a mean luminance (0-255) bellow this are considered black and
+	// the next seconds are tried instead. 0 disables the check.
+	ThumbnailBlackThreshold int
+	// Adjacent thumbnails with a mean difference (0-255) bellow this are merged in a single tile whose cue
+	// lasts for both, this shrinks sprites of low motion videos (lectures, slideshows...). 0 disables it.
+	ThumbnailDedupThreshold int
+	// Number of times a frame that could not be decoded is retried (a bit later) before being skipped.
+	ThumbnailRetries int
+	// Number of frames (half a second apart) compared for each thumbnail to keep the sharpest one, which avoids
+	// motion blurred frames. Each thumbnail costs this many decodes, 0 or 1 grabs a single frame.
+	ThumbnailSharpWindow int
+	// Niceness (1 to 19) of the threads grabbing frames, 0 to keep the transcoder's priority.
+	// Only supported on linux.
+	ThumbnailPriority int
+	// Maximum number of frames grabbed per second by an extraction, 0 for no limit.
+	ThumbnailMaxFps int
+	// Frame rate of image sequences (a folder of images or a frame%05d.jpg pattern), their duration is
+	// their number of images at this rate.
+	ImageSequenceFps int
+	// Number of generators grabbing frames of a video in parallel, some codecs (vc1...) decode badly when
+	// a lot of generators seek in the same file, CodecGenerators overrides it for them.
+	ThumbnailGenerators int
+	CodecGenerators     map[string]int
+	// Number of threads of each decoder of the ffmpeg generator, 0 lets ffmpeg pick. CodecDecodeThreads overrides
+	// it per codec, for decoders that produce garbled frames with frame threading for example. screengen opens
+	// its decoders without options, they always use ffmpeg's defaults.
+	DecodeThreads      int
+	CodecDecodeThreads map[string]int
+	// Decode the frames of thumbnails with the hardware decoder of HwAccel (frames are still scaled and
+	// converted on the cpu), for the ffmpeg generator. ffmpeg falls back to software decoding when the device
+	// can't decode the codec.
+	ThumbnailHwDecode bool
+	// Answer 202 (with a Retry-After) to thumbnails requests while they are extracted instead of waiting.
+	LazyThumbnails bool
+	// When disabled, nothing is extracted: every video gets the same placeholder sprite (a single tile of
+	// SpriteBackground) and vtt, so clients still get a valid response without any cpu cost.
+	ThumbnailsEnabled bool
+	// Maximum duration (in seconds) of an extraction before it is abandoned, 0 for no limit.
+	ThumbnailTimeout int
+	// Only extract thumbnails over the first seconds of longer videos (their ThumbnailMaxCaps thumbnails are
+	// spread over this span), for libraries whose players only scrub the start. 0 covers the whole video.
+	// Ranges (see ThumbnailOptions.End) and counts are not limited.
+	ThumbnailMaxSpanSeconds int
+	// Compute a blurhash of the video (returned with the thumbnails info) for placeholders.
+	ThumbnailBlurhash bool
+	// Write the cues of the vtts in a json (sprite.json) too, for players that can't read vtt.
+	EmitJsonThumbnails bool
+	// Write the size of the tiles and the layout of the sprite in a NOTE block at the top of the vtts.
+	// NOTE blocks are comments, players that don't read it are not affected.
+	VttIncludeGeometry bool
+	// Maximum number of thumbnails extractions running at the same time.
+	ThumbnailWorkers int
+	// We want to have a thumbnail every ${interval} seconds.
+	// Sprites already generated with the previous defaults are kept, clear the metadata to regenerate them.
+	ThumbnailInterval int
+	// Smallest interval (in seconds) callers can request (see ThumbnailOptions.Interval), smaller ones are raised
+	// to it. Short videos still get MinThumbnails thumbnails.
+	ThumbnailMinInterval int
+	// The maximim number of thumbnails per video.
+	// Setting this too high allows really long processing times.
+	ThumbnailMaxCaps int
+	// Maximum number of sets of overrides (density, height, format... see ThumbnailOptions) extracted per video,
+	// each of them gets its own directory. Extractions of other overrides fail with ErrTooManyVariants.
+	ThumbnailMaxVariants int
+	// Minimum number of thumbnails of short videos (a 25s clip would only get 2 thumbnails every 10s),
+	// their interval is reduced instead. ThumbnailMaxCaps still applies.
+	MinThumbnails int
+	// Skip the intro (studio logos...) of videos, thumbnails are spread after this offset (in seconds or in
+	// percents of the duration). Ranges and thumbnails at custom timestamps ignore it.
+	ThumbnailStartOffset StartOffset
+	// With ThumbnailStartOffset, the first cue starts at 0 so the skipped part shows the first thumbnail.
+	// Otherwise, it is not covered by the vtt.
+	ThumbnailCoverStart bool
+	// Number of frames of the animated previews.
+	PreviewFrames int
+	// Allow extracting gif previews, for legacy clients (gifs are heavy so this is disabled by default).
+	GifPreview bool
+	// Number of frames of the gif previews.
+	GifFrames int
+	// Height of the frames of the gif previews.
+	GifHeight int
+	// Seek to the exact frame of thumbnails instead of the nearest keyframe (which can be a few seconds off).
+	// This makes extractions a lot slower.
+	AccurateThumbnails bool
+	// Detect black bars baked in videos (with a few sampled frames) and crop them out of thumbnails.
+	CropThumbnails bool
+	// Without AccurateThumbnails, move thumbnails to the nearest keyframe so cues match their frame.
+	KeyframeThumbnails bool
+	// Spread thumbnails according to the activity of the video (more of them in action scenes) instead of
+	// evenly. Frames are sampled before the extraction so this makes it slower.
+	AdaptiveThumbnails bool
+	// Save the frames of extractions while they are grabbed (in a .partial directory next to the sprites) so
+	// an extraction interrupted by a crash or a restart only grabs the missing frames when it runs again.
+	// Every frame is then also encoded to png and written to disk, disabled by default since it costs more
+	// than regenerating the few extractions a crash interrupts.
+	ResumableThumbnails bool
+	// Deinterlace thumbnails of interlaced videos (combed otherwise): "auto" for videos detected as interlaced,
+	// "always" or "never". Deinterlaced frames are decoded by ffmpeg, a lot slower than screengen.
+	DeinterlaceThumbnails string
+	// Tonemap thumbnails of hdr videos to sdr, without this they look washed out. This costs some cpu.
+	TonemapThumbnails bool
+	// Called on every tile of the sprites (with its time in seconds) before it is drawn, to overlay a timecode
+	// or a watermark for example. Tiles are resized back if the returned image has another size.
+	// nil (the default) keeps tiles as they are. There is no env var, it can only be set by programs
+	// embedding the package.
+	TileTransform func(img image.Image, ts float64) image.Image
+}
+
+type S3T struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// Redirect clients to presigned urls of the sprites valid for this many seconds instead of streaming them
+	// through the transcoder, 0 to always stream them. The bucket must allow cross-origin requests.
+	PresignExpiry int
 }
 
 type HwAccelT struct {
@@ -25,8 +296,94 @@ type HwAccelT struct {
 }
 
 var Settings = SettingsT{
-	Outpath:     GetEnvOr("GOCODER_CACHE_ROOT", "/cache"),
-	Metadata:    GetEnvOr("GOCODER_METADATA_ROOT", "/metadata"),
-	RoutePrefix: GetEnvOr("GOCODER_PREFIX", ""),
-	HwAccel:     DetectHardwareAccel(),
+	LogFormat:          GetEnvOr("GOCODER_LOG_FORMAT", "text"),
+	Outpath:            GetEnvOr("GOCODER_CACHE_ROOT", "/cache"),
+	Metadata:           GetEnvOr("GOCODER_METADATA_ROOT", "/metadata"),
+	MetadataDirMode:    getFileModeEnvOr("GOCODER_METADATA_DIR_MODE", 0o755),
+	MetadataFileMode:   getFileModeEnvOr("GOCODER_METADATA_FILE_MODE", 0o644),
+	MetadataShardDepth: GetEnvIntOr("GOCODER_METADATA_SHARD_DEPTH", 0),
+	MediaSha:           getMediaShaMode(),
+	MetadataStore:      GetEnvOr("GOCODER_METADATA_STORE", "local"),
+	S3: S3T{
+		Endpoint:      GetEnvOr("GOCODER_S3_ENDPOINT", ""),
+		Bucket:        GetEnvOr("GOCODER_S3_BUCKET", ""),
+		Region:        GetEnvOr("GOCODER_S3_REGION", ""),
+		AccessKey:     GetEnvOr("GOCODER_S3_ACCESS_KEY", ""),
+		SecretKey:     GetEnvOr("GOCODER_S3_SECRET_KEY", ""),
+		UseSSL:        GetEnvBoolOr("GOCODER_S3_USE_SSL", true),
+		PresignExpiry: GetEnvIntOr("GOCODER_S3_PRESIGN_EXPIRY", 0),
+	},
+	RoutePrefix:      GetEnvOr("GOCODER_PREFIX", ""),
+	FfmpegPath:       GetEnvOr("GOCODER_FFMPEG_PATH", "ffmpeg"),
+	FfprobePath:      GetEnvOr("GOCODER_FFPROBE_PATH", getDefaultFfprobePath()),
+	HwAccel:          DetectHardwareAccel(),
+	ThumbnailFormat:  getThumbnailFormat(),
+	SpriteBackground: getSpriteBackground(),
+	SpriteOrder:      getSpriteOrder(),
+	SpriteBaseName:   getSpriteBaseName(),
+	ThumbnailQuality: getThumbnailQuality(),
+	ThumbnailSharpen: getThumbnailSharpen(),
+	// only used for jpeg thumbnails.
+	ThumbnailChromaSubsampling: getChromaSubsampling(),
+	// webp images can't be bigger than 16383px.
+	MaxSpriteDimension:      getPositiveEnvOr("GOCODER_MAX_SPRITE_DIMENSION", 16383),
+	TileGap:                 getTileGap(),
+	MaxSpriteBytes:          int64(GetEnvIntOr("GOCODER_MAX_SPRITE_BYTES", 0)),
+	MaxThumbnailCacheBytes:  int64(GetEnvIntOr("GOCODER_MAX_THUMBNAIL_CACHE_BYTES", 0)),
+	LocalScratchDir:         GetEnvOr("GOCODER_SCRATCH_DIR", ""),
+	ScratchMaxBytes:         int64(GetEnvIntOr("GOCODER_SCRATCH_MAX_BYTES", 4<<30)),
+	ThumbnailHeight:         thumbnail_height,
+	ThumbnailHeights:        getThumbnailHeights(),
+	ThumbnailScales:         getThumbnailScales(),
+	MaxTileWidth:            GetEnvIntOr("GOCODER_MAX_TILE_WIDTH", 0),
+	ThumbnailBlackThreshold: GetEnvIntOr("GOCODER_THUMBNAIL_BLACK_THRESHOLD", 10),
+	ThumbnailDedupThreshold: GetEnvIntOr("GOCODER_THUMBNAIL_DEDUP_THRESHOLD", 0),
+	ThumbnailRetries:        GetEnvIntOr("GOCODER_THUMBNAIL_RETRIES", 2),
+	ThumbnailSharpWindow:    GetEnvIntOr("GOCODER_THUMBNAIL_SHARP_WINDOW", 0),
+	ThumbnailResizeFilter:   getThumbnailResizeFilter(),
+	ThumbnailPriority:       GetEnvIntOr("GOCODER_THUMBNAIL_PRIORITY", 0),
+	ThumbnailMaxFps:         GetEnvIntOr("GOCODER_THUMBNAIL_MAX_FPS", 0),
+	ImageSequenceFps:        getPositiveEnvOr("GOCODER_IMAGE_SEQUENCE_FPS", 24),
+	ThumbnailGenerators:     getPositiveEnvOr("GOCODER_THUMBNAIL_GENERATORS", 4),
+	CodecGenerators:         getCodecCounts("GOCODER_THUMBNAIL_CODEC_GENERATORS"),
+	DecodeThreads:           GetEnvIntOr("GOCODER_THUMBNAIL_DECODE_THREADS", 0),
+	CodecDecodeThreads:      getCodecCounts("GOCODER_THUMBNAIL_CODEC_THREADS"),
+	ThumbnailHwDecode:       GetEnvBoolOr("GOCODER_THUMBNAIL_HWDECODE", false),
+	LazyThumbnails:          GetEnvBoolOr("GOCODER_LAZY_THUMBNAILS", false),
+	ThumbnailsEnabled:       GetEnvBoolOr("GOCODER_THUMBNAILS_ENABLED", true),
+	ThumbnailTimeout:        GetEnvIntOr("GOCODER_THUMBNAIL_TIMEOUT", 3600),
+	ThumbnailMaxSpanSeconds: GetEnvIntOr("GOCODER_THUMBNAIL_MAX_SPAN", 0),
+	ThumbnailBlurhash:       GetEnvBoolOr("GOCODER_THUMBNAIL_BLURHASH", true),
+	EmitJsonThumbnails:      GetEnvBoolOr("GOCODER_THUMBNAIL_JSON", false),
+	VttIncludeGeometry:      GetEnvBoolOr("GOCODER_VTT_GEOMETRY", false),
+	ThumbnailWorkers:        getPositiveEnvOr("GOCODER_THUMBNAIL_WORKERS", runtime.NumCPU()),
+	ThumbnailInterval:       getPositiveEnvOr("GOCODER_THUMBNAIL_INTERVAL", 10),
+	ThumbnailMinInterval:    getPositiveEnvOr("GOCODER_THUMBNAIL_MIN_INTERVAL", 1),
+	ThumbnailMaxCaps:        getPositiveEnvOr("GOCODER_THUMBNAIL_MAX_CAPS", 150),
+	ThumbnailMaxVariants:    getPositiveEnvOr("GOCODER_THUMBNAIL_MAX_VARIANTS", 16),
+	MinThumbnails:           getPositiveEnvOr("GOCODER_THUMBNAIL_MIN_CAPS", 5),
+	ThumbnailStartOffset:    getThumbnailStartOffset(),
+	ThumbnailCoverStart:     GetEnvBoolOr("GOCODER_THUMBNAIL_COVER_START", true),
+	PreviewFrames:           getPositiveEnvOr("GOCODER_PREVIEW_FRAMES", 20),
+	GifPreview:              GetEnvBoolOr("GOCODER_GIF_PREVIEW", false),
+	GifFrames:               getPositiveEnvOr("GOCODER_GIF_FRAMES", 10),
+	GifHeight:               getPositiveEnvOr("GOCODER_GIF_HEIGHT", 120),
+	AccurateThumbnails:      GetEnvBoolOr("GOCODER_ACCURATE_THUMBNAILS", false),
+	CropThumbnails:          GetEnvBoolOr("GOCODER_CROP_THUMBNAILS", false),
+	KeyframeThumbnails:      GetEnvBoolOr("GOCODER_KEYFRAME_THUMBNAILS", true),
+	AdaptiveThumbnails:      GetEnvBoolOr("GOCODER_ADAPTIVE_THUMBNAILS", false),
+	ResumableThumbnails:     GetEnvBoolOr("GOCODER_RESUMABLE_THUMBNAILS", false),
+	DeinterlaceThumbnails:   getDeinterlaceMode(),
+	TonemapThumbnails:       GetEnvBoolOr("GOCODER_THUMBNAIL_TONEMAP", false),
+}
+
+// Use structured json logs if requested, the text format keeps the default logger.
+func SetupLogger() {
+	switch Settings.LogFormat {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	case "text":
+	default:
+		slog.Warn("Invalid log format, using text", "format", Settings.LogFormat)
+	}
 }
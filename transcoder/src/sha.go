@@ -0,0 +1,67 @@
+package src
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Encode the version in the sha to update cached values.
+// Older versions won't be deleted (needed to allow multiples versions of the transcoder to run at the same time)
+// If the version changes a lot, we might want to automatically delete older versions.
+var sha_version = "v2-"
+
+// Number of bytes read at the start and at the end of files for "sample" shas.
+var sha_sample_size int64 = 1 << 20
+
+// How ComputeMediaSha identifies files, see Settings.MediaSha.
+func getMediaShaMode() string {
+	mode := GetEnvOr("GOCODER_MEDIA_SHA", "path")
+	if mode != "path" && mode != "sample" && mode != "full" {
+		slog.Warn("Invalid media sha mode, falling back to path", "mode", mode)
+		return "path"
+	}
+	return mode
+}
+
+// Compute the sha identifying the metadata (thumbnails, subtitles...) of a video, callers of
+// ExtractThumbnail and co should use it so every part of kyoo uses the same keys. See Settings.MediaSha
+// for the tradeoffs of each mode. Shas of different modes never collide.
+func ComputeMediaSha(path string) (string, error) {
+	if isImageSequence(path) {
+		return getImageSequenceSha(path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	switch Settings.MediaSha {
+	case "sample", "full":
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		binary.Write(h, binary.LittleEndian, info.Size())
+		if Settings.MediaSha == "full" || info.Size() <= 2*sha_sample_size {
+			_, err = io.Copy(h, file)
+		} else {
+			_, err = io.Copy(h, io.NewSectionReader(file, 0, sha_sample_size))
+			if err == nil {
+				_, err = io.Copy(h, io.NewSectionReader(file, info.Size()-sha_sample_size, sha_sample_size))
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		return sha_version + Settings.MediaSha + "-" + hex.EncodeToString(h.Sum(nil)), nil
+	default:
+		h.Write([]byte(path))
+		h.Write([]byte(info.ModTime().String()))
+		return sha_version + hex.EncodeToString(h.Sum(nil)), nil
+	}
+}
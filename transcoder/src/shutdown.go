@@ -0,0 +1,51 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrShuttingDown = errors.New("the transcoder is shutting down")
+
+// Extractions running in the background, tracked to let them finish writing their files on shutdown.
+var jobs struct {
+	lock   sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Register a new background extraction, false means we are shutting down and it should not start.
+// Call endJob once the extraction is done.
+func startJob() bool {
+	jobs.lock.Lock()
+	defer jobs.lock.Unlock()
+	if jobs.closed {
+		return false
+	}
+	jobs.wg.Add(1)
+	return true
+}
+
+func endJob() {
+	jobs.wg.Done()
+}
+
+// Stop accepting new extractions and wait for running ones to finish, or for ctx to be done.
+func Shutdown(ctx context.Context) error {
+	jobs.lock.Lock()
+	jobs.closed = true
+	jobs.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		jobs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
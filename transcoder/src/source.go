@@ -0,0 +1,58 @@
+package src
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Identify the content of a video without reading it. Files replaced in place ("upgrade to a better rip"
+// workflows keep the path) have another size or modification time, cached probes and thumbnails of the
+// old file are then discarded.
+type FileSource struct {
+	/// The size of the video in bytes.
+	Size int64 `json:"size"`
+	/// The modification time of the video (unix time in nanoseconds).
+	ModTime int64 `json:"modTime"`
+}
+
+// The source of the video at path, nil when it can't be stat (remote files...).
+// The path is not stored: thumbnails.json is served to clients and should not leak the server's file tree.
+func getFileSource(path string) *FileSource {
+	if IsRemotePath(path) {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	return &FileSource{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+}
+
+// Check if data extracted from s can be used for other. Unknown sources always match, data extracted
+// before sources were recorded would be extracted again otherwise.
+func (s *FileSource) matches(other *FileSource) bool {
+	return s == nil || other == nil || *s == *other
+}
+
+// Check if the file at path changed since it was probed or since its thumbnails (with the default options)
+// were extracted with this sha. This only costs a stat and reading the saved infos, the scanner can use it to
+// log files that will be probed and extracted again.
+func HasFileChanged(path string, sha string) bool {
+	source := getFileSource(path)
+	var info MediaInfo
+	if err := getSavedInfo(getMediaInfoPath(sha), &info); err == nil && !info.Source.matches(source) {
+		return true
+	}
+	return !getSavedSource(getThumbnailPath(sha, "")).matches(source)
+}
+
+// Forget what was probed from the old version of a file replaced in place (the caller handles the entry of infos).
+// Thumbnails check their own source, see startThumbnailExtraction.
+func invalidateProbes(path string, sha string) {
+	slog.Warn("File changed since it was probed, probing it again", "path", path, "sha", sha)
+	keyframes.Remove(sha)
+	for _, name := range []string{"info.json", "keyframes.json", "frames.json"} {
+		metadata_store.RemoveAll(fmt.Sprintf("%s/%s", GetMetadataPath(sha), name))
+	}
+}
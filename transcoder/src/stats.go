@@ -0,0 +1,165 @@
+package src
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of durations kept per kind of extraction to compute the averages and percentiles.
+var stats_window = 1000
+
+var stats = struct {
+	lock  sync.Mutex
+	total map[string]int
+	// Durations of the most recent extractions of each kind, used as a ring buffer.
+	durations map[string][]time.Duration
+	next      map[string]int
+	// Time taken per thumbnail by the most recent sprite extractions, used as a ring buffer.
+	frames     []time.Duration
+	next_frame int
+}{
+	total:     make(map[string]int),
+	durations: make(map[string][]time.Duration),
+	next:      make(map[string]int),
+}
+
+type Stats struct {
+	/// Stats of each kind of extraction (sprite, bif, preview...).
+	Kinds map[string]KindStats `json:"kinds"`
+	/// The number of extractions running or waiting for a worker.
+	Pending int `json:"pending"`
+	/// The number of extractions (running or done) kept in memory.
+	Cached int `json:"cached"`
+	/// The size (in bytes) of the metadata dir when it was last measured, 0 when
+	/// GOCODER_MAX_THUMBNAIL_CACHE_BYTES is not set.
+	CacheBytes int64 `json:"cacheBytes"`
+	/// The most requested shas since the transcoder started (the thumbnails of every option of a sha are counted
+	/// together), the most requested first.
+	Hottest []ShaHits `json:"hottest"`
+	/// The progress of the running (or last) regeneration of the library, null if none was started.
+	Regeneration *LibraryRegeneration `json:"regeneration"`
+}
+
+type ShaHits struct {
+	/// The sha of the video.
+	Sha string `json:"sha"`
+	/// The number of thumbnails requests (extractions and sprites served) of the sha.
+	Hits int64 `json:"hits"`
+}
+
+// Number of shas listed in Stats.Hottest.
+var stats_hottest = 10
+
+type KindStats struct {
+	/// The number of extractions since the transcoder started.
+	Total int `json:"total"`
+	/// Durations (in seconds) of the last extractions, excluding the time waiting for a worker.
+	Average float64 `json:"average"`
+	P50     float64 `json:"p50"`
+	P95     float64 `json:"p95"`
+	Max     float64 `json:"max"`
+}
+
+func recordExtraction(kind string, duration time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.total[kind]++
+	if len(stats.durations[kind]) < stats_window {
+		stats.durations[kind] = append(stats.durations[kind], duration)
+		return
+	}
+	stats.durations[kind][stats.next[kind]] = duration
+	stats.next[kind] = (stats.next[kind] + 1) % stats_window
+}
+
+// Record the time an extraction of numcaps thumbnails took, averaged per thumbnail for getFrameDuration.
+func recordFrameDuration(duration time.Duration, numcaps int) {
+	if numcaps <= 0 {
+		return
+	}
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	per_frame := duration / time.Duration(numcaps)
+	if len(stats.frames) < stats_window {
+		stats.frames = append(stats.frames, per_frame)
+		return
+	}
+	stats.frames[stats.next_frame] = per_frame
+	stats.next_frame = (stats.next_frame + 1) % stats_window
+}
+
+// Rolling average of the time taken per thumbnail by the last extractions. ok is false until one finished.
+func getFrameDuration() (time.Duration, bool) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if len(stats.frames) == 0 {
+		return 0, false
+	}
+	var sum time.Duration
+	for _, frame := range stats.frames {
+		sum += frame
+	}
+	return sum / time.Duration(len(stats.frames)), true
+}
+
+// Number of requests of the thumbnails of each sha kept in memory, entries removed from the cache
+// (invalidated, failed or evicted) lose their count.
+func getThumbnailHits() map[string]int64 {
+	ret := make(map[string]int64)
+	thumbnails.ForEach(func(key string, t *Thumbnail) {
+		sha, _, _ := strings.Cut(key, "/")
+		if hits := t.hits.Load(); hits > 0 {
+			ret[sha] += hits
+		}
+	})
+	return ret
+}
+
+// Aggregate timings of extractions and the state of the cache, prometheus metrics (see /metrics)
+// contain the same data for long term monitoring.
+func ThumbnailStats() Stats {
+	ret := Stats{
+		Kinds: make(map[string]KindStats),
+		Pending: thumbnails.Count(func(_ string, t *Thumbnail) bool {
+			return !t.finished.Load()
+		}) + posters.Count(func(_ string, t *Thumbnail) bool {
+			return !t.finished.Load()
+		}),
+		Cached: thumbnails.Count(func(string, *Thumbnail) bool { return true }) +
+			posters.Count(func(string, *Thumbnail) bool { return true }),
+		CacheBytes:   metadata_usage.Load(),
+		Regeneration: getLibraryRegeneration(),
+	}
+	for sha, hits := range getThumbnailHits() {
+		ret.Hottest = append(ret.Hottest, ShaHits{Sha: sha, Hits: hits})
+	}
+	slices.SortFunc(ret.Hottest, func(a, b ShaHits) int { return cmp.Or(cmp.Compare(b.Hits, a.Hits), cmp.Compare(a.Sha, b.Sha)) })
+	ret.Hottest = ret.Hottest[:min(len(ret.Hottest), stats_hottest)]
+
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	for kind, total := range stats.total {
+		durations := slices.Clone(stats.durations[kind])
+		slices.Sort(durations)
+		var sum time.Duration
+		for _, duration := range durations {
+			sum += duration
+		}
+		percentile := func(p float64) float64 {
+			return durations[int(p*float64(len(durations)-1))].Seconds()
+		}
+		ret.Kinds[kind] = KindStats{
+			Total:   total,
+			Average: (sum / time.Duration(len(durations))).Seconds(),
+			P50:     percentile(0.5),
+			P95:     percentile(0.95),
+			Max:     durations[len(durations)-1].Seconds(),
+		}
+	}
+	return ret
+}
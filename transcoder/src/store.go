@@ -0,0 +1,128 @@
+package src
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Storage of the files of the metadata dir. Files are always generated in the local metadata dir
+// (ffmpeg and sprites need real files), Save then publishes them to the store once they are complete.
+// Paths are local paths in Settings.Metadata.
+// Extractions check the store before generating anything, a store shared by multiple transcoders (s3 or one
+// given to SetMetadataStore) works as a read-through cache: sprites generated by a node are served by the others.
+type MetadataStore interface {
+	// Check if a complete file exists.
+	Exists(path string) bool
+	// Open a file for reading.
+	Open(path string) (io.ReadCloser, error)
+	// Get the size and the modification time of a complete file.
+	Stat(path string) (MetadataFileInfo, error)
+	// Publish a file written in the local metadata dir.
+	Save(path string) error
+	// Remove a file, its local copy and its published one. Missing files are not errors.
+	Remove(path string) error
+	// Remove a file or a directory and everything it contains.
+	RemoveAll(path string) error
+}
+
+type MetadataFileInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Stores that can give clients a temporary url to download a file from, instead of streaming it through the
+// transcoder (see GetMetadataURL).
+type MetadataLinker interface {
+	// The url of a complete file, ok is false if it can't be downloaded directly.
+	URL(path string) (url string, ok bool)
+}
+
+var metadata_store = newMetadataStore()
+
+func newMetadataStore() MetadataStore {
+	switch Settings.MetadataStore {
+	case "local":
+		return localStore{}
+	case "s3":
+		store, err := newS3Store()
+		if err != nil {
+			slog.Error("Could not create the s3 metadata store, using the local metadata dir", "err", err)
+			return localStore{}
+		}
+		return store
+	default:
+		slog.Warn("Invalid metadata store, using the local metadata dir", "store", Settings.MetadataStore)
+		return localStore{}
+	}
+}
+
+// Use a custom store (redis, another object storage...) instead of Settings.MetadataStore. Like
+// RegisterThumbnailEncoder, call it from main before the server starts.
+func SetMetadataStore(store MetadataStore) {
+	metadata_store = store
+}
+
+// Write metadata files to dir instead of Settings.Metadata and Settings.MetadataStore, for the cli.
+func UseLocalMetadata(dir string) {
+	Settings.Metadata = dir
+	metadata_store = localStore{}
+}
+
+// Open a file of the metadata dir, the local copy is used if there is one.
+func OpenMetadata(path string) (io.ReadCloser, error) {
+	return metadata_store.Open(path)
+}
+
+// Get the size and the modification time of a file of the metadata dir, the local copy is used if there is one.
+func StatMetadata(path string) (MetadataFileInfo, error) {
+	return metadata_store.Stat(path)
+}
+
+// A url clients can download a file of the metadata dir from directly, ok is false if the store is not a
+// MetadataLinker (or can't link this file), the file must then be served through OpenMetadata.
+func GetMetadataURL(path string) (string, bool) {
+	linker, ok := metadata_store.(MetadataLinker)
+	if !ok {
+		return "", false
+	}
+	return linker.URL(path)
+}
+
+// Store files directly in the local metadata dir.
+type localStore struct{}
+
+func (localStore) Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (localStore) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (localStore) Stat(path string) (MetadataFileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return MetadataFileInfo{}, err
+	}
+	return MetadataFileInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (localStore) Save(string) error {
+	return nil
+}
+
+func (localStore) Remove(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (localStore) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
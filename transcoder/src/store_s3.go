@@ -0,0 +1,162 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Store files in an s3 bucket so every transcoder of a cluster share them. The local
+// metadata dir is kept as a cache, files are only downloaded when they are not there.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3Store() (*s3Store, error) {
+	if Settings.S3.Endpoint == "" || Settings.S3.Bucket == "" {
+		return nil, errors.New("GOCODER_S3_ENDPOINT and GOCODER_S3_BUCKET are required")
+	}
+	client, err := minio.New(Settings.S3.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(Settings.S3.AccessKey, Settings.S3.SecretKey, ""),
+		Secure: Settings.S3.UseSSL,
+		Region: Settings.S3.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{client: client, bucket: Settings.S3.Bucket}, nil
+}
+
+// Name of the object of a local path, paths are relative to the metadata dir.
+func (s *s3Store) key(path string) (string, error) {
+	rel, err := filepath.Rel(Settings.Metadata, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is not in the metadata dir", path)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (s *s3Store) Exists(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	key, err := s.key(path)
+	if err != nil {
+		return false
+	}
+	_, err = s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	return err == nil
+}
+
+func (s *s3Store) Open(path string) (io.ReadCloser, error) {
+	if file, err := os.Open(path); err == nil {
+		return file, nil
+	}
+	key, err := s.key(path)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, stat to return missing objects as errors now.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *s3Store) Stat(path string) (MetadataFileInfo, error) {
+	if info, err := os.Stat(path); err == nil {
+		return MetadataFileInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+	}
+	key, err := s.key(path)
+	if err != nil {
+		return MetadataFileInfo{}, err
+	}
+	info, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return MetadataFileInfo{}, err
+	}
+	return MetadataFileInfo{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+// Presigned urls of the objects when Settings.S3.PresignExpiry is set. Files that were not published yet (or
+// that are outside of the metadata dir) are not linked.
+func (s *s3Store) URL(path string) (string, bool) {
+	if Settings.S3.PresignExpiry <= 0 {
+		return "", false
+	}
+	key, err := s.key(path)
+	if err != nil {
+		return "", false
+	}
+	ctx := context.Background()
+	if _, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{}); err != nil {
+		return "", false
+	}
+	ret, err := s.client.PresignedGetObject(ctx, s.bucket, key, time.Duration(Settings.S3.PresignExpiry)*time.Second, url.Values{})
+	if err != nil {
+		return "", false
+	}
+	return ret.String(), true
+}
+
+func (s *s3Store) Save(path string) error {
+	key, err := s.key(path)
+	if err != nil {
+		// files written outside of the metadata dir (see ThumbnailOptions.Out) stay local.
+		return nil
+	}
+	_, err = s.client.FPutObject(context.Background(), s.bucket, key, path, minio.PutObjectOptions{})
+	return err
+}
+
+func (s *s3Store) Remove(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	key, err := s.key(path)
+	if err != nil {
+		return nil
+	}
+	// removing a missing object is not an error.
+	return s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Store) RemoveAll(path string) error {
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	key, err := s.key(path)
+	if err != nil {
+		return nil
+	}
+	ctx := context.Background()
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: key + "/", Recursive: true})
+	var ret error
+	// the channel has to be drained for the deletion to finish.
+	for err := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if ret == nil {
+			ret = err.Err
+		}
+	}
+	if ret != nil {
+		return ret
+	}
+	// path can also be a single file.
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,178 @@
+package src
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A store shared with other transcoders: published files stay available when the local metadata dir loses them.
+type remoteStore struct {
+	localStore
+	lock    sync.Mutex
+	objects map[string][]byte
+	// Every saved file, in order.
+	saves []string
+	// Saving this file fails.
+	fail string
+}
+
+func useRemoteStore(t *testing.T) *remoteStore {
+	t.Helper()
+	old := metadata_store
+	t.Cleanup(func() { metadata_store = old })
+	ret := &remoteStore{objects: map[string][]byte{}}
+	SetMetadataStore(ret)
+	return ret
+}
+
+func (s *remoteStore) Exists(path string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.objects[path]
+	return ok || s.localStore.Exists(path)
+}
+
+func (s *remoteStore) Open(path string) (io.ReadCloser, error) {
+	if file, err := os.Open(path); err == nil {
+		return file, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	content, ok := s.objects[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (s *remoteStore) Stat(path string) (MetadataFileInfo, error) {
+	if info, err := s.localStore.Stat(path); err == nil {
+		return info, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	content, ok := s.objects[path]
+	if !ok {
+		return MetadataFileInfo{}, os.ErrNotExist
+	}
+	return MetadataFileInfo{Size: int64(len(content))}, nil
+}
+
+func (s *remoteStore) Save(path string) error {
+	if path == s.fail {
+		return errors.New("upload failed")
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects[path] = content
+	s.saves = append(s.saves, path)
+	return nil
+}
+
+func (s *remoteStore) Remove(path string) error {
+	s.lock.Lock()
+	delete(s.objects, path)
+	s.lock.Unlock()
+	return s.localStore.Remove(path)
+}
+
+func (s *remoteStore) RemoveAll(path string) error {
+	s.lock.Lock()
+	for key := range s.objects {
+		if key == path || strings.HasPrefix(key, path+"/") {
+			delete(s.objects, key)
+		}
+	}
+	s.lock.Unlock()
+	return s.localStore.RemoveAll(path)
+}
+
+// Published sprites, checksums, vtts and layouts of out.
+func (s *remoteStore) sheets(out string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var ret []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, out+"/") && (strings.HasSuffix(key, ".vtt") || strings.Contains(key, "/"+Settings.SpriteBaseName) || key == getThumbnailInfoPath(out)) {
+			ret = append(ret, key)
+		}
+	}
+	return ret
+}
+
+func TestRemoveSheetsFromStore(t *testing.T) {
+	useSolidSource(t, 600, 1280, 720)
+	// more than one page.
+	Settings.MaxSpriteDimension = 1024
+	store := useRemoteStore(t)
+	out, err := ExtractThumbnail("/remote.mkv", "remote-sheets", ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 1); !ok {
+		t.Fatal("the sheet has a single page")
+	}
+	// only the store has the sprites, like on another transcoder.
+	removeLocal := func() {
+		for _, file := range store.sheets(out) {
+			os.Remove(file)
+		}
+	}
+	removeLocal()
+	if _, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0); !ok {
+		t.Fatal("the published sprite was not found")
+	}
+	Settings.ThumbnailFormat = "jpeg"
+	if !hasStaleSprites(out, "jpeg") {
+		t.Error("published sprites of another format are not stale")
+	}
+	Settings.ThumbnailFormat = "png"
+
+	discardThumbnails(out)
+	if files := store.sheets(out); len(files) != 0 {
+		t.Errorf("discarded sheets are still published: %v", files)
+	}
+	if _, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0); ok {
+		t.Error("a discarded sprite is still served")
+	}
+}
+
+func TestFailedUploadRollsBack(t *testing.T) {
+	useSolidSource(t, 600, 1280, 720)
+	store := useRemoteStore(t)
+	sha := "remote-rollback"
+	out := getThumbnailPath(sha, "")
+	store.fail = GetVttPath(out, DefaultSheetSize())
+	if _, err := ExtractThumbnail("/remote.mkv", sha, ThumbnailOptions{}); err == nil {
+		t.Fatal("the extraction succeeded without publishing its vtt")
+	}
+	if files := store.sheets(out); len(files) != 0 {
+		t.Errorf("a failed upload left %v", files)
+	}
+
+	store.fail = ""
+	if _, err := ExtractThumbnail("/remote.mkv", sha, ThumbnailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// the vtts are published once their sprites are.
+	last_sprite, first_vtt := -1, len(store.saves)
+	for i, file := range store.saves {
+		if strings.HasSuffix(file, ".vtt") {
+			first_vtt = min(first_vtt, i)
+		} else if strings.HasSuffix(file, ".png") {
+			last_sprite = i
+		}
+	}
+	if last_sprite == -1 || last_sprite > first_vtt {
+		t.Errorf("a vtt was published before its sprites: %v", store.saves)
+	}
+}
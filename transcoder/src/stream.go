@@ -263,7 +263,7 @@ func (ts *Stream) run(start int32) error {
 		outpath,
 	)
 
-	cmd := exec.Command("ffmpeg", args...)
+	cmd := exec.Command(Settings.FfmpegPath, args...)
 	log.Printf("Running %s", strings.Join(cmd.Args, " "))
 
 	stdout, err := cmd.StdoutPipe()
@@ -0,0 +1,176 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalidSubtitle     = errors.New("invalid subtitle index")
+	ErrUnsupportedSubtitle = errors.New("image subtitles can't be converted to vtt")
+)
+
+// Subtitles codecs (as returned by getSubtitleCodec) that are stored as images and can't be converted to text.
+var image_subtitles = []string{"pgs", "vobsub", "dvb subtitle", "dvd subtitle"}
+
+// Muxers of the extensions of image subtitles (see SubtitleExtensions), they are extracted as is.
+var subtitle_muxers = map[string]string{
+	"sup": "sup",
+	"mks": "matroska",
+}
+
+// The codec of a subtitle stream from the format mediainfo reports (UTF-8, ASS, PGS, VobSub...).
+func getSubtitleCodec(format string) string {
+	ret := strings.ToLower(strings.TrimSpace(format))
+	if ret == "utf-8" {
+		return "subrip"
+	}
+	return ret
+}
+
+func isImageSubtitle(codec string) bool {
+	return slices.Contains(image_subtitles, getSubtitleCodec(codec))
+}
+
+type subtitleExtraction struct {
+	ready sync.WaitGroup
+	err   error
+}
+
+// Subtitles extracted (or being extracted) by ExtractSubtitles, by sha.
+var subtitles = NewCMap[string, *subtitleExtraction]()
+
+func getSubtitlesPath(sha string) string {
+	return fmt.Sprintf("%s/subs", GetMetadataPath(sha))
+}
+
+// The file of a subtitle stream extracted by ExtractSubtitles: text subtitles are converted to vtt and
+// image ones are kept as is, ok is false for image subtitles that can't be extracted.
+func getSubtitlePath(sha string, sub Subtitle) (path string, ok bool) {
+	if !isImageSubtitle(sub.Codec) {
+		return fmt.Sprintf("%s/%d.vtt", getSubtitlesPath(sha), sub.Index), true
+	}
+	if sub.Extension == nil || subtitle_muxers[*sub.Extension] == "" {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%d.%s", getSubtitlesPath(sha), sub.Index, *sub.Extension), true
+}
+
+// Extract every subtitle stream of a video in GetMetadataPath(sha)/subs. Text subtitles are converted to vtt,
+// which every browser can display: ass styling is dropped (except bold, italic and underline) but timings
+// are kept. Image subtitles are extracted as is, they must be burnt in (see Subtitle.IsImage).
+// Streams are extracted once, concurrent calls wait for the same extraction.
+func ExtractSubtitles(path string, sha string) error {
+	info, err := ProbeMedia(path, sha)
+	if err != nil {
+		return err
+	}
+	ret, created := subtitles.GetOrCreate(sha, func() *subtitleExtraction {
+		ret := &subtitleExtraction{}
+		if !startJob() {
+			ret.err = ErrShuttingDown
+			return ret
+		}
+		ret.ready.Add(1)
+		go func() {
+			defer endJob()
+			defer ret.ready.Done()
+			ret.err = extractSubtitles(path, sha, info.Subtitles)
+			if ret.err != nil {
+				slog.Error("Could not extract subtitles", "path", path, "sha", sha, "err", ret.err)
+				extraction_failures.WithLabelValues("subtitle").Inc()
+				// a retry (or an invalidation) may have replaced this extraction already.
+				subtitles.RemoveFunc(func(_ string, val *subtitleExtraction) bool { return val == ret })
+			}
+		}()
+		return ret
+	})
+	observeCache("subtitle", created)
+	ret.ready.Wait()
+	return ret.err
+}
+
+// Get the vtt of an embedded text subtitle track, see ExtractSubtitles.
+func ExtractSubtitle(path string, sha string, stream_index int) (string, error) {
+	info, err := ProbeMedia(path, sha)
+	if err != nil {
+		return "", err
+	}
+	if stream_index < 0 || stream_index >= len(info.Subtitles) {
+		return "", fmt.Errorf("%w: %d, the file has %d subtitles", ErrInvalidSubtitle, stream_index, len(info.Subtitles))
+	}
+	sub := info.Subtitles[stream_index]
+	if isImageSubtitle(sub.Codec) {
+		return "", fmt.Errorf("%w: subtitle %d is %s", ErrUnsupportedSubtitle, stream_index, sub.Codec)
+	}
+	if err := ExtractSubtitles(path, sha); err != nil {
+		return "", err
+	}
+	ret, _ := getSubtitlePath(sha, sub)
+	return ret, nil
+}
+
+// Extract the streams that are not in the store yet with a single ffmpeg, the file is only read once.
+func extractSubtitles(path string, sha string, subs []Subtitle) error {
+	defer printExecTime("extracting subtitles of %s", path)()
+	mkdirMetadata(getSubtitlesPath(sha))
+
+	cmd := exec.Command(
+		Settings.FfmpegPath,
+		"-nostats", "-hide_banner", "-loglevel", "warning",
+		"-i", path,
+	)
+	// the temporary file of every output, they are moved in place once ffmpeg succeeded.
+	tmps := map[string]string{}
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	for _, sub := range subs {
+		out, ok := getSubtitlePath(sha, sub)
+		if !ok || metadata_store.Exists(out) {
+			continue
+		}
+		tmp, err := createTempFor(out)
+		if err != nil {
+			return err
+		}
+		tmps[out] = tmp
+		cmd.Args = append(cmd.Args, "-map", fmt.Sprintf("0:s:%d", sub.Index))
+		if isImageSubtitle(sub.Codec) {
+			cmd.Args = append(cmd.Args, "-c:s", "copy", "-f", subtitle_muxers[*sub.Extension])
+		} else {
+			// ffmpeg's webvtt encoder converts ass dialogues to plain cues and keeps simple tags (<b>, <i>, <u>).
+			cmd.Args = append(cmd.Args, "-c:s", "webvtt", "-f", "webvtt")
+		}
+		cmd.Args = append(cmd.Args, "-y", tmp)
+	}
+	if len(tmps) == 0 {
+		return nil
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not extract subtitles: %s: %s", err, stderr.String())
+	}
+	for out, tmp := range tmps {
+		if err := os.Chmod(tmp, Settings.MetadataFileMode); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, out); err != nil {
+			return err
+		}
+		delete(tmps, out)
+		if err := metadata_store.Save(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
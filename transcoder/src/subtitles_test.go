@@ -0,0 +1,106 @@
+package src
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSubtitleCodecs(t *testing.T) {
+	// formats reported by mediainfo.
+	tests := []struct {
+		format string
+		codec  string
+		image  bool
+	}{
+		{"UTF-8", "subrip", false},
+		{"ASS", "ass", false},
+		{"SSA", "ssa", false},
+		{"WebVTT", "webvtt", false},
+		{"Timed Text", "timed text", false},
+		{"PGS", "pgs", true},
+		{"VobSub", "vobsub", true},
+		{"DVB Subtitle", "dvb subtitle", true},
+		{"DVD Subtitle", "dvd subtitle", true},
+	}
+	for _, test := range tests {
+		codec := getSubtitleCodec(test.format)
+		if codec != test.codec || isImageSubtitle(codec) != test.image {
+			t.Errorf("%s: got %s (image: %v), expected %s (image: %v)", test.format, codec, isImageSubtitle(codec), test.codec, test.image)
+		}
+	}
+}
+
+func TestSubtitlePath(t *testing.T) {
+	defer func(old SettingsT) { Settings = old }(Settings)
+	Settings.Metadata = "/metadata"
+	sup, mks := "sup", "mks"
+	tests := []struct {
+		sub  Subtitle
+		want string
+	}{
+		{Subtitle{Index: 0, Codec: "subrip"}, "/metadata/sha/subs/0.vtt"},
+		{Subtitle{Index: 1, Codec: "ass"}, "/metadata/sha/subs/1.vtt"},
+		{Subtitle{Index: 2, Codec: "pgs", Extension: &sup}, "/metadata/sha/subs/2.sup"},
+		{Subtitle{Index: 3, Codec: "vobsub", Extension: &mks}, "/metadata/sha/subs/3.mks"},
+		// unknown image subtitles can't be extracted.
+		{Subtitle{Index: 4, Codec: "dvd subtitle"}, ""},
+	}
+	for _, test := range tests {
+		if got, ok := getSubtitlePath("sha", test.sub); got != test.want || ok != (test.want != "") {
+			t.Errorf("%+v: got %q, expected %q", test.sub, got, test.want)
+		}
+	}
+}
+
+func TestExtractSubtitles(t *testing.T) {
+	if _, err := exec.LookPath(Settings.FfmpegPath); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	defer func(old SettingsT) { Settings = old }(Settings)
+	Settings.Metadata = t.TempDir()
+	dir := t.TempDir()
+	for i, content := range []string{"1\n00:00:00,000 --> 00:00:01,000\nfirst\n", "1\n00:00:00,000 --> 00:00:01,000\nsecond\n"} {
+		if err := os.WriteFile(filepath.Join(dir, string(rune('a'+i))+".srt"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	video := filepath.Join(dir, "subs.mkv")
+	cmd := exec.Command(
+		Settings.FfmpegPath, "-loglevel", "error",
+		"-f", "lavfi", "-i", "color=c=red:s=64x36:d=2",
+		"-i", filepath.Join(dir, "a.srt"), "-i", filepath.Join(dir, "b.srt"),
+		"-map", "0", "-map", "1", "-map", "2", "-c:s", "srt", video,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	sha := "subtitles"
+	info, err := ProbeMedia(video, sha)
+	if err != nil || len(info.Subtitles) != 2 {
+		t.Skipf("mediainfo could not read the subtitles of the video (%v)", err)
+	}
+	// extracting one extracts every stream.
+	first, err := ExtractSubtitle(video, sha, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"first", "second"} {
+		path, _ := getSubtitlePath(sha, info.Subtitles[i])
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(content), "WEBVTT") || !strings.Contains(string(content), want) {
+			t.Errorf("subtitle %d is %q", i, content)
+		}
+	}
+	if first != filepath.Join(getSubtitlesPath(sha), "0.vtt") {
+		t.Errorf("the subtitle is at %s", first)
+	}
+	if _, ok := thumbnails.Get(sha + "/sub.0"); ok {
+		t.Error("subtitles are tracked with the thumbnails")
+	}
+}
@@ -1,126 +1,3129 @@
 package src
 
 import (
-	"encoding/base64"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"image"
 	"image/color"
-	"log"
+	"image/draw"
+	"io"
+	"io/fs"
+	"log/slog"
 	"math"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/disintegration/imaging"
-	"gitlab.com/opennota/screengen"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// We want to have a thumbnail every ${interval} seconds.
-var default_interval = 10
+// The maximum number of seconds to skip when a thumbnail is black.
+var max_black_retries = 5
 
-// The maximim number of thumbnails per video.
-// Setting this too high allows really long processing times.
-var max_numcaps = 150
+// Formats that can be used for the sprite (see Settings.ThumbnailFormat).
+var ThumbnailFormats = []string{"webp", "jpeg", "png"}
+
+func getThumbnailFormat() string {
+	format := GetEnvOr("GOCODER_THUMBNAIL_FORMAT", "webp")
+	for _, f := range ThumbnailFormats {
+		if f == format {
+			return format
+		}
+	}
+	// encoders registered later switch to their format (see RegisterThumbnailEncoder).
+	slog.Warn("Invalid thumbnail format, falling back to webp unless an encoder is registered for it", "format", format)
+	return "webp"
+}
+
+// Placement of the tiles in sprites, row (left to right then top to bottom) or column (top to bottom then
+// left to right).
+func getSpriteOrder() string {
+	order := GetEnvOr("GOCODER_SPRITE_ORDER", "row")
+	if order != "row" && order != "column" {
+		slog.Warn("Invalid sprite order, falling back to row", "order", order)
+		return "row"
+	}
+	return order
+}
+
+// Names of the other files of the sha directory (info.json, chapters.vtt...), sheets written next to them
+// can't use them.
+var reserved_sprite_names = []string{"info", "keyframes", "frames", "peaks", "chapters", "preview", "sub", "layout"}
+
+// The base name of the sheets files, its suffixes (see getPageName) and extensions are added to it so it
+// can't contain a dot or a path separator.
+func getSpriteBaseName() string {
+	name := GetEnvOr("GOCODER_SPRITE_BASE_NAME", "sprite")
+	if name == "" || strings.ContainsAny(name, `./\`) || slices.Contains(reserved_sprite_names, name) {
+		slog.Warn("Invalid sprite base name, falling back to sprite", "name", name)
+		return "sprite"
+	}
+	return name
+}
+
+// Parse a hex color (#rrggbb or #rrggbbaa, the # is optional).
+func getSpriteBackground() color.NRGBA {
+	hex_color := GetEnvOr("GOCODER_SPRITE_BACKGROUND", "#000000")
+	raw, err := hex.DecodeString(strings.TrimPrefix(hex_color, "#"))
+	if err != nil || (len(raw) != 3 && len(raw) != 4) {
+		slog.Warn("Invalid sprite background, it should be an hex color, falling back to black", "background", hex_color)
+		return color.NRGBA{A: 255}
+	}
+	ret := color.NRGBA{R: raw[0], G: raw[1], B: raw[2], A: 255}
+	if len(raw) == 4 {
+		ret.A = raw[3]
+	}
+	return ret
+}
+
+func getThumbnailSharpen() float64 {
+	env := GetEnvOr("GOCODER_THUMBNAIL_SHARPEN", "0")
+	sigma, err := strconv.ParseFloat(env, 64)
+	// imaging's sharpening is a blur behind the scenes, big sigmas only make halos.
+	if err != nil || !(sigma >= 0 && sigma <= 5) {
+		slog.Warn("Invalid thumbnail sharpen, it should be a sigma between 0 and 5, disabling it", "sharpen", env)
+		return 0
+	}
+	return sigma
+}
+
+// Offset of the first thumbnail, in seconds or in percents of the duration (see Settings.ThumbnailStartOffset).
+type StartOffset struct {
+	Seconds float64
+	Percent float64
+}
+
+// The offset in seconds for a video of the given duration (in seconds).
+func (o StartOffset) get(duration float64) float64 {
+	return o.Seconds + o.Percent*duration/100
+}
+
+// Parse an offset in seconds (90) or in percents of the duration (5%).
+func ParseStartOffset(value string) (StartOffset, error) {
+	if percent, found := strings.CutSuffix(value, "%"); found {
+		if ret, err := strconv.ParseFloat(percent, 64); err == nil && ret >= 0 && ret < 100 {
+			return StartOffset{Percent: ret}, nil
+		}
+	} else if ret, err := strconv.ParseFloat(value, 64); err == nil && ret >= 0 && !math.IsInf(ret, 0) {
+		return StartOffset{Seconds: ret}, nil
+	}
+	return StartOffset{}, fmt.Errorf("invalid start offset %s, it should be a number of seconds or a percentage (5%%)", value)
+}
+
+func (o StartOffset) String() string {
+	if o.Percent > 0 {
+		return formatSeconds(o.Percent) + "%"
+	}
+	return formatSeconds(o.Seconds)
+}
+
+func getThumbnailStartOffset() StartOffset {
+	env := GetEnvOr("GOCODER_THUMBNAIL_START_OFFSET", "0")
+	ret, err := ParseStartOffset(env)
+	if err != nil {
+		slog.Warn("Invalid thumbnail start offset, it should be a number of seconds or a percentage (5%), starting at 0", "offset", env)
+	}
+	return ret
+}
+
+func getTileGap() int {
+	gap := GetEnvIntOr("GOCODER_TILE_GAP", 0)
+	if gap < 0 || gap > 64 {
+		slog.Warn("Invalid tile gap, it should be a number of pixels between 0 and 64, packing tiles", "gap", gap)
+		return 0
+	}
+	return gap
+}
+
+// Videos up to this height are SD, only their thumbnails are sharpened (see Settings.ThumbnailSharpen).
+var sharpen_max_height = 576
+
+func getThumbnailQuality() int {
+	quality := GetEnvIntOr("GOCODER_THUMBNAIL_QUALITY", 80)
+	if quality < 1 || quality > 100 {
+		clamped := min(max(quality, 1), 100)
+		slog.Warn("Invalid thumbnail quality, it should be between 1 and 100", "quality", quality, "using", clamped)
+		return clamped
+	}
+	return quality
+}
+
+// 4:2:0, 4:2:2 and 4:4:4 are also accepted.
+func getChromaSubsampling() string {
+	mode := GetEnvOr("GOCODER_THUMBNAIL_CHROMA_SUBSAMPLING", "420")
+	switch strings.ReplaceAll(mode, ":", "") {
+	case "420", "422", "444":
+		return strings.ReplaceAll(mode, ":", "")
+	default:
+		slog.Warn("Invalid chroma subsampling, it should be 420, 422 or 444, falling back to 420", "subsampling", mode)
+		return "420"
+	}
+}
+
+// Height of the thumbnails of the main sheet (the one named sprite), other heights are optional.
+// Also exposed as Settings.ThumbnailHeight (Settings.ThumbnailHeights can't depend on Settings).
+var thumbnail_height = getThumbnailHeight()
+
+func getThumbnailHeight() int {
+	// auto (or 0) picks the height from the resolution of each video, see getAutoThumbnailHeight.
+	if env := GetEnvOr("GOCODER_THUMBNAIL_HEIGHT", ""); env == "auto" || env == "0" {
+		return 0
+	}
+	height := GetEnvIntOr("GOCODER_THUMBNAIL_HEIGHT", 144)
+	// bigger thumbnails would make sprites huge, smaller ones are unreadable.
+	if height < 32 || height > 1080 {
+		clamped := min(max(height, 32), 1080)
+		slog.Warn("Invalid thumbnail height, it should be between 32 and 1080", "height", height, "using", clamped)
+		height = clamped
+	}
+	// chroma subsampling of jpeg and webp works on 2x2 blocks, odd heights blur the last row.
+	if height%2 != 0 {
+		slog.Warn("Invalid thumbnail height, it should be even", "height", height, "using", height+1)
+		height++
+	}
+	return height
+}
+
+// Replace the height of the main sheet (GOCODER_THUMBNAIL_HEIGHT), for the cli. 0 is the auto mode.
+func SetThumbnailHeight(height int) error {
+	if height != 0 && (height < 32 || height > 1080 || height%2 != 0) {
+		return fmt.Errorf("invalid thumbnail height %d, it should be an even number between 32 and 1080", height)
+	}
+	thumbnail_height = height
+	Settings.ThumbnailHeight = height
+	Settings.ThumbnailHeights = getThumbnailHeights()
+	return nil
+}
+
+// Bounds of the heights picked in auto mode, explicit heights can be outside of them.
+var (
+	auto_thumbnail_min_height = 90
+	auto_thumbnail_max_height = 240
+)
+
+// Height of the main sprite's thumbnails when GOCODER_THUMBNAIL_HEIGHT is auto: a sixth of the video's (so SD
+// videos aren't upscaled and UHD ones get sharper thumbnails), never bigger than the video itself.
+func getAutoThumbnailHeight(gen *Generator, sar float64) int {
+	_, height := getDisplaySize(gen, sar)
+	ret := min(max(height/6, auto_thumbnail_min_height), auto_thumbnail_max_height, height)
+	// see getThumbnailHeight, odd heights blur the last row.
+	return ret + ret%2
+}
+
+// Height of the thumbnails of a sheet, main is the height of the main sprite (see getAutoThumbnailHeight and
+// ThumbnailOptions.Height).
+func (size SheetSize) tileHeight(main int) int {
+	if size.Height == 0 || size.Height == thumbnail_height {
+		return main
+	}
+	return size.Height
+}
+
+func getThumbnailHeights() []int {
+	ret := []int{thumbnail_height}
+	for _, s := range strings.Split(GetEnvOr("GOCODER_THUMBNAIL_HEIGHTS", fmt.Sprint(thumbnail_height)), ",") {
+		// the main height is always generated (and is 0 in auto mode).
+		if strings.TrimSpace(s) == fmt.Sprint(thumbnail_height) {
+			continue
+		}
+		height, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || height <= 0 {
+			slog.Warn("Invalid thumbnail height, ignoring it", "height", s)
+			continue
+		}
+		if !slices.Contains(ret, height) {
+			ret = append(ret, height)
+		}
+	}
+	return ret
+}
+
+func getThumbnailScales() []int {
+	// the 1x sheet is always generated, others are optional.
+	ret := []int{1}
+	for _, s := range strings.Split(GetEnvOr("GOCODER_THUMBNAIL_SCALES", "1"), ",") {
+		scale, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || scale <= 0 {
+			slog.Warn("Invalid thumbnail scale, ignoring it", "scale", s)
+			continue
+		}
+		if !slices.Contains(ret, scale) {
+			ret = append(ret, scale)
+		}
+	}
+	return ret
+}
+
+// Identify a sheet, the default one is {thumbnail_height, 1}.
+type SheetSize struct {
+	Height int
+	// One of Settings.ThumbnailScales.
+	Scale int
+}
+
+func DefaultSheetSize() SheetSize {
+	return SheetSize{Height: thumbnail_height, Scale: 1}
+}
+
+// Every sheet generated for a video.
+func getSheetSizes() []SheetSize {
+	ret := make([]SheetSize, 0, len(Settings.ThumbnailHeights)*len(Settings.ThumbnailScales))
+	for _, height := range Settings.ThumbnailHeights {
+		for _, scale := range Settings.ThumbnailScales {
+			ret = append(ret, SheetSize{Height: height, Scale: scale})
+		}
+	}
+	return ret
+}
+
+type ThumbnailOptions struct {
+	// Number of seconds between two thumbnails, at least Settings.ThumbnailMinInterval (the interval of short
+	// videos can still be reduced, see Settings.MinThumbnails). Zero means Settings.ThumbnailInterval.
+	Interval float64
+	// Maximum number of thumbnails in the sprite, at most Settings.ThumbnailMaxCaps. Zero means
+	// Settings.ThumbnailMaxCaps.
+	MaxCaps int
+	// Identify the timestamps given to ExtractThumbnailsAt, Interval and MaxCaps are ignored when this is set.
+	At string
+	// Identify the poster given to ExtractThumbnailWithPoster, used as the first thumbnail.
+	Poster string
+	// Extract exactly Count thumbnails evenly spread over the video (see ExtractThumbnailsCount).
+	// Interval and MaxCaps are ignored when this is set.
+	Count int
+	// Index of the video stream (in MediaInfo.Videos) to use, for files with multiple angles.
+	Stream int
+	// Only extract thumbnails between Start and End (in seconds). Zero End means the whole video.
+	Start float64
+	End   float64
+	// Files played after the path, the thumbnails cover all of them as a single video (see ExtractThumbnailParts).
+	Parts []string
+	// Display aspect ratio (width / height) replacing the one of the file, for files with a wrong flag.
+	// Zero uses the aspect ratio of the file.
+	Aspect float64
+	// Duration (in seconds) of the video replacing the one of the container, for badly muxed files whose
+	// duration is wrong. Zero uses the duration of the file.
+	Duration float64
+	// Directory the thumbnails are written to instead of the metadata dir of the sha, to keep them next to the
+	// video for example. Cues then point to the sprites with urls relative to the vtt. Extractions are still
+	// shared by sha (this is not part of the key), the first one decides where the files are.
+	Out string
+
+	// Overrides of the settings for this call (to tune them per library for example), zero values use the
+	// settings. Unlike Out, they are part of the key so each set of overrides gets its own sprites.
+	// Height of the thumbnails of the main sprite (see Settings.ThumbnailHeight), other heights are unchanged.
+	Height int
+	// Format of the sprites, one of ThumbnailFormats (see Settings.ThumbnailFormat).
+	Format string
+	// Quality of the sprites (see Settings.ThumbnailQuality).
+	Quality int
+	// Offset of the first thumbnail (see Settings.ThumbnailStartOffset), nil for the settings'.
+	StartOffset *StartOffset
+}
+
+var (
+	ErrInvalidStream     = errors.New("invalid video stream index")
+	ErrUnsupportedStream = errors.New("the frame generator can only read the default video stream")
+	ErrExtractionTimeout = errors.New("the extraction took longer than GOCODER_THUMBNAIL_TIMEOUT")
+	ErrInsufficientSpace = errors.New("not enough free space in the metadata dir")
+	// The file does not exist, is not a video or its first frames can't be decoded.
+	ErrUnreadableSource = errors.New("the video could not be read")
+	ErrUnsupportedCodec = errors.New("the video codec can't be decoded")
+	ErrNoVideoStream    = errors.New("no video stream to extract thumbnails from")
+	// The video is encrypted (DRM), it is detected before grabbing frames since none could be decoded.
+	ErrEncryptedSource = errors.New("the video is encrypted")
+	// Videos with an unknown duration only get their first thumbnail, this is returned when it can't be decoded.
+	ErrNoDuration = errors.New("the duration of the video is unknown")
+	// Thumbnails could not be saved in the metadata dir, ErrInsufficientSpace is also wrapped when it is full.
+	ErrWriteFailed = errors.New("the thumbnails could not be written")
+	// A sprite could not be encoded (usually out of memory on huge sheets, see Settings.MaxSpriteDimension to
+	// split them in smaller pages), it is wrapped with ErrWriteFailed.
+	ErrEncodeFailed = errors.New("the sprite could not be encoded")
+	// The extraction was stopped by CancelThumbnail.
+	ErrExtractionCancelled = errors.New("the extraction was cancelled")
+	// The video already has Settings.ThumbnailMaxVariants sets of overrides extracted.
+	ErrTooManyVariants = errors.New("too many thumbnails variants of this video")
+)
+
+// Check if err is caused by the video itself, retrying the extraction of the same file would fail again.
+// Other errors (timeouts, write failures, shutdowns...) can be retried.
+func IsPermanentThumbnailError(err error) bool {
+	return errors.Is(err, ErrUnreadableSource) ||
+		errors.Is(err, ErrUnsupportedCodec) ||
+		errors.Is(err, ErrNoVideoStream) ||
+		errors.Is(err, ErrEncryptedSource) ||
+		errors.Is(err, ErrNoDuration) ||
+		errors.Is(err, ErrInvalidStream) ||
+		errors.Is(err, ErrUnsupportedStream)
+}
+
+func (o ThumbnailOptions) withDefaults() ThumbnailOptions {
+	if o.Interval <= 0 {
+		o.Interval = float64(Settings.ThumbnailInterval)
+	} else {
+		o.Interval = max(o.Interval, float64(Settings.ThumbnailMinInterval))
+	}
+	if o.MaxCaps <= 0 {
+		o.MaxCaps = Settings.ThumbnailMaxCaps
+	} else {
+		o.MaxCaps = min(o.MaxCaps, Settings.ThumbnailMaxCaps)
+	}
+	return o
+}
+
+// Identify a set of options, empty for the defaults (files generated with them are stored
+// at the root of the sha directory).
+func (o ThumbnailOptions) key() string {
+	var parts []string
+	if o.Stream != 0 {
+		parts = append(parts, fmt.Sprintf("v%d", o.Stream))
+	}
+	if o.End > 0 {
+		parts = append(parts, fmt.Sprintf("r%s-%s", formatSeconds(o.Start), formatSeconds(o.End)))
+	}
+	if o.At != "" {
+		parts = append(parts, fmt.Sprintf("at-%s", o.At))
+	} else if o.Count > 0 {
+		parts = append(parts, fmt.Sprintf("n%d", o.Count))
+	} else if o.hasCustomInterval() {
+		o = o.withDefaults()
+		parts = append(parts, fmt.Sprintf("i%s-c%d", formatSeconds(o.Interval), o.MaxCaps))
+	}
+	if o.Poster != "" {
+		parts = append(parts, fmt.Sprintf("p%s", o.Poster))
+	}
+	if o.Aspect > 0 {
+		parts = append(parts, fmt.Sprintf("a%s", formatSeconds(o.Aspect)))
+	}
+	if o.Duration > 0 {
+		parts = append(parts, fmt.Sprintf("d%s", formatSeconds(o.Duration)))
+	}
+	if o.getHeight() != thumbnail_height {
+		parts = append(parts, fmt.Sprintf("h%d", o.Height))
+	}
+	if o.getFormat() != Settings.ThumbnailFormat {
+		parts = append(parts, fmt.Sprintf("f%s", o.Format))
+	}
+	if o.getQuality() != Settings.ThumbnailQuality {
+		parts = append(parts, fmt.Sprintf("q%d", o.Quality))
+	}
+	if o.getStartOffset() != Settings.ThumbnailStartOffset {
+		parts = append(parts, fmt.Sprintf("o%s", o.getStartOffset()))
+	}
+	return strings.Join(parts, "-")
+}
+
+func (o ThumbnailOptions) getHeight() int {
+	return cmp.Or(o.Height, thumbnail_height)
+}
+
+func (o ThumbnailOptions) getFormat() string {
+	return cmp.Or(o.Format, Settings.ThumbnailFormat)
+}
+
+func (o ThumbnailOptions) getQuality() int {
+	return cmp.Or(o.Quality, Settings.ThumbnailQuality)
+}
+
+func (o ThumbnailOptions) getStartOffset() StartOffset {
+	if o.StartOffset == nil {
+		return Settings.ThumbnailStartOffset
+	}
+	return *o.StartOffset
+}
+
+func (o ThumbnailOptions) hasCustomInterval() bool {
+	o = o.withDefaults()
+	return o.Interval != float64(Settings.ThumbnailInterval) || o.MaxCaps != Settings.ThumbnailMaxCaps
+}
+
+// Whether o overrides the density or the settings of the sprites (see Settings.ThumbnailMaxVariants).
+func (o ThumbnailOptions) hasOverrides() bool {
+	return (o.At == "" && o.Count == 0 && o.hasCustomInterval()) ||
+		o.getHeight() != thumbnail_height ||
+		o.getFormat() != Settings.ThumbnailFormat ||
+		o.getQuality() != Settings.ThumbnailQuality ||
+		o.getStartOffset() != Settings.ThumbnailStartOffset
+}
+
+// Whether the sha already has Settings.ThumbnailMaxVariants directories of thumbnails besides the default one.
+func hasTooManyVariants(sha string) bool {
+	entries, _ := os.ReadDir(GetMetadataPath(sha))
+	count := 0
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "thumbnails-") {
+			count++
+		}
+	}
+	return count >= Settings.ThumbnailMaxVariants
+}
+
+func formatSeconds(ts float64) string {
+	return strconv.FormatFloat(ts, 'f', -1, 64)
+}
+
+// Query string that should be used to request the sheet of the given size generated with those options.
+func (o ThumbnailOptions) query(size SheetSize, page int) string {
+	params := url.Values{}
+	if o.At != "" {
+		params.Set("at", o.At)
+	} else if o.Count > 0 {
+		params.Set("count", fmt.Sprint(o.Count))
+	} else if o.hasCustomInterval() {
+		o = o.withDefaults()
+		params.Set("interval", formatSeconds(o.Interval))
+		params.Set("maxcaps", fmt.Sprint(o.MaxCaps))
+	}
+	if o.Poster != "" {
+		params.Set("poster", o.Poster)
+	}
+	if o.Aspect > 0 {
+		params.Set("aspect", formatSeconds(o.Aspect))
+	}
+	if o.Duration > 0 {
+		params.Set("duration", formatSeconds(o.Duration))
+	}
+	if o.Stream != 0 {
+		params.Set("stream", fmt.Sprint(o.Stream))
+	}
+	if o.End > 0 {
+		params.Set("start", formatSeconds(o.Start))
+		params.Set("end", formatSeconds(o.End))
+	}
+	// height already selects the sheet.
+	if o.getHeight() != thumbnail_height {
+		params.Set("tileheight", fmt.Sprint(o.Height))
+	}
+	if o.getFormat() != Settings.ThumbnailFormat {
+		params.Set("format", o.Format)
+	}
+	if o.getQuality() != Settings.ThumbnailQuality {
+		params.Set("quality", fmt.Sprint(o.Quality))
+	}
+	if o.getStartOffset() != Settings.ThumbnailStartOffset {
+		params.Set("offset", o.getStartOffset().String())
+	}
+	if size.Height != thumbnail_height {
+		params.Set("height", fmt.Sprint(size.Height))
+	}
+	if size.Scale != 1 {
+		params.Set("scale", fmt.Sprint(size.Scale))
+	}
+	if page != 0 {
+		params.Set("page", fmt.Sprint(page))
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return "?" + params.Encode()
+}
 
 type Thumbnail struct {
 	ready sync.WaitGroup
 	path  string
+	err   error
+	// Number of thumbnails already extracted and total number of thumbnails, updated during the extraction.
+	done  atomic.Int32
+	total atomic.Int32
+	// Set when ready is done, a WaitGroup can't be checked without blocking.
+	finished atomic.Bool
+	// Set for extractions started by RegenerateThumbnail, which ignore existing files.
+	forced bool
+	// Identify the extraction in logs and events, empty for thumbnails that were already extracted.
+	id string
+	// The file the thumbnails were extracted from, nil when unknown.
+	source *FileSource
+	// Closed (and replaced) when done or total change, see WatchThumbnailProgress.
+	progress_lock sync.Mutex
+	progress      chan struct{}
+	// Stop the running extraction with a cause, see CancelThumbnail. nil for thumbnails that were already extracted.
+	cancel context.CancelCauseFunc
+	// Number of times the thumbnails were requested (extracted or served) since the entry was created, atomic
+	// since it is incremented by every request.
+	hits atomic.Int64
+}
+
+func (t *Thumbnail) finish() {
+	t.finished.Store(true)
+	t.notify()
+	t.ready.Done()
+}
+
+// Get a channel closed on the next change of the progress (or at the end of the extraction).
+func (t *Thumbnail) changed() <-chan struct{} {
+	t.progress_lock.Lock()
+	defer t.progress_lock.Unlock()
+	if t.progress == nil {
+		t.progress = make(chan struct{})
+	}
+	return t.progress
+}
+
+// Wake up the listeners of the progress.
+func (t *Thumbnail) notify() {
+	t.progress_lock.Lock()
+	defer t.progress_lock.Unlock()
+	if t.progress != nil {
+		close(t.progress)
+		t.progress = nil
+	}
+}
+
+// Only keep the most recently used thumbnails in memory, evicted entries are reloaded from disk.
+var max_cached_thumbnails = 1024
+
+// Running extractions are never evicted: another one would be started in the same directory and
+// CancelThumbnail could not reach the first one anymore.
+func isRunning(t *Thumbnail) bool {
+	return !t.finished.Load()
+}
+
+var thumbnails = NewCMapWithLimitPinned[string, *Thumbnail](max_cached_thumbnails, isRunning)
+
+// Running regenerations (by cache key of thumbnails). They are kept here until they finish since entries of
+// thumbnails can be evicted, a second extraction would then write to the same directory.
+var regenerations = NewCMap[string, *Thumbnail]()
+
+// Thumbnails directory of physical files (see getFileId) with the options key, to share them between hardlinks.
+var thumbnail_files = NewCMapWithLimit[string, string](max_cached_thumbnails)
+
+// Semaphore limiting the number of extractions running at the same time.
+var thumbnail_workers = make(chan struct{}, Settings.ThumbnailWorkers)
+
+// Wait for a worker slot to be available, call the returned function to free it.
+// kind is used to label metrics of the extraction (sprite, bif, preview, gif, poster or waveform).
+func acquireWorker(ctx context.Context, kind string) (func(), error) {
+	select {
+	case thumbnail_workers <- struct{}{}:
+		active_extractions.WithLabelValues(kind).Inc()
+		timer := prometheus.NewTimer(extraction_duration.WithLabelValues(kind))
+		var once sync.Once
+		release := func() {
+			once.Do(func() {
+				recordExtraction(kind, timer.ObserveDuration())
+				active_extractions.WithLabelValues(kind).Dec()
+				<-thumbnail_workers
+			})
+		}
+		// timed out extractions may be stuck in the generator forever, give their slot back.
+		stop := context.AfterFunc(ctx, func() {
+			if errors.Is(context.Cause(ctx), ErrExtractionTimeout) {
+				release()
+			}
+		})
+		return func() {
+			stop()
+			release()
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Time left to a timed out extraction to stop by itself before it is abandoned.
+var extraction_grace = 5 * time.Second
+
+// Run extract with the Settings.ThumbnailTimeout deadline. Extractions check ctx between frames but
+// screengen can block forever on malformed files, so an extraction that does not stop after the
+// deadline is abandoned: its worker slot is freed (see acquireWorker) and ErrExtractionTimeout returned.
+func withExtractionTimeout(ctx context.Context, extract func(ctx context.Context) error) error {
+	if Settings.ThumbnailTimeout <= 0 {
+		return extract(ctx)
+	}
+	ctx, cancel := context.WithTimeoutCause(ctx, time.Duration(Settings.ThumbnailTimeout)*time.Second, ErrExtractionTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- extract(ctx)
+	}()
+	result := func(err error) error {
+		if errors.Is(context.Cause(ctx), ErrExtractionTimeout) {
+			return ErrExtractionTimeout
+		}
+		return err
+	}
+	select {
+	case err := <-done:
+		return result(err)
+	case <-ctx.Done():
+	}
+	if !errors.Is(context.Cause(ctx), ErrExtractionTimeout) {
+		// cancelled by the caller, the extraction stops before its next frame.
+		return <-done
+	}
+	select {
+	case err := <-done:
+		return result(err)
+	case <-time.After(extraction_grace):
+		getLogger(ctx).Error("Extraction is stuck after its timeout, abandoning it", "timeout", Settings.ThumbnailTimeout)
+		return ErrExtractionTimeout
+	}
+}
+
+// Extract the thumbnails sprite and vtt of a video. path can be a local file or an http(s) url,
+// files are always stored in the metadata directory of sha.
+func ExtractThumbnail(path string, sha string, opts ThumbnailOptions) (string, error) {
+	return ExtractThumbnailContext(context.Background(), path, sha, opts)
+}
+
+// Same as ExtractThumbnail but the extraction is aborted when ctx is cancelled.
+// Since extractions are shared, cancelling ctx also fails concurrent calls waiting for the same
+// thumbnails (the next call will restart the extraction).
+func ExtractThumbnailContext(ctx context.Context, path string, sha string, opts ThumbnailOptions) (string, error) {
+	return extractThumbnailContext(ctx, path, sha, opts, nil, nil)
+}
+
+// Extract a sprite containing thumbnails at the given timestamps (in seconds) instead of evenly spaced ones
+// (chapters boundaries for example). Cues of the vtt span from each timestamp to the next one.
+func ExtractThumbnailsAt(path string, sha string, timestamps []float64) (string, error) {
+	timestamps = slices.DeleteFunc(slices.Clone(timestamps), func(ts float64) bool { return ts < 0 })
+	if len(timestamps) == 0 {
+		return "", errors.New("no timestamps to extract thumbnails at")
+	}
+	slices.Sort(timestamps)
+	timestamps = slices.Compact(timestamps)
+
+	h := sha1.New()
+	for _, ts := range timestamps {
+		fmt.Fprintf(h, "%g,", ts)
+	}
+	opts := ThumbnailOptions{At: hex.EncodeToString(h.Sum(nil))[:16]}
+	return extractThumbnailContext(context.Background(), path, sha, opts, timestamps, nil)
+}
+
+// Extract thumbnails only between start and end (in seconds), for long videos where sprites can be
+// generated on demand around the position the user seeks to. The vtt is standalone, it only contains
+// cues of this range (with absolute timings).
+func ExtractThumbnailRange(path string, sha string, start float64, end float64) (string, error) {
+	if start < 0 || end <= start {
+		return "", fmt.Errorf("invalid range %g-%g", start, end)
+	}
+	return extractThumbnailContext(context.Background(), path, sha, ThumbnailOptions{Start: start, End: end}, nil, nil)
+}
+
+// Extract exactly n thumbnails evenly spread over the video (for filmstrips of a fixed size), whatever its
+// duration. n is clamped to Settings.ThumbnailMaxCaps and videos shorter than n seconds get one thumbnail
+// per second instead.
+func ExtractThumbnailsCount(path string, sha string, n int) (string, error) {
+	if n <= 0 {
+		return "", fmt.Errorf("invalid thumbnails count %d", n)
+	}
+	return extractThumbnailContext(context.Background(), path, sha, ThumbnailOptions{Count: n}, nil, nil)
+}
+
+// Same as ExtractThumbnail but the first thumbnail (from t=0 to the first interval) is the image at
+// poster_path (a curated poster for example) instead of the first frame, so the scrub bar starts with it.
+func ExtractThumbnailWithPoster(path string, sha string, poster_path string) (string, error) {
+	content, err := os.ReadFile(poster_path)
+	if err != nil {
+		return "", err
+	}
+	poster, err := imaging.Decode(bytes.NewReader(content), imaging.AutoOrientation(true))
+	if err != nil {
+		return "", fmt.Errorf("could not decode the poster %s: %w", poster_path, err)
+	}
+	h := sha1.Sum(content)
+	opts := ThumbnailOptions{Poster: hex.EncodeToString(h[:])[:16]}
+	return extractThumbnailContext(context.Background(), path, sha, opts, nil, poster)
+}
+
+// timestamps can be nil to extract evenly spaced thumbnails using opts. poster is the image used as the
+// first thumbnail when opts.Poster is set.
+func extractThumbnailContext(ctx context.Context, path string, sha string, opts ThumbnailOptions, timestamps []float64, poster image.Image) (string, error) {
+	ret := startThumbnailExtraction(ctx, path, sha, opts, timestamps, poster)
+	ret.ready.Wait()
+	return ret.path, ret.err
+}
+
+// Same as ExtractThumbnail but never waits for the extraction, done is false while the thumbnails are
+// being extracted. Calls made after the end of the extraction return its result.
+func ExtractThumbnailAsync(path string, sha string, opts ThumbnailOptions) (out string, done bool, err error) {
+	ret := startThumbnailExtraction(context.Background(), path, sha, opts, nil, nil)
+	if !ret.finished.Load() {
+		return "", false, nil
+	}
+	// finished is set right before ready is done.
+	ret.ready.Wait()
+	return ret.path, true, ret.err
+}
+
+// Start the extraction of the thumbnails (or reuse the running one), the returned Thumbnail is ready once
+// they are extracted.
+func startThumbnailExtraction(ctx context.Context, path string, sha string, opts ThumbnailOptions, timestamps []float64, poster image.Image) *Thumbnail {
+	if !Settings.ThumbnailsEnabled {
+		return getPlaceholderThumbnail(opts)
+	}
+	// disc folders are extracted from the files of their main feature, cached with the sha of those files.
+	if len(opts.Parts) == 0 && isDiscFolder(path) {
+		paths, err := resolveDiscTitle(path)
+		if err == nil {
+			sha, err = GetPartsSha(paths)
+		}
+		if err != nil {
+			ret := &Thumbnail{err: err}
+			ret.finished.Store(true)
+			return ret
+		}
+		path, opts.Parts = paths[0], paths[1:]
+		if len(opts.Parts) == 0 {
+			opts.Parts = nil
+		}
+	}
+	key := opts.key()
+	cache_key := fmt.Sprintf("%s/%s", sha, key)
+	source := getFileSource(path)
+	touchMetadata(sha)
+
+	// thumbnails already extracted (or checked) by this process, the most common case once the library is
+	// warm. They are returned without allocating an extraction, as long as their sprite is still there.
+	if ret, ok := thumbnails.Get(cache_key); ok && ret.finished.Load() && ret.err == nil && ret.source.matches(source) {
+		if _, found := FindSprite(ret.path, opts, DefaultSheetSize(), 0); found {
+			observeCache("sprite", false)
+			ret.hits.Add(1)
+			return ret
+		}
+		// the files were removed behind our back, extract them again.
+		thumbnails.RemoveFunc(func(key string, val *Thumbnail) bool {
+			return key == cache_key && val == ret
+		})
+	}
+
+	// hardlinks have different paths (so different shas) but the same content, reuse their thumbnails.
+	file_id, has_id := getFileId(path)
+	// thumbnails of multiple parts only belong to their set, not to the first file.
+	has_id = has_id && len(opts.Parts) == 0
+	if has_id {
+		if out, ok := thumbnail_files.Get(fmt.Sprintf("%s/%s", file_id, key)); ok && hasAllSprites(out, opts) {
+			ret := &Thumbnail{path: out}
+			ret.finished.Store(true)
+			return ret
+		}
+	}
+	remember := func(out string) {
+		if has_id {
+			thumbnail_files.Set(fmt.Sprintf("%s/%s", file_id, key), out)
+		}
+	}
+
+	ret, created := thumbnails.GetOrCreate(cache_key, func() *Thumbnail {
+		// the regeneration's entry was evicted, wait for it instead of extracting in the same directory.
+		if running, ok := regenerations.Get(cache_key); ok {
+			return running
+		}
+		ret := &Thumbnail{
+			path:   getThumbnailPath(sha, key),
+			source: source,
+		}
+		if opts.Out != "" {
+			ret.path = filepath.Clean(opts.Out)
+		}
+		if !startJob() {
+			ret.err = ErrShuttingDown
+			ret.finished.Store(true)
+			return ret
+		}
+		ret.id = newExtractionId()
+		ret.ready.Add(1)
+		extract_ctx, cancel := context.WithCancelCause(ctx)
+		ret.cancel = cancel
+		// the sprites of a previous run are checked here, not while holding the lock of thumbnails: the
+		// metadata directory can be slow (network shares) and it would block every other extraction.
+		go func() {
+			defer endJob()
+			defer cancel(nil)
+			if reuseSavedThumbnails(ret, path, sha, opts, source) {
+				remember(ret.path)
+				ret.finish()
+				return
+			}
+			// every set of overrides is a new directory, callers can't fill the metadata dir with them.
+			if opts.Out == "" && opts.hasOverrides() && hasTooManyVariants(sha) {
+				ret.err = ErrTooManyVariants
+				thumbnails.RemoveFunc(func(key string, val *Thumbnail) bool {
+					return key == cache_key && val == ret
+				})
+				ret.finish()
+				return
+			}
+			logger := slog.With("extraction", ret.id, "sha", sha)
+			start := time.Now()
+			ret.err = withExtractionTimeout(withLogger(extract_ctx, logger), func(ctx context.Context) error {
+				return extractThumbnail(ctx, path, sha, ret, opts.withDefaults(), timestamps, poster)
+			})
+			if purgeCancelled(extract_ctx, ret, cache_key) {
+				logger.Info("Thumbnails extraction cancelled", "path", path)
+			} else if ret.err != nil {
+				logLimited(logger, slog.LevelError, "Could not extract thumbnails", "path", path, "err", ret.err)
+				extraction_failures.WithLabelValues("sprite").Inc()
+				recordFailure(cache_key, path, sha, opts, ret.err)
+				// do not cache failures, the next call will retry the extraction.
+				thumbnails.RemoveFunc(func(key string, val *Thumbnail) bool {
+					return key == cache_key && val == ret
+				})
+			} else {
+				clearFailure(cache_key)
+				remember(ret.path)
+			}
+			publishThumbnailEvent(sha, ret, start)
+			ret.finish()
+		}()
+		return ret
+	})
+	observeCache("sprite", created)
+	// same as above for thumbnails extracted (or checked) earlier by this process, this only costs a stat.
+	if !created && ret.finished.Load() && ret.err == nil && !ret.source.matches(source) {
+		slog.Error("Thumbnails of this sha were extracted from another file (or an older version of it), extracting them again", "path", path, "sha", sha)
+		thumbnails.RemoveFunc(func(key string, val *Thumbnail) bool {
+			return key == cache_key && val == ret
+		})
+		return startThumbnailExtraction(ctx, path, sha, opts, timestamps, poster)
+	}
+	ret.hits.Add(1)
+	return ret
+}
+
+// Whether the sprites of a previous run in ret.path are still valid and can be used as is. Those of another
+// format or layout are removed so they are extracted again.
+func reuseSavedThumbnails(ret *Thumbnail, path string, sha string, opts ThumbnailOptions, source *FileSource) bool {
+	if !hasAllSprites(ret.path, opts) {
+		return false
+	}
+	saved := getSavedThumbnailInfo(ret.path)
+	if !saved.Source.matches(source) {
+		// a caller bug (or a collision) gave the same sha to another file, serving them would show the
+		// previews of the wrong video.
+		slog.Error("Thumbnails of this sha were extracted from another file (or an older version of it), extracting them again", "path", path, "sha", sha)
+		return false
+	}
+	if !saved.matchesSettings(opts) {
+		// the sprites have the same names, pages of the old layout would be left behind.
+		slog.Info("Thumbnails were extracted with other settings, extracting them again", "path", path, "sha", sha)
+		removeSheets(ret.path)
+		removeCheckpoint(ret.path)
+		return false
+	}
+	return true
+}
+
+// Extract the thumbnails (with default options) again even if they already exist, after a codec or
+// a settings change for example. Calls made during the regeneration wait for the new thumbnails and
+// concurrent regenerations of the same sha share the same extraction.
+func RegenerateThumbnail(path string, sha string) (string, error) {
+	opts := ThumbnailOptions{}
+	key := opts.key()
+	cache_key := fmt.Sprintf("%s/%s", sha, key)
+	// the running regeneration is checked and replaced under the lock of thumbnails so concurrent calls
+	// can't both start one, the others wait for its ready.
+	ret := thumbnails.Update(cache_key, func(old *Thumbnail, ok bool) *Thumbnail {
+		if running, found := regenerations.Get(cache_key); found {
+			return running
+		}
+		ret := &Thumbnail{
+			path:   getThumbnailPath(sha, key),
+			forced: true,
+			id:     newExtractionId(),
+			source: getFileSource(path),
+		}
+		if !startJob() {
+			ret.err = ErrShuttingDown
+			ret.finished.Store(true)
+			return ret
+		}
+		ret.ready.Add(1)
+		extract_ctx, cancel := context.WithCancelCause(context.Background())
+		ret.cancel = cancel
+		regenerations.Set(cache_key, ret)
+		go func() {
+			defer endJob()
+			defer cancel(nil)
+			defer regenerations.RemoveFunc(func(key string, val *Thumbnail) bool {
+				return key == cache_key && val == ret
+			})
+			// the previous extraction writes in the same directory, let it finish first.
+			if ok {
+				old.ready.Wait()
+			}
+			removeSheets(ret.path)
+			// frames saved by an interrupted extraction may come from the settings being replaced.
+			removeCheckpoint(ret.path)
+			logger := slog.With("extraction", ret.id, "sha", sha)
+			start := time.Now()
+			ret.err = withExtractionTimeout(withLogger(extract_ctx, logger), func(ctx context.Context) error {
+				return extractThumbnail(ctx, path, sha, ret, opts.withDefaults(), nil, nil)
+			})
+			if purgeCancelled(extract_ctx, ret, cache_key) {
+				logger.Info("Thumbnails regeneration cancelled", "path", path)
+			} else if ret.err != nil {
+				logger.Error("Could not regenerate thumbnails", "path", path, "err", ret.err)
+				extraction_failures.WithLabelValues("sprite").Inc()
+				recordFailure(cache_key, path, sha, opts, ret.err)
+				thumbnails.RemoveFunc(func(key string, val *Thumbnail) bool {
+					return key == cache_key && val == ret
+				})
+			} else {
+				clearFailure(cache_key)
+			}
+			publishThumbnailEvent(sha, ret, start)
+			ret.finish()
+		}()
+		return ret
+	})
+	ret.ready.Wait()
+	return ret.path, ret.err
+}
+
+// Stop the running extractions (and regenerations) of thumbnails of a sha, for a wrong file or before changing
+// a setting. Their partial files are removed and the callers waiting for them get ErrExtractionCancelled, the
+// next calls extract them again. This returns the number of extractions cancelled once they have stopped,
+// they stop before their next frame (or when abandoned after Settings.ThumbnailTimeout).
+func CancelThumbnail(sha string) int {
+	prefix := sha + "/"
+	running := thumbnails.Filter(func(key string, val *Thumbnail) bool {
+		return strings.HasPrefix(key, prefix) && !val.finished.Load() && val.cancel != nil
+	})
+	for _, t := range running {
+		t.cancel(ErrExtractionCancelled)
+	}
+	for _, t := range running {
+		t.ready.Wait()
+	}
+	return len(running)
+}
+
+// Drop the files and the cache entry of an extraction stopped by CancelThumbnail, false if it was not cancelled.
+func purgeCancelled(ctx context.Context, t *Thumbnail, cache_key string) bool {
+	if !errors.Is(context.Cause(ctx), ErrExtractionCancelled) {
+		return false
+	}
+	t.err = ErrExtractionCancelled
+	// sheets saved before the cancellation would be served as if they were complete.
+	removeSheets(t.path)
+	removeCheckpoint(t.path)
+	thumbnails.RemoveFunc(func(key string, val *Thumbnail) bool {
+		return key == cache_key && val == t
+	})
+	return true
+}
+
+// Get the progress of the thumbnails extraction (with default options) of the given sha.
+// ok is false if no extraction was started for this sha since the transcoder started.
+func ExtractThumbnailStatus(sha string) (done int, total int, ok bool) {
+	ret, ok := thumbnails.Get(fmt.Sprintf("%s/%s", sha, ThumbnailOptions{}.key()))
+	if !ok {
+		return 0, 0, false
+	}
+	return int(ret.done.Load()), int(ret.total.Load()), true
+}
+
+// Call on_progress with the progress of the thumbnails extraction (with default options) of the given sha
+// every time it changes, until the extraction finishes. Every watcher is fed by the same extraction, this
+// returns its error (or ErrThumbnailsNotFound if no extraction was started for this sha).
+// Updates are not queued: a slow on_progress skips the intermediate values.
+func WatchThumbnailProgress(ctx context.Context, sha string, on_progress func(done int, total int)) error {
+	ret, ok := thumbnails.Get(fmt.Sprintf("%s/%s", sha, ThumbnailOptions{}.key()))
+	if !ok {
+		return ErrThumbnailsNotFound
+	}
+	return ret.watch(ctx, on_progress)
+}
+
+// Same as ExtractThumbnail (with any options) but on_progress is called like in WatchThumbnailProgress until the
+// extraction finishes. Cancelling ctx only stops watching, the extraction keeps running for the other callers.
+func ExtractThumbnailProgress(ctx context.Context, path string, sha string, opts ThumbnailOptions, on_progress func(done int, total int)) (string, error) {
+	ret := startThumbnailExtraction(context.Background(), path, sha, opts, nil, nil)
+	if err := ret.watch(ctx, on_progress); err != nil {
+		return "", err
+	}
+	return ret.path, nil
+}
+
+func (t *Thumbnail) watch(ctx context.Context, on_progress func(done int, total int)) error {
+	for {
+		// taken before reading the progress, a change happening in between closes it.
+		changed := t.changed()
+		finished := t.finished.Load()
+		on_progress(int(t.done.Load()), int(t.total.Load()))
+		if finished {
+			t.ready.Wait()
+			return t.err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Estimate when the thumbnails extraction of the given video will be done, from the average time taken per
+// thumbnail by the previous extractions. Extractions that did not start yet are planned with PlanThumbnail.
+// ok is false when no extraction finished since the transcoder started (there is nothing to estimate from).
+func EstimateThumbnailCompletion(path string, sha string, opts ThumbnailOptions) (eta time.Time, ok bool, err error) {
+	frame, ok := getFrameDuration()
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	var remaining int
+	ret, found := thumbnails.Get(fmt.Sprintf("%s/%s", sha, opts.key()))
+	if found && ret.finished.Load() {
+		return time.Now(), true, nil
+	}
+	if found && ret.total.Load() > 0 {
+		remaining = int(ret.total.Load() - ret.done.Load())
+	} else {
+		plan, err := PlanThumbnail(path)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		remaining = plan.Numcaps
+	}
+	return time.Now().Add(time.Duration(remaining) * frame), true, nil
+}
+
+// Purge everything cached for the given sha, in memory and on disk (see GetMetadataPath).
+// Use this when a video is replaced or deleted to stop serving stale thumbnails.
+// Callers waiting on an extraction are not affected, they still get its result.
+func InvalidateThumbnail(sha string) error {
+	forgetThumbnail(sha)
+	return metadata_store.RemoveAll(GetMetadataPath(sha))
+}
+
+// Drop everything kept in memory about the metadata of a sha, its files have been (or are being) removed.
+func forgetThumbnail(sha string) {
+	prefix := sha + "/"
+	is_sha := func(key string, _ *Thumbnail) bool { return strings.HasPrefix(key, prefix) }
+	thumbnails.RemoveFunc(is_sha)
+	posters.RemoveFunc(is_sha)
+	thumbnail_files.RemoveFunc(func(_ string, out string) bool {
+		return out == getThumbnailPath(sha, "") || strings.HasPrefix(out, getThumbnailPath(sha, "")+"/")
+	})
+	// the whole directory is removed so other extractors have to run again too.
+	extracted.Remove(sha)
+	subtitles.Remove(sha)
+	infos.Remove(sha)
+	keyframes.Remove(sha)
+}
+
+// Remove metadata directories of videos that are no longer in the library (keep returns false for them).
+// Directories with thumbnails currently being extracted are skipped.
+func PruneThumbnails(keep func(sha string) bool) error {
+	dirs, err := listMetadataDirs()
+	if err != nil {
+		return err
+	}
+	for sha := range dirs {
+		if keep(sha) {
+			continue
+		}
+		if isExtracting(sha) {
+			slog.Info("Not pruning metadata, thumbnails are being extracted", "sha", sha)
+			continue
+		}
+		slog.Info("Pruning metadata", "sha", sha)
+		if err := InvalidateThumbnail(sha); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check if the thumbnails (with default options) of a sha are ready to be served, without waiting for a
+// running extraction or starting one. Unlike GetThumbnailSprite, nothing is created or marked as used.
+func ThumbnailExists(sha string) bool {
+	if ret, ok := thumbnails.Get(fmt.Sprintf("%s/%s", sha, ThumbnailOptions{}.key())); ok {
+		if !ret.finished.Load() || ret.err != nil {
+			return false
+		}
+	}
+	_, ok := FindSprite(getThumbnailPath(sha, ""), ThumbnailOptions{}, DefaultSheetSize(), 0)
+	return ok
+}
+
+// Check if the thumbnails (with default options) of a sha are being extracted.
+func ThumbnailExtracting(sha string) bool {
+	ret, ok := thumbnails.Get(fmt.Sprintf("%s/%s", sha, ThumbnailOptions{}.key()))
+	return ok && !ret.finished.Load()
+}
+
+// True while thumbnails (or posters) of the sha are being extracted, its directory must not be removed.
+func isExtracting(sha string) bool {
+	prefix := sha + "/"
+	is_pending := func(key string, val *Thumbnail) bool {
+		return strings.HasPrefix(key, prefix) && !val.finished.Load()
+	}
+	return thumbnails.Any(is_pending) || posters.Any(is_pending)
+}
+
+func getThumbnailPath(sha string, key string) string {
+	ret := GetMetadataPath(sha)
+	if key != "" {
+		ret = fmt.Sprintf("%s/thumbnails-%s", ret, key)
+	}
+	return ret
+}
+
+// Find a sprite that was already generated (or that is being generated) for the given sha.
+// Unlike ExtractThumbnail, this never starts an extraction since the video's path is not known.
+func GetThumbnailSprite(sha string, opts ThumbnailOptions, size SheetSize, page int) (string, bool) {
+	key := opts.key()
+	touchMetadata(sha)
+	if ret, ok := thumbnails.Get(fmt.Sprintf("%s/%s", sha, key)); ok {
+		ret.hits.Add(1)
+		ret.ready.Wait()
+		if ret.err != nil {
+			return "", false
+		}
+	}
+	return FindSprite(getThumbnailPath(sha, key), opts, size, page)
+}
+
+// Layout of a thumbnails sprite, for clients that do not use the vtt file.
+type ThumbnailInfo struct {
+	/// The number of thumbnails in the sprite.
+	Count int `json:"count"`
+	/// The number of seconds between two thumbnails, zero for thumbnails at custom timestamps.
+	Interval float64 `json:"interval"`
+	/// The timestamps (in seconds) of thumbnails, only for thumbnails at custom timestamps, of a range, aligned on
+	/// keyframes (see GOCODER_KEYFRAME_THUMBNAILS) or when identical adjacent thumbnails were merged
+	/// (see GOCODER_THUMBNAIL_DEDUP_THRESHOLD).
+	Timestamps []float64 `json:"timestamps,omitempty"`
+	/// The number of thumbnails per row.
+	Columns int `json:"columns"`
+	/// The number of rows of the sprite.
+	Rows int `json:"rows"`
+	/// How the thumbnails are placed in the sprite: "row" (left to right, then top to bottom) or "column"
+	/// (top to bottom, then left to right), see GOCODER_SPRITE_ORDER.
+	Order string `json:"order"`
+	/// The number of sprite files, sprites bigger than Settings.MaxSpriteDimension are split in multiple pages
+	/// (see the page param of the sprite route).
+	Pages int `json:"pages"`
+	/// The width of a thumbnail in the main sprite (multiply it by the scale for other sprites).
+	Width int `json:"width"`
+	/// The height of a thumbnail in the main sprite.
+	Height int `json:"height"`
+	/// The number of pixels between two thumbnails of the main sprite (multiply it by the scale for other sprites),
+	/// see GOCODER_TILE_GAP.
+	Gap int `json:"gap"`
+	/// The heights of the sprites generated (widths keep the aspect ratio of the main sprite).
+	Heights []int `json:"heights"`
+	/// The scales of the sprites generated.
+	Scales []int `json:"scales"`
+	/// The GOCODER_MAX_TILE_WIDTH of the extraction, 0 when the tiles were not limited.
+	MaxTileWidth int `json:"maxTileWidth,omitempty"`
+	/// The GOCODER_THUMBNAIL_MAX_SPAN of the extraction, 0 when the thumbnails cover the whole video.
+	MaxSpan int `json:"maxSpan,omitempty"`
+	/// A blurhash (https://blurha.sh) of a frame of the video, to display while images load.
+	/// Empty when GOCODER_THUMBNAIL_BLURHASH is disabled.
+	Blurhash string `json:"blurhash,omitempty"`
+	/// The video the thumbnails were extracted from, missing for remote files.
+	Source *FileSource `json:"source,omitempty"`
+}
+
+// The layout of out, empty if there is none.
+func getSavedThumbnailInfo(out string) ThumbnailInfo {
+	var info ThumbnailInfo
+	if err := getSavedLayout(out, &info); err != nil {
+		return ThumbnailInfo{}
+	}
+	return info
+}
+
+// The source recorded in the layout of out, nil if there is none.
+func getSavedSource(out string) *FileSource {
+	return getSavedThumbnailInfo(out).Source
+}
+
+// Check if sprites of this layout could have been extracted with the current settings (and opts), the height,
+// the sheets or the order may have changed since. Like sources, fields missing from older infos are not compared.
+func (info ThumbnailInfo) matchesSettings(opts ThumbnailOptions) bool {
+	if info.Order != "" && info.Order != Settings.SpriteOrder {
+		return false
+	}
+	if info.Scales != nil && !slices.Equal(info.Scales, Settings.ThumbnailScales) {
+		return false
+	}
+	// older infos have no gap, their tiles are packed.
+	if info.Gap != Settings.TileGap {
+		return false
+	}
+	if info.MaxTileWidth != Settings.MaxTileWidth || info.MaxSpan != Settings.ThumbnailMaxSpanSeconds {
+		return false
+	}
+	// the main height is picked for each video in auto mode, only the other ones are fixed. It is lowered for
+	// videos too wide for Settings.MaxTileWidth.
+	if opts.getHeight() != 0 && info.Height != 0 && info.Height != opts.getHeight() &&
+		(info.MaxTileWidth == 0 || info.Height > opts.getHeight()) {
+		return false
+	}
+	if info.Heights != nil && (len(info.Heights) != len(Settings.ThumbnailHeights) ||
+		!slices.Equal(info.Heights[1:], Settings.ThumbnailHeights[1:])) {
+		return false
+	}
+	// the pages depend on Settings.MaxSpriteDimension.
+	if info.Pages != 0 && info.Count > 0 && info.Width > 0 && info.Height > 0 {
+		scale := 1
+		if len(info.Scales) > 0 {
+			scale = info.Scales[0]
+		}
+		columns, rows, pages := getSpriteLayout(info.Count, (info.Width+info.Gap)*scale, (info.Height+info.Gap)*scale)
+		if columns != info.Columns || rows != info.Rows || pages != info.Pages {
+			return false
+		}
+	}
+	return true
+}
+
+func getThumbnailInfoPath(out string) string {
+	// "layout" can't be a sprite base name, json cues never overwrite it.
+	return fmt.Sprintf("%s/layout.json", out)
+}
+
+// Where the layout was written before layout.json, it now holds the json cues of the main sheet when the
+// sprites are named thumbnails.
+func getLegacyThumbnailInfoPath(out string) string {
+	return fmt.Sprintf("%s/thumbnails.json", out)
+}
+
+// Read the layout of out, thumbnails extracted by older versions are still used.
+func getSavedLayout(out string, info *ThumbnailInfo) error {
+	err := getSavedInfo(getThumbnailInfoPath(out), info)
+	if err != nil && Settings.SpriteBaseName != "thumbnails" {
+		err = getSavedInfo(getLegacyThumbnailInfoPath(out), info)
+	}
+	return err
+}
+
+// Get the layout of the sprite generated with the default options for this sha.
+func GetThumbnailInfo(sha string) (ThumbnailInfo, error) {
+	var ret ThumbnailInfo
+	err := getSavedLayout(getThumbnailPath(sha, ""), &ret)
+	return ret, err
+}
+
+// A sprite and its vtt. Every sheet contains the same thumbnails, only the size differs.
+type spriteSheet struct {
+	size   SheetSize
+	width  int
+	height int
+	// Number of tiles per row and per column of a page.
+	columns int
+	rows    int
+	// Pages of the sheet, only the last one can have less rows.
+	sprites []*image.NRGBA
+	// Keep the sprites transparent instead of filling them with Settings.SpriteBackground (see hasAlpha).
+	transparent bool
+	// Pixels between two tiles, see Settings.TileGap.
+	gap int
+	// Format and quality of the sprites (see ThumbnailOptions).
+	format  string
+	quality int
+	// vtt cues, one per tile.
+	cues []string
+	// Same as cues, for the json format (only when Settings.EmitJsonThumbnails is set).
+	json_cues []JsonCue
+}
+
+// A thumbnail in the json format (same as a vtt cue), for players that can't read vtt.
+type JsonCue struct {
+	/// The start time of the thumbnail (in seconds).
+	Start float64 `json:"start"`
+	/// The end time of the thumbnail (in seconds).
+	End float64 `json:"end"`
+	/// The position and size (in pixels) of the thumbnail in the sprite.
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+	/// The url of the sprite containing the thumbnail.
+	Src string `json:"src"`
+}
+
+// Allocate the pages of a sheet for count tiles, the returned function releases them.
+func (sheet *spriteSheet) allocate(out string, count int) func() {
+	columns, rows, pages := getSpriteLayout(count, sheet.width+sheet.gap, sheet.height+sheet.gap)
+	sheet.columns, sheet.rows = columns, rows
+	sheet.sprites = make([]*image.NRGBA, pages)
+	releases := make([]func(), pages)
+	for page := range sheet.sprites {
+		tiles := min(sheet.columns*sheet.rows, count-page*sheet.columns*sheet.rows)
+		// the last page only has the rows (or columns) it needs.
+		columns, rows := sheet.columns, int(math.Ceil(float64(tiles)/float64(sheet.columns)))
+		if Settings.SpriteOrder == "column" {
+			columns, rows = int(math.Ceil(float64(tiles)/float64(sheet.rows))), min(tiles, sheet.rows)
+		}
+		sheet.sprites[page], releases[page] = newSprite(
+			out,
+			(sheet.width+sheet.gap)*columns-sheet.gap,
+			(sheet.height+sheet.gap)*rows-sheet.gap,
+			sheet.transparent,
+		)
+		// cells after the last tile (the end of the last row or column) would show as background squares.
+		if supportsAlpha(sheet.format) && tiles != columns*rows {
+			sprite := sheet.sprites[page]
+			col, row := getTileCell(Settings.SpriteOrder, tiles, columns, rows)
+			x, y := col*(sheet.width+sheet.gap), row*(sheet.height+sheet.gap)
+			draw.Draw(sprite, image.Rect(x, y, sprite.Rect.Dx(), sprite.Rect.Dy()), image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	return func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+}
+
+// The vtt of the sheet. With Settings.VttIncludeGeometry, a NOTE block (ignored by players) gives the size of
+// the tiles and the layout of the pages so players can scale tiles without decoding the sprite first.
+func (sheet *spriteSheet) vtt() string {
+	header := "WEBVTT\n\n"
+	if Settings.VttIncludeGeometry {
+		header += fmt.Sprintf(
+			"NOTE\nwidth=%d\nheight=%d\ncolumns=%d\nrows=%d\npages=%d\ngap=%d\n\n",
+			sheet.width,
+			sheet.height,
+			sheet.columns,
+			sheet.rows,
+			len(sheet.sprites),
+			sheet.gap,
+		)
+	}
+	return header + strings.Join(sheet.cues, "")
+}
+
+// Page and position (in pixels) of the i-th tile of the sheet.
+func (sheet *spriteSheet) tilePos(i int) (page int, x int, y int) {
+	page = i / (sheet.columns * sheet.rows)
+	col, row := getTileCell(Settings.SpriteOrder, i%(sheet.columns*sheet.rows), sheet.columns, sheet.rows)
+	return page, col * (sheet.width + sheet.gap), row * (sheet.height + sheet.gap)
+}
+
+// Column and row of the pos-th tile of a page of the given layout, see Settings.SpriteOrder.
+func getTileCell(order string, pos int, columns int, rows int) (col int, row int) {
+	if order == "column" {
+		return pos / rows, pos % rows
+	}
+	return pos % columns, pos / columns
+}
+
+// Only keep the tiles of the given frames, moving them to the start of the sheet.
+func (sheet *spriteSheet) compact(out string, frames []int) func() {
+	old := *sheet
+	release := sheet.allocate(out, len(frames))
+	for i, frame := range frames {
+		from_page, from_x, from_y := old.tilePos(frame)
+		page, x, y := sheet.tilePos(i)
+		draw.Draw(
+			sheet.sprites[page],
+			image.Rect(x, y, x+sheet.width, y+sheet.height),
+			old.sprites[from_page],
+			image.Pt(from_x, from_y),
+			draw.Src,
+		)
+	}
+	return release
+}
+
+// Split numcaps tiles of w x h in pages of columns x rows tiles so no page is bigger than
+// Settings.MaxSpriteDimension (browsers and decoders have a limit on the size of images).
+// With a Settings.TileGap, w and h include the gap after each tile.
+func getSpriteLayout(numcaps int, w int, h int) (columns int, rows int, pages int) {
+	return getGridLayout(numcaps, w, h, Settings.MaxSpriteDimension)
+}
+
+func getGridLayout(numcaps int, w int, h int, max_dimension int) (columns int, rows int, pages int) {
+	columns = int(math.Sqrt(float64(numcaps)))
+	columns = max(min(columns, max_dimension/w), 1)
+	rows = int(math.Ceil(float64(numcaps) / float64(columns)))
+	page_rows := max(min(rows, max_dimension/h), 1)
+	pages = int(math.Ceil(float64(rows) / float64(page_rows)))
+	return columns, page_rows, pages
+}
+
+// Sprites bigger than this (in bytes) are stored in a memory mapped file instead of the heap.
+var max_sprite_memory = 64 * 1024 * 1024
+
+// Allocate a sprite filled with the background color (or transparent). Big sprites are mapped to a file of dir,
+// they always stay on the heap when dir is empty.
+func newSprite(dir string, w int, h int, transparent bool) (*image.NRGBA, func()) {
+	var background color.Color = Settings.SpriteBackground
+	if transparent {
+		background = color.Transparent
+	}
+	if dir != "" && w*h*4 > max_sprite_memory {
+		sprite, release, err := newMappedImage(dir, w, h)
+		if err == nil {
+			draw.Draw(sprite, sprite.Rect, image.NewUniform(background), image.Point{}, draw.Src)
+			return sprite, release
+		}
+		slog.Warn("Could not map a sprite, keeping it in memory", "width", w, "height", h, "err", err)
+	}
+	return imaging.New(w, h, background), func() {}
+}
+
+func supportsAlpha(format string) bool {
+	return format == "png" || format == "webp"
+}
+
+func extractThumbnail(ctx context.Context, path string, sha string, status *Thumbnail, opts ThumbnailOptions, timestamps []float64, poster image.Image) (err error) {
+	logger := getLogger(ctx)
+	exec_time := printExecTimeWith(logger, "extracting thumbnails for %s", path)
+	start := time.Now()
+	defer func() {
+		exec_time()
+		// feeds the estimates of EstimateThumbnailCompletion, sprites already on disk grab no frames.
+		if err == nil {
+			recordFrameDuration(time.Since(start), int(status.done.Load()))
+		}
+	}()
+	out := status.path
+	mkdirMetadata(out)
+	// the vtt and info of the old format would stay valid with sprites that don't exist anymore.
+	if hasStaleSprites(out, opts.getFormat()) {
+		logger.Info("Removing thumbnails extracted in another format", "path", path, "format", opts.getFormat())
+		removeSheets(out)
+	}
+
+	// set once the frames are rendered, the errors after it come from writing the files.
+	writing := false
+	// never leave a partial sprite/vtt behind, they would be used as a valid cache.
+	defer func() {
+		if err != nil {
+			removeSheets(out)
+		}
+		if writing && err != nil {
+			err = fmt.Errorf("%w: %w", ErrWriteFailed, err)
+		}
+		if isDiskFull(err) && !errors.Is(err, ErrInsufficientSpace) {
+			err = fmt.Errorf("%w: %w", ErrInsufficientSpace, err)
+		}
+	}()
+
+	for {
+		sheets, info, release, err := renderThumbnails(ctx, path, sha, out, status, getSheetSizes(), opts, timestamps, poster)
+		if err != nil {
+			return err
+		}
+		writing = true
+		err = writeThumbnails(logger, out, sheets, info)
+		release()
+		if err == nil {
+			removeCheckpoint(out)
+		}
+		if !errors.Is(err, errSpriteOverCap) {
+			return err
+		}
+		// even the lowest quality doesn't fit in Settings.MaxSpriteBytes, try again with less thumbnails.
+		// custom timestamps can't be dropped.
+		writing = false
+		numcaps := int(status.total.Load())
+		if timestamps != nil || numcaps <= 1 {
+			return err
+		}
+		numcaps = max(numcaps*2/3, 1)
+		if opts.Count > 0 {
+			opts.Count = numcaps
+		} else {
+			opts.MaxCaps = numcaps
+		}
+		logger.Warn("Sprite is bigger than GOCODER_MAX_SPRITE_BYTES, extracting less thumbnails", "path", path, "numcaps", numcaps)
+		status.done.Store(0)
+	}
+}
+
+// Write the rendered sheets and their info in out.
+func writeThumbnails(logger *slog.Logger, out string, sheets []*spriteSheet, info ThumbnailInfo) (err error) {
+	// everything is written to temporary files and moved in place once all of them are saved, readers
+	// never see a truncated sprite or a vtt without its sprite.
+	// the layout and the json cues.
+	var files []string
+	var vtts []string
+	// pages other than the first ones and the checksums.
+	var sprites []string
+	// first pages are moved last since their presence marks the extraction as complete (see hasAllSprites).
+	var first_pages []string
+	// the temporary file of every file, see createTempFor.
+	tmps := map[string]string{}
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	temp := func(file string) (string, error) {
+		tmp, err := createTempFor(file)
+		if err == nil {
+			tmps[file] = tmp
+		}
+		return tmp, err
+	}
+	write := func(file string, content []byte) error {
+		tmp, err := temp(file)
+		if err != nil {
+			return err
+		}
+		return writeMetadataFile(tmp, content)
+	}
+
+	files = append(files, getThumbnailInfoPath(out))
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err = write(getThumbnailInfoPath(out), content); err != nil {
+		return err
+	}
+	for _, sheet := range sheets {
+		vtts = append(vtts, GetVttPath(out, sheet.size))
+		if err = write(GetVttPath(out, sheet.size), []byte(sheet.vtt())); err != nil {
+			return err
+		}
+		if Settings.EmitJsonThumbnails {
+			content, err := json.Marshal(sheet.json_cues)
+			if err != nil {
+				return err
+			}
+			files = append(files, GetJsonCuesPath(out, sheet.size))
+			if err = write(GetJsonCuesPath(out, sheet.size), content); err != nil {
+				return err
+			}
+		}
+		for page, sprite := range sheet.sprites {
+			sprite_path := getSpritePath(out, sheet.format, sheet.size, page)
+			if page == 0 {
+				first_pages = append(first_pages, sprite_path)
+			} else {
+				sprites = append(sprites, sprite_path)
+			}
+			tmp, err := temp(sprite_path)
+			if err != nil {
+				return err
+			}
+			quality, err := saveSheetPage(logger, sheet, sprite, tmp)
+			if err != nil {
+				return err
+			}
+			if quality != sheet.quality {
+				logger.Info("Lowered the quality of the sprite to fit in GOCODER_MAX_SPRITE_BYTES", "sprite", sprite_path, "quality", quality)
+			}
+			// corrupted sprites (bad disks, partial copies) are detected when served, see VerifySprite.
+			sprites = append(sprites, getChecksumPath(sprite_path))
+			checksum_tmp, err := temp(getChecksumPath(sprite_path))
+			if err != nil {
+				return err
+			}
+			if err = writeChecksum(tmp, checksum_tmp); err != nil {
+				return err
+			}
+		}
+	}
+	var renames []string
+	for _, list := range [][]string{files, vtts, sprites, first_pages} {
+		renames = append(renames, list...)
+	}
+	for _, file := range renames {
+		// sprites are written by ffmpeg or os.Create which do not use our permissions.
+		if err = os.Chmod(tmps[file], Settings.MetadataFileMode); err != nil {
+			return err
+		}
+		if err = os.Rename(tmps[file], file); err != nil {
+			return err
+		}
+		delete(tmps, file)
+	}
+	// sprites are published before the vtts pointing to them, readers of the store never see a vtt of
+	// missing sheets.
+	var uploads []string
+	for _, list := range [][]string{sprites, first_pages, files, vtts} {
+		uploads = append(uploads, list...)
+	}
+	for _, file := range uploads {
+		if err = metadata_store.Save(file); err != nil {
+			// don't leave new sprites next to a missing or old vtt.
+			for _, file := range uploads {
+				metadata_store.Remove(file)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Grab the frames of a video and draw them in sheets of the given sizes (sizes[0] is the main one), the returned
+// release function frees the sprites. Nothing is written: out is only used to map big sprites to files (in memory
+// when empty) and an empty sha is used for in memory extractions (probes are not cached and cues use relative urls).
+func renderThumbnails(
+	ctx context.Context,
+	path string,
+	sha string,
+	out string,
+	status *Thumbnail,
+	sizes []SheetSize,
+	opts ThumbnailOptions,
+	timestamps []float64,
+	poster image.Image,
+) (sheets []*spriteSheet, info ThumbnailInfo, release func(), err error) {
+	logger := getLogger(ctx)
+	var releases []func()
+	free := func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+	defer func() {
+		if err != nil {
+			free()
+		}
+	}()
+
+	if opts.Poster != "" && poster == nil {
+		return nil, ThumbnailInfo{}, nil, errors.New("unknown poster, thumbnails with a poster must be created with ExtractThumbnailWithPoster")
+	}
+
+	// fail before waiting for a worker on files that can't have thumbnails (audio only files...).
+	// mediainfo only reads local files, image sequences and registered sources are checked when they are opened.
+	if !IsRemotePath(path) && !isImageSequence(path) && frame_source == nil {
+		media, err := ProbeMedia(path, sha)
+		if err != nil {
+			return nil, ThumbnailInfo{}, nil, err
+		}
+		if len(media.Videos) == 0 {
+			return nil, ThumbnailInfo{}, nil, fmt.Errorf("%w in %s", ErrNoVideoStream, path)
+		}
+		if opts.Stream < 0 || opts.Stream >= len(media.Videos) {
+			return nil, ThumbnailInfo{}, nil, fmt.Errorf("%w: %d, the file has %d video streams", ErrInvalidStream, opts.Stream, len(media.Videos))
+		}
+		if media.Videos[opts.Stream].Encrypted {
+			return nil, ThumbnailInfo{}, nil, fmt.Errorf("%w: %s", ErrEncryptedSource, path)
+		}
+	}
+	// screengen always decodes the same stream and has no way to select another one.
+	if opts.Stream != 0 {
+		return nil, ThumbnailInfo{}, nil, fmt.Errorf("%w: can't read stream %d", ErrUnsupportedStream, opts.Stream)
+	}
+
+	release_worker, err := acquireWorker(ctx, "sprite")
+	if err != nil {
+		return nil, ThumbnailInfo{}, nil, err
+	}
+	// the worker is held until the sprites are saved, encoding them is part of the extraction.
+	releases = append(releases, release_worker)
+
+	// the generator's dimensions are still used below since it handles the rotation of the video.
+	// the copy is only decoded, the info and the source are still read from path.
+	gen_path, remove_copy := stageScratchCopy(ctx, path)
+	defer remove_copy()
+	gen, close_gen, err := openSessionGenerator(ctx, gen_path)
+	if err != nil {
+		logger.Error("Error reading video file", "path", path, "err", err)
+		return nil, ThumbnailInfo{}, nil, err
+	}
+	defer close_gen()
+	if filter := getDeinterlaceFilter(path, sha); filter != "" && gen.deinterlace == "" {
+		logger.Info("Deinterlacing thumbnails", "path", path, "filter", filter)
+		gen.useDeinterlacer(filter)
+	}
+	// the layout and cues use the duration of every part, the thumbnails keep the size of the first one.
+	timeline, parts, close_parts, err := openParts(gen, opts.Parts)
+	if err != nil {
+		return nil, ThumbnailInfo{}, nil, err
+	}
+	defer close_parts()
+	// frames are still grabbed from the parts, thumbnails after the real end are dropped like undecodable ones.
+	if opts.Duration > 0 {
+		overridden := *timeline
+		overridden.Duration = int64(opts.Duration * 1000)
+		timeline = &overridden
+	}
+
+	// interval is zero for thumbnails at custom timestamps.
+	interval := 0.
+	aligned := false
+	adaptive := false
+	// set when the first thumbnail is after the start offset (see ThumbnailOptions.StartOffset).
+	skipped_intro := false
+	// the end of the thumbnails of videos longer than Settings.ThumbnailMaxSpanSeconds, 0 for the whole video.
+	span_end := 0.
+	if timestamps == nil {
+		if opts.At != "" {
+			return nil, ThumbnailInfo{}, nil, errors.New("unknown timestamps, thumbnails at custom timestamps must be created with ExtractThumbnailsAt")
+		}
+		if opts.Count > 0 {
+			timestamps, err = getCountTimestamps(timeline, opts)
+			if err != nil {
+				return nil, ThumbnailInfo{}, nil, err
+			}
+		} else {
+			var numcaps int
+			start := opts.Start
+			duration := float64(timeline.Duration) / 1000
+			end := duration
+			if span := float64(Settings.ThumbnailMaxSpanSeconds); span > 0 && opts.End == 0 && duration > span {
+				end, span_end = span, span
+			}
+			if opts.End > 0 {
+				numcaps, interval, err = getRangeLayout(timeline, opts)
+				if err != nil {
+					return nil, ThumbnailInfo{}, nil, err
+				}
+			} else if offset := opts.getStartOffset().get(duration); opts.Start == 0 && offset > 0 && offset < end {
+				// skip the intro: the thumbnails are spread over the rest of the video (or of the span).
+				ranged := opts
+				ranged.Start, ranged.End = offset, end
+				numcaps, interval, err = getRangeLayout(timeline, ranged)
+				if err != nil {
+					return nil, ThumbnailInfo{}, nil, err
+				}
+				start = offset
+				skipped_intro = true
+			} else if span_end > 0 {
+				ranged := opts
+				ranged.Start, ranged.End = 0, span_end
+				numcaps, interval, err = getRangeLayout(timeline, ranged)
+				if err != nil {
+					return nil, ThumbnailInfo{}, nil, err
+				}
+			} else {
+				numcaps, interval = getThumbnailLayout(timeline, opts)
+			}
+			timestamps = getEvenTimestamps(numcaps, interval)
+			for i := range timestamps {
+				timestamps[i] += start
+			}
+			// the samples are taken from the first part only, ranges keep their even spacing.
+			if Settings.AdaptiveThumbnails && start == 0 && opts.End == 0 && span_end == 0 && len(opts.Parts) == 0 && numcaps > 1 {
+				if ret := getAdaptiveTimestamps(ctx, timeline, numcaps); ret != nil {
+					timestamps = ret
+					adaptive = true
+				}
+			}
+		}
+		// the keyframes are only listed for the first video stream, counts must stay exact (merged
+		// timestamps would drop thumbnails).
+		// keyframes are saved in the metadata dir, in memory extractions (without sha) don't list them.
+		// they are only listed for the first part.
+		if Settings.KeyframeThumbnails && !Settings.AccurateThumbnails && !IsRemotePath(path) && sha != "" && opts.Stream == 0 && opts.Count == 0 && len(opts.Parts) == 0 {
+			if kfs, ok := GetKeyframes(sha, path).WaitAll(ctx); ok && len(kfs) > 1 {
+				timestamps = alignToKeyframes(timestamps, kfs)
+				aligned = true
+			} else {
+				logger.Info("Could not list keyframes, thumbnails are not aligned on them", "path", path)
+			}
+		}
+		// exact seeks stop at the first frame after the timestamp, with a variable frame rate it can be far from it
+		// and several timestamps can end on the same frame. Keyframe aligned timestamps are already frame times.
+		if Settings.AccurateThumbnails && !aligned && !IsRemotePath(path) && sha != "" && opts.Stream == 0 && opts.Count == 0 && len(opts.Parts) == 0 {
+			if pts, err := getFrameTimes(ctx, path, sha); err != nil || len(pts) == 0 {
+				logger.Info("Could not list frames, thumbnails are not aligned on them", "path", path, "err", err)
+			} else if isVariableFrameRate(pts) {
+				timestamps = snapToFrames(timestamps, pts)
+				aligned = true
+			}
+		}
+	}
+	numcaps := len(timestamps)
+	status.total.Store(int32(numcaps))
+	status.notify()
+
+	sar := getPixelAspectRatio(path, sha)
+	if opts.Aspect > 0 {
+		sar = getAspectSar(gen, opts.Aspect)
+	}
+	height := opts.getHeight()
+	if height == 0 {
+		height = getAutoThumbnailHeight(gen, sar)
+	}
+	var crop *cropRect
+	if Settings.CropThumbnails {
+		crop = detectCrop(gen, sar)
+	}
+	// width of the (cropped) thumbnails of the given height.
+	tile_width := func(h int) int {
+		if crop == nil {
+			return getThumbnailWidth(gen, h, sar)
+		}
+		return int(float64(getThumbnailWidth(gen, h, sar)) * crop.w / crop.h)
+	}
+	height = capTileHeight(height, Settings.MaxTileWidth, tile_width)
+	width := tile_width(height)
+	sharpen := 0.
+	if _, display_height := getDisplaySize(gen, sar); display_height <= sharpen_max_height {
+		sharpen = Settings.ThumbnailSharpen
+	}
+	transfer := getTransfer(path, sha)
+	colors := getColorFix(path, sha)
+	// transparent tiles are drawn over the sprite: they stay transparent on the transparent sprites of formats
+	// supporting it and are flattened on Settings.SpriteBackground for others.
+	alpha := hasAlpha(path, sha)
+	op := draw.Src
+	if alpha {
+		op = draw.Over
+	}
+
+	// sprites can be mapped to files of the metadata dir, check before allocating them.
+	if out != "" {
+		if err := checkFreeSpace(out, estimateSpritesSize(numcaps, height, tile_width)); err != nil {
+			return nil, ThumbnailInfo{}, nil, err
+		}
+	}
+
+	sheets = make([]*spriteSheet, len(sizes))
+	var biggest *spriteSheet
+	for i, size := range sizes {
+		tile_height := capTileHeight(size.tileHeight(height), Settings.MaxTileWidth, tile_width)
+		w := tile_width(tile_height) * size.Scale
+		h := tile_height * size.Scale
+		sheets[i] = &spriteSheet{
+			size:        size,
+			width:       w,
+			height:      h,
+			transparent: alpha && supportsAlpha(opts.getFormat()),
+			gap:         Settings.TileGap * size.Scale,
+			format:      opts.getFormat(),
+			quality:     opts.getQuality(),
+		}
+		releases = append(releases, sheets[i].allocate(out, numcaps))
+		if biggest == nil || h > biggest.height {
+			biggest = sheets[i]
+		}
+	}
+
+	logger.Info(
+		"Extracting thumbnails",
+		"path", path,
+		"numcaps", numcaps,
+		"interval", interval,
+		// accurate thumbnails match the vtt timing but can take several times longer to extract.
+		"accurate", Settings.AccurateThumbnails,
+		"codec", gen.VideoCodec,
+		"generators", getGeneratorCount(gen),
+		"decode_flags", gen.decodeFlags(),
+	)
+
+	signatures := make([][]uint8, numcaps)
+	missing := make([]bool, numcaps)
+	var hash string
+	// decode only once at the biggest size, smaller sheets use a downscaled version.
+	// cropped frames are grabbed whole, big enough for their picture to fill the biggest sheet.
+	grab_width, grab_height := biggest.width, biggest.height
+	if crop != nil {
+		grab_height = int(math.Round(float64(biggest.height) / crop.h))
+		grab_width = getThumbnailWidth(gen, grab_height, sar)
+	}
+	// everything changing the saved frames is part of the key, a restart with other settings must not reuse them.
+	// Settings.TileTransform is applied after the frames are saved, only its presence changes the signatures.
+	var crop_key cropRect
+	if crop != nil {
+		crop_key = *crop
+	}
+	var colors_key [3][3]float64
+	if colors != nil {
+		colors_key = colors.mat
+	}
+	checkpoint_key := fmt.Sprintf(
+		"%s/sharpen=%v/crop=%v/colors=%v/transfer=%d/deinterlace=%s/sharp_window=%d/black=%d/filter=%v/accurate=%t/sar=%v/alpha=%t/poster=%t/transform=%t",
+		opts.key(),
+		sharpen,
+		crop_key,
+		colors_key,
+		transfer,
+		gen.deinterlace,
+		Settings.ThumbnailSharpWindow,
+		Settings.ThumbnailBlackThreshold,
+		Settings.ThumbnailResizeFilter.Support,
+		Settings.AccurateThumbnails,
+		sar,
+		alpha,
+		poster != nil,
+		Settings.TileTransform != nil,
+	)
+	checkpoint := openCheckpoint(logger, out, checkpoint_key, timestamps, biggest.width, biggest.height)
+	// draw the processed frame i in every sheet (on_frame calls are serialized, saved frames are drawn first).
+	add_tile := func(i int, ts float64, img image.Image) {
+		if Settings.ThumbnailDedupThreshold > 0 {
+			signatures[i] = getSignature(img)
+		}
+		// reuse the decoded frame instead of grabbing another one (on_frame calls are serialized).
+		if Settings.ThumbnailBlurhash && i == getBlurhashFrame(numcaps) {
+			hash = getBlurhash(img)
+		}
+		// after the signatures and the blurhash, overlays should not prevent merging identical frames.
+		if Settings.TileTransform != nil {
+			img = Settings.TileTransform(img, ts)
+			if size := img.Bounds().Size(); size.X != biggest.width || size.Y != biggest.height {
+				img = imaging.Resize(img, biggest.width, biggest.height, Settings.ThumbnailResizeFilter)
+			}
+		}
+		for _, sheet := range sheets {
+			tile := img
+			if sheet != biggest {
+				tile = imaging.Resize(img, sheet.width, sheet.height, Settings.ThumbnailResizeFilter)
+			}
+			page, x, y := sheet.tilePos(i)
+			// imaging.Paste would copy the whole sprite for every tile, draw in place instead.
+			draw.Draw(sheet.sprites[page], image.Rect(x, y, x+sheet.width, y+sheet.height), tile, tile.Bounds().Min, op)
+		}
+		status.done.Add(1)
+		status.notify()
+	}
+	// timestamps of the frames to grab, the ones saved by an interrupted extraction are already processed.
+	indexes := checkpoint.missing(numcaps)
+	for _, i := range checkpoint.frames() {
+		if img, err := checkpoint.load(i); err == nil {
+			add_tile(i, timestamps[i], img)
+		} else {
+			indexes = append(indexes, i)
+		}
+	}
+	slices.Sort(indexes)
+	grabbing := make([]float64, len(indexes))
+	for j, i := range indexes {
+		grabbing[j] = timestamps[i]
+	}
+
+	grab := func(on_frame func(i int, ts float64, img image.Image) error) error {
+		return grabTimeline(ctx, parts, grabbing, grab_width, grab_height, on_frame)
+	}
+	// ffmpeg decodes the default video stream, files where seeks land at random are read from start to end instead.
+	if len(parts) == 1 && opts.Stream == 0 && !IsRemotePath(path) && hasInaccurateSeeks(gen, sar) {
+		logger.Warn("Seeks are inaccurate in this file, decoding it sequentially", "path", path)
+		grab = func(on_frame func(i int, ts float64, img image.Image) error) error {
+			return grabSequential(ctx, path, gen.deinterlace, grabbing, grab_width, grab_height, on_frame)
+		}
+	}
+	if len(grabbing) > 0 {
+		err = grab(func(j int, ts float64, img image.Image) error {
+			i := indexes[j]
+			_, missing[i] = img.(missingFrame)
+			if i == 0 && poster != nil {
+				// the poster is already a displayable image, fill the tile with it like the frames.
+				img = imaging.Fill(poster, biggest.width, biggest.height, imaging.Center, Settings.ThumbnailResizeFilter)
+			} else {
+				if crop != nil {
+					img = cropFrame(img, crop, biggest.width, biggest.height)
+				}
+				img = tonemap(fixColors(img, colors), transfer)
+				// frames are already scaled by the decoder, smaller sheets are downscaled from the sharpened tile.
+				if sharpen > 0 {
+					img = imaging.Sharpen(img, sharpen)
+				}
+			}
+			// missing frames are grabbed again, they may be decodable after a crash (of a network share...).
+			if !missing[i] {
+				if err := checkpoint.save(i, img); err != nil {
+					logger.Warn("Could not save a frame, the extraction can't be resumed from it", "path", path, "err", err)
+					checkpoint = nil
+				}
+			}
+			add_tile(i, ts, img)
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, ThumbnailInfo{}, nil, err
+	}
+
+	// durations are sometimes a bit too long, the last timestamps can be past the end of the video. Instead of
+	// black tiles, the last frame that could be decoded lasts until the end.
+	grabbed := numcaps
+	for grabbed > 1 && missing[grabbed-1] {
+		grabbed--
+	}
+	if grabbed < numcaps {
+		logger.Warn("Could not decode the last frames, dropping them", "path", path, "numcaps", numcaps, "grabbed", grabbed)
+	}
+	// frames displayed in the sheets, runs of identical frames (slideshows...) only keep their first tile.
+	tiles := dedupFrames(signatures[:grabbed])
+	if len(tiles) < grabbed {
+		logger.Info("Merged identical thumbnails", "path", path, "numcaps", grabbed, "tiles", len(tiles))
+	}
+	if len(tiles) < numcaps {
+		for _, sheet := range sheets {
+			// the previous pages are only released at the end of the extraction.
+			releases = append(releases, sheet.compact(out, tiles))
+		}
+	}
+	// ranges are clamped to the video, like their thumbnails.
+	range_end := cmp.Or(opts.End, span_end)
+	if duration := float64(timeline.Duration) / 1000; duration > 0 && range_end > duration {
+		range_end = duration
+	}
+	for _, sheet := range sheets {
+		sheet.cues = make([]string, len(tiles))
+		sheet.json_cues = make([]JsonCue, len(tiles))
+		for i, frame := range tiles {
+			// a tile lasts until the next tile, including the frames merged into it.
+			last := numcaps - 1
+			if i+1 < len(tiles) {
+				last = tiles[i+1] - 1
+			}
+			page, x, y := sheet.tilePos(i)
+			ts := timestamps[frame]
+			if i == 0 && skipped_intro && Settings.ThumbnailCoverStart {
+				// the intro shows the first thumbnail instead of nothing.
+				ts = 0
+			}
+			end := getCueEnd(timeline, timestamps, last, interval, range_end)
+			// the route is named after the main sprite file so cues always point to the file we write
+			// (other sheets are selected with the height, scale and page params).
+			src := fmt.Sprintf("%s.%s%s", Settings.SpriteBaseName, sheet.format, opts.query(sheet.size, page))
+			if opts.Out != "" {
+				// the vtt is written next to the sprites, they are served together.
+				src = filepath.Base(getSpritePath(out, sheet.format, sheet.size, page))
+			} else if sha != "" {
+				// use the sha instead of the path to keep cues short and not leak the server's file tree.
+				src = fmt.Sprintf("%s/thumbnails/%s/%s", Settings.RoutePrefix, sha, src)
+			}
+			sheet.cues[i] = fmt.Sprintf(
+				"%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+				tsToVttTime(ts),
+				tsToVttTime(end),
+				src,
+				x,
+				y,
+				sheet.width,
+				sheet.height,
+			)
+			sheet.json_cues[i] = JsonCue{
+				Start: ts,
+				End:   end,
+				X:     x,
+				Y:     y,
+				W:     sheet.width,
+				H:     sheet.height,
+				Src:   src,
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, ThumbnailInfo{}, nil, err
+	}
+	// sheets[0] is the main sheet.
+	info = ThumbnailInfo{
+		Count:    len(tiles),
+		Interval: interval,
+		Columns:  sheets[0].columns,
+		Rows:     sheets[0].rows,
+		Order:    Settings.SpriteOrder,
+		Pages:    len(sheets[0].sprites),
+		Width:    width,
+		Height:   height,
+		Gap:      Settings.TileGap,
+		// the first height is the main one, 0 in auto mode.
+		Heights:      slices.Replace(slices.Clone(Settings.ThumbnailHeights), 0, 1, sizes[0].tileHeight(height)),
+		Scales:       Settings.ThumbnailScales,
+		MaxTileWidth: Settings.MaxTileWidth,
+		MaxSpan:      Settings.ThumbnailMaxSpanSeconds,
+		Blurhash:     hash,
+		Source:       getFileSource(path),
+	}
+	if opts.At != "" || opts.Count > 0 || opts.End > 0 || aligned || adaptive || skipped_intro || len(tiles) < numcaps {
+		info.Timestamps = make([]float64, len(tiles))
+		for i, frame := range tiles {
+			info.Timestamps[i] = timestamps[frame]
+		}
+	}
+	return sheets, info, free, nil
+}
+
+// Remove the sprites, vtts and layout of a thumbnails directory, from the local metadata dir and from the store.
+func removeSheets(out string) {
+	verified_sprites.RemoveFunc(func(path string, _ bool) bool { return strings.HasPrefix(path, out+"/") })
+	remove := func(path string) {
+		if err := metadata_store.Remove(path); err != nil {
+			slog.Warn("Could not remove a thumbnail file", "path", path, "err", err)
+		}
+	}
+	for _, size := range getSheetSizes() {
+		// sprites of every format, the format may have changed since they were extracted.
+		for page := 0; ; page++ {
+			found := false
+			for _, format := range ThumbnailFormats {
+				sprite := getSpritePath(out, format, size, page)
+				if page == 0 || metadata_store.Exists(sprite) {
+					found = true
+					remove(sprite)
+					remove(getChecksumPath(sprite))
+				}
+			}
+			// pages are numbered without gaps, the store can't be listed.
+			if page > 0 && !found {
+				break
+			}
+		}
+		// leftovers of the local metadata dir (pages of an older layout...).
+		pages, _ := filepath.Glob(fmt.Sprintf("%s/%s.*.*", out, getSheetName(size)))
+		for _, page := range pages {
+			remove(page)
+		}
+		remove(GetVttPath(out, size))
+		remove(GetJsonCuesPath(out, size))
+	}
+	remove(getThumbnailInfoPath(out))
+	remove(getLegacyThumbnailInfoPath(out))
 }
 
-var thumbnails = NewCMap[string, *Thumbnail]()
+func getEvenTimestamps(numcaps int, interval float64) []float64 {
+	ret := make([]float64, numcaps)
+	for i := range ret {
+		ret[i] = float64(i) * interval
+	}
+	return ret
+}
 
-func ExtractThumbnail(path string, sha string) (string, error) {
-	ret, _ := thumbnails.GetOrCreate(sha, func() *Thumbnail {
-		ret := &Thumbnail{
-			path: fmt.Sprintf("%s/%s", Settings.Metadata, sha),
+// Move timestamps to their nearest keyframe. Without accurate thumbnails, seeks stop at the keyframe before
+// the timestamp anyway: aligned timestamps avoid seeking back in the same gop and keep cues on the frame they show.
+// Timestamps ending on the same keyframe are merged.
+func alignToKeyframes(timestamps []float64, keyframes []float64) []float64 {
+	keyframes = slices.Clone(keyframes)
+	slices.Sort(keyframes)
+	ret := make([]float64, 0, len(timestamps))
+	for _, ts := range timestamps {
+		i, _ := slices.BinarySearch(keyframes, ts)
+		kf := keyframes[min(i, len(keyframes)-1)]
+		if i > 0 && (i == len(keyframes) || ts-keyframes[i-1] < kf-ts) {
+			kf = keyframes[i-1]
 		}
-		ret.ready.Add(1)
-		go func() {
-			extractThumbnail(path, ret.path)
-			ret.ready.Done()
-		}()
+		if len(ret) > 0 && kf <= ret[len(ret)-1] {
+			continue
+		}
+		ret = append(ret, kf)
+	}
+	return ret
+}
+
+// A cue lasts until the next thumbnail starts. The last one lasts until end (the end of the range, 0 for the
+// end of the video) so cues cover everything: intervals are rounded down and the last ones would stop before
+// the end of the video. When it is unknown, we use the interval of evenly spaced thumbnails.
+func getCueEnd(gen *Generator, timestamps []float64, i int, interval float64, end float64) float64 {
+	if i+1 < len(timestamps) {
+		return timestamps[i+1]
+	}
+	if end <= 0 {
+		end = float64(gen.Duration) / 1000
+	}
+	if end > timestamps[i] {
+		return end
+	}
+	if interval > 0 {
+		return timestamps[i] + interval
+	}
+	return timestamps[i] + float64(Settings.ThumbnailInterval)
+}
+
+// The generator doesn't know the frame rate of videos, this is used to estimate the number of frames of clips.
+var assumed_frame_rate = 24.
+
+// Inputs of computeSpriteLayout, see layoutOpts to fill them from the settings.
+type LayoutOpts struct {
+	// Requested number of seconds between two thumbnails.
+	Interval float64
+	// Maximum and minimum number of thumbnails (see Settings.ThumbnailMaxCaps and Settings.MinThumbnails).
+	MaxCaps int
+	MinCaps int
+	// Height of the thumbnails, the size of the tiles and the grid are only computed when it is set.
+	Height int
+	// Space between tiles and maximum size of a page (see Settings.TileGap and Settings.MaxSpriteDimension).
+	Gap          int
+	MaxDimension int
+	// Maximum width of the tiles, their height is lowered to fit (see Settings.MaxTileWidth).
+	MaxTileWidth int
+}
+
+// Layout of the main sprite of a video, see computeSpriteLayout.
+type Layout struct {
+	Numcaps  int
+	Interval float64
+	// Number of tiles per row and per column of a page and number of pages.
+	Columns int
+	Rows    int
+	Pages   int
+	// Size of a thumbnail.
+	Width  int
+	Height int
+}
+
+// The layout options of o, with the settings for the rest. height is the height of the thumbnails (0 to skip the grid).
+func (o ThumbnailOptions) layoutOpts(height int) LayoutOpts {
+	return LayoutOpts{
+		Interval:     o.Interval,
+		MaxCaps:      o.MaxCaps,
+		MinCaps:      Settings.MinThumbnails,
+		Height:       height,
+		Gap:          Settings.TileGap,
+		MaxDimension: Settings.MaxSpriteDimension,
+		MaxTileWidth: Settings.MaxTileWidth,
+	}
+}
+
+// The layout of the thumbnails of a video of duration seconds displayed at width x height. This does not read
+// anything, videos with an unknown duration (0) only get the first thumbnail.
+func computeSpriteLayout(duration float64, width int, height int, opts LayoutOpts) Layout {
+	var numcaps int
+	if opts.Interval < duration {
+		numcaps = int(duration / opts.Interval)
+	} else {
+		numcaps = int(duration / 10)
+	}
+	requested := opts.Interval
+	if numcaps < opts.MinCaps && duration > 0 {
+		// clips of a few frames would repeat the same frame in multiple tiles.
+		numcaps = min(opts.MinCaps, max(int(duration*assumed_frame_rate), 1))
+		// the interval can get below a second, round it to milliseconds.
+		requested = min(requested, duration/float64(numcaps))
+	}
+	// videos shorter than an interval (or with an unknown duration) still get a thumbnail at t=0.
+	numcaps = max(min(numcaps, opts.MaxCaps), 1)
+	ret := Layout{
+		Numcaps:  numcaps,
+		Interval: roundInterval(duration/float64(numcaps), requested),
+	}
+	if ret.Interval <= 0 {
+		ret.Interval = opts.Interval
+	}
+	if opts.Height <= 0 || width <= 0 || height <= 0 {
 		return ret
-	})
-	ret.ready.Wait()
-	return ret.path, nil
+	}
+	tile_width := func(h int) int { return int(float64(h) / float64(height) * float64(width)) }
+	ret.Height = capTileHeight(opts.Height, opts.MaxTileWidth, tile_width)
+	ret.Width = tile_width(ret.Height)
+	ret.Columns, ret.Rows, ret.Pages = getGridLayout(numcaps, ret.Width+opts.Gap, ret.Height+opts.Gap, opts.MaxDimension)
+	return ret
+}
+
+// Lower height until tiles (of width(height)) are at most max_width wide, 0 for no limit. Like
+// getAutoThumbnailHeight, lowered heights are even.
+func capTileHeight(height int, max_width int, width func(h int) int) int {
+	if max_width <= 0 {
+		return height
+	}
+	w := width(height)
+	if w <= max_width {
+		return height
+	}
+	ret := height * max_width / w
+	return max(ret-ret%2, 2)
+}
+
+// Compute the number of thumbnails and the interval (in seconds) between them.
+func getThumbnailLayout(gen *Generator, opts ThumbnailOptions) (int, float64) {
+	if gen.Duration <= 0 {
+		slog.Warn("Unknown duration, only extracting the first thumbnail", "path", gen.Filename, "duration", gen.Duration)
+	}
+	layout := computeSpriteLayout(float64(gen.Duration)/1000, 0, 0, opts.layoutOpts(0))
+	return layout.Numcaps, layout.Interval
+}
+
+// Intervals are rounded down to whole seconds, or to milliseconds when less than a second was requested
+// (for short videos), so cues are readable.
+func roundInterval(interval float64, requested float64) float64 {
+	if requested >= 1 {
+		return math.Floor(interval)
+	}
+	return math.Floor(interval*1000) / 1000
+}
+
+// Same as getThumbnailLayout but only for the opts.Start-opts.End range, clamped to the video.
+func getRangeLayout(gen *Generator, opts ThumbnailOptions) (int, float64, error) {
+	end := opts.End
+	if duration := float64(gen.Duration) / 1000; duration > 0 {
+		end = min(end, duration)
+	}
+	length := roundInterval(end-opts.Start, opts.Interval)
+	if length <= 0 {
+		return 0, 0, fmt.Errorf("the range %g-%g is outside of the video", opts.Start, opts.End)
+	}
+	numcaps := max(min(int(length/opts.Interval), opts.MaxCaps), 1)
+	return numcaps, max(roundInterval(length/float64(numcaps), opts.Interval), min(opts.Interval, 1)), nil
 }
 
-func extractThumbnail(path string, out string) error {
-	defer printExecTime("extracting thumbnails for %s", path)()
-	os.MkdirAll(out, 0o755)
-	sprite_path := fmt.Sprintf("%s/sprite.png", out)
-	vtt_path := fmt.Sprintf("%s/sprite.vtt", out)
+// Timestamps of opts.Count thumbnails evenly spread over the video (or the opts.Start-opts.End range).
+// Unlike getThumbnailLayout, thumbnails are not aligned on whole seconds so exactly opts.Count fit.
+func getCountTimestamps(gen *Generator, opts ThumbnailOptions) ([]float64, error) {
+	end := float64(gen.Duration) / 1000
+	if opts.End > 0 {
+		if end > 0 {
+			end = min(end, opts.End)
+		} else {
+			end = opts.End
+		}
+		if end <= opts.Start {
+			return nil, fmt.Errorf("the range %g-%g is outside of the video", opts.Start, opts.End)
+		}
+	}
+	length := max(end-opts.Start, 0)
+	// at most one thumbnail per second, videos with an unknown duration only get the first one.
+	numcaps := max(min(opts.Count, Settings.ThumbnailMaxCaps, int(length)), 1)
+	step := length / float64(numcaps)
 
-	if _, err := os.Stat(sprite_path); err == nil {
-		return nil
+	ret := make([]float64, numcaps)
+	for i := range ret {
+		ret[i] = opts.Start + float64(i)*step
 	}
+	return ret, nil
+}
 
-	gen, err := screengen.NewGenerator(path)
+// Open a frame generator. By default, it seeks to the nearest keyframe which can be a few seconds away from
+// the requested time, Settings.AccurateThumbnails decodes up to the exact frame instead (way slower).
+func openGenerator(path string) (*Generator, error) {
+	gen, err := newGenerator(path)
 	if err != nil {
-		log.Printf("Error reading video file: %v", err)
+		return nil, err
+	}
+	// malformed files can report an empty video stream, thumbnails would have a 0 (or NaN) width.
+	if gen.Width() <= 0 || gen.Height() <= 0 {
+		width, height := gen.Width(), gen.Height()
+		gen.Close()
+		return nil, fmt.Errorf("%w: %s has a video stream of %dx%d", ErrUnreadableSource, path, width, height)
+	}
+	gen.Fast = !Settings.AccurateThumbnails
+	return gen, nil
+}
+
+// Number of generators used to grab frames of a single video in parallel. Seeking dominates the
+// extraction time so multiple decoders on the same file are a lot faster than a single one.
+func getGeneratorCount(gen *Generator) int {
+	if count, ok := Settings.CodecGenerators[strings.ToUpper(gen.VideoCodec)]; ok {
+		return count
+	}
+	return Settings.ThumbnailGenerators
+}
+
+// Number of threads of the decoders of a codec, 0 for ffmpeg's default.
+func getDecodeThreads(codec string) int {
+	if threads, ok := Settings.CodecDecodeThreads[strings.ToUpper(codec)]; ok {
+		return threads
+	}
+	return Settings.DecodeThreads
+}
+
+// Input flags of the ffmpeg decoder of thumbnails: its threads and, with Settings.ThumbnailHwDecode, the hardware
+// decoder of Settings.HwAccel. Its -hwaccel_output_format is dropped so frames are downloaded to the cpu.
+func getThumbnailDecodeFlags(codec string) []string {
+	var ret []string
+	if threads := getDecodeThreads(codec); threads > 0 {
+		ret = append(ret, "-threads", strconv.Itoa(threads))
+	}
+	if Settings.ThumbnailHwDecode {
+		flags := Settings.HwAccel.DecodeFlags
+		for i := 0; i < len(flags); i++ {
+			if flags[i] == "-hwaccel_output_format" {
+				i++
+				continue
+			}
+			ret = append(ret, flags[i])
+		}
+	}
+	return ret
+}
+
+// Parse per codec counts (codec=count, comma separated) of env. Codecs use the ffmpeg decoder names
+// (vc1, hevc...), case insensitive.
+func getCodecCounts(env string) map[string]int {
+	ret := make(map[string]int)
+	for _, s := range strings.Split(GetEnvOr(env, ""), ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		codec, value, found := strings.Cut(s, "=")
+		count, err := strconv.Atoi(strings.TrimSpace(value))
+		if !found || err != nil || count <= 0 {
+			slog.Warn("Invalid codec count, it should be codec=count, ignoring it", "env", env, "value", s)
+			continue
+		}
+		ret[strings.ToUpper(strings.TrimSpace(codec))] = count
+	}
+	return ret
+}
+
+// Placeholder (a black frame) given to on_frame for frames that could not be decoded.
+type missingFrame struct {
+	*image.NRGBA
+}
+
+// Grab a frame at each timestamp (in seconds) and call on_frame with each of them.
+// Frames are grabbed in parallel so on_frame can be called in any order, but never concurrently.
+// Frames that can't be decoded are replaced by a missingFrame, this only fails if none could be decoded.
+func grabFrames(
+	ctx context.Context,
+	gen *Generator,
+	timestamps []float64,
+	width int,
+	height int,
+	on_frame func(i int, ts float64, img image.Image) error,
+) error {
+	logger := getLogger(ctx)
+	numcaps := len(timestamps)
+	gens := []*Generator{gen}
+	for len(gens) < min(getGeneratorCount(gen), numcaps) {
+		other, err := openGenerator(gen.Filename)
+		if err != nil {
+			logger.Warn("Could not open another generator", "path", gen.Filename, "generators", len(gens), "err", err)
+			break
+		}
+		defer other.Close()
+		if gen.deinterlace != "" {
+			other.useDeinterlacer(gen.deinterlace)
+		}
+		gens = append(gens, other)
+	}
+
+	grab_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var ret error
+	// number of frames successfully decoded and of frames replaced by a black one.
+	var grabbed atomic.Int32
+	var skipped atomic.Int32
+	// only warn once per extraction, every frame of the file usually has the same size.
+	var warn_size sync.Once
+	fail := func(err error) {
+		lock.Lock()
+		if ret == nil {
+			ret = err
+		}
+		lock.Unlock()
+		cancel()
+	}
+
+	// the fps limit is shared by all generators of the extraction.
+	var frame_interval time.Duration
+	if Settings.ThumbnailMaxFps > 0 {
+		frame_interval = time.Duration(len(gens)) * time.Second / time.Duration(Settings.ThumbnailMaxFps)
+	}
+
+	// each generator grabs a contiguous range of frames.
+	chunk := int(math.Ceil(float64(numcaps) / float64(len(gens))))
+	for j, g := range gens {
+		wg.Add(1)
+		go func(g *Generator, start int, end int) {
+			defer wg.Done()
+			defer lowerPriority()()
+			var last time.Time
+			for i := start; i < end; i++ {
+				if wait := frame_interval - time.Since(last); frame_interval > 0 && wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-grab_ctx.Done():
+					}
+				}
+				last = time.Now()
+				if grab_ctx.Err() != nil {
+					return
+				}
+				ts := timestamps[i]
+				// black frames are replaced by the next seconds, up to the next thumbnail.
+				end := getCueEnd(g, timestamps, i, 0, 0)
+				img, err := grabThumbnailWithRetries(logger, g, ts, end, width, height)
+				if errors.Is(err, ErrEncryptedSource) {
+					// no other frame could be decoded.
+					fail(err)
+					return
+				}
+				if err != nil {
+					// an unreadable file fails on its first frames, don't spend time retrying all of them.
+					// other generators start in the middle of the file, their first frame can be past the
+					// real end of a video with a wrong duration.
+					if i == 0 && grabbed.Load() == 0 {
+						logLimited(logger, slog.LevelError, "Could not generate screenshot", "path", g.Filename, "ts", ts, "err", err)
+						if g.Duration <= 0 {
+							fail(fmt.Errorf("%w: %w: %s: %w", ErrNoDuration, ErrUnreadableSource, g.Filename, err))
+						} else {
+							fail(fmt.Errorf("%w: %s: %w", ErrUnreadableSource, g.Filename, err))
+						}
+						return
+					}
+					// only the first skipped frame is logged, the others are counted in the summary below.
+					if skipped.Add(1) == 1 {
+						logger.Warn("Could not generate screenshot, skipping it", "path", g.Filename, "ts", ts, "err", err)
+					} else {
+						logger.Debug("Could not generate screenshot, skipping it", "path", g.Filename, "ts", ts, "err", err)
+					}
+					img = missingFrame{imaging.New(width, height, color.Black)}
+				} else {
+					grabbed.Add(1)
+				}
+				// some decoders ignore the requested size, tiles would not fill their cell and misalign the crops.
+				if size := img.Bounds().Size(); size.X != width || size.Y != height {
+					warn_size.Do(func() {
+						logger.Warn(
+							"Frame has a wrong size, resizing it",
+							"path", g.Filename,
+							"ts", ts,
+							"size", fmt.Sprintf("%dx%d", size.X, size.Y),
+							"expected", fmt.Sprintf("%dx%d", width, height),
+						)
+					})
+					img = imaging.Resize(img, width, height, Settings.ThumbnailResizeFilter)
+				}
+				lock.Lock()
+				err = on_frame(i, ts, img)
+				lock.Unlock()
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+		}(g, j*chunk, min((j+1)*chunk, numcaps))
+	}
+	wg.Wait()
+
+	if n := skipped.Load(); n > 1 {
+		logger.Warn("Skipped screenshots that could not be generated", "path", gen.Filename, "skipped", n, "total", numcaps)
+	}
+	if ret != nil {
+		return ret
+	}
+	if err := ctx.Err(); err != nil {
+		logger.Info("Thumbnails extraction cancelled", "path", gen.Filename, "err", err)
 		return err
 	}
-	defer gen.Close()
+	if numcaps > 0 && grabbed.Load() == 0 {
+		return fmt.Errorf("%w: %s: no frame could be decoded", ErrUnreadableSource, gen.Filename)
+	}
+	return nil
+}
 
-	gen.Fast = true
+// Some codecs fail to decode specific frames, frames that could not be decoded are retried a bit later.
+var frame_retry_nudge = 0.5
 
-	duration := int(gen.Duration) / 1000
-	var numcaps int
-	if default_interval < duration {
-		numcaps = duration / default_interval
-	} else {
-		numcaps = duration / 10
+// Same as grabThumbnail but decode errors are retried (up to Settings.ThumbnailRetries times) with a
+// timestamp nudged forward, never past end.
+func grabThumbnailWithRetries(logger *slog.Logger, gen *Generator, ts float64, end float64, width int, height int) (image.Image, error) {
+	img, err := grabThumbnail(gen, ts, end, width, height)
+	for retry := 1; err != nil && !errors.Is(err, ErrEncryptedSource) && retry <= Settings.ThumbnailRetries; retry++ {
+		// jitter the nudge so retries don't land on the same broken packet.
+		next := ts + float64(retry)*frame_retry_nudge*(1+getRetryJitter(ts, retry)/2)
+		if next >= end {
+			break
+		}
+		logger.Debug("Retrying screenshot", "path", gen.Filename, "ts", ts, "next", next, "err", err)
+		time.Sleep(time.Duration(retry*retry) * 10 * time.Millisecond)
+		img, err = grabThumbnail(gen, next, end, width, height)
+	}
+	return img, err
+}
+
+// A pseudo random number in [0, 1) derived from the timestamp and the retry: the same file and settings
+// always grab the same frames, regenerated sprites are identical (see checksums and the cdn's etags).
+func getRetryJitter(ts float64, retry int) float64 {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, math.Float64bits(ts))
+	binary.Write(h, binary.LittleEndian, int64(retry))
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
+
+// Grab the frame at ts (in seconds) for a thumbnail lasting until end.
+func grabThumbnail(gen *Generator, ts float64, end float64, width int, height int) (image.Image, error) {
+	img, err := grabFrame(gen, int64(ts*1000), width, height)
+	if err != nil {
+		return nil, err
 	}
-	numcaps = min(numcaps, max_numcaps)
-	interval := duration / numcaps
-	columns := int(math.Sqrt(float64(numcaps)))
-	rows := int(math.Ceil(float64(numcaps) / float64(columns)))
+	// black frames (intros, fade outs) are useless as previews, try the next seconds instead.
+	// we never go past the end of this thumbnail's cue.
+	for retry := 1; retry <= max_black_retries && ts+float64(retry) < end && isBlack(img); retry++ {
+		next, err := grabFrame(gen, int64((ts+float64(retry))*1000), width, height)
+		if err != nil {
+			break
+		}
+		img = next
+	}
+	if Settings.ThumbnailSharpWindow > 1 && !isBlack(img) {
+		img = grabSharpest(gen, img, ts, end, width, height)
+	}
+	return img, nil
+}
+
+// Seconds between the frames compared by grabSharpest, seeks land on keyframes (without
+// Settings.AccurateThumbnails) so closer frames would often be the same.
+var sharp_window_step = 0.5
+
+// Grab Settings.ThumbnailSharpWindow-1 frames after img (the frame at ts) and return the sharpest of them, to avoid
+// motion blurred or transition frames. Like black frames, we never go past the end of the cue.
+func grabSharpest(gen *Generator, img image.Image, ts float64, end float64, width int, height int) image.Image {
+	sharpness := getSharpness(img)
+	for i := 1; i < Settings.ThumbnailSharpWindow && ts+float64(i)*sharp_window_step < end; i++ {
+		next, err := grabFrame(gen, int64((ts+float64(i)*sharp_window_step)*1000), width, height)
+		if err != nil {
+			break
+		}
+		if s := getSharpness(next); s > sharpness && !isBlack(next) {
+			img, sharpness = next, s
+		}
+	}
+	return img
+}
+
+// Name of the files of a sheet (without extension). Sheets other than the main one are suffixed by their
+// height and scale (sprite-240.vtt, sprite@2x.webp, sprite-240@2x.webp), see Settings.SpriteBaseName.
+func getSheetName(size SheetSize) string {
+	ret := Settings.SpriteBaseName
+	if size.Height != thumbnail_height {
+		ret += fmt.Sprintf("-%d", size.Height)
+	}
+	if size.Scale != 1 {
+		ret += fmt.Sprintf("@%dx", size.Scale)
+	}
+	return ret
+}
+
+// Name of the file of a page of a sheet (without extension), pages other than the first one are
+// suffixed by their index (sprite.webp, sprite.1.webp, sprite.2.webp...).
+func getPageName(size SheetSize, page int) string {
+	if page == 0 {
+		return getSheetName(size)
+	}
+	return fmt.Sprintf("%s.%d", getSheetName(size), page)
+}
+
+func getSpritePath(out string, format string, size SheetSize, page int) string {
+	return fmt.Sprintf("%s/%s.%s", out, getPageName(size, page), format)
+}
+
+func GetVttPath(out string, size SheetSize) string {
+	return fmt.Sprintf("%s/%s.vtt", out, getSheetName(size))
+}
+
+func GetJsonCuesPath(out string, size SheetSize) string {
+	return fmt.Sprintf("%s/%s.json", out, getSheetName(size))
+}
+
+func hasAllSprites(out string, opts ThumbnailOptions) bool {
+	for _, size := range getSheetSizes() {
+		if _, ok := FindSprite(out, opts, size, 0); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Find the sprite stored in a thumbnail directory extracted with opts. Sprites generated with another
+// format (before a Settings.ThumbnailFormat change) are still served so libraries don't have to be
+// regenerated at once, the next regeneration replaces them (see hasStaleSprites).
+func FindSprite(out string, opts ThumbnailOptions, size SheetSize, page int) (string, bool) {
+	sprite_path := getSpritePath(out, opts.getFormat(), size, page)
+	if metadata_store.Exists(sprite_path) {
+		return sprite_path, true
+	}
+	for _, format := range ThumbnailFormats {
+		if format == opts.getFormat() {
+			continue
+		}
+		if sprite_path := getSpritePath(out, format, size, page); metadata_store.Exists(sprite_path) {
+			return sprite_path, true
+		}
+	}
+	return "", false
+}
 
-	height := 144
-	width := int(float64(height) / float64(gen.Height()) * float64(gen.Width()))
+// Check if out contains sprites of another format than current, left by an extraction made before a
+// Settings.ThumbnailFormat change.
+func hasStaleSprites(out string, current string) bool {
+	for _, format := range ThumbnailFormats {
+		if format == current {
+			continue
+		}
+		for _, size := range getSheetSizes() {
+			if metadata_store.Exists(getSpritePath(out, format, size, 0)) {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	sprite := imaging.New(width*columns, height*rows, color.Black)
-	vtt := "WEBVTT\n\n"
+// Save the sprite in the given format, whatever the extension of sprite_path is.
+// Lowest quality used to fit sprites in Settings.MaxSpriteBytes and the step between each try.
+var (
+	sprite_min_quality  = 20
+	sprite_quality_step = 15
+)
 
-	log.Printf("Extracting %d thumbnails for %s (interval of %d).", numcaps, path, interval)
+var errSpriteOverCap = errors.New("the sprite is bigger than GOCODER_MAX_SPRITE_BYTES even at the lowest quality")
 
-	ts := 0
-	for i := 0; i < numcaps; i++ {
-		img, err := gen.ImageWxH(int64(ts*1000), width, height)
+// Save the sprite, lowering its quality until it fits in Settings.MaxSpriteBytes. Returns the quality used,
+// errSpriteOverCap if even the lowest one is too big (png sprites have no quality to lower).
+func saveSpriteWithin(sprite *image.NRGBA, sprite_path string, format string, quality int) (int, error) {
+	for {
+		if err := saveSprite(sprite, sprite_path, format, quality); err != nil {
+			return quality, err
+		}
+		if Settings.MaxSpriteBytes <= 0 {
+			return quality, nil
+		}
+		info, err := os.Stat(sprite_path)
 		if err != nil {
-			log.Printf("Could not generate screenshot %s", err)
-			return err
+			return quality, err
+		}
+		if info.Size() <= Settings.MaxSpriteBytes {
+			return quality, nil
 		}
+		if format == "png" || quality <= sprite_min_quality {
+			return quality, fmt.Errorf("%w: %d bytes", errSpriteOverCap, info.Size())
+		}
+		quality = max(quality-sprite_quality_step, sprite_min_quality)
+	}
+}
 
-		x := (i % columns) * width
-		y := (i / columns) * height
-		sprite = imaging.Paste(sprite, img, image.Pt(x, y))
-
-		timestamps := ts
-		ts += interval
-		vtt += fmt.Sprintf(
-			"%s --> %s\n%s/%s/thumbnails.png#xywh=%d,%d,%d,%d\n\n",
-			tsToVttTime(timestamps),
-			tsToVttTime(ts),
-			Settings.RoutePrefix,
-			base64.StdEncoding.EncodeToString([]byte(path)),
-			x,
-			y,
-			width,
-			height,
+// Same as saveSpriteWithin for a page of sheet, encoding failures (errors and panics of the encoders) are
+// returned as ErrEncodeFailed with the size of the page. The geometry of the sheet is logged to find which
+// settings make sprites too big to encode. Like other write errors, temporary files are removed by the caller.
+func saveSheetPage(logger *slog.Logger, sheet *spriteSheet, sprite *image.NRGBA, sprite_path string) (quality int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("the encoder panicked: %v", r)
+		}
+		// file errors (permissions, full disks...) are not caused by the sprite.
+		var path_err *fs.PathError
+		if err == nil || errors.Is(err, errSpriteOverCap) || errors.As(err, &path_err) || isDiskFull(err) {
+			return
+		}
+		logger.Error(
+			"Could not encode the sprite",
+			"sprite", sprite_path,
+			"format", sheet.format,
+			"width", sprite.Rect.Dx(),
+			"height", sprite.Rect.Dy(),
+			"columns", sheet.columns,
+			"rows", sheet.rows,
+			"pages", len(sheet.sprites),
+			"tile", fmt.Sprintf("%dx%d", sheet.width, sheet.height),
+			"err", err,
 		)
-	}
+		err = fmt.Errorf("%w: %dx%d %s sprite: %w", ErrEncodeFailed, sprite.Rect.Dx(), sprite.Rect.Dy(), sheet.format, err)
+	}()
+	return saveSpriteWithin(sprite, sprite_path, sheet.format, sheet.quality)
+}
 
-	err = os.WriteFile(vtt_path, []byte(vtt), 0o644)
+func saveSprite(sprite *image.NRGBA, sprite_path string, ext string, quality int) error {
+	if encode, ok := getThumbnailEncoder(ext); ok {
+		return saveWithEncoder(encode, sprite, sprite_path)
+	}
+	if ext == "webp" {
+		return saveWebp(sprite, sprite_path, quality)
+	}
+	format, err := imaging.FormatFromExtension(ext)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(sprite_path)
 	if err != nil {
 		return err
 	}
-	err = imaging.Save(sprite, sprite_path)
+	defer file.Close()
+	if format == imaging.JPEG {
+		err = encodeJpeg(file, sprite, quality)
+	} else {
+		err = imaging.Encode(file, sprite, format)
+	}
 	if err != nil {
 		return err
 	}
+	return file.Close()
+}
+
+// Encode a jpeg thumbnail with Settings.ThumbnailChromaSubsampling. The std encoder always uses 4:2:0,
+// other modes are encoded by ffmpeg (with the same quality scale as libjpeg, so sizes stay comparable).
+func encodeJpeg(w io.Writer, img image.Image, quality int) error {
+	if Settings.ThumbnailChromaSubsampling == "420" {
+		// jpeg quality defaults to 95 which is way too much for thumbnails.
+		return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(quality))
+	}
+	// libjpeg scales its base tables by this percentage, ffmpeg's qscale 8 uses the base tables as is.
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	rgba := imaging.Clone(img)
+	cmd := exec.Command(
+		Settings.FfmpegPath,
+		"-nostats", "-hide_banner", "-loglevel", "warning",
+		"-f", "rawvideo",
+		"-pix_fmt", "rgba",
+		"-s", fmt.Sprintf("%dx%d", rgba.Rect.Dx(), rgba.Rect.Dy()),
+		"-i", "pipe:0",
+		"-map_metadata", "-1",
+		"-fflags", "+bitexact",
+		"-flags:v", "+bitexact",
+		"-c:v", "mjpeg",
+		"-pix_fmt", "yuvj"+Settings.ThumbnailChromaSubsampling+"p",
+		"-qmin", "1",
+		"-q:v", fmt.Sprint(min(max((scale*8+50)/100, 1), 31)),
+		"-frames:v", "1",
+		"-f", "image2pipe",
+		"pipe:1",
+	)
+	cmd.Stdin = bytes.NewReader(rgba.Pix)
+	cmd.Stdout = w
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not encode jpeg thumbnail: %s: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// Neither the std nor imaging can encode webp so we ask ffmpeg to do it.
+// The sprite is sent as raw rgba frames to skip a useless encode/decode.
+// Like the std encoders used for other formats, no metadata (exif, icc profile, encoder version) is written:
+// sprites are plain srgb and the same frames always give the same bytes, which keeps caches valid.
+func saveWebp(sprite *image.NRGBA, sprite_path string, quality int) error {
+	bounds := sprite.Bounds()
+	cmd := exec.Command(
+		Settings.FfmpegPath,
+		"-nostats", "-hide_banner", "-loglevel", "warning",
+		"-f", "rawvideo",
+		"-pix_fmt", "rgba",
+		"-s", fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy()),
+		"-i", "pipe:0",
+		"-map_metadata", "-1",
+		"-fflags", "+bitexact",
+		"-flags:v", "+bitexact",
+		"-c:v", "libwebp",
+		"-quality", fmt.Sprint(quality),
+		"-f", "webp",
+		"-y", sprite_path,
+	)
+	cmd.Stdin = bytes.NewReader(sprite.Pix)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not encode webp sprite: %s: %s", err, stderr.String())
+	}
 	return nil
 }
 
-func tsToVttTime(ts int) string {
-	return fmt.Sprintf("%02d:%02d:%02d.000", ts/3600, (ts/60)%60, ts%60)
+// Width of a thumbnail of the given height that respects the aspect ratio of the video.
+func getThumbnailWidth(gen *Generator, height int, sar float64) int {
+	width, gen_height := getDisplaySize(gen, sar)
+	return int(float64(height) / float64(gen_height) * float64(width))
+}
+
+// Retrieve the pixel aspect ratio of the main video stream since screengen does not expose it.
+func getPixelAspectRatio(path string, sha string) float64 {
+	// mediainfo only reads local files.
+	if IsRemotePath(path) {
+		return 1
+	}
+	info, err := ProbeMedia(path, sha)
+	if err != nil || info.Video == nil || info.Video.PixelAspectRatio <= 0 {
+		return 1
+	}
+	return float64(info.Video.PixelAspectRatio)
+}
+
+// The ffmpeg filter deinterlacing the frames of the video (see Settings.DeinterlaceThumbnails), empty for
+// progressive videos: deinterlacing softens them.
+func getDeinterlaceFilter(path string, sha string) string {
+	switch Settings.DeinterlaceThumbnails {
+	case "always":
+		return "yadif"
+	case "auto":
+		if IsRemotePath(path) {
+			return ""
+		}
+		// only frames flagged as interlaced, files with mixed content keep their progressive frames sharp.
+		if info, err := ProbeMedia(path, sha); err == nil && info.Video != nil && info.Video.Interlaced {
+			return "yadif=deint=interlaced"
+		}
+	}
+	return ""
+}
+
+func getDeinterlaceMode() string {
+	mode := GetEnvOr("GOCODER_THUMBNAIL_DEINTERLACE", "auto")
+	if mode != "auto" && mode != "always" && mode != "never" {
+		slog.Warn("Invalid thumbnail deinterlace mode, it should be auto, always or never, falling back to auto", "mode", mode)
+		return "auto"
+	}
+	return mode
+}
+
+// Check if the video stream has an alpha channel. Its transparency is kept in formats supporting it.
+func hasAlpha(path string, sha string) bool {
+	if IsRemotePath(path) {
+		return false
+	}
+	info, err := ProbeMedia(path, sha)
+	return err == nil && info.Video != nil && info.Video.HasAlpha
+}
+
+// screengen handles pure rotations itself (it rotates frames and swaps Width/Height) but it ignores
+// flips and rotations combined with a flip, we handle those here.
+func isOrientationHandled(gen *Generator) bool {
+	switch gen.Orientation {
+	case AVIdentity, AVRotation90, AVRotation180, AVRotation270:
+		return true
+	}
+	return false
+}
+
+func isRotated(gen *Generator) bool {
+	return gen.Orientation&(AVRotation90|AVRotation270) != 0
+}
+
+// Size of the video as it should be displayed (after rotations and with a sar of 1).
+func getDisplaySize(gen *Generator, sar float64) (int, int) {
+	width, height := gen.Width(), gen.Height()
+	// the sample aspect ratio applies to the stored orientation, undo screengen's swap.
+	if isOrientationHandled(gen) && isRotated(gen) {
+		width, height = height, width
+	}
+	width = int(float64(width)*sar + 0.5)
+	if isRotated(gen) {
+		return height, width
+	}
+	return width, height
+}
+
+// The sample aspect ratio giving frames of gen the display aspect ratio aspect (see getDisplaySize).
+func getAspectSar(gen *Generator, aspect float64) float64 {
+	width, height := gen.Width(), gen.Height()
+	if isOrientationHandled(gen) && isRotated(gen) {
+		width, height = height, width
+	}
+	// rotated frames are displayed with the stored height as their width.
+	if isRotated(gen) {
+		return float64(height) / (float64(width) * aspect)
+	}
+	return aspect * float64(height) / float64(width)
+}
+
+// Grab the frame at ts (in milliseconds) in the display orientation, scaled to width x height.
+func grabFrame(gen *Generator, ts int64, width int, height int) (image.Image, error) {
+	if isOrientationHandled(gen) {
+		return gen.ImageWxH(ts, width, height)
+	}
+	// the frame is decoded in its stored orientation, width and height need to match it.
+	if isRotated(gen) {
+		width, height = height, width
+	}
+	img, err := gen.ImageWxH(ts, width, height)
+	if err != nil {
+		return nil, err
+	}
+	var ret image.Image = img
+	if gen.Orientation&AVFlipHorizontal != 0 {
+		ret = imaging.FlipH(ret)
+	}
+	if gen.Orientation&AVFlipVertical != 0 {
+		ret = imaging.FlipV(ret)
+	}
+	// screengen's rotations are clockwise while imaging's are counter-clockwise.
+	switch {
+	case gen.Orientation&AVRotation90 != 0:
+		ret = imaging.Rotate270(ret)
+	case gen.Orientation&AVRotation180 != 0:
+		ret = imaging.Rotate180(ret)
+	case gen.Orientation&AVRotation270 != 0:
+		ret = imaging.Rotate90(ret)
+	}
+	return ret, nil
+}
+
+func isBlack(img image.Image) bool {
+	if Settings.ThumbnailBlackThreshold <= 0 {
+		return false
+	}
+	// sampling a 32x32 grid is more than enough to know if an image is black.
+	bounds := img.Bounds()
+	step_x := max(bounds.Dx()/32, 1)
+	step_y := max(bounds.Dy()/32, 1)
+	var total float64
+	count := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step_y {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step_x {
+			r, g, b, _ := img.At(x, y).RGBA()
+			// rec.601 luma, RGBA() returns 16bits values.
+			total += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			count++
+		}
+	}
+	return count > 0 && total/float64(count) < float64(Settings.ThumbnailBlackThreshold)
+}
+
+// Size of the grid used to compare thumbnails.
+var signature_size = 16
+
+// Downscaled grayscale version of a frame, used to detect identical adjacent thumbnails.
+func getSignature(img image.Image) []uint8 {
+	small := imaging.Grayscale(imaging.Resize(img, signature_size, signature_size, imaging.Box))
+	ret := make([]uint8, signature_size*signature_size)
+	for i := range ret {
+		ret[i] = small.Pix[i*4]
+	}
+	return ret
+}
+
+// Edge energy of a frame (the variance of the laplacian of its luma), blurry frames have less of it.
+func getSharpness(img image.Image) float64 {
+	gray := imaging.Grayscale(img)
+	w, h := gray.Rect.Dx(), gray.Rect.Dy()
+	if w < 3 || h < 3 {
+		return 0
+	}
+	luma := func(x int, y int) float64 {
+		return float64(gray.Pix[y*gray.Stride+x*4])
+	}
+	var sum, sum_sq float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			laplacian := 4*luma(x, y) - luma(x-1, y) - luma(x+1, y) - luma(x, y-1) - luma(x, y+1)
+			sum += laplacian
+			sum_sq += laplacian * laplacian
+		}
+	}
+	n := float64((w - 2) * (h - 2))
+	mean := sum / n
+	return sum_sq/n - mean*mean
+}
+
+// Mean difference (0-255) between two signatures.
+func getSignatureDiff(a []uint8, b []uint8) float64 {
+	var diff int
+	for i := range a {
+		diff += max(int(a[i])-int(b[i]), int(b[i])-int(a[i]))
+	}
+	return float64(diff) / float64(len(a))
+}
+
+// Indices of the frames to keep, a frame is dropped if its mean difference with the last kept
+// frame is bellow Settings.ThumbnailDedupThreshold. signatures are nil if dedup is disabled.
+func dedupFrames(signatures [][]uint8) []int {
+	ret := make([]int, 0, len(signatures))
+	for i, signature := range signatures {
+		if len(ret) > 0 && signature != nil {
+			last := signatures[ret[len(ret)-1]]
+			if getSignatureDiff(signature, last) < float64(Settings.ThumbnailDedupThreshold) {
+				continue
+			}
+		}
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+// Format a time in seconds as a vtt timestamp (hh:mm:ss.ttt). WebVTT hours have two or more digits and no
+// upper bound, they keep counting past 24h (and widen past 99h) for long timelines of multiple parts.
+// fmt does not depend on the locale. Negative times (rounding of starts before 0) are clamped.
+func tsToVttTime(ts float64) string {
+	// int64 since 32-bit ints overflow after ~596h.
+	ms := max(int64(math.Round(ts*1000)), 0)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3_600_000, (ms/60_000)%60, (ms/1000)%60, ms%1000)
 }
@@ -0,0 +1,991 @@
+package src
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestThumbnailOptionsLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     ThumbnailOptions
+		interval float64
+		maxcaps  int
+	}{
+		{"defaults", ThumbnailOptions{}, float64(Settings.ThumbnailInterval), Settings.ThumbnailMaxCaps},
+		{"custom", ThumbnailOptions{Interval: 5, MaxCaps: 20}, 5, 20},
+		{"interval too small", ThumbnailOptions{Interval: 0.1}, float64(Settings.ThumbnailMinInterval), Settings.ThumbnailMaxCaps},
+		{"too many caps", ThumbnailOptions{MaxCaps: 100000}, float64(Settings.ThumbnailInterval), Settings.ThumbnailMaxCaps},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := test.opts.withDefaults()
+			if opts.Interval != test.interval || opts.MaxCaps != test.maxcaps {
+				t.Errorf("got interval %g and maxcaps %d, expected %g and %d", opts.Interval, opts.MaxCaps, test.interval, test.maxcaps)
+			}
+		})
+	}
+
+	// clamped options share the sprites of the options they are clamped to.
+	if key := (ThumbnailOptions{MaxCaps: 100000}).key(); key != "" {
+		t.Errorf("maxcaps above the settings got its own key %q", key)
+	}
+	if a, b := (ThumbnailOptions{Interval: 0.1}).key(), (ThumbnailOptions{Interval: float64(Settings.ThumbnailMinInterval)}).key(); a != b {
+		t.Errorf("interval below the minimum got the key %q instead of %q", a, b)
+	}
+}
+
+func TestThumbnailVariantsLimit(t *testing.T) {
+	Settings.Metadata = t.TempDir()
+	defer func(old int) { Settings.ThumbnailMaxVariants = old }(Settings.ThumbnailMaxVariants)
+	Settings.ThumbnailMaxVariants = 3
+	sha := "variants"
+
+	for i := 0; i < Settings.ThumbnailMaxVariants; i++ {
+		if hasTooManyVariants(sha) {
+			t.Fatalf("%d variants are below the limit", i)
+		}
+		key := ThumbnailOptions{Height: 100 + i}.key()
+		if err := os.MkdirAll(getThumbnailPath(sha, key), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// files of the default thumbnails are not variants.
+	os.WriteFile(filepath.Join(GetMetadataPath(sha), "thumbnails.vtt"), nil, 0o644)
+	if !hasTooManyVariants(sha) {
+		t.Errorf("%d variants should reach the limit", Settings.ThumbnailMaxVariants)
+	}
+	if hasTooManyVariants("other") {
+		t.Error("variants are counted per sha")
+	}
+
+	if (ThumbnailOptions{}).hasOverrides() || (ThumbnailOptions{Count: 10}).hasOverrides() {
+		t.Error("the default density and counts are not overrides")
+	}
+	for _, opts := range []ThumbnailOptions{{Interval: 3}, {Height: 42}, {Quality: 1}, {Format: otherFormat()}} {
+		if !opts.hasOverrides() {
+			t.Errorf("%+v should be an override", opts)
+		}
+	}
+}
+
+// A sprite format that is not the one of the settings.
+func otherFormat() string {
+	for _, format := range ThumbnailFormats {
+		if format != Settings.ThumbnailFormat {
+			return format
+		}
+	}
+	return ""
+}
+
+func TestThumbnailDecodeFlags(t *testing.T) {
+	defer func(old SettingsT) { Settings = old }(Settings)
+	Settings.DecodeThreads = 2
+	Settings.CodecDecodeThreads = map[string]int{"VC1": 1}
+	Settings.HwAccel = HwAccelT{
+		DecodeFlags: []string{"-hwaccel", "vaapi", "-hwaccel_device", "/dev/dri/renderD128", "-hwaccel_output_format", "vaapi"},
+	}
+
+	tests := []struct {
+		codec    string
+		hwdecode bool
+		want     []string
+	}{
+		{"h264", false, []string{"-threads", "2"}},
+		{"vc1", false, []string{"-threads", "1"}},
+		// frames are downloaded to the cpu, the output format of the device is dropped.
+		{"hevc", true, []string{"-threads", "2", "-hwaccel", "vaapi", "-hwaccel_device", "/dev/dri/renderD128"}},
+	}
+	for _, test := range tests {
+		Settings.ThumbnailHwDecode = test.hwdecode
+		if got := getThumbnailDecodeFlags(test.codec); !slices.Equal(got, test.want) {
+			t.Errorf("%s (hwdecode %t): got %v, expected %v", test.codec, test.hwdecode, got, test.want)
+		}
+	}
+
+	Settings.DecodeThreads = 0
+	Settings.ThumbnailHwDecode = false
+	if got := getThumbnailDecodeFlags("h264"); len(got) != 0 {
+		t.Errorf("ffmpeg's defaults should not add flags, got %v", got)
+	}
+}
+
+func TestCodecCounts(t *testing.T) {
+	t.Setenv("GOCODER_TEST_CODEC_COUNTS", "vc1=1, HEVC=2,,invalid,av1=0,h264=x")
+	got := getCodecCounts("GOCODER_TEST_CODEC_COUNTS")
+	if want := map[string]int{"VC1": 1, "HEVC": 2}; !maps.Equal(got, want) {
+		t.Errorf("got %v, expected %v", got, want)
+	}
+
+	defer func(old SettingsT) { Settings = old }(Settings)
+	Settings.ThumbnailGenerators = 4
+	Settings.CodecGenerators = got
+	if count := getGeneratorCount(&Generator{VideoCodec: "vc1"}); count != 1 {
+		t.Errorf("vc1 got %d generators, expected 1", count)
+	}
+	if count := getGeneratorCount(&Generator{VideoCodec: "h264"}); count != 4 {
+		t.Errorf("h264 got %d generators, expected 4", count)
+	}
+}
+
+var layout_tests = []struct {
+	name     string
+	duration float64
+	width    int
+	height   int
+	opts     func(o *LayoutOpts)
+	want     Layout
+}{
+	{"ten minutes", 600, 1920, 1080, nil, Layout{Numcaps: 60, Interval: 10, Columns: 7, Rows: 9, Pages: 1, Width: 256, Height: 144}},
+	{"caps clamped", 10800, 1920, 1080, nil, Layout{Numcaps: 150, Interval: 72, Columns: 12, Rows: 13, Pages: 1, Width: 256, Height: 144}},
+	{"short video", 25, 1920, 1080, nil, Layout{Numcaps: 5, Interval: 5, Columns: 2, Rows: 3, Pages: 1, Width: 256, Height: 144}},
+	{"sub-second interval", 2, 1920, 1080, nil, Layout{Numcaps: 5, Interval: 0.4, Columns: 2, Rows: 3, Pages: 1, Width: 256, Height: 144}},
+	// 0.1s is 2 frames at assumed_frame_rate.
+	{"few frames", 0.1, 1920, 1080, nil, Layout{Numcaps: 2, Interval: 0.05, Columns: 1, Rows: 2, Pages: 1, Width: 256, Height: 144}},
+	{"unknown duration", 0, 1920, 1080, nil, Layout{Numcaps: 1, Interval: 10, Columns: 1, Rows: 1, Pages: 1, Width: 256, Height: 144}},
+	{"portrait", 600, 1080, 1920, nil, Layout{Numcaps: 60, Interval: 10, Columns: 7, Rows: 9, Pages: 1, Width: 81, Height: 144}},
+	{"no grid", 600, 0, 0, nil, Layout{Numcaps: 60, Interval: 10}},
+	{"max tile width", 600, 1920, 1080, func(o *LayoutOpts) { o.MaxTileWidth = 200 }, Layout{Numcaps: 60, Interval: 10, Columns: 7, Rows: 9, Pages: 1, Width: 199, Height: 112}},
+	// 2.39:1 is lowered to fit, 4:3 is already narrower.
+	{"2.39:1 max tile width", 600, 1920, 804, func(o *LayoutOpts) { o.MaxTileWidth = 256 }, Layout{Numcaps: 60, Interval: 10, Columns: 7, Rows: 9, Pages: 1, Width: 253, Height: 106}},
+	{"4:3 max tile width", 600, 1440, 1080, func(o *LayoutOpts) { o.MaxTileWidth = 256 }, Layout{Numcaps: 60, Interval: 10, Columns: 7, Rows: 9, Pages: 1, Width: 192, Height: 144}},
+
+	// MaxSpriteDimension edge cases, tiles are 256x144.
+	{"split in pages", 600, 1920, 1080, func(o *LayoutOpts) { o.MaxDimension = 1024 }, Layout{Numcaps: 60, Interval: 10, Columns: 4, Rows: 7, Pages: 3, Width: 256, Height: 144}},
+	{"exactly the max dimension", 600, 1920, 1080, func(o *LayoutOpts) { o.MaxDimension = 7 * 256 }, Layout{Numcaps: 60, Interval: 10, Columns: 7, Rows: 9, Pages: 1, Width: 256, Height: 144}},
+	{"a pixel below the max dimension", 600, 1920, 1080, func(o *LayoutOpts) { o.MaxDimension = 7*256 - 1 }, Layout{Numcaps: 60, Interval: 10, Columns: 6, Rows: 10, Pages: 1, Width: 256, Height: 144}},
+	{"gap over the max dimension", 600, 1920, 1080, func(o *LayoutOpts) { o.MaxDimension, o.Gap = 7*256, 2 }, Layout{Numcaps: 60, Interval: 10, Columns: 6, Rows: 10, Pages: 1, Width: 256, Height: 144}},
+	{"tile bigger than the max dimension", 600, 1920, 1080, func(o *LayoutOpts) { o.MaxDimension = 100 }, Layout{Numcaps: 60, Interval: 10, Columns: 1, Rows: 1, Pages: 60, Width: 256, Height: 144}},
+
+	// the 16k limit of browsers, a page holds at most 64x113 tiles (63x113 a pixel below).
+	{"full 16k page", 72320, 1920, 1080, func(o *LayoutOpts) { o.MaxDimension, o.MaxCaps = 16384, 7232 }, Layout{Numcaps: 7232, Interval: 10, Columns: 64, Rows: 113, Pages: 1, Width: 256, Height: 144}},
+	{"a tile over a 16k page", 72330, 1920, 1080, func(o *LayoutOpts) { o.MaxDimension, o.MaxCaps = 16384, 7233 }, Layout{Numcaps: 7233, Interval: 10, Columns: 64, Rows: 113, Pages: 2, Width: 256, Height: 144}},
+	{"full 16k page, a pixel below", 71190, 1920, 1080, func(o *LayoutOpts) { o.MaxDimension, o.MaxCaps = 16383, 7119 }, Layout{Numcaps: 7119, Interval: 10, Columns: 63, Rows: 113, Pages: 1, Width: 256, Height: 144}},
+	{"a tile over a 16k page, a pixel below", 71200, 1920, 1080, func(o *LayoutOpts) { o.MaxDimension, o.MaxCaps = 16383, 7120 }, Layout{Numcaps: 7120, Interval: 10, Columns: 63, Rows: 113, Pages: 2, Width: 256, Height: 144}},
+}
+
+func layoutTestOpts(edit func(o *LayoutOpts)) LayoutOpts {
+	ret := LayoutOpts{Interval: 10, MaxCaps: 150, MinCaps: 5, Height: 144, MaxDimension: 16000}
+	if edit != nil {
+		edit(&ret)
+	}
+	return ret
+}
+
+func TestComputeSpriteLayout(t *testing.T) {
+	for _, test := range layout_tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := computeSpriteLayout(test.duration, test.width, test.height, layoutTestOpts(test.opts))
+			if got != test.want {
+				t.Errorf("got %+v, expected %+v", got, test.want)
+			}
+			if got.Columns > 0 && got.Columns*got.Rows*got.Pages < got.Numcaps {
+				t.Errorf("%d pages of %dx%d tiles can't hold %d thumbnails", got.Pages, got.Columns, got.Rows, got.Numcaps)
+			}
+			// pages only go over the max dimension when a single tile does.
+			opts := layoutTestOpts(test.opts)
+			if got.Columns > 1 && got.Columns*(got.Width+opts.Gap)-opts.Gap > opts.MaxDimension {
+				t.Errorf("pages of %d columns of %dpx are wider than %dpx", got.Columns, got.Width, opts.MaxDimension)
+			}
+			if got.Rows > 1 && got.Rows*(got.Height+opts.Gap)-opts.Gap > opts.MaxDimension {
+				t.Errorf("pages of %d rows of %dpx are taller than %dpx", got.Rows, got.Height, opts.MaxDimension)
+			}
+		})
+	}
+}
+
+func TestTileCells(t *testing.T) {
+	// a page of 3x2 tiles.
+	tests := []struct {
+		order    string
+		pos      int
+		col, row int
+	}{
+		{"row", 0, 0, 0},
+		{"row", 2, 2, 0},
+		{"row", 3, 0, 1},
+		{"row", 5, 2, 1},
+		{"column", 0, 0, 0},
+		{"column", 1, 0, 1},
+		{"column", 2, 1, 0},
+		{"column", 5, 2, 1},
+	}
+	for _, test := range tests {
+		if col, row := getTileCell(test.order, test.pos, 3, 2); col != test.col || row != test.row {
+			t.Errorf("%s order: tile %d is at %d,%d, expected %d,%d", test.order, test.pos, col, row, test.col, test.row)
+		}
+	}
+}
+
+func TestSheetLastPage(t *testing.T) {
+	defer func(old SettingsT) { Settings = old }(Settings)
+	// 10 tiles of 10x10 in pages of at most 30x30: a full page of 3x3 tiles and a page with a single one.
+	Settings.MaxSpriteDimension = 30
+	tests := []struct {
+		order string
+		// size of the last page and position of the last tile.
+		width, height int
+		x, y          int
+	}{
+		{"row", 30, 10, 0, 0},
+		{"column", 10, 10, 0, 0},
+	}
+	for _, test := range tests {
+		Settings.SpriteOrder = test.order
+		sheet := &spriteSheet{width: 10, height: 10, format: "jpeg"}
+		release := sheet.allocate("", 10)
+		if len(sheet.sprites) != 2 || sheet.sprites[0].Rect.Dx() != 30 || sheet.sprites[0].Rect.Dy() != 30 {
+			t.Fatalf("%s order: expected a full first page of 30x30, got %d pages", test.order, len(sheet.sprites))
+		}
+		if last := sheet.sprites[1].Rect; last.Dx() != test.width || last.Dy() != test.height {
+			t.Errorf("%s order: the last page is %dx%d, expected %dx%d", test.order, last.Dx(), last.Dy(), test.width, test.height)
+		}
+		if page, x, y := sheet.tilePos(9); page != 1 || x != test.x || y != test.y {
+			t.Errorf("%s order: the last tile is on page %d at %d,%d", test.order, page, x, y)
+		}
+		// the second tile follows the order.
+		_, x, y := sheet.tilePos(1)
+		if (test.order == "row") != (x == 10 && y == 0) {
+			t.Errorf("%s order: the second tile is at %d,%d", test.order, x, y)
+		}
+		release()
+	}
+}
+
+func BenchmarkComputeSpriteLayout(b *testing.B) {
+	for _, test := range layout_tests {
+		opts := layoutTestOpts(test.opts)
+		b.Run(test.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				computeSpriteLayout(test.duration, test.width, test.height, opts)
+			}
+		})
+	}
+}
+
+// Downscale a frame to a tile with every filter of GOCODER_THUMBNAIL_RESIZE_FILTER.
+func BenchmarkResizeFilter(b *testing.B) {
+	frame := imaging.New(512, 288, color.NRGBA{})
+	rng := rand.New(rand.NewSource(1))
+	rng.Read(frame.Pix)
+	for _, name := range []string{"lanczos", "catmullrom", "linear", "box", "nearest"} {
+		filter := thumbnail_resize_filters[name]
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				imaging.Resize(frame, 256, 144, filter)
+			}
+		})
+	}
+}
+
+// The sprite each cue of the vtts of out points to.
+func cueSprites(t *testing.T, out string, sha string, opts ThumbnailOptions) []string {
+	t.Helper()
+	var ret []string
+	for _, size := range getSheetSizes() {
+		content, err := os.ReadFile(GetVttPath(out, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cues, err := ParseThumbnailVtt(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cue := range cues {
+			if opts.Out != "" {
+				// the vtt is next to the sprites.
+				ret = append(ret, filepath.Join(out, cue.Src))
+				continue
+			}
+			// resolve the route like the sprite handler.
+			name, found := strings.CutPrefix(cue.Src, fmt.Sprintf("%s/thumbnails/%s/", Settings.RoutePrefix, sha))
+			if !found {
+				t.Fatalf("the cue %q does not point to the thumbnails route", cue.Src)
+			}
+			name, raw_query, _ := strings.Cut(name, "?")
+			if want := fmt.Sprintf("%s.%s", Settings.SpriteBaseName, opts.getFormat()); name != want {
+				t.Fatalf("the cue %q points to %s instead of %s", cue.Src, name, want)
+			}
+			query, err := url.ParseQuery(raw_query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, _ := strconv.Atoi(query.Get("page"))
+			cue_size := SheetSize{Height: thumbnail_height, Scale: 1}
+			if height := query.Get("height"); height != "" {
+				cue_size.Height, _ = strconv.Atoi(height)
+			}
+			if scale := query.Get("scale"); scale != "" {
+				cue_size.Scale, _ = strconv.Atoi(scale)
+			}
+			if cue_size != size {
+				t.Fatalf("the cue %q of the %+v sheet points to the %+v sheet", cue.Src, size, cue_size)
+			}
+			path, _ := FindSprite(out, opts, cue_size, page)
+			ret = append(ret, cmp.Or(path, cue.Src))
+		}
+	}
+	return ret
+}
+
+func TestVttSpritesExist(t *testing.T) {
+	tests := []struct {
+		name string
+		out  bool
+	}{
+		{"route", false},
+		{"out", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useSolidSource(t, 600, 1280, 720)
+			// split the sprite in pages.
+			Settings.MaxSpriteDimension = 1024
+			opts := ThumbnailOptions{}
+			if test.out {
+				opts.Out = t.TempDir()
+			}
+			sha := "vtt-sprites-" + test.name
+			out, err := ExtractThumbnail("/sprites.mkv", sha, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sprites := map[string]bool{}
+			for _, path := range cueSprites(t, out, sha, opts) {
+				sprites[path] = true
+			}
+			if len(sprites) < 2*len(getSheetSizes()) {
+				t.Errorf("expected multiple pages per sheet, the cues point to %v", sprites)
+			}
+			for path := range sprites {
+				if _, err := os.Stat(path); err != nil {
+					t.Errorf("a cue points to a missing sprite: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// Frames of the requested size in the stored orientation, with a red top left corner.
+type cornerDecoder struct {
+	// The size of the last frame decoded.
+	width, height *int
+}
+
+func (d cornerDecoder) ImageWxH(ts int64, width int, height int, fast bool) (image.Image, error) {
+	*d.width, *d.height = width, height
+	img := imaging.New(width, height, color.NRGBA{B: 255, A: 255})
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	return img, nil
+}
+
+func (d cornerDecoder) Close() error { return nil }
+
+func TestGrabFrameOrientation(t *testing.T) {
+	tests := []struct {
+		orientation Orientation
+		// where the red corner is displayed.
+		right, bottom bool
+	}{
+		// applied by the decoder.
+		{AVIdentity, false, false},
+		{AVRotation90, false, false},
+		{AVFlipHorizontal, true, false},
+		{AVFlipVertical, false, true},
+		// flipped, then rotated clockwise.
+		{AVRotation90 | AVFlipHorizontal, true, true},
+		{AVRotation270 | AVFlipHorizontal, false, false},
+		{AVRotation180 | AVFlipVertical, true, false},
+		{AVRotation90 | AVFlipVertical, false, false},
+	}
+	for _, test := range tests {
+		var width, height int
+		gen := &Generator{Orientation: test.orientation, decoder: cornerDecoder{&width, &height}}
+		img, err := grabFrame(gen, 0, 16, 9)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bounds := img.Bounds(); bounds.Dx() != 16 || bounds.Dy() != 9 {
+			t.Errorf("orientation %d: the frame is %dx%d instead of 16x9", test.orientation, bounds.Dx(), bounds.Dy())
+			continue
+		}
+		// the decoder gets the stored orientation.
+		if (width == 9) != (isRotated(gen) && !isOrientationHandled(gen)) {
+			t.Errorf("orientation %d: decoded a %dx%d frame", test.orientation, width, height)
+		}
+		x, y := 0, 0
+		if test.right {
+			x = 15
+		}
+		if test.bottom {
+			y = 8
+		}
+		if r, _, _, _ := img.At(x, y).RGBA(); r>>8 != 255 {
+			t.Errorf("orientation %d: the top left corner is not displayed at %d,%d", test.orientation, x, y)
+		}
+	}
+}
+
+func TestDisplaySize(t *testing.T) {
+	tests := []struct {
+		orientation Orientation
+		// size of the generator (swapped by screengen for pure rotations).
+		width, height int
+		sar           float64
+		// expected display size.
+		display_width, display_height int
+	}{
+		{AVIdentity, 1920, 1080, 1, 1920, 1080},
+		{AVIdentity, 1440, 1080, 4.0 / 3, 1920, 1080},
+		{AVRotation90, 1080, 1920, 1, 1080, 1920},
+		{AVRotation270, 1080, 1920, 1, 1080, 1920},
+		{AVRotation180, 1920, 1080, 1, 1920, 1080},
+		// the sar applies to the stored width.
+		{AVRotation90, 1080, 1440, 4.0 / 3, 1080, 1920},
+		{AVRotation90 | AVFlipHorizontal, 1920, 1080, 1, 1080, 1920},
+		{AVRotation270 | AVFlipVertical, 1440, 1080, 4.0 / 3, 1080, 1920},
+	}
+	for _, test := range tests {
+		gen := &Generator{Orientation: test.orientation, width: test.width, height: test.height}
+		if width, height := getDisplaySize(gen, test.sar); width != test.display_width || height != test.display_height {
+			t.Errorf("%+v: displayed at %dx%d", test, width, height)
+		}
+	}
+}
+
+func TestFailedSaveLeavesNoSprite(t *testing.T) {
+	useSolidSource(t, 600, 1280, 720)
+	// the second page of the main sheet can't be encoded.
+	Settings.MaxSpriteDimension = 1024
+	Settings.ThumbnailFormat = "failing"
+	defer func(formats []string) { ThumbnailFormats = formats }(ThumbnailFormats)
+	defer thumbnail_encoders.Remove("failing")
+	var lock sync.Mutex
+	encoded := 0
+	RegisterThumbnailEncoder("failing", func(w io.Writer, img image.Image) error {
+		lock.Lock()
+		defer lock.Unlock()
+		encoded++
+		if encoded == 2 {
+			return errors.New("could not encode the sprite")
+		}
+		return png.Encode(w, img)
+	})
+
+	sha := "failed-save"
+	if _, err := ExtractThumbnail("/failed-save.mkv", sha, ThumbnailOptions{}); err == nil {
+		t.Fatal("the failure of the encoder was not returned")
+	}
+	// the first page was encoded but the sheet is written with every other file, or not at all.
+	err := filepath.WalkDir(GetMetadataPath(sha), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if ext := filepath.Ext(path); ext == ".failing" || ext == ".vtt" || ext == ".tmp" {
+			t.Errorf("%s was left behind", path)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractionTimeout(t *testing.T) {
+	defer func(old SettingsT) { Settings = old }(Settings)
+	Settings.ThumbnailTimeout = 1
+	defer func(grace time.Duration) { extraction_grace = grace }(extraction_grace)
+	extraction_grace = 100 * time.Millisecond
+	// a single worker, the stuck extraction has to give it back.
+	defer func(workers chan struct{}) { thumbnail_workers = workers }(thumbnail_workers)
+	thumbnail_workers = make(chan struct{}, 1)
+
+	// like screengen on some malformed files, the generator blocks and never checks the context.
+	stuck, stopped := make(chan struct{}), make(chan struct{})
+	start := time.Now()
+	err := withExtractionTimeout(context.Background(), func(ctx context.Context) error {
+		defer close(stopped)
+		release, err := acquireWorker(ctx, "sprite")
+		if err != nil {
+			return err
+		}
+		defer release()
+		<-stuck
+		return nil
+	})
+	if !errors.Is(err, ErrExtractionTimeout) {
+		t.Fatalf("expected ErrExtractionTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the stuck extraction was abandoned after %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	release, err := acquireWorker(ctx, "sprite")
+	if err != nil {
+		t.Fatal("the worker of the stuck extraction was not freed")
+	}
+	release()
+
+	// the abandoned extraction does not free it twice once it stops.
+	close(stuck)
+	<-stopped
+	thumbnail_workers <- struct{}{}
+	select {
+	case thumbnail_workers <- struct{}{}:
+		t.Error("a worker was freed twice")
+	default:
+	}
+}
+
+func TestLayoutName(t *testing.T) {
+	useSolidSource(t, 60, 640, 360)
+	Settings.EmitJsonThumbnails = true
+	for _, name := range []string{"sprite", "thumbnails"} {
+		Settings.SpriteBaseName = name
+		sha := "layout-" + name
+		out, err := ExtractThumbnail("/layout.mkv", sha, ThumbnailOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the name of the layout doesn't depend on the sprites', json cues don't overwrite it.
+		info, err := GetThumbnailInfo(sha)
+		if err != nil || info.Count == 0 {
+			t.Errorf("%s: the layout is %+v (%v)", name, info, err)
+		}
+		if _, err := os.Stat(filepath.Join(out, "layout.json")); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if _, err := os.Stat(GetJsonCuesPath(out, DefaultSheetSize())); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// layouts written by older versions are still read.
+	Settings.SpriteBaseName = "sprite"
+	out := getThumbnailPath("layout-sprite", "")
+	if err := os.Rename(getThumbnailInfoPath(out), getLegacyThumbnailInfoPath(out)); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := GetThumbnailInfo("layout-sprite"); err != nil || info.Count == 0 {
+		t.Errorf("the legacy layout is %+v (%v)", info, err)
+	}
+}
+
+func TestFormatChange(t *testing.T) {
+	useSolidSource(t, 60, 640, 360)
+	sha := "format-change"
+	if _, err := ExtractThumbnail("/format.mkv", sha, ThumbnailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// restarted with another format, the old sprites are served until they are regenerated.
+	Settings.ThumbnailFormat = "jpeg"
+	thumbnails.RemoveFunc(func(key string, _ *Thumbnail) bool { return true })
+	out, err := ExtractThumbnail("/format.mkv", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sprite, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0); !ok || filepath.Ext(sprite) != ".png" {
+		t.Fatalf("the png sprite is not served, got %q", sprite)
+	}
+	if _, err := RegenerateThumbnail("/format.mkv", sha); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sprites := 0
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".png":
+			t.Errorf("the old sprite %s was not removed", entry.Name())
+		case ".jpeg":
+			sprites++
+		}
+	}
+	if sprites != len(getSheetSizes()) {
+		t.Errorf("expected %d jpeg sprites, found %d in %v", len(getSheetSizes()), sprites, entries)
+	}
+	for _, path := range cueSprites(t, out, sha, ThumbnailOptions{}) {
+		if filepath.Ext(path) != ".jpeg" {
+			t.Errorf("a cue points to %s", path)
+		}
+	}
+}
+
+func TestSpriteOrder(t *testing.T) {
+	for _, order := range []string{"row", "column"} {
+		t.Run(order, func(t *testing.T) {
+			grabbed := useSolidSource(t, 120, 1280, 720)
+			Settings.SpriteOrder = order
+			sha := "sprite-order-" + order
+			out, err := ExtractThumbnail("/order.mkv", sha, ThumbnailOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := GetThumbnailInfo(sha)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Order != order {
+				t.Errorf("the layout is in %s order", info.Order)
+			}
+			content, err := os.ReadFile(GetVttPath(out, DefaultSheetSize()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cues, err := ParseThumbnailVtt(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0)
+			if !ok {
+				t.Fatal("the sprite was not written")
+			}
+			sprite, err := imaging.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			timestamps := grabbed()
+			if len(cues) != len(timestamps) || len(cues) != info.Count {
+				t.Fatalf("%d cues for %d frames and %d thumbnails", len(cues), len(timestamps), info.Count)
+			}
+			// the crop of each cue is the frame of its thumbnail.
+			for i, cue := range cues {
+				if got, want := color.NRGBAModel.Convert(sprite.At(cue.X+cue.W/2, cue.Y+cue.H/2)).(color.NRGBA), solidColor(timestamps[i]); got != want {
+					t.Errorf("cue %d at %d,%d is %v, expected the frame at %dms", i, cue.X, cue.Y, got, timestamps[i])
+				}
+			}
+			// the second tile is next to the first one in the order.
+			if second := cues[1]; (order == "row") != (second.Y == cues[0].Y) {
+				t.Errorf("the second tile is at %d,%d", second.X, second.Y)
+			}
+		})
+	}
+}
+
+func TestTsToVttTime(t *testing.T) {
+	tests := []struct {
+		ts   float64
+		want string
+	}{
+		{0, "00:00:00.000"},
+		{59, "00:00:59.000"},
+		{59.9996, "00:01:00.000"},
+		{3661, "01:01:01.000"},
+		{86400 + 0.5, "24:00:00.500"},
+		{360000, "100:00:00.000"},
+		{-1, "00:00:00.000"},
+	}
+	for _, test := range tests {
+		got := tsToVttTime(test.ts)
+		if got != test.want {
+			t.Errorf("%v: got %s, expected %s", test.ts, got, test.want)
+		}
+		if parsed, err := parseVttTime(got); err != nil || parsed != math.Round(max(test.ts, 0)*1000)/1000 {
+			t.Errorf("%s is parsed as %v (%v)", got, parsed, err)
+		}
+	}
+}
+
+func TestHeightChange(t *testing.T) {
+	grabbed := useSolidSource(t, 60, 1280, 720)
+	defer func(height int) { thumbnail_height = height }(thumbnail_height)
+	sha := "height-change"
+	if _, err := ExtractThumbnail("/height.mkv", sha, ThumbnailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	first := len(grabbed())
+
+	// restarted with another height.
+	if err := SetThumbnailHeight(180); err != nil {
+		t.Fatal(err)
+	}
+	thumbnails.RemoveFunc(func(key string, _ *Thumbnail) bool { return true })
+	out, err := ExtractThumbnail("/height.mkv", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grabbed()) == first {
+		t.Fatal("the sprites of the old height were served")
+	}
+	info, err := GetThumbnailInfo(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Height != 180 || info.Width != 320 {
+		t.Errorf("tiles are %dx%d, expected 320x180", info.Width, info.Height)
+	}
+	path, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0)
+	if !ok {
+		t.Fatal("the sprite was not written")
+	}
+	sprite, err := imaging.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds := sprite.Bounds(); bounds.Dx() != info.Columns*320 || bounds.Dy() != info.Rows*180 {
+		t.Errorf("the sprite is %dx%d for %dx%d tiles of 320x180", bounds.Dx(), bounds.Dy(), info.Columns, info.Rows)
+	}
+
+	// the new sprites are kept.
+	thumbnails.RemoveFunc(func(key string, _ *Thumbnail) bool { return true })
+	regenerated := len(grabbed())
+	if _, err := ExtractThumbnail("/height.mkv", sha, ThumbnailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(grabbed()) != regenerated {
+		t.Error("sprites with the current height were extracted again")
+	}
+}
+
+func TestMaxTileWidth(t *testing.T) {
+	tests := []struct {
+		name   string
+		width  int
+		height int
+		want   [2]int
+	}{
+		// the height is lowered so tiles keep the aspect without letterboxing.
+		{"2.39:1", 1920, 804, [2]int{253, 106}},
+		{"4:3", 1440, 1080, [2]int{192, 144}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useSolidSource(t, 60, test.width, test.height)
+			Settings.MaxTileWidth = 256
+			sha := "max-tile-width-" + test.name
+			out, err := ExtractThumbnail("/wide.mkv", sha, ThumbnailOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := GetThumbnailInfo(sha)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Width != test.want[0] || info.Height != test.want[1] || info.MaxTileWidth != 256 {
+				t.Fatalf("tiles are %dx%d (max %d), expected %dx%d", info.Width, info.Height, info.MaxTileWidth, test.want[0], test.want[1])
+			}
+			path, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0)
+			if !ok {
+				t.Fatal("the sprite was not written")
+			}
+			sprite, err := imaging.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bounds := sprite.Bounds(); bounds.Dx() != info.Columns*info.Width || bounds.Dy() != info.Rows*info.Height {
+				t.Errorf("the sprite is %dx%d for %dx%d tiles of %dx%d", bounds.Dx(), bounds.Dy(), info.Columns, info.Rows, info.Width, info.Height)
+			}
+			content, err := os.ReadFile(GetVttPath(out, DefaultSheetSize()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cues, err := ParseThumbnailVtt(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the frame covers the whole tile, up to its corners. The first cue may start before its frame.
+			for _, cue := range cues[1:] {
+				for _, p := range [][2]int{{cue.X, cue.Y}, {cue.X + cue.W - 1, cue.Y + cue.H - 1}} {
+					if got := color.NRGBAModel.Convert(sprite.At(p[0], p[1])).(color.NRGBA); got != solidColor(int64(math.Round(cue.Start*1000))) {
+						t.Fatalf("the tile at %vs is %v at %v, letterboxed", cue.Start, got, p)
+					}
+				}
+			}
+		})
+	}
+}
+
+// The content of every file of dir, by name.
+func readDir(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := map[string][]byte{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret[entry.Name()] = content
+	}
+	return ret
+}
+
+func TestReproducibleExtraction(t *testing.T) {
+	// broken frames are retried at jittered timestamps.
+	useSolidSource(t, 300, 1280, 720, 30000, 150000)
+	Settings.ThumbnailFormat = "jpeg"
+	sha := "reproducible"
+	out, err := ExtractThumbnail("/reproducible.mkv", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := readDir(t, out)
+	if len(first) == 0 {
+		t.Fatal("nothing was written")
+	}
+	if _, err := RegenerateThumbnail("/reproducible.mkv", sha); err != nil {
+		t.Fatal(err)
+	}
+	second := readDir(t, out)
+	for name, content := range first {
+		if !bytes.Equal(content, second[name]) {
+			t.Errorf("%s changed after a regeneration", name)
+		}
+	}
+	for name := range second {
+		if _, ok := first[name]; !ok {
+			t.Errorf("%s was only written by the regeneration", name)
+		}
+	}
+}
+
+func TestTileGap(t *testing.T) {
+	grabbed := useSolidSource(t, 120, 1280, 720)
+	Settings.TileGap = 4
+	Settings.SpriteBackground = color.NRGBA{R: 255, G: 0, B: 255, A: 255}
+	sha := "tile-gap"
+	out, err := ExtractThumbnail("/gap.mkv", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := GetThumbnailInfo(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Gap != 4 {
+		t.Errorf("the layout has a gap of %d", info.Gap)
+	}
+	content, err := os.ReadFile(GetVttPath(out, DefaultSheetSize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cues, err := ParseThumbnailVtt(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), 0)
+	if !ok {
+		t.Fatal("the sprite was not written")
+	}
+	sprite, err := imaging.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds := sprite.Bounds(); bounds.Dx() != info.Columns*(info.Width+4)-4 || bounds.Dy() != info.Rows*(info.Height+4)-4 {
+		t.Errorf("the sprite is %dx%d for %dx%d tiles of %dx%d with a gap of 4", bounds.Dx(), bounds.Dy(), info.Columns, info.Rows, info.Width, info.Height)
+	}
+	at := func(x int, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(sprite.At(x, y)).(color.NRGBA)
+	}
+	timestamps := grabbed()
+	for i, cue := range cues {
+		// the whole crop is the tile, up to its edges.
+		want := solidColor(timestamps[i])
+		for _, corner := range [][2]int{{cue.X, cue.Y}, {cue.X + cue.W - 1, cue.Y}, {cue.X, cue.Y + cue.H - 1}, {cue.X + cue.W - 1, cue.Y + cue.H - 1}} {
+			if got := at(corner[0], corner[1]); got != want {
+				t.Errorf("cue %d is %v at %v, expected %v", i, got, corner, want)
+			}
+		}
+		// and the gap around it is the background.
+		if x := cue.X + cue.W; x < sprite.Bounds().Dx() {
+			if got := at(x, cue.Y); got != Settings.SpriteBackground {
+				t.Errorf("the gap after cue %d is %v", i, got)
+			}
+		}
+		if y := cue.Y + cue.H; y < sprite.Bounds().Dy() {
+			if got := at(cue.X, y+3); got != Settings.SpriteBackground {
+				t.Errorf("the gap below cue %d is %v", i, got)
+			}
+		}
+	}
+}
+
+// Sampling factors of the luma of a jpeg (from its start of frame), 0x22 for 4:2:0, 0x21 for 4:2:2 and 0x11
+// for 4:4:4 since the chroma components are not subsampled themselves.
+func jpegLumaSampling(t *testing.T, data []byte) byte {
+	t.Helper()
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			t.Fatalf("invalid jpeg marker at %d", i)
+		}
+		marker := data[i+1]
+		length := int(data[i+2])<<8 | int(data[i+3])
+		// baseline, extended and progressive start of frames: precision, height, width, components and
+		// the id and sampling of the first component.
+		if marker >= 0xc0 && marker <= 0xc2 {
+			return data[i+4+6+1]
+		}
+		i += 2 + length
+	}
+	t.Fatal("no start of frame")
+	return 0
+}
+
+func TestJpegChromaSubsampling(t *testing.T) {
+	defer func(old SettingsT) { Settings = old }(Settings)
+	img := imaging.New(64, 32, color.NRGBA{R: 200, G: 30, B: 90, A: 255})
+	tests := []struct {
+		env      string
+		mode     string
+		sampling byte
+	}{
+		{"420", "420", 0x22},
+		{"4:2:0", "420", 0x22},
+		{"422", "422", 0x21},
+		{"4:4:4", "444", 0x11},
+		{"411", "420", 0x22},
+	}
+	for _, test := range tests {
+		t.Setenv("GOCODER_THUMBNAIL_CHROMA_SUBSAMPLING", test.env)
+		if Settings.ThumbnailChromaSubsampling = getChromaSubsampling(); Settings.ThumbnailChromaSubsampling != test.mode {
+			t.Errorf("%s: got the mode %s, expected %s", test.env, Settings.ThumbnailChromaSubsampling, test.mode)
+			continue
+		}
+		if _, err := exec.LookPath(Settings.FfmpegPath); err != nil && test.mode != "420" {
+			t.Logf("%s: skipping the encoding, ffmpeg is not installed", test.env)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := encodeJpeg(&buf, img, 80); err != nil {
+			t.Fatal(err)
+		}
+		if got := jpegLumaSampling(t, buf.Bytes()); got != test.sampling {
+			t.Errorf("%s: the luma sampling is %#x, expected %#x", test.env, got, test.sampling)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package src
+
+import (
+	"errors"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+var ErrThumbnailsNotFound = errors.New("thumbnails are not extracted")
+
+// Crop the tile shown at t (in seconds) out of the main sprite of sha (generated with the default options),
+// for clients that want a single image instead of the sprite and its vtt. Like GetThumbnailSprite, this never
+// starts an extraction. The tile is encoded in the sprite format, mime is its content type.
+func GetThumbnailTile(sha string, t float64) (content []byte, mime string, err error) {
+	// waits for a running extraction, its info is written with the sprites.
+	if _, ok := GetThumbnailSprite(sha, ThumbnailOptions{}, DefaultSheetSize(), 0); !ok {
+		return nil, "", ErrThumbnailsNotFound
+	}
+	info, err := GetThumbnailInfo(sha)
+	if err != nil || info.Count == 0 || info.Columns == 0 || info.Rows == 0 {
+		return nil, "", ErrThumbnailsNotFound
+	}
+
+	i := getCueIndex(info, t)
+	page := i / (info.Columns * info.Rows)
+	col, row := getTileCell(info.Order, i%(info.Columns*info.Rows), info.Columns, info.Rows)
+	sprite, err := openSprite(getThumbnailPath(sha, ""), ThumbnailOptions{}, DefaultSheetSize(), page)
+	if err != nil {
+		return nil, "", err
+	}
+	x, y := col*(info.Width+info.Gap), row*(info.Height+info.Gap)
+	tile := imaging.Crop(sprite, image.Rect(x, y, x+info.Width, y+info.Height))
+	encoded, err := encodeTiles([]image.Image{tile})
+	if err != nil {
+		return nil, "", err
+	}
+	return encoded[0], getThumbnailMime(), nil
+}
+
+// Index of the cue displayed at t: the last one starting before it (a cue lasts until the next one starts,
+// see getCueEnd). Times before the first cue use it.
+func getCueIndex(info ThumbnailInfo, t float64) int {
+	ret := 0
+	for i := 1; i < info.Count; i++ {
+		start := float64(i) * info.Interval
+		if info.Timestamps != nil {
+			start = info.Timestamps[i]
+		}
+		if start > t {
+			break
+		}
+		ret = i
+	}
+	return ret
+}
@@ -0,0 +1,97 @@
+package src
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+type transferFunc int
+
+const (
+	transferSDR transferFunc = iota
+	transferPQ
+	transferHLG
+)
+
+// Luminance (in nits) of the sdr white and of the brightest highlights we try to keep.
+const (
+	sdr_white = 203.
+	hdr_peak  = 1000.
+)
+
+// Find the transfer characteristics of the video, transferSDR is returned when tonemapping is disabled.
+func getTransfer(path string, sha string) transferFunc {
+	if !Settings.TonemapThumbnails || IsRemotePath(path) {
+		return transferSDR
+	}
+	info, err := ProbeMedia(path, sha)
+	if err != nil || info.Video == nil || info.Video.Transfer == nil {
+		return transferSDR
+	}
+	transfer := strings.ToUpper(*info.Video.Transfer)
+	switch {
+	case strings.Contains(transfer, "PQ"), strings.Contains(transfer, "2084"):
+		return transferPQ
+	case strings.Contains(transfer, "HLG"), strings.Contains(transfer, "B67"):
+		return transferHLG
+	default:
+		return transferSDR
+	}
+}
+
+// Decode a PQ or HLG value (0-1) to a linear light relative to the sdr white.
+func toLinear(transfer transferFunc, v float64) float64 {
+	switch transfer {
+	case transferPQ:
+		// SMPTE ST 2084 EOTF
+		const m1, m2 = 2610. / 16384, 2523. / 4096 * 128
+		const c1, c2, c3 = 3424. / 4096, 2413. / 4096 * 32, 2392. / 4096 * 32
+		p := math.Pow(v, 1/m2)
+		return 10000 * math.Pow(max(p-c1, 0)/(c2-c3*p), 1/m1) / sdr_white
+	case transferHLG:
+		// ARIB STD-B67 inverse OETF and the OOTF of a 1000 nits display.
+		const a, b, c = 0.17883277, 0.28466892, 0.55991073
+		var e float64
+		if v <= 0.5 {
+			e = v * v / 3
+		} else {
+			e = (math.Exp((v-c)/a) + b) / 12
+		}
+		return hdr_peak * math.Pow(e, 1.2) / sdr_white
+	default:
+		return v
+	}
+}
+
+// Tonemap an hdr frame to sdr. Frames decoded from hdr videos are only converted to 8 bits without
+// changing the transfer function nor the primaries, which makes them look washed out.
+func tonemap(img image.Image, transfer transferFunc) image.Image {
+	if transfer == transferSDR {
+		return img
+	}
+
+	var linear [256]float64
+	for i := range linear {
+		linear[i] = toLinear(transfer, float64(i)/255)
+	}
+	// extended reinhard, keeps the mid tones and compresses highlights up to hdr_peak.
+	peak := hdr_peak / sdr_white
+	curve := func(x float64) uint8 {
+		x = max(x, 0)
+		x = x * (1 + x/(peak*peak)) / (1 + x)
+		return uint8(math.Round(math.Pow(min(x, 1), 1/2.2) * 255))
+	}
+
+	ret := imaging.Clone(img)
+	for i := 0; i < len(ret.Pix); i += 4 {
+		r, g, b := linear[ret.Pix[i]], linear[ret.Pix[i+1]], linear[ret.Pix[i+2]]
+		// bt.2020 to bt.709 primaries
+		ret.Pix[i] = curve(1.6605*r - 0.5876*g - 0.0728*b)
+		ret.Pix[i+1] = curve(-0.1246*r + 1.1329*g - 0.0083*b)
+		ret.Pix[i+2] = curve(-0.0182*r - 0.1006*g + 1.1187*b)
+	}
+	return ret
+}
@@ -1,17 +1,169 @@
 package src
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 func printExecTime(message string, args ...any) func() {
+	return printExecTimeWith(slog.Default(), message, args...)
+}
+
+// Same as printExecTime but logs with the given logger (see getLogger).
+func printExecTimeWith(logger *slog.Logger, message string, args ...any) func() {
 	msg := fmt.Sprintf(message, args...)
 	start := time.Now()
-	log.Printf("Running %s", msg)
+	logger.Info("Running " + msg)
 
 	return func() {
-		log.Printf("%s finished in %s", msg, time.Since(start))
+		logger.Info(msg+" finished", "duration", time.Since(start))
+	}
+}
+
+// Identifier of a video in urls (/:path/...). Unlike standard base64, url safe base64 never has a / or a +
+// that clients would read as a path separator or a space.
+func EncodePath(path string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(path))
+}
+
+// Read an identifier of EncodePath. Identifiers in standard base64 (with or without padding, sent by older
+// clients) are still accepted.
+func DecodePath(key string) (string, error) {
+	key = strings.TrimRight(key, "=")
+	key = strings.NewReplacer("+", "-", "/", "_").Replace(key)
+	ret, err := base64.RawURLEncoding.DecodeString(key)
+	return string(ret), err
+}
+
+type logger_key struct{}
+
+// Attach a logger to ctx, functions taking a context log with it. Extractions use it to tag
+// every line with their id and sha, interleaved logs of concurrent extractions can be told apart.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, logger_key{}, logger)
+}
+
+// The logger attached to ctx with withLogger, the default one if there is none.
+func getLogger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(logger_key{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Identical messages are logged at most once per window, a batch of broken files would flood the logs otherwise.
+var log_limit_window = time.Minute
+
+var log_limits = struct {
+	lock sync.Mutex
+	last map[string]time.Time
+	// Number of messages logged at debug level since the last time each message was logged.
+	suppressed map[string]int
+}{
+	last:       make(map[string]time.Time),
+	suppressed: make(map[string]int),
+}
+
+// Log msg at level unless it was already logged in the last log_limit_window, repeats are logged at debug
+// level and the next log of msg contains the number of repeats hidden.
+func logLimited(logger *slog.Logger, level slog.Level, msg string, args ...any) {
+	log_limits.lock.Lock()
+	now := time.Now()
+	if last, ok := log_limits.last[msg]; ok && now.Sub(last) < log_limit_window {
+		log_limits.suppressed[msg]++
+		log_limits.lock.Unlock()
+		logger.Debug(msg, args...)
+		return
+	}
+	log_limits.last[msg] = now
+	suppressed := log_limits.suppressed[msg]
+	delete(log_limits.suppressed, msg)
+	log_limits.lock.Unlock()
+
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	logger.Log(context.Background(), level, msg, args...)
+}
+
+// A short random id to correlate the logs of an extraction.
+func newExtractionId() string {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Check if path is an http(s) url instead of a local file. ffmpeg can open those directly.
+func IsRemotePath(path string) bool {
+	u, err := url.Parse(path)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+// Create an empty temporary file next to path, its name is unique so concurrent writers of path never write
+// to the same temporary file. The caller writes it (overwriting it) and renames it to path.
+func createTempFor(path string) (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	return file.Name(), nil
+}
+
+// Write a file by calling write with a temporary path and moving it in place once it succeeded.
+// Readers never see a partially written file.
+func writeAtomic(path string, write func(tmp string) error) error {
+	tmp, err := createTempFor(path)
+	if err != nil {
+		return err
+	}
+	if err := write(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, Settings.MetadataFileMode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return metadata_store.Save(path)
+}
+
+// Create a directory (and its parents) in the metadata dir with Settings.MetadataDirMode.
+// Permissions are set explicitly since MkdirAll applies the umask.
+func mkdirMetadata(dir string) error {
+	if err := os.MkdirAll(dir, Settings.MetadataDirMode); err != nil {
+		return err
+	}
+	root := filepath.Clean(Settings.Metadata)
+	for dir = filepath.Clean(dir); strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := os.Chmod(dir, Settings.MetadataDirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Same as os.WriteFile with Settings.MetadataFileMode, ignoring the umask.
+func writeMetadataFile(path string, content []byte) error {
+	if err := os.WriteFile(path, content, Settings.MetadataFileMode); err != nil {
+		return err
 	}
+	return os.Chmod(path, Settings.MetadataFileMode)
 }
@@ -0,0 +1,37 @@
+package src
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestEncodePathRoundTrip(t *testing.T) {
+	paths := []string{
+		"/video/Some Show/Season 1/Some Show S01E01.mkv",
+		"/video/日本語/アニメ 第1話.mkv",
+		"/video/Amélie (2001)/Amélie.mkv",
+		"/video/emoji 🎬/file?.mkv",
+		// bytes that encode to + and / in standard base64.
+		"\xfb\xff\xbf/video.mkv",
+		"",
+	}
+	for _, path := range paths {
+		key := EncodePath(path)
+		if strings.ContainsAny(key, "+/= ") {
+			t.Errorf("EncodePath(%q) = %q is not url safe", path, key)
+		}
+		got, err := DecodePath(key)
+		if err != nil || got != path {
+			t.Errorf("DecodePath(EncodePath(%q)) = %q, %v", path, got, err)
+		}
+
+		// identifiers of older clients.
+		for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding} {
+			got, err := DecodePath(encoding.EncodeToString([]byte(path)))
+			if err != nil || got != path {
+				t.Errorf("DecodePath of the standard base64 of %q = %q, %v", path, got, err)
+			}
+		}
+	}
+}
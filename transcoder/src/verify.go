@@ -0,0 +1,80 @@
+package src
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/disintegration/imaging"
+	// register the webp decoder for imaging.Decode, imaging can only encode png and jpeg.
+	_ "golang.org/x/image/webp"
+)
+
+// Number of cues compared by VerifyThumbnail.
+var verify_samples = 10
+
+type Drift struct {
+	/// The start time of the cue (in seconds).
+	Time float64 `json:"time"`
+	/// The mean luma difference (0-255) between the tile and the exact frame at Time, comparable to
+	/// GOCODER_THUMBNAIL_DEDUP_THRESHOLD. High values mean the tile shows another frame.
+	Distance float64 `json:"distance"`
+}
+
+// Compare a sample of the tiles of the sprite (generated with the default options) to the exact frames at
+// their cue times. Without Settings.AccurateThumbnails, frames are taken at the previous keyframe so tiles
+// can show a frame a few seconds before their cue; this measures how much. Tiles cropped with
+// Settings.CropThumbnails are compared to uncropped frames and always drift a bit.
+func VerifyThumbnail(path string, sha string) ([]Drift, error) {
+	out := getThumbnailPath(sha, "")
+	info, err := GetThumbnailInfo(sha)
+	if err != nil {
+		return nil, fmt.Errorf("thumbnails are not extracted: %w", err)
+	}
+	if info.Count == 0 || info.Columns == 0 || info.Rows == 0 {
+		return nil, fmt.Errorf("invalid thumbnails info for %s", sha)
+	}
+
+	gen, err := openGenerator(path)
+	if err != nil {
+		return nil, err
+	}
+	defer gen.Close()
+	// decode up to the exact frame, this is what the tiles are compared to.
+	gen.Fast = false
+	transfer := getTransfer(path, sha)
+	colors := getColorFix(path, sha)
+
+	pages := make(map[int]image.Image)
+	ret := make([]Drift, 0, verify_samples)
+	for s := 0; s < min(verify_samples, info.Count); s++ {
+		i := s * info.Count / min(verify_samples, info.Count)
+		ts := float64(i) * info.Interval
+		if info.Timestamps != nil {
+			ts = info.Timestamps[i]
+		}
+
+		page := i / (info.Columns * info.Rows)
+		pos := i % (info.Columns * info.Rows)
+		sprite, ok := pages[page]
+		if !ok {
+			sprite, err = openSprite(out, ThumbnailOptions{}, DefaultSheetSize(), page)
+			if err != nil {
+				return nil, err
+			}
+			pages[page] = sprite
+		}
+		col, row := getTileCell(info.Order, pos, info.Columns, info.Rows)
+		x, y := col*(info.Width+info.Gap), row*(info.Height+info.Gap)
+		tile := imaging.Crop(sprite, image.Rect(x, y, x+info.Width, y+info.Height))
+
+		frame, err := grabFrame(gen, int64(ts*1000), info.Width, info.Height)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Drift{
+			Time:     ts,
+			Distance: getSignatureDiff(getSignature(tile), getSignature(tonemap(fixColors(frame, colors), transfer))),
+		})
+	}
+	return ret, nil
+}
@@ -0,0 +1,104 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Frames whose duration differ from the median by more than this fraction mean the video has a variable frame
+// rate. Some jitter is normal: pts are rounded to the stream's time base.
+var vfr_tolerance = 0.1
+
+type FrameTimes struct {
+	// Presentation time (in seconds) of every frame of the first video stream, sorted.
+	Pts []float64
+}
+
+// List the presentation time of every frame, cached in the metadata dir next to the keyframes.
+func getFrameTimes(ctx context.Context, path string, sha string) ([]float64, error) {
+	save_path := fmt.Sprintf("%s/frames.json", GetMetadataPath(sha))
+	var ret FrameTimes
+	if err := getSavedInfo(save_path, &ret); err == nil {
+		return ret.Pts, nil
+	}
+
+	defer printExecTimeWith(getLogger(ctx), "listing frames of %s", path)()
+	// same as getKeyframes, packets are listed instead of frames since it doesn't need decoding.
+	cmd := exec.CommandContext(
+		ctx,
+		Settings.FfprobePath,
+		"-loglevel", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "packet=pts_time",
+		"-of", "csv=print_section=0",
+		path,
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	defer cmd.Wait()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		// packets without pts (N/A) can't be presented, skip them.
+		pts, err := strconv.ParseFloat(strings.TrimSuffix(scanner.Text(), ","), 64)
+		if err != nil {
+			continue
+		}
+		ret.Pts = append(ret.Pts, pts)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// packets are in decoding order, b-frames are presented before the packets preceding them.
+	slices.Sort(ret.Pts)
+	ret.Pts = slices.Compact(ret.Pts)
+	saveInfo(save_path, &ret)
+	return ret.Pts, nil
+}
+
+// Check if frames are not evenly spaced (variable frame rate), ms timestamps can't be mapped to frames
+// with the average frame rate then.
+func isVariableFrameRate(pts []float64) bool {
+	if len(pts) < 3 {
+		return false
+	}
+	durations := make([]float64, len(pts)-1)
+	for i := range durations {
+		durations[i] = pts[i+1] - pts[i]
+	}
+	median := slices.Clone(durations)
+	slices.Sort(median)
+	frame := median[len(median)/2]
+	for _, d := range durations {
+		if math.Abs(d-frame) > frame*vfr_tolerance {
+			return true
+		}
+	}
+	return false
+}
+
+// Move timestamps to the frame exact seeks stop at: the first one presented at or after it. Cues then use the
+// time of the frame they show. Timestamps ending on the same frame are merged (a tile would repeat otherwise).
+func snapToFrames(timestamps []float64, pts []float64) []float64 {
+	ret := make([]float64, 0, len(timestamps))
+	for _, ts := range timestamps {
+		i, _ := slices.BinarySearch(pts, ts)
+		frame := pts[min(i, len(pts)-1)]
+		if len(ret) > 0 && frame <= ret[len(ret)-1] {
+			continue
+		}
+		ret = append(ret, frame)
+	}
+	return ret
+}
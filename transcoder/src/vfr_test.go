@@ -0,0 +1,122 @@
+package src
+
+import (
+	"image/color"
+	"math"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// Frame times of a video starting with a slideshow (a frame every 5s) for 30s, then at 24 fps up to 60s.
+func slideshowFrames() []float64 {
+	var ret []float64
+	for ts := 0.; ts < 30; ts += 5 {
+		ret = append(ret, ts)
+	}
+	for i := 0; i < 30*24; i++ {
+		ret = append(ret, 30+float64(i)/24)
+	}
+	return ret
+}
+
+func TestIsVariableFrameRate(t *testing.T) {
+	constant := make([]float64, 100)
+	jitter := make([]float64, 100)
+	for i := range constant {
+		constant[i] = float64(i) / 24
+		// pts rounded to a 1/1000 time base.
+		jitter[i] = math.Round(constant[i]*1000) / 1000
+	}
+	tests := []struct {
+		name string
+		pts  []float64
+		want bool
+	}{
+		{"constant", constant, false},
+		{"rounded", jitter, false},
+		{"too short", []float64{0, 5}, false},
+		{"slideshow", slideshowFrames(), true},
+	}
+	for _, test := range tests {
+		if got := isVariableFrameRate(test.pts); got != test.want {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSnapToFrames(t *testing.T) {
+	pts := slideshowFrames()
+	timestamps := getEvenTimestamps(30, 2)
+	got := snapToFrames(timestamps, pts)
+	// 0, 2->5, 4->5, 6->10, 8->10... every frame of the slideshow is shown once.
+	if want := []float64{0, 5, 10, 15, 20, 25}; !slices.Equal(got[:6], want) {
+		t.Errorf("the slideshow is snapped to %v, expected %v", got[:6], want)
+	}
+	for i, ts := range got {
+		if !slices.Contains(pts, ts) {
+			t.Errorf("timestamp %v is not a frame time", ts)
+		}
+		if i > 0 && ts <= got[i-1] {
+			t.Errorf("timestamp %d (%v) shows the same frame as the previous one", i, ts)
+		}
+	}
+	if len(got) != 6+15 {
+		t.Errorf("got %d timestamps, expected 21", len(got))
+	}
+	// timestamps after the last frame show it.
+	if got := snapToFrames([]float64{0, 100}, []float64{0, 1, 2}); !slices.Equal(got, []float64{0, 2}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestExtractVariableFrameRate(t *testing.T) {
+	useSolidSource(t, 60, 640, 360)
+	Settings.AccurateThumbnails = true
+	sha := "solid-vfr"
+	// the frames listed by ffprobe.
+	if err := mkdirMetadata(GetMetadataPath(sha)); err != nil {
+		t.Fatal(err)
+	}
+	pts := slideshowFrames()
+	if err := saveInfo(GetMetadataPath(sha)+"/frames.json", &FrameTimes{Pts: pts}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ThumbnailOptions{Interval: 2}
+	out, err := ExtractThumbnail("/vfr.mkv", sha, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(GetVttPath(out, DefaultSheetSize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cues, err := ParseThumbnailVtt(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, ok := FindSprite(out, opts, DefaultSheetSize(), 0)
+	if !ok {
+		t.Fatal("the sprite was not written")
+	}
+	sprite, err := imaging.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cue := range cues {
+		if !slices.Contains(pts, cue.Start) {
+			t.Errorf("cue %d starts at %v, between two frames", i, cue.Start)
+		}
+		if i > 0 && cue.Start == cues[i-1].Start {
+			t.Errorf("cue %d shows the same frame as the previous one", i)
+		}
+		// the tile is the frame the cue is labelled with.
+		want := solidColor(int64(math.Round(cue.Start * 1000)))
+		if got := color.NRGBAModel.Convert(sprite.At(cue.X+cue.W/2, cue.Y+cue.H/2)).(color.NRGBA); got != want {
+			t.Errorf("cue %d at %vs is %v, expected %v", i, cue.Start, got, want)
+		}
+	}
+}
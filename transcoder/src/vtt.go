@@ -0,0 +1,144 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidVtt = errors.New("invalid thumbnails vtt")
+
+// Parse a vtt written by the extraction (or any vtt of sprite crops) and check it is well formed: every cue
+// points to a tile with a #xywh fragment, cues are in order and none ends before it starts. NOTE blocks (see
+// Settings.VttIncludeGeometry) and cue identifiers are skipped, cue settings are ignored.
+func ParseThumbnailVtt(content []byte) ([]JsonCue, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("%w: empty file", ErrInvalidVtt)
+	}
+	header := strings.TrimPrefix(scanner.Text(), "\ufeff")
+	if header != "WEBVTT" && !strings.HasPrefix(header, "WEBVTT ") && !strings.HasPrefix(header, "WEBVTT\t") {
+		return nil, fmt.Errorf("%w: missing WEBVTT header", ErrInvalidVtt)
+	}
+
+	var ret []JsonCue
+	// lines of the current block (starting at block_line), a block ends at an empty line.
+	var block []string
+	line, block_line := 1, 0
+	parse := func() error {
+		defer func() { block = block[:0] }()
+		if len(block) == 0 || block[0] == "NOTE" || strings.HasPrefix(block[0], "NOTE ") {
+			return nil
+		}
+		// the identifier is optional.
+		if !strings.Contains(block[0], "-->") {
+			block_line++
+			block = block[1:]
+		}
+		if len(block) != 2 {
+			return fmt.Errorf("%w: line %d: a cue should have a timing and a tile", ErrInvalidVtt, block_line)
+		}
+		cue, err := parseThumbnailCue(block[0], block[1])
+		if err != nil {
+			return fmt.Errorf("%w: line %d: %w", ErrInvalidVtt, block_line, err)
+		}
+		if len(ret) > 0 && cue.Start < ret[len(ret)-1].Start {
+			return fmt.Errorf("%w: line %d: the cue starts before the previous one", ErrInvalidVtt, block_line)
+		}
+		ret = append(ret, cue)
+		return nil
+	}
+	for scanner.Scan() {
+		line++
+		if text := scanner.Text(); text != "" {
+			if len(block) == 0 {
+				block_line = line
+			}
+			block = append(block, text)
+			continue
+		}
+		if err := parse(); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := parse(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func parseThumbnailCue(timing string, payload string) (JsonCue, error) {
+	var ret JsonCue
+	start, rest, found := strings.Cut(timing, " --> ")
+	if !found {
+		return ret, fmt.Errorf("invalid timing %q", timing)
+	}
+	// cue settings follow the end time.
+	end, _, _ := strings.Cut(strings.TrimLeft(rest, " \t"), " ")
+	var err error
+	if ret.Start, err = parseVttTime(strings.TrimSpace(start)); err != nil {
+		return ret, err
+	}
+	if ret.End, err = parseVttTime(end); err != nil {
+		return ret, err
+	}
+	if ret.End < ret.Start {
+		return ret, fmt.Errorf("the cue ends before it starts (%s)", timing)
+	}
+
+	src, fragment, found := strings.Cut(payload, "#xywh=")
+	if !found || src == "" {
+		return ret, fmt.Errorf("invalid tile %q, it should be a url with a #xywh fragment", payload)
+	}
+	ret.Src = src
+	coords := strings.Split(fragment, ",")
+	if len(coords) != 4 {
+		return ret, fmt.Errorf("invalid tile %q, #xywh needs 4 coordinates", payload)
+	}
+	values := make([]int, 4)
+	for i, coord := range coords {
+		if values[i], err = strconv.Atoi(coord); err != nil || values[i] < 0 {
+			return ret, fmt.Errorf("invalid tile %q, coordinates should be positive integers", payload)
+		}
+	}
+	ret.X, ret.Y, ret.W, ret.H = values[0], values[1], values[2], values[3]
+	if ret.W == 0 || ret.H == 0 {
+		return ret, fmt.Errorf("empty tile %q", payload)
+	}
+	return ret, nil
+}
+
+// Parse a vtt timestamp ([hh:]mm:ss.ttt, see tsToVttTime) in seconds.
+func parseVttTime(ts string) (float64, error) {
+	parts := strings.Split(ts, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", ts)
+	}
+	hours := "00"
+	if len(parts) == 3 {
+		hours, parts = parts[0], parts[1:]
+	}
+	seconds, millis, found := strings.Cut(parts[1], ".")
+	// hours have two or more digits, minutes and seconds exactly two.
+	if !found || len(hours) < 2 || len(parts[0]) != 2 || len(seconds) != 2 || len(millis) != 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", ts)
+	}
+	var values [4]uint64
+	for i, part := range []string{hours, parts[0], seconds, millis} {
+		value, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", ts)
+		}
+		values[i] = value
+	}
+	if values[1] >= 60 || values[2] >= 60 {
+		return 0, fmt.Errorf("invalid timestamp %q", ts)
+	}
+	return float64(values[0]*3600+values[1]*60+values[2]) + float64(values[3])/1000, nil
+}
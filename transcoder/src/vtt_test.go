@@ -0,0 +1,219 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/png"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseThumbnailVtt(t *testing.T) {
+	valid := []struct {
+		name    string
+		content string
+		want    []JsonCue
+	}{
+		{"empty", "WEBVTT\n", nil},
+		{
+			"cues",
+			"WEBVTT\n\n00:00.000 --> 00:10.000\nsprite.jpg#xywh=0,0,160,90\n\n00:00:10.000 --> 00:00:20.500\nsprite.jpg#xywh=160,0,160,90\n",
+			[]JsonCue{{Start: 0, End: 10, X: 0, Y: 0, W: 160, H: 90, Src: "sprite.jpg"}, {Start: 10, End: 20.5, X: 160, Y: 0, W: 160, H: 90, Src: "sprite.jpg"}},
+		},
+		{
+			"bom, notes, identifiers and settings",
+			"\ufeffWEBVTT - thumbnails\n\nNOTE\ncolumns=2\n\nfirst\n01:00:00.000 --> 01:00:05.000 align:start\n/thumbnails/sha/sprite.jpg?page=1#xywh=0,90,160,90\n",
+			[]JsonCue{{Start: 3600, End: 3605, X: 0, Y: 90, W: 160, H: 90, Src: "/thumbnails/sha/sprite.jpg?page=1"}},
+		},
+		{
+			"same start",
+			"WEBVTT\n\n00:01.000 --> 00:01.000\na.png#xywh=0,0,1,1\n\n00:01.000 --> 00:02.000\na.png#xywh=1,0,1,1\n",
+			[]JsonCue{{Start: 1, End: 1, X: 0, Y: 0, W: 1, H: 1, Src: "a.png"}, {Start: 1, End: 2, X: 1, Y: 0, W: 1, H: 1, Src: "a.png"}},
+		},
+	}
+	for _, test := range valid {
+		cues, err := ParseThumbnailVtt([]byte(test.content))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !slices.Equal(cues, test.want) {
+			t.Errorf("%s: got %+v, expected %+v", test.name, cues, test.want)
+		}
+	}
+
+	invalid := []struct {
+		name    string
+		content string
+	}{
+		{"no content", ""},
+		{"no header", "00:00.000 --> 00:10.000\nsprite.jpg#xywh=0,0,160,90\n"},
+		{"bad header", "WEBVTTX\n"},
+		{"no tile", "WEBVTT\n\n00:00.000 --> 00:10.000\n"},
+		{"extra line", "WEBVTT\n\n00:00.000 --> 00:10.000\nsprite.jpg#xywh=0,0,160,90\nsprite.jpg\n"},
+		{"no arrow", "WEBVTT\n\n00:00.000 00:10.000\nsprite.jpg#xywh=0,0,160,90\n"},
+		{"bad time", "WEBVTT\n\n0:00.000 --> 00:10.000\nsprite.jpg#xywh=0,0,160,90\n"},
+		{"minutes overflow", "WEBVTT\n\n00:60.000 --> 01:10.000\nsprite.jpg#xywh=0,0,160,90\n"},
+		{"ends before start", "WEBVTT\n\n00:10.000 --> 00:05.000\nsprite.jpg#xywh=0,0,160,90\n"},
+		{"out of order", "WEBVTT\n\n00:10.000 --> 00:20.000\na.jpg#xywh=0,0,1,1\n\n00:05.000 --> 00:10.000\na.jpg#xywh=0,0,1,1\n"},
+		{"no fragment", "WEBVTT\n\n00:00.000 --> 00:10.000\nsprite.jpg\n"},
+		{"no src", "WEBVTT\n\n00:00.000 --> 00:10.000\n#xywh=0,0,160,90\n"},
+		{"three coordinates", "WEBVTT\n\n00:00.000 --> 00:10.000\nsprite.jpg#xywh=0,0,160\n"},
+		{"negative coordinate", "WEBVTT\n\n00:00.000 --> 00:10.000\nsprite.jpg#xywh=-1,0,160,90\n"},
+		{"empty tile", "WEBVTT\n\n00:00.000 --> 00:10.000\nsprite.jpg#xywh=0,0,0,90\n"},
+	}
+	for _, test := range invalid {
+		if cues, err := ParseThumbnailVtt([]byte(test.content)); !errors.Is(err, ErrInvalidVtt) {
+			t.Errorf("%s: got %+v (%v), expected an invalid vtt", test.name, cues, err)
+		}
+	}
+}
+
+// Write cues like the extraction does.
+func formatThumbnailVtt(cues []JsonCue) string {
+	var ret strings.Builder
+	ret.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&ret, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n", tsToVttTime(cue.Start), tsToVttTime(cue.End), cue.Src, cue.X, cue.Y, cue.W, cue.H)
+	}
+	return ret.String()
+}
+
+// Check the invariants of ParseThumbnailVtt on valid vtts.
+func checkThumbnailCues(t *testing.T, cues []JsonCue) {
+	t.Helper()
+	for i, cue := range cues {
+		if cue.End < cue.Start {
+			t.Fatalf("cue %d ends before it starts: %+v", i, cue)
+		}
+		if cue.W <= 0 || cue.H <= 0 || cue.X < 0 || cue.Y < 0 {
+			t.Fatalf("cue %d has an invalid tile: %+v", i, cue)
+		}
+		if i > 0 && cue.Start < cues[i-1].Start {
+			t.Fatalf("cue %d starts before the previous one: %+v, %+v", i, cues[i-1], cue)
+		}
+	}
+}
+
+func FuzzParseThumbnailVtt(f *testing.F) {
+	f.Add([]byte("WEBVTT\n"))
+	f.Add([]byte("WEBVTT\n\n00:00.000 --> 00:10.000\nsprite.jpg#xywh=0,0,160,90\n\n00:10.000 --> 00:20.000\nsprite.jpg#xywh=160,0,160,90\n"))
+	f.Add([]byte("\ufeffWEBVTT\r\n\r\nNOTE columns=2\r\n\r\nid\r\n01:00:00.000 --> 01:00:05.000 align:start\r\nsprite.jpg?page=1#xywh=0,90,160,90\r\n"))
+	f.Add([]byte("WEBVTT\n\n00:10.000 --> 00:05.000\nsprite.jpg#xywh=0,0,160,90\n"))
+	f.Fuzz(func(t *testing.T, content []byte) {
+		cues, err := ParseThumbnailVtt(content)
+		if err != nil {
+			return
+		}
+		checkThumbnailCues(t, cues)
+
+		// timestamps are in milliseconds so the cues survive a round trip through the extraction's format.
+		again, err := ParseThumbnailVtt([]byte(formatThumbnailVtt(cues)))
+		if err != nil {
+			t.Fatalf("the cues %+v could not be parsed again: %v", cues, err)
+		}
+		if !slices.Equal(cues, again) {
+			t.Fatalf("the cues changed after a round trip: %+v, %+v", cues, again)
+		}
+	})
+}
+
+func TestExtractedVtt(t *testing.T) {
+	useSolidSource(t, 95, 1280, 720)
+	sha := "solid-vtt"
+	out, err := ExtractThumbnail("/vtt.mkv", sha, ThumbnailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := GetThumbnailInfo(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(GetVttPath(out, DefaultSheetSize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cues, err := ParseThumbnailVtt(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cues) != info.Count {
+		t.Fatalf("the vtt has %d cues for %d thumbnails", len(cues), info.Count)
+	}
+	checkThumbnailCues(t, cues)
+	for i := 1; i < len(cues); i++ {
+		if cues[i].Start <= cues[i-1].Start {
+			t.Errorf("cue %d starts at %v, with the previous one", i, cues[i].Start)
+		}
+	}
+	if end := cues[len(cues)-1].End; end > 95 {
+		t.Errorf("the last cue ends at %v, after the video", end)
+	}
+
+	// every tile is inside the sprite it points to.
+	pages := map[string]image.Config{}
+	for page := 0; page < info.Pages; page++ {
+		path, ok := FindSprite(out, ThumbnailOptions{}, DefaultSheetSize(), page)
+		if !ok {
+			t.Fatalf("the sprite %d was not written", page)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := image.DecodeConfig(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages[fmt.Sprint(page)] = config
+	}
+	for i, cue := range cues {
+		page := "0"
+		if _, query, found := strings.Cut(cue.Src, "page="); found {
+			page, _, _ = strings.Cut(query, "&")
+		}
+		config, ok := pages[page]
+		if !ok {
+			t.Fatalf("cue %d points to the unknown page %q (%s)", i, page, cue.Src)
+		}
+		if cue.X+cue.W > config.Width || cue.Y+cue.H > config.Height {
+			t.Errorf("cue %d (%+v) is outside of its %dx%d sprite", i, cue, config.Width, config.Height)
+		}
+	}
+}
+
+func TestVttCoversDuration(t *testing.T) {
+	// durations that are not multiples of the interval, and one over the maximum number of thumbnails.
+	for _, duration := range []int64{7, 95, 601, 10803} {
+		t.Run(fmt.Sprint(duration), func(t *testing.T) {
+			useSolidSource(t, duration, 640, 360)
+			out, err := ExtractThumbnail("/cover.mkv", fmt.Sprintf("vtt-cover-%d", duration), ThumbnailOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := os.ReadFile(GetVttPath(out, DefaultSheetSize()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cues, err := ParseThumbnailVtt(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cues[0].Start != 0 {
+				t.Errorf("the first cue starts at %v", cues[0].Start)
+			}
+			for i := 1; i < len(cues); i++ {
+				if cues[i].Start != cues[i-1].End {
+					t.Errorf("cue %d starts at %v but the previous one ends at %v", i, cues[i].Start, cues[i-1].End)
+				}
+			}
+			if end := cues[len(cues)-1].End; end != float64(duration) {
+				t.Errorf("the last cue ends at %v instead of %v", end, duration)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Number of peaks of a waveform, whatever the duration of the file.
+var waveform_peaks = 2000
+
+// Height of the waveform image, its width is the number of peaks.
+var waveform_height = 128
+
+// Sample rate used to decode the audio, peaks don't need a high precision.
+var waveform_samplerate = 8000
+
+type Waveform struct {
+	/// The duration of the file in seconds.
+	Duration float32 `json:"duration"`
+	/// Min and max amplitude (between -1 and 1) of each bucket, buckets are evenly spaced over the whole file.
+	Peaks [][2]float32 `json:"peaks"`
+}
+
+// Extract the peaks of the audio of a file, clients can display it instead of thumbnails for audio only files.
+// The peaks are stored in peaks.json and rendered in waveform.png, next to it.
+func ExtractWaveform(path string, sha string) (string, error) {
+	cache_key := fmt.Sprintf("%s/waveform", sha)
+	ret, created := thumbnails.GetOrCreate(cache_key, func() *Thumbnail {
+		ret := &Thumbnail{
+			path: fmt.Sprintf("%s/peaks.json", GetMetadataPath(sha)),
+		}
+		if !startJob() {
+			ret.err = ErrShuttingDown
+			ret.finished.Store(true)
+			return ret
+		}
+		ret.ready.Add(1)
+		go func() {
+			defer endJob()
+			ret.err = extractWaveform(path, sha, ret.path)
+			if ret.err != nil {
+				slog.Error("Could not extract waveform", "path", path, "sha", sha, "err", ret.err)
+				extraction_failures.WithLabelValues("waveform").Inc()
+				thumbnails.Remove(cache_key)
+			}
+			ret.finish()
+		}()
+		return ret
+	})
+	observeCache("waveform", created)
+	ret.ready.Wait()
+	return ret.path, ret.err
+}
+
+// Path of the image rendered from the peaks stored at peaks_path.
+func GetWaveformImagePath(peaks_path string) string {
+	return filepath.Join(filepath.Dir(peaks_path), "waveform.png")
+}
+
+func extractWaveform(path string, sha string, out string) error {
+	defer printExecTime("extracting waveform for %s", path)()
+	if metadata_store.Exists(GetWaveformImagePath(out)) {
+		return nil
+	}
+
+	info, err := GetInfo(path, sha)
+	if err != nil {
+		return err
+	}
+	if len(info.Audios) == 0 {
+		return errors.New("no audio stream to extract a waveform from")
+	}
+	if info.Duration <= 0 {
+		return errors.New("unknown duration, can't compute the waveform")
+	}
+
+	release, err := acquireWorker(context.Background(), "waveform")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	cmd := exec.Command(
+		Settings.FfmpegPath,
+		"-nostats", "-hide_banner", "-loglevel", "warning",
+		"-i", path,
+		"-map", "0:a:0",
+		"-ac", "1",
+		"-ar", fmt.Sprint(waveform_samplerate),
+		"-f", "s16le",
+		"pipe:1",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	ret := Waveform{
+		Duration: info.Duration,
+		Peaks:    make([][2]float32, waveform_peaks),
+	}
+	total := float64(info.Duration) * float64(waveform_samplerate)
+	reader := bufio.NewReader(stdout)
+	var sample int16
+	for i := 0; ; i++ {
+		if err := binary.Read(reader, binary.LittleEndian, &sample); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+		bucket := min(int(float64(i)/total*float64(waveform_peaks)), waveform_peaks-1)
+		value := float32(sample) / 32768
+		ret.Peaks[bucket][0] = min(ret.Peaks[bucket][0], value)
+		ret.Peaks[bucket][1] = max(ret.Peaks[bucket][1], value)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("could not decode audio: %s: %s", err, stderr.String())
+	}
+
+	content, err := json.Marshal(ret)
+	if err != nil {
+		return err
+	}
+	mkdirMetadata(filepath.Dir(out))
+	err = writeAtomic(out, func(tmp string) error {
+		return writeMetadataFile(tmp, content)
+	})
+	if err != nil {
+		return err
+	}
+	// the image is written last since it marks the extraction as complete.
+	return writeAtomic(GetWaveformImagePath(out), func(tmp string) error {
+		file, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err = imaging.Encode(file, drawWaveform(ret.Peaks), imaging.PNG); err != nil {
+			return err
+		}
+		return file.Close()
+	})
+}
+
+func drawWaveform(peaks [][2]float32) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, len(peaks), waveform_height))
+	fill := image.NewUniform(color.White)
+	middle := float32(waveform_height) / 2
+	for x, peak := range peaks {
+		top := int(middle - peak[1]*middle)
+		bottom := int(middle - peak[0]*middle)
+		// always draw at least a pixel so silences are visible.
+		draw.Draw(img, image.Rect(x, top, x+1, max(bottom, top+1)), fill, image.Point{}, draw.Src)
+	}
+	return img
+}
@@ -0,0 +1,268 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: thumbnails.proto
+
+package thumbnailspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Thumbnails_Extract_FullMethodName    = "/kyoo.transcoder.thumbnails.Thumbnails/Extract"
+	Thumbnails_Status_FullMethodName     = "/kyoo.transcoder.thumbnails.Thumbnails/Status"
+	Thumbnails_GetInfo_FullMethodName    = "/kyoo.transcoder.thumbnails.Thumbnails/GetInfo"
+	Thumbnails_Invalidate_FullMethodName = "/kyoo.transcoder.thumbnails.Thumbnails/Invalidate"
+)
+
+// ThumbnailsClient is the client API for Thumbnails service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Thumbnails operations for backend services, the same operations as the http routes (see main.go) backed by
+// the same functions so extractions are shared between both.
+type ThumbnailsClient interface {
+	// Extract the thumbnails of a video (see src.ExtractThumbnail), progress is streamed like
+	// /thumbnail/:sha/progress, the last message has done set.
+	Extract(ctx context.Context, in *ExtractRequest, opts ...grpc.CallOption) (Thumbnails_ExtractClient, error)
+	// Progress of a running extraction (see src.ExtractThumbnailStatus).
+	Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	// Layout of the sprite extracted with the default options (see src.GetThumbnailInfo).
+	GetInfo(ctx context.Context, in *InfoRequest, opts ...grpc.CallOption) (*ThumbnailInfo, error)
+	// Remove the thumbnails of a sha (see src.InvalidateThumbnail).
+	Invalidate(ctx context.Context, in *InvalidateRequest, opts ...grpc.CallOption) (*InvalidateResponse, error)
+}
+
+type thumbnailsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewThumbnailsClient(cc grpc.ClientConnInterface) ThumbnailsClient {
+	return &thumbnailsClient{cc}
+}
+
+func (c *thumbnailsClient) Extract(ctx context.Context, in *ExtractRequest, opts ...grpc.CallOption) (Thumbnails_ExtractClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Thumbnails_ServiceDesc.Streams[0], Thumbnails_Extract_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &thumbnailsExtractClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Thumbnails_ExtractClient interface {
+	Recv() (*ExtractProgress, error)
+	grpc.ClientStream
+}
+
+type thumbnailsExtractClient struct {
+	grpc.ClientStream
+}
+
+func (x *thumbnailsExtractClient) Recv() (*ExtractProgress, error) {
+	m := new(ExtractProgress)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *thumbnailsClient) Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatusResponse)
+	err := c.cc.Invoke(ctx, Thumbnails_Status_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *thumbnailsClient) GetInfo(ctx context.Context, in *InfoRequest, opts ...grpc.CallOption) (*ThumbnailInfo, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ThumbnailInfo)
+	err := c.cc.Invoke(ctx, Thumbnails_GetInfo_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *thumbnailsClient) Invalidate(ctx context.Context, in *InvalidateRequest, opts ...grpc.CallOption) (*InvalidateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(InvalidateResponse)
+	err := c.cc.Invoke(ctx, Thumbnails_Invalidate_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ThumbnailsServer is the server API for Thumbnails service.
+// All implementations must embed UnimplementedThumbnailsServer
+// for forward compatibility
+//
+// Thumbnails operations for backend services, the same operations as the http routes (see main.go) backed by
+// the same functions so extractions are shared between both.
+type ThumbnailsServer interface {
+	// Extract the thumbnails of a video (see src.ExtractThumbnail), progress is streamed like
+	// /thumbnail/:sha/progress, the last message has done set.
+	Extract(*ExtractRequest, Thumbnails_ExtractServer) error
+	// Progress of a running extraction (see src.ExtractThumbnailStatus).
+	Status(context.Context, *StatusRequest) (*StatusResponse, error)
+	// Layout of the sprite extracted with the default options (see src.GetThumbnailInfo).
+	GetInfo(context.Context, *InfoRequest) (*ThumbnailInfo, error)
+	// Remove the thumbnails of a sha (see src.InvalidateThumbnail).
+	Invalidate(context.Context, *InvalidateRequest) (*InvalidateResponse, error)
+	mustEmbedUnimplementedThumbnailsServer()
+}
+
+// UnimplementedThumbnailsServer must be embedded to have forward compatible implementations.
+type UnimplementedThumbnailsServer struct {
+}
+
+func (UnimplementedThumbnailsServer) Extract(*ExtractRequest, Thumbnails_ExtractServer) error {
+	return status.Errorf(codes.Unimplemented, "method Extract not implemented")
+}
+func (UnimplementedThumbnailsServer) Status(context.Context, *StatusRequest) (*StatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Status not implemented")
+}
+func (UnimplementedThumbnailsServer) GetInfo(context.Context, *InfoRequest) (*ThumbnailInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetInfo not implemented")
+}
+func (UnimplementedThumbnailsServer) Invalidate(context.Context, *InvalidateRequest) (*InvalidateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Invalidate not implemented")
+}
+func (UnimplementedThumbnailsServer) mustEmbedUnimplementedThumbnailsServer() {}
+
+// UnsafeThumbnailsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ThumbnailsServer will
+// result in compilation errors.
+type UnsafeThumbnailsServer interface {
+	mustEmbedUnimplementedThumbnailsServer()
+}
+
+func RegisterThumbnailsServer(s grpc.ServiceRegistrar, srv ThumbnailsServer) {
+	s.RegisterService(&Thumbnails_ServiceDesc, srv)
+}
+
+func _Thumbnails_Extract_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExtractRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ThumbnailsServer).Extract(m, &thumbnailsExtractServer{ServerStream: stream})
+}
+
+type Thumbnails_ExtractServer interface {
+	Send(*ExtractProgress) error
+	grpc.ServerStream
+}
+
+type thumbnailsExtractServer struct {
+	grpc.ServerStream
+}
+
+func (x *thumbnailsExtractServer) Send(m *ExtractProgress) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Thumbnails_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ThumbnailsServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Thumbnails_Status_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ThumbnailsServer).Status(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Thumbnails_GetInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ThumbnailsServer).GetInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Thumbnails_GetInfo_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ThumbnailsServer).GetInfo(ctx, req.(*InfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Thumbnails_Invalidate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InvalidateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ThumbnailsServer).Invalidate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Thumbnails_Invalidate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ThumbnailsServer).Invalidate(ctx, req.(*InvalidateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Thumbnails_ServiceDesc is the grpc.ServiceDesc for Thumbnails service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Thumbnails_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kyoo.transcoder.thumbnails.Thumbnails",
+	HandlerType: (*ThumbnailsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Status",
+			Handler:    _Thumbnails_Status_Handler,
+		},
+		{
+			MethodName: "GetInfo",
+			Handler:    _Thumbnails_GetInfo_Handler,
+		},
+		{
+			MethodName: "Invalidate",
+			Handler:    _Thumbnails_Invalidate_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Extract",
+			Handler:       _Thumbnails_Extract_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "thumbnails.proto",
+}
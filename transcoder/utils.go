@@ -1,14 +1,20 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/zoriya/kyoo/transcoder/src"
@@ -16,28 +22,28 @@ import (
 
 var safe_path = src.GetEnvOr("GOCODER_SAFE_PATH", "/video")
 
-// Encode the version in the hash path to update cached values.
-// Older versions won't be deleted (needed to allow multiples versions of the transcoder to run at the same time)
-// If the version changes a lot, we might want to automatically delete older versions.
-var version = "v2-"
-
 func GetPath(c echo.Context) (string, string, error) {
 	key := c.Param("path")
 	if key == "" {
 		return "", "", echo.NewHTTPError(http.StatusBadRequest, "Missing resouce path.")
 	}
-	pathb, err := base64.StdEncoding.DecodeString(key)
+	path, err := src.DecodePath(key)
 	if err != nil {
 		return "", "", echo.NewHTTPError(http.StatusBadRequest, "Invalid path. Should be base64 encoded.")
 	}
-	path := filepath.Clean(string(pathb))
+	return checkPath(path)
+}
+
+// Check that path is in GOCODER_SAFE_PATH and compute its sha, for paths decoded from a request.
+func checkPath(path string) (string, string, error) {
+	path = filepath.Clean(path)
 	if !filepath.IsAbs(path) {
 		return "", "", echo.NewHTTPError(http.StatusBadRequest, "Absolute path required.")
 	}
 	if !strings.HasPrefix(path, safe_path) {
 		return "", "", echo.NewHTTPError(http.StatusBadRequest, "Selected path is not marked as safe.")
 	}
-	hash, err := getHash(path)
+	hash, err := src.ComputeMediaSha(path)
 	if err != nil {
 		return "", "", echo.NewHTTPError(http.StatusNotFound, "File does not exist")
 	}
@@ -45,18 +51,6 @@ func GetPath(c echo.Context) (string, string, error) {
 	return path, hash, nil
 }
 
-func getHash(path string) (string, error) {
-	info, err := os.Stat(path)
-	if err != nil {
-		return "", err
-	}
-	h := sha1.New()
-	h.Write([]byte(path))
-	h.Write([]byte(info.ModTime().String()))
-	sha := hex.EncodeToString(h.Sum(nil))
-	return version + sha, nil
-}
-
 func SanitizePath(path string) error {
 	if strings.Contains(path, "/") || strings.Contains(path, "..") {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter. Can't contains path delimiters or ..")
@@ -81,6 +75,304 @@ func ParseSegment(segment string) (int32, error) {
 	return ret, nil
 }
 
+func ParseThumbnailOptions(c echo.Context) (src.ThumbnailOptions, error) {
+	return parseThumbnailOptions(c.QueryParams())
+}
+
+// Same as ParseThumbnailOptions for options that are not in query params (see ThumbnailsServer).
+func parseThumbnailOptions(query url.Values) (src.ThumbnailOptions, error) {
+	var ret src.ThumbnailOptions
+	if interval := query.Get("interval"); interval != "" {
+		val, err := strconv.ParseFloat(interval, 64)
+		if err != nil || !(val >= float64(src.Settings.ThumbnailMinInterval)) || math.IsInf(val, 0) {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid interval, it should be a number of seconds (at least %d).", src.Settings.ThumbnailMinInterval))
+		}
+		ret.Interval = val
+	}
+	if maxcaps := query.Get("maxcaps"); maxcaps != "" {
+		val, err := strconv.Atoi(maxcaps)
+		if err != nil || val <= 0 {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid maxcaps, it should be a positive number.")
+		}
+		// bigger values would be the same sprites as GOCODER_THUMBNAIL_MAX_CAPS.
+		ret.MaxCaps = min(val, src.Settings.ThumbnailMaxCaps)
+	}
+	if at := query.Get("at"); at != "" {
+		if _, err := hex.DecodeString(at); err != nil {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid at, it should be the identifier of thumbnails at custom timestamps.")
+		}
+		ret.At = at
+	}
+	if poster := query.Get("poster"); poster != "" {
+		if _, err := hex.DecodeString(poster); err != nil {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid poster, it should be the identifier of thumbnails with a poster.")
+		}
+		ret.Poster = poster
+	}
+	if count := query.Get("count"); count != "" {
+		val, err := strconv.Atoi(count)
+		if err != nil || val <= 0 {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid count, it should be a positive number.")
+		}
+		ret.Count = val
+	}
+	if start := query.Get("start"); start != "" {
+		val, err := strconv.ParseFloat(start, 64)
+		if err != nil || val < 0 {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid start, it should be a positive number of seconds.")
+		}
+		ret.Start = val
+	}
+	if end := query.Get("end"); end != "" {
+		val, err := strconv.ParseFloat(end, 64)
+		if err != nil || val <= ret.Start {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid end, it should be a number of seconds after start.")
+		}
+		ret.End = val
+	}
+	if ret.Start > 0 && ret.End == 0 {
+		return ret, echo.NewHTTPError(http.StatusBadRequest, "Missing end, it is required with start.")
+	}
+	if stream := query.Get("stream"); stream != "" {
+		val, err := strconv.Atoi(stream)
+		if err != nil || val < 0 {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid stream, it should be the index of a video stream.")
+		}
+		ret.Stream = val
+	}
+	if aspect := query.Get("aspect"); aspect != "" {
+		val, err := parseAspect(aspect)
+		if err != nil {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid aspect, it should be a display aspect ratio (16:9 or 1.78 for example).")
+		}
+		ret.Aspect = val
+	}
+	if duration := query.Get("duration"); duration != "" {
+		val, err := strconv.ParseFloat(duration, 64)
+		if err != nil || !(val > 0) || math.IsInf(val, 0) {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid duration, it should be a positive number of seconds.")
+		}
+		ret.Duration = val
+	}
+	// overrides of the settings, they are set in the cues of vtts extracted with them.
+	if height := query.Get("tileheight"); height != "" {
+		val, err := strconv.Atoi(height)
+		if err != nil || val <= 0 || val > src.Settings.MaxSpriteDimension {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid tileheight, it should be a positive number of pixels.")
+		}
+		ret.Height = val
+	}
+	if format := query.Get("format"); format != "" {
+		if !slices.Contains(src.ThumbnailFormats, format) {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid format, it should be one of %s.", strings.Join(src.ThumbnailFormats, ", ")))
+		}
+		ret.Format = format
+	}
+	if quality := query.Get("quality"); quality != "" {
+		val, err := strconv.Atoi(quality)
+		if err != nil || val < 1 || val > 100 {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid quality, it should be between 1 and 100.")
+		}
+		ret.Quality = val
+	}
+	if offset := query.Get("offset"); offset != "" {
+		val, err := src.ParseStartOffset(offset)
+		if err != nil {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid offset, it should be a number of seconds or a percentage (5%).")
+		}
+		ret.StartOffset = &val
+	}
+	return ret, nil
+}
+
+// Parse an aspect ratio written as width:height or as a number.
+func parseAspect(aspect string) (float64, error) {
+	var ret float64
+	if w, h, found := strings.Cut(aspect, ":"); found {
+		width, err := strconv.ParseFloat(w, 64)
+		if err != nil {
+			return 0, err
+		}
+		height, err := strconv.ParseFloat(h, 64)
+		if err != nil {
+			return 0, err
+		}
+		ret = width / height
+	} else {
+		val, err := strconv.ParseFloat(aspect, 64)
+		if err != nil {
+			return 0, err
+		}
+		ret = val
+	}
+	if !(ret > 0) || math.IsInf(ret, 0) {
+		return 0, fmt.Errorf("invalid aspect ratio %s", aspect)
+	}
+	return ret, nil
+}
+
+func ParseThumbnailSize(c echo.Context) (src.SheetSize, error) {
+	ret := src.DefaultSheetSize()
+	if param := c.QueryParam("height"); param != "" {
+		height, err := strconv.Atoi(param)
+		if err != nil || !slices.Contains(src.Settings.ThumbnailHeights, height) {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid height, this height is not generated.")
+		}
+		ret.Height = height
+	}
+	if param := c.QueryParam("scale"); param != "" {
+		scale, err := strconv.Atoi(param)
+		if err != nil || !slices.Contains(src.Settings.ThumbnailScales, scale) {
+			return ret, echo.NewHTTPError(http.StatusBadRequest, "Invalid scale, this scale is not generated.")
+		}
+		ret.Scale = scale
+	}
+	return ret, nil
+}
+
+func ParseThumbnailPage(c echo.Context) (int, error) {
+	param := c.QueryParam("page")
+	if param == "" {
+		return 0, nil
+	}
+	page, err := strconv.Atoi(param)
+	if err != nil || page < 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid page, it should be a positive number.")
+	}
+	return page, nil
+}
+
+// Convert errors of thumbnails extractions caused by invalid requests to http errors.
+func ThumbnailError(err error) error {
+	if errors.Is(err, src.ErrInvalidStream) {
+		return echo.NewHTTPError(http.StatusNotFound, "Video stream not found.")
+	}
+	if errors.Is(err, src.ErrUnsupportedStream) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Thumbnails can only be generated for the default video stream.")
+	}
+	if errors.Is(err, src.ErrNoVideoStream) {
+		return echo.NewHTTPError(http.StatusNotFound, "The file has no video stream.")
+	}
+	if errors.Is(err, src.ErrEncryptedSource) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "The video is encrypted, thumbnails can't be extracted.")
+	}
+	if errors.Is(err, src.ErrUnsupportedCodec) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "The video codec of this file can't be decoded.")
+	}
+	if errors.Is(err, src.ErrThumbnailsNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thumbnails not found. Request the vtt file first.")
+	}
+	if errors.Is(err, src.ErrExtractionCancelled) {
+		return echo.NewHTTPError(http.StatusConflict, "The extraction was cancelled.")
+	}
+	if errors.Is(err, src.ErrTooManyVariants) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Too many thumbnails variants were extracted for this video, use the default options.")
+	}
+	if errors.Is(err, src.ErrInsufficientSpace) {
+		return echo.NewHTTPError(http.StatusInsufficientStorage, "Not enough disk space to extract thumbnails.")
+	}
+	return err
+}
+
+// Serve a file of the metadata dir, from the local dir when it is there or from the metadata store.
+func ServeMetadata(c echo.Context, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return c.File(path)
+	}
+	file, err := src.OpenMetadata(path)
+	if err != nil {
+		return echo.NotFoundHandler(c)
+	}
+	defer file.Close()
+	content_type := mime.TypeByExtension(filepath.Ext(path))
+	if filepath.Ext(path) == ".vtt" {
+		content_type = "text/vtt"
+	} else if content_type == "" {
+		content_type = echo.MIMEOctetStream
+	}
+	return c.Stream(http.StatusOK, content_type, file)
+}
+
+// Serve a sprite of the given sha with headers letting browsers and cdns cache it. The etag is based on
+// the sha and the sprite's modification time (sprites can be regenerated at the same url).
+// Range requests are supported (for local files and stores that can seek). Sprites are the biggest files,
+// stores that can link them (s3 with GOCODER_S3_PRESIGN_EXPIRY) redirect clients to the store instead.
+func ServeThumbnail(c echo.Context, sha string, path string) error {
+	if url, ok := src.GetMetadataURL(path); ok {
+		return c.Redirect(http.StatusTemporaryRedirect, url)
+	}
+	file, err := src.OpenMetadata(path)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Thumbnails not found. They may still be extracting.")
+	}
+	defer file.Close()
+
+	var mod_time time.Time
+	if info, err := src.StatMetadata(path); err == nil {
+		mod_time = info.ModTime
+	}
+	header := c.Response().Header()
+	header.Set("ETag", fmt.Sprintf("\"%s-%s-%d\"", sha, filepath.Base(path), mod_time.Unix()))
+	header.Set("Cache-Control", "public, max-age=604800")
+
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		return c.Stream(http.StatusOK, mime.TypeByExtension(filepath.Ext(path)), file)
+	}
+	// ServeContent detects the content type from the name and handles Range and If-None-Match.
+	http.ServeContent(c.Response(), c.Request(), filepath.Base(path), mod_time, content)
+	return nil
+}
+
+// Seconds clients should wait before retrying a request for thumbnails being extracted.
+var thumbnails_retry_after = 5
+
+// Extract the thumbnails for a request. With GOCODER_LAZY_THUMBNAILS, the extraction runs in the background
+// and a 202 with a Retry-After (the estimated time left, see EstimateThumbnailCompletion) is sent while it is running: ok is false and err is the result of sending it.
+func ExtractThumbnails(c echo.Context, path string, sha string, opts src.ThumbnailOptions) (out string, ok bool, err error) {
+	if !src.Settings.LazyThumbnails {
+		out, err = src.ExtractThumbnail(path, sha, opts)
+		if err != nil {
+			return "", false, ThumbnailError(err)
+		}
+		return out, true, nil
+	}
+	out, done, err := src.ExtractThumbnailAsync(path, sha, opts)
+	if err != nil {
+		return "", false, ThumbnailError(err)
+	}
+	if !done {
+		setRetryAfter(c, path, sha, opts)
+		return "", false, c.NoContent(http.StatusAccepted)
+	}
+	return out, true, nil
+}
+
+// Tell clients when the running extraction should be done.
+func setRetryAfter(c echo.Context, path string, sha string, opts src.ThumbnailOptions) {
+	retry := thumbnails_retry_after
+	// let the scanner schedule its next request when the extraction should be done.
+	if eta, ok, err := src.EstimateThumbnailCompletion(path, sha, opts); err == nil && ok {
+		retry = max(retry, int(math.Ceil(time.Until(eta).Seconds())))
+	}
+	c.Response().Header().Set("Retry-After", fmt.Sprint(retry))
+}
+
+// Serve the poster of the video (see ExtractPoster) instead of its sprite while the sprite is extracted in the
+// background. The X-Thumbnails-Provisional header tells clients to fetch the sprite again after Retry-After,
+// the placeholder is never cached.
+func ServePlaceholder(c echo.Context, path string, sha string, opts src.ThumbnailOptions) error {
+	poster, err := src.ExtractPoster(path, sha, 0)
+	if err != nil {
+		return ThumbnailError(err)
+	}
+	header := c.Response().Header()
+	header.Set("X-Thumbnails-Provisional", "true")
+	header.Set("Cache-Control", "no-store")
+	setRetryAfter(c, path, sha, opts)
+	return ServeMetadata(c, poster)
+}
+
 func ErrorHandler(err error, c echo.Context) {
 	code := http.StatusInternalServerError
 	var message string